@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// registerAdmin serves the admin API under prefix/admin, every request must
+// carry the token as Authorization: Bearer <token>. Nothing is served without
+// a token. The dashboard at /admin/ is a static page asking for the token, all
+// it shows and does goes through the API. A tenant serves the API of its own
+// uploads under its prefix, see tenantPrefix. An upload is looked up with
+// lookup, the one of sharedUploads finds the uploads of the other instances,
+// the list has the ones of storage.
+func registerAdmin(mux *http.ServeMux, prefix, token string, storage *Storage, lookup func(id string) *File, processing *pipeline, expiration *expirer, events *events, traffic *trafficStats, audit *auditLog, aliases *aliasIndex) {
+	if len(token) <= 0 {
+		return
+	}
+	admin := func(handler http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			handler(w, r)
+		}
+	}
+
+	// the uploads whose processing failed for good
+	mux.HandleFunc("GET "+prefix+"/admin/processing/dead-letters", admin(func(w http.ResponseWriter, r *http.Request) {
+		letters := []deadLetter{}
+		if processing != nil {
+			letters = processing.deadLetters()
+		}
+		writeJSON(w, http.StatusOK, letters)
+	}))
+
+	// the uploads held matching the filter of the query, sorted by id
+	mux.HandleFunc("GET "+prefix+"/admin/uploads", admin(func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseUploadFilter(r.URL.Query())
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		now := time.Now()
+		uploads := []uploadSummary{}
+		for _, f := range storage.Files() {
+			if summary := f.summary(); filter.match(summary, now) {
+				uploads = append(uploads, summary)
+			}
+		}
+		slices.SortFunc(uploads, func(a, b uploadSummary) int { return strings.Compare(a.ID, b.ID) })
+		if filter.limit > 0 && len(uploads) > filter.limit {
+			uploads = uploads[:filter.limit]
+		}
+		writeJSON(w, http.StatusOK, uploads)
+	}))
+
+	mux.HandleFunc("GET "+prefix+"/admin/uploads/{id}", admin(func(w http.ResponseWriter, r *http.Request) {
+		f := lookup(r.PathValue("id"))
+		if f == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, f.summary())
+	}))
+
+	// terminate or expire an upload, whatever its age
+	end := func(state string) http.HandlerFunc {
+		return admin(func(w http.ResponseWriter, r *http.Request) {
+			f := lookup(r.PathValue("id"))
+			if f == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			switch err := expiration.end(f, state); {
+			case errors.Is(err, errFinished):
+				w.WriteHeader(http.StatusGone)
+				return
+			case errors.Is(err, errLocked):
+				writeJSON(w, http.StatusConflict, map[string]string{"error": "the upload is being written"})
+				return
+			case errors.Is(err, errHeld):
+				writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+				return
+			case err != nil:
+				slog.Error("Fail to end upload", slog.String("id", f.ID.String()), slog.String("state", state), slog.Any("Error", err))
+				writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+				return
+			}
+			slog.Info("Upload ended by an admin", slog.String("id", f.ID.String()), slog.String("state", state))
+			if state == UPLOAD_STATE_TERMINATED {
+				events.publish(EVENT_TERMINATED, f)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	mux.HandleFunc("DELETE "+prefix+"/admin/uploads/{id}", end(UPLOAD_STATE_TERMINATED))
+	mux.HandleFunc("POST "+prefix+"/admin/uploads/{id}/expire", end(UPLOAD_STATE_EXPIRED))
+
+	// pause or unpause an upload, see expirer.pause
+	pause := func(paused bool) http.HandlerFunc {
+		return admin(func(w http.ResponseWriter, r *http.Request) {
+			f := lookup(r.PathValue("id"))
+			if f == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			switch err := expiration.pause(f, paused); {
+			case errors.Is(err, errFinished):
+				w.WriteHeader(http.StatusGone)
+				return
+			case errors.Is(err, errLocked):
+				writeJSON(w, http.StatusConflict, map[string]string{"error": "the upload is being written"})
+				return
+			case err != nil:
+				slog.Error("Fail to pause upload", slog.String("id", f.ID.String()), slog.Bool("paused", paused), slog.Any("Error", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			slog.Info("Upload paused by an admin", slog.String("id", f.ID.String()), slog.Bool("paused", paused))
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	mux.HandleFunc("POST "+prefix+"/admin/uploads/{id}/pause", pause(true))
+	mux.HandleFunc("POST "+prefix+"/admin/uploads/{id}/unpause", pause(false))
+
+	// put an upload under legal hold or release it, see expirer.hold, with
+	// an optional {"reason": "..."} recorded in the audit log
+	hold := func(held bool) http.HandlerFunc {
+		return admin(func(w http.ResponseWriter, r *http.Request) {
+			f := lookup(r.PathValue("id"))
+			if f == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			var body struct {
+				Reason string `json:"reason"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			action := AUDIT_HOLD
+			if !held {
+				action = AUDIT_RELEASE
+			}
+			record := func() error {
+				return audit.record(auditEntry{Time: time.Now(), Action: action, ID: f.ID.String(), Reason: body.Reason, RemoteAddr: r.RemoteAddr})
+			}
+			switch err := expiration.hold(f, held, record); {
+			case errors.Is(err, errFinished):
+				w.WriteHeader(http.StatusGone)
+				return
+			case errors.Is(err, errLocked):
+				writeJSON(w, http.StatusConflict, map[string]string{"error": "the upload is being written"})
+				return
+			case errors.Is(err, errNotRecorded):
+				slog.Error("Fail to record audit entry", slog.String("id", f.ID.String()), slog.String("action", action), slog.Any("Error", err))
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "the change is not recorded in the audit log, it is rolled back"})
+				return
+			case err != nil:
+				slog.Error("Fail to hold upload", slog.String("id", f.ID.String()), slog.Bool("held", held), slog.Any("Error", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	mux.HandleFunc("POST "+prefix+"/admin/uploads/{id}/hold", hold(true))
+	mux.HandleFunc("POST "+prefix+"/admin/uploads/{id}/release", hold(false))
+
+	// take an upload out of the trash, see expirer.restore
+	mux.HandleFunc("POST "+prefix+"/admin/uploads/{id}/restore", admin(func(w http.ResponseWriter, r *http.Request) {
+		f := lookup(r.PathValue("id"))
+		if f == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch err := expiration.restore(f); {
+		case errors.Is(err, errNotTrashed):
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		case errors.Is(err, errLocked):
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "the upload is being purged"})
+			return
+		case err != nil:
+			slog.Error("Fail to restore upload", slog.String("id", f.ID.String()), slog.Any("Error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Upload restored by an admin", slog.String("id", f.ID.String()), slog.String("state", f.state()))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// name an upload with {"alias": "..."}, an empty alias removes its
+	// alias, see aliasIndex
+	mux.HandleFunc("PUT "+prefix+"/admin/uploads/{id}/alias", admin(func(w http.ResponseWriter, r *http.Request) {
+		f := lookup(r.PathValue("id"))
+		if f == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if f.finished() {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		var body struct {
+			Alias string `json:"alias"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		// the info file is not saved under a PATCH
+		lock, err := expiration.locker.TryLock(f.ID.String())
+		if err != nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "the upload is being written"})
+			return
+		}
+		defer lock.Unlock()
+		switch err := aliases.assign(f, body.Alias); {
+		case errors.Is(err, errInvalidAlias):
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		case errors.Is(err, errAliasTaken):
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		if f.persist {
+			if err := f.saveInfo(); err != nil {
+				slog.Error("Fail to save upload alias", slog.String("id", f.ID.String()), slog.Any("Error", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		slog.Info("Upload alias set by an admin", slog.String("id", f.ID.String()), slog.String("alias", body.Alias))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// the traffic of the last minutes, oldest first
+	mux.HandleFunc("GET "+prefix+"/admin/stats", admin(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"interval": TRAFFIC_BUCKET.Seconds(),
+			"traffic":  traffic.snapshot(time.Now()),
+		})
+	}))
+
+	mux.HandleFunc("GET "+prefix+"/admin/{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HEADER_CONTENT_TYPE, "text/html; charset=utf-8")
+		w.Write(dashboardPage)
+	})
+}
+
+// uploadSummary is an upload as the admin API shows it
+type uploadSummary struct {
+	ID        string            `json:"id"`
+	Size      int               `json:"size"`
+	Offset    int               `json:"offset"`
+	State     string            `json:"state"`
+	Metadata  map[string]string `json:"metadata"`
+	MIMEType  string            `json:"mime_type,omitempty"` // sniffed from the data once complete, see detectMIMEType
+	Paused    bool              `json:"paused,omitempty"`
+	Owner     string            `json:"owner,omitempty"` // the subject of the policy of the creation, see checkOwner
+	Anonymous bool              `json:"anonymous,omitempty"`
+	Trashed   time.Time         `json:"trashed,omitzero"` // when the upload went to the trash, zero when it is not in it
+	LegalHold bool              `json:"legal_hold,omitempty"`
+	Alias     string            `json:"alias,omitempty"` // see aliasIndex
+	Path      string            `json:"path"`
+	Modified  time.Time         `json:"modified"` // the last write of the data file, zero when it is missing
+	Created   time.Time         `json:"created"`
+	Activity  time.Time         `json:"last_activity"` // the last write of the upload, its creation before any
+}
+
+func (f *File) summary() uploadSummary {
+	summary := uploadSummary{
+		ID:        f.ID.String(),
+		Size:      f.Size,
+		Offset:    f.offset(),
+		State:     f.state(),
+		Metadata:  parseMetadata(f.metadata()),
+		MIMEType:  f.mimeType(),
+		Paused:    f.isPaused(),
+		Owner:     f.owner,
+		Anonymous: f.anonymous,
+		Trashed:   f.trashedAt(),
+		LegalHold: f.onHold(),
+		Alias:     f.alias(),
+		Path:      f.storedPath(),
+	}
+	summary.Created, summary.Activity = f.timestamps()
+	if stat, err := os.Stat(summary.Path); err == nil {
+		summary.Modified = stat.ModTime().UTC()
+	}
+	return summary
+}
+
+// uploadFilter selects the uploads the admin API lists from its query:
+//
+//	state=created,uploading    the uploads in one of the states
+//	metadata.owner=alice       the decoded metadata value of owner is alice
+//	metadata.filename~=report  the filename contains report, ignoring case
+//	q=alice                    the id or any metadata value contains alice, ignoring case
+//	older_than=24h             the last activity is older than 24h
+//	newer_than=1h              the last activity is more recent than 1h
+//	limit=50                   the first 50 matches only
+type uploadFilter struct {
+	states    []string
+	equals    map[string]string
+	contains  map[string]string // lower cased
+	text      string            // lower cased
+	olderThan time.Duration
+	newerThan time.Duration
+	limit     int
+}
+
+func parseUploadFilter(query url.Values) (uploadFilter, error) {
+	filter := uploadFilter{equals: map[string]string{}, contains: map[string]string{}}
+	for name, values := range query {
+		value := values[0]
+		var err error
+		switch {
+		case name == "state":
+			filter.states = strings.Split(value, ",")
+		case name == "q":
+			filter.text = strings.ToLower(value)
+		case name == "older_than":
+			filter.olderThan, err = time.ParseDuration(value)
+		case name == "newer_than":
+			filter.newerThan, err = time.ParseDuration(value)
+		case name == "limit":
+			filter.limit, err = strconv.Atoi(value)
+		case strings.HasPrefix(name, "metadata.") && strings.HasSuffix(name, "~"):
+			filter.contains[strings.TrimSuffix(strings.TrimPrefix(name, "metadata."), "~")] = strings.ToLower(value)
+		case strings.HasPrefix(name, "metadata."):
+			filter.equals[strings.TrimPrefix(name, "metadata.")] = value
+		default:
+			return filter, fmt.Errorf("unknown filter %q", name)
+		}
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s %q", name, value)
+		}
+	}
+	return filter, nil
+}
+
+// match reports whether the upload of summary passes the filter at now
+func (u uploadFilter) match(summary uploadSummary, now time.Time) bool {
+	if len(u.states) > 0 && !slices.Contains(u.states, summary.State) {
+		return false
+	}
+	for k, v := range u.equals {
+		if value, ok := summary.Metadata[k]; !ok || value != v {
+			return false
+		}
+	}
+	for k, v := range u.contains {
+		if value, ok := summary.Metadata[k]; !ok || !strings.Contains(strings.ToLower(value), v) {
+			return false
+		}
+	}
+	if len(u.text) > 0 && !strings.Contains(summary.ID, u.text) && !slices.ContainsFunc(slices.Collect(maps.Values(summary.Metadata)), func(value string) bool {
+		return strings.Contains(strings.ToLower(value), u.text)
+	}) {
+		return false
+	}
+	// an upload without data has no age, it matches no age filter
+	age := now.Sub(summary.Activity)
+	if u.olderThan > 0 && (summary.Activity.IsZero() || age < u.olderThan) {
+		return false
+	}
+	if u.newerThan > 0 && (summary.Activity.IsZero() || age > u.newerThan) {
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set(HEADER_CONTENT_TYPE, "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Fail to write JSON response", slog.Any("Error", err))
+	}
+}
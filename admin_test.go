@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadFilter(t *testing.T) {
+	now := time.Now()
+	summary := uploadSummary{
+		ID:       "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+		State:    UPLOAD_STATE_UPLOADING,
+		Metadata: map[string]string{"filename": "Q3 Report.pdf", "owner": "alice"},
+		Activity: now.Add(-2 * time.Hour),
+	}
+
+	tests := []struct {
+		testName string
+		query    string
+		expected bool
+	}{
+		{"no filter", "", true},
+		{"state", "state=created,uploading", true},
+		{"other state", "state=completed", false},
+		{"metadata equals", "metadata.owner=alice", true},
+		{"metadata differs", "metadata.owner=bob", false},
+		{"metadata missing", "metadata.tenant=a", false},
+		{"metadata contains", "metadata.filename~=report", true},
+		{"metadata does not contain", "metadata.filename~=invoice", false},
+		{"text in metadata", "q=ALICE", true},
+		{"text in id", "q=9dad", true},
+		{"text nowhere", "q=bob", false},
+		{"older", "older_than=1h", true},
+		{"not older", "older_than=3h", false},
+		{"newer", "newer_than=3h", true},
+		{"not newer", "newer_than=1h", false},
+		{"all of them", "state=uploading&metadata.owner=alice&older_than=1h", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			query, _ := url.ParseQuery(test.query)
+			filter, err := parseUploadFilter(query)
+			if err != nil {
+				t.Fatalf("Fail to parse filter. error=%v", err)
+			}
+			if got := filter.match(summary, now); got != test.expected {
+				t.Errorf("match of %s does not return %v. got=%v", test.query, test.expected, got)
+			}
+		})
+	}
+
+	for _, query := range []string{"older_than=soon", "limit=all", "owner=alice"} {
+		values, _ := url.ParseQuery(query)
+		if _, err := parseUploadFilter(values); err == nil {
+			t.Errorf("an invalid filter does not fail. query=%s", query)
+		}
+	}
+}
+
+func TestAdminDashboard(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: t.TempDir(), AdminToken: "secret"}))
+	defer server.Close()
+	host := server.URL + "/files"
+	adminRequest := func(method, path string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("Fail to create test data. error=%v", err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to execute %s request. error=%v", method, err)
+		}
+		return res
+	}
+
+	res, err := http.Get(server.URL + "/admin/")
+	if err != nil {
+		t.Fatalf("Fail to execute GET request. error=%v", err)
+	}
+	page, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(page), `api("GET", "stats")`) {
+		t.Errorf("GET /admin/ does not return the dashboard. got=%d", res.StatusCode)
+	}
+
+	terminated := createUpload(t, host, 10)
+	patchUpload(t, host, terminated, 0, content[:5])
+	expired := createUpload(t, host, 10)
+
+	res = adminRequest(http.MethodGet, "/admin/stats")
+	var stats struct {
+		Traffic []trafficBucket `json:"traffic"`
+	}
+	json.NewDecoder(res.Body).Decode(&stats)
+	res.Body.Close()
+	requests, bytes := 0, int64(0)
+	for _, b := range stats.Traffic {
+		requests += b.Requests
+		bytes += b.Bytes
+	}
+	// the 3 requests and the GET of the dashboard
+	if requests != 4 || bytes != 5 {
+		t.Errorf("the stats do not count the traffic. got=%d requests of %d bytes", requests, bytes)
+	}
+
+	tests := []struct {
+		testName       string
+		method         string
+		path           string
+		expectedStatus int
+	}{
+		{"terminate", http.MethodDelete, "/admin/uploads/" + terminated, http.StatusNoContent},
+		{"terminate again", http.MethodDelete, "/admin/uploads/" + terminated, http.StatusNotFound},
+		{"expire", http.MethodPost, "/admin/uploads/" + expired + "/expire", http.StatusNoContent},
+		{"unknown", http.MethodDelete, "/admin/uploads/00000000-0000-0000-0000-000000000000", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			res := adminRequest(test.method, test.path)
+			res.Body.Close()
+			if res.StatusCode != test.expectedStatus {
+				t.Errorf("%s %s does not return %d. got=%d", test.method, test.path, test.expectedStatus, res.StatusCode)
+			}
+		})
+	}
+	// the ended uploads are removed, files and entry
+	for _, id := range []string{terminated, expired} {
+		res, err := http.Head(host + "/" + id)
+		if err != nil {
+			t.Fatalf("Fail to execute HEAD request. error=%v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("HEAD of an ended upload does not return 404. got=%d", res.StatusCode)
+		}
+	}
+}
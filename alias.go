@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// HEADER_UPLOAD_ALIAS names the upload at its creation, see aliasIndex
+const HEADER_UPLOAD_ALIAS = "Upload-Alias"
+
+// the longest alias
+const MAX_ALIAS_LENGTH = 255
+
+// errInvalidAlias is returned for an alias that is not a relative path
+var errInvalidAlias = errors.New("alias is not a relative path of letters, digits, '.', '_' and '-'")
+
+// errAliasTaken is returned for an alias naming another upload
+var errAliasTaken = errors.New("alias names another upload")
+
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+(/[A-Za-z0-9._-]+)*$`)
+
+// validateAlias checks alias is a relative path without . or .. segments,
+// i.e., builds/2024-06-01/app.tar.gz
+func validateAlias(alias string) error {
+	if len(alias) > MAX_ALIAS_LENGTH || !aliasPattern.MatchString(alias) {
+		return errInvalidAlias
+	}
+	for _, segment := range strings.Split(alias, "/") {
+		if segment == "." || segment == ".." {
+			return errInvalidAlias
+		}
+	}
+	return nil
+}
+
+// alias returns the alias of the upload, empty when it has none
+func (f *File) alias() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.aliasName
+}
+
+// aliasIndex resolves the aliases of the uploads to their id, so other
+// systems reference an upload by a stable name. An alias names one upload at
+// a time, it is free again once its upload is terminated or expired. The
+// aliases of a shared directory set by another instance are found from the
+// info files, see expirer.uploads.
+type aliasIndex struct {
+	mu      sync.Mutex
+	ids     map[string]string
+	lookup  func(id string) *File
+	uploads func() []*File
+	shared  bool
+}
+
+func newAliasIndex(lookup func(id string) *File, uploads func() []*File, shared bool) *aliasIndex {
+	a := &aliasIndex{ids: make(map[string]string), lookup: lookup, uploads: uploads, shared: shared}
+	// the uploads of a shared directory are found on demand
+	if !shared {
+		for _, f := range uploads() {
+			if alias := f.alias(); len(alias) > 0 && !f.finished() {
+				a.ids[alias] = f.ID.String()
+			}
+		}
+	}
+	return a
+}
+
+// resolve returns the upload alias names, nil when there is none
+func (a *aliasIndex) resolve(alias string) *File {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.find(alias)
+}
+
+// find resolves alias under mu
+func (a *aliasIndex) find(alias string) *File {
+	if id, ok := a.ids[alias]; ok {
+		if f := a.lookup(id); f != nil && f.alias() == alias && !f.finished() {
+			return f
+		}
+		delete(a.ids, alias)
+	}
+	if !a.shared {
+		return nil
+	}
+	for _, f := range a.uploads() {
+		if f.alias() == alias && !f.finished() {
+			a.ids[alias] = f.ID.String()
+			return f
+		}
+	}
+	return nil
+}
+
+// assign names f alias, an empty alias removes the one of f. It does not
+// persist the alias, see File.saveInfo, it returns errAliasTaken when
+// another upload has it.
+func (a *aliasIndex) assign(f *File, alias string) error {
+	if len(alias) > 0 {
+		if err := validateAlias(alias); err != nil {
+			return err
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(alias) > 0 {
+		if other := a.find(alias); other != nil && other.ID != f.ID {
+			return errAliasTaken
+		}
+	}
+	f.mu.Lock()
+	previous := f.aliasName
+	f.aliasName = alias
+	f.mu.Unlock()
+	if len(previous) > 0 && a.ids[previous] == f.ID.String() {
+		delete(a.ids, previous)
+	}
+	if len(alias) > 0 {
+		a.ids[alias] = f.ID.String()
+	}
+	return nil
+}
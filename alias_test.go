@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateAlias(t *testing.T) {
+	tests := []struct {
+		testName    string
+		alias       string
+		expectError bool
+	}{
+		{"path", "builds/2024-06-01/app.tar.gz", false},
+		{"name", "latest", false},
+		{"leading slash", "/builds/app", true},
+		{"trailing slash", "builds/", true},
+		{"empty segment", "builds//app", true},
+		{"parent segment", "builds/../app", true},
+		{"space", "my build", true},
+		{"too long", strings.Repeat("a", MAX_ALIAS_LENGTH+1), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			if err := validateAlias(test.alias); (err != nil) != test.expectError {
+				t.Errorf("validateAlias does not return error=%v. got=%v", test.expectError, err)
+			}
+		})
+	}
+}
+
+func TestUploadAlias(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	dir := t.TempDir()
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: dir, AdminToken: "secret", RelativeLocation: true, PersistState: true}))
+	defer server.Close()
+	host := server.URL + "/files"
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	create := func(alias string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, host, nil)
+		if err != nil {
+			t.Fatalf("Fail to create test data. error=%v", err)
+		}
+		req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+		req.Header.Set(HEADER_UPLOAD_ALIAS, alias)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to execute POST request. error=%v", err)
+		}
+		res.Body.Close()
+		return res
+	}
+	resolve := func(alias string) *http.Response {
+		t.Helper()
+		res, err := client.Get(server.URL + "/aliases/" + alias)
+		if err != nil {
+			t.Fatalf("Fail to execute GET request. error=%v", err)
+		}
+		res.Body.Close()
+		return res
+	}
+	adminRequest := func(method, path, body string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Fail to create test data. error=%v", err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to execute %s request. error=%v", method, err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	res := create("builds/2024-06-01/app.tar.gz")
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("POST with an alias does not return 201. got=%d", res.StatusCode)
+	}
+	location := res.Header.Get(HEADER_LOCATION)
+	fileId := location[strings.LastIndex(location, "/")+1:]
+	if res := resolve("builds/2024-06-01/app.tar.gz"); res.StatusCode != http.StatusTemporaryRedirect || res.Header.Get(HEADER_LOCATION) != location {
+		t.Errorf("the alias does not redirect to the upload. got=%d %s", res.StatusCode, res.Header.Get(HEADER_LOCATION))
+	}
+	if res := create("builds/2024-06-01/app.tar.gz"); res.StatusCode != http.StatusConflict {
+		t.Errorf("POST with a taken alias does not return 409. got=%d", res.StatusCode)
+	}
+	if res := create("../app"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST with an invalid alias does not return 400. got=%d", res.StatusCode)
+	}
+	if res := resolve("builds/unknown"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("an unknown alias does not return 404. got=%d", res.StatusCode)
+	}
+
+	// renamed by an admin
+	if status := adminRequest(http.MethodPut, "/admin/uploads/"+fileId+"/alias", `{"alias": "releases/app.tar.gz"}`); status != http.StatusNoContent {
+		t.Fatalf("PUT of the alias does not return 204. got=%d", status)
+	}
+	if res := resolve("builds/2024-06-01/app.tar.gz"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("the previous alias still resolves. got=%d", res.StatusCode)
+	}
+	if res := resolve("releases/app.tar.gz"); res.StatusCode != http.StatusTemporaryRedirect || res.Header.Get(HEADER_LOCATION) != location {
+		t.Errorf("the new alias does not redirect to the upload. got=%d %s", res.StatusCode, res.Header.Get(HEADER_LOCATION))
+	}
+	info, err := readInfo(filepath.Join(dir, fileId+INFO_EXTENSION))
+	if err != nil {
+		t.Fatalf("Fail to read upload info. error=%v", err)
+	}
+	if info.Alias != "releases/app.tar.gz" {
+		t.Errorf("the info does not record the alias. got=%s", info.Alias)
+	}
+
+	// a terminated upload frees its alias
+	if status := adminRequest(http.MethodDelete, "/admin/uploads/"+fileId, ""); status != http.StatusNoContent {
+		t.Fatalf("DELETE does not return 204. got=%d", status)
+	}
+	if res := resolve("releases/app.tar.gz"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("the alias of a terminated upload still resolves. got=%d", res.StatusCode)
+	}
+	if res := create("releases/app.tar.gz"); res.StatusCode != http.StatusCreated {
+		t.Errorf("POST with a freed alias does not return 201. got=%d", res.StatusCode)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// the actions of the audit log
+const (
+	AUDIT_HOLD    = "hold"
+	AUDIT_RELEASE = "release"
+)
+
+// auditLog appends the admin actions compliance has to account for, the
+// legal holds, to a file as JSON lines, fsynced one by one. Every entry is
+// logged as well, a nil auditLog only logs them.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"` // see AUDIT_*
+	ID         string    `json:"id"`
+	Reason     string    `json:"reason,omitempty"`
+	RemoteAddr string    `json:"remote_addr"` // of the admin request
+}
+
+func newAuditLog(path string) (*auditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file}, nil
+}
+
+// record appends entry to the log
+func (a *auditLog) record(entry auditEntry) error {
+	slog.Info("Audit", slog.String("action", entry.Action), slog.String("id", entry.ID), slog.String("reason", entry.Reason), slog.String("remote_addr", entry.RemoteAddr))
+	if a == nil {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/binary"
+	"maps"
+	"slices"
+)
+
+// uploadEventAvroSchema is the Avro schema of UploadEvent, time is in
+// milliseconds since the epoch
+const uploadEventAvroSchema = `{
+  "type": "record",
+  "name": "UploadEvent",
+  "fields": [
+    {"name": "type", "type": "string"},
+    {"name": "time", "type": "long"},
+    {"name": "upload", "type": {
+      "type": "record",
+      "name": "EventUpload",
+      "fields": [
+        {"name": "id", "type": "string"},
+        {"name": "size", "type": "long"},
+        {"name": "offset", "type": "long"},
+        {"name": "metadata", "type": {"type": "map", "values": "string"}},
+        {"name": "state", "type": "string"},
+        {"name": "path", "type": "string"},
+        {"name": "checksum", "type": ["null", "string"], "default": null}
+      ]
+    }}
+  ]
+}`
+
+// the parsing canonical form of uploadEventAvroSchema, which its
+// fingerprint is computed over
+const uploadEventAvroCanonical = `{"name":"UploadEvent","type":"record","fields":[{"name":"type","type":"string"},{"name":"time","type":"long"},{"name":"upload","type":{"name":"EventUpload","type":"record","fields":[{"name":"id","type":"string"},{"name":"size","type":"long"},{"name":"offset","type":"long"},{"name":"metadata","type":{"type":"map","values":"string"}},{"name":"state","type":"string"},{"name":"path","type":"string"},{"name":"checksum","type":["null","string"]}]}}]}`
+
+var uploadEventAvroFingerprint = avroFingerprint(uploadEventAvroCanonical)
+
+// marshalAvro returns the event in the Avro single object encoding: the
+// C3 01 marker, the CRC-64-AVRO fingerprint of the schema, little endian,
+// then the binary encoding of the event
+func (e *UploadEvent) marshalAvro() []byte {
+	buff := []byte{0xc3, 0x01}
+	buff = binary.LittleEndian.AppendUint64(buff, uploadEventAvroFingerprint)
+	buff = appendAvroString(buff, e.Type)
+	buff = binary.AppendVarint(buff, e.Time.UnixMilli())
+	buff = appendAvroString(buff, e.Upload.ID)
+	buff = binary.AppendVarint(buff, int64(e.Upload.Size))
+	buff = binary.AppendVarint(buff, int64(e.Upload.Offset))
+	if len(e.Upload.Metadata) > 0 {
+		buff = binary.AppendVarint(buff, int64(len(e.Upload.Metadata)))
+		for _, k := range slices.Sorted(maps.Keys(e.Upload.Metadata)) {
+			buff = appendAvroString(buff, k)
+			buff = appendAvroString(buff, e.Upload.Metadata[k])
+		}
+	}
+	buff = binary.AppendVarint(buff, 0) // the end of the map blocks
+	buff = appendAvroString(buff, e.Upload.State)
+	buff = appendAvroString(buff, e.Upload.Path)
+	if len(e.Upload.Checksum) <= 0 {
+		buff = binary.AppendVarint(buff, 0) // null
+	} else {
+		buff = binary.AppendVarint(buff, 1)
+		buff = appendAvroString(buff, e.Upload.Checksum)
+	}
+	return buff
+}
+
+// appendAvroString appends s as its zigzag varint length and its bytes,
+// binary.AppendVarint is the zigzag encoding Avro uses for longs
+func appendAvroString(buff []byte, s string) []byte {
+	buff = binary.AppendVarint(buff, int64(len(s)))
+	return append(buff, s...)
+}
+
+// avroFingerprint returns the CRC-64-AVRO fingerprint of a canonical schema
+func avroFingerprint(schema string) uint64 {
+	const empty = 0xc15d213aa4d7a795
+	var table [256]uint64
+	for i := range table {
+		fp := uint64(i)
+		for range 8 {
+			fp = (fp >> 1) ^ (empty & -(fp & 1))
+		}
+		table[i] = fp
+	}
+	fp := uint64(empty)
+	for i := 0; i < len(schema); i++ {
+		fp = (fp >> 8) ^ table[byte(fp)^schema[i]]
+	}
+	return fp
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestMarshalAvro(t *testing.T) {
+	tests := []struct {
+		testName string
+		event    *UploadEvent
+		expected string
+	}{
+		{
+			testName: "Should encode a complete upload",
+			event: &UploadEvent{
+				Type: EVENT_COMPLETED,
+				Time: time.UnixMilli(1700000000123),
+				Upload: EventUpload{
+					ID:       "abc",
+					Size:     10,
+					Offset:   10,
+					Metadata: map[string]string{"filename": "a.txt", "b": "c"},
+					State:    UPLOAD_STATE_COMPLETED,
+					Path:     "/x/y",
+					Checksum: "sha256 Zm9v",
+				},
+			},
+			expected: "c3010b7cd503c6ab356312636f6d706c65746564f6a1abfef9620661626314140402620263106669" +
+				"6c656e616d650a612e7478740012636f6d706c65746564082f782f7902167368613235362" +
+				"05a6d3976",
+		},
+		{
+			testName: "Should encode an empty map and a null checksum",
+			event: &UploadEvent{
+				Type:   EVENT_COMPLETED,
+				Time:   time.UnixMilli(1700000000123),
+				Upload: EventUpload{ID: "abc", Size: 10, Offset: 10, State: UPLOAD_STATE_COMPLETED, Path: "/x/y"},
+			},
+			expected: "c3010b7cd503c6ab356312636f6d706c65746564f6a1abfef9620661626314140012636f6d706c65746564082f782f7900",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			if got := hex.EncodeToString(test.event.marshalAvro()); got != test.expected {
+				t.Errorf("marshalAvro does not return %s. got=%s", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// how many times in a row a client resumes a chunk before giving up on
+	// the upload, with a linear backoff
+	benchMaxRetries = 10
+	benchRetryDelay = 10 * time.Millisecond
+)
+
+// errBenchConflict is returned when the PATCH conflicts with a cut off one the
+// server is still writing
+var errBenchConflict = errors.New("Upload-Offset conflict or upload locked")
+
+// benchConfig describes a load generation run of the bench subcommand
+type benchConfig struct {
+	URL         string  // the creation endpoint of the target server
+	Clients     int     // the number of concurrent simulated clients
+	Uploads     int     // the number of uploads each client makes
+	FileSize    int     // the Upload-Length of every upload
+	ChunkSize   int     // the body size of every PATCH
+	FailureRate float64 // the probability for a PATCH to be cut off in the middle of its body
+}
+
+// benchResult is the report of a bench run. Latencies are the ones of the
+// successful PATCH requests.
+type benchResult struct {
+	Uploads   int64
+	Failures  int64 // uploads given up on after an unexpected response
+	Resumes   int64 // PATCHes cut off by the failure injection or conflicting, and resumed
+	Bytes     int64
+	Duration  time.Duration
+	latencies []time.Duration
+}
+
+func (r *benchResult) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Duration.Seconds()
+}
+
+// Percentile returns the PATCH latency under which p percent of them are
+func (r *benchResult) Percentile(p float64) time.Duration {
+	if len(r.latencies) <= 0 {
+		return 0
+	}
+	sorted := slices.Clone(r.latencies)
+	slices.Sort(sorted)
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
+
+func (r *benchResult) String() string {
+	return fmt.Sprintf(
+		"uploads=%d failures=%d resumes=%d bytes=%d duration=%s throughput=%.2fMB/s\npatch latency p50=%s p90=%s p99=%s max=%s",
+		r.Uploads, r.Failures, r.Resumes, r.Bytes, r.Duration.Round(time.Millisecond), r.Throughput()/(1024*1024),
+		r.Percentile(50), r.Percentile(90), r.Percentile(99), r.Percentile(100),
+	)
+}
+
+// runBench parses the arguments of the bench subcommand, runs it and prints
+// the report
+func runBench(args []string) error {
+	cfg := benchConfig{}
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.StringVar(&cfg.URL, "url", "http://localhost:8080/files", "the creation endpoint of the target server")
+	flags.IntVar(&cfg.Clients, "clients", 8, "the number of concurrent clients")
+	flags.IntVar(&cfg.Uploads, "uploads", 4, "the number of uploads per client")
+	flags.IntVar(&cfg.FileSize, "size", 16*CHUNK_SIZE, "the size of every upload in bytes")
+	flags.IntVar(&cfg.ChunkSize, "chunk", CHUNK_SIZE, "the size of every PATCH in bytes")
+	flags.Float64Var(&cfg.FailureRate, "failure-rate", 0, "the probability in [0, 1] for a PATCH to be cut off and resumed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	result, err := bench(cfg)
+	if err != nil {
+		return err
+	}
+	fmt.Println(result)
+	return nil
+}
+
+// bench runs cfg.Clients concurrent clients, each making cfg.Uploads uploads
+// one after the other
+func bench(cfg benchConfig) (*benchResult, error) {
+	if cfg.Clients <= 0 || cfg.Uploads <= 0 || cfg.FileSize <= 0 || cfg.ChunkSize <= 0 {
+		return nil, errors.New("clients, uploads, size and chunk must be positive")
+	}
+	if cfg.FailureRate < 0 || cfg.FailureRate >= 1 {
+		return nil, errors.New("failure-rate must be in [0, 1)")
+	}
+	endpoint, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid url %v", err)
+	}
+
+	result := &benchResult{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range cfg.Clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := &benchClient{cfg: cfg, endpoint: endpoint, client: &http.Client{}, result: result}
+			for range cfg.Uploads {
+				if err := c.upload(); err != nil {
+					atomic.AddInt64(&result.Failures, 1)
+					continue
+				}
+				atomic.AddInt64(&result.Uploads, 1)
+			}
+			mu.Lock()
+			result.latencies = append(result.latencies, c.latencies...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// benchClient is a simulated tus client
+type benchClient struct {
+	cfg       benchConfig
+	endpoint  *url.URL
+	client    *http.Client
+	result    *benchResult
+	latencies []time.Duration
+}
+
+// upload creates an upload and sends it chunk by chunk, resuming from the
+// offset of the server whenever a chunk is cut off or conflicts with a cut
+// off one the server is still writing
+func (c *benchClient) upload() error {
+	location, err := c.create()
+	if err != nil {
+		return err
+	}
+
+	offset, retries := 0, 0
+	for offset < c.cfg.FileSize {
+		size := min(c.cfg.ChunkSize, c.cfg.FileSize-offset)
+		cutAt := -1
+		if rand.Float64() < c.cfg.FailureRate {
+			cutAt = rand.IntN(size)
+		}
+
+		start := time.Now()
+		next, err := c.patch(location, offset, size, cutAt)
+		if err == nil {
+			c.latencies = append(c.latencies, time.Since(start))
+			atomic.AddInt64(&c.result.Bytes, int64(next-offset))
+			offset, retries = next, 0
+			continue
+		}
+		if errors.Is(err, errBenchConflict) {
+			// the injected failures always end, only the conflicts in a row
+			// are bounded
+			if retries++; retries > benchMaxRetries {
+				return err
+			}
+			time.Sleep(time.Duration(retries) * benchRetryDelay)
+		} else if cutAt < 0 {
+			return err
+		}
+
+		atomic.AddInt64(&c.result.Resumes, 1)
+		next, err = c.offset(location)
+		if err != nil {
+			return err
+		}
+		if next > offset {
+			retries = 0
+		}
+		atomic.AddInt64(&c.result.Bytes, int64(next-offset))
+		offset = next
+	}
+	return nil
+}
+
+func (c *benchClient) create() (string, error) {
+	req, err := http.NewRequest(http.MethodPost, c.endpoint.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+	req.Header.Set(HEADER_UPLOAD_LENGTH, strconv.Itoa(c.cfg.FileSize))
+	res, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("Unexpected creation status %d", res.StatusCode)
+	}
+
+	location, err := c.endpoint.Parse(res.Header.Get(HEADER_LOCATION))
+	if err != nil {
+		return "", fmt.Errorf("Invalid location %v", err)
+	}
+	return location.String(), nil
+}
+
+// patch sends size bytes at offset, cutting the body off after cutAt bytes
+// when it is not negative, and returns the new offset
+func (c *benchClient) patch(location string, offset, size, cutAt int) (int, error) {
+	var body io.Reader = io.LimitReader(zeroes{}, int64(size))
+	if cutAt >= 0 {
+		body = io.MultiReader(io.LimitReader(zeroes{}, int64(cutAt)), failingBody{})
+	}
+	req, err := http.NewRequest(http.MethodPatch, location, body)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = int64(size)
+	req.Header.Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+	req.Header.Set(HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM)
+	req.Header.Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(offset))
+	res, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusConflict || res.StatusCode == http.StatusLocked {
+		return 0, errBenchConflict
+	}
+	if res.StatusCode != http.StatusNoContent {
+		return 0, fmt.Errorf("Unexpected PATCH status %d", res.StatusCode)
+	}
+	return strconv.Atoi(res.Header.Get(HEADER_UPLOAD_OFFSET))
+}
+
+// offset asks the server for the offset to resume from
+func (c *benchClient) offset(location string) (int, error) {
+	req, err := http.NewRequest(http.MethodHead, location, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+	res, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Unexpected HEAD status %d", res.StatusCode)
+	}
+	return strconv.Atoi(res.Header.Get(HEADER_UPLOAD_OFFSET))
+}
+
+// zeroes is the endless body of the simulated uploads
+type zeroes struct{}
+
+func (zeroes) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// failingBody simulates a client dropping its connection mid request
+type failingBody struct{}
+
+func (failingBody) Read(p []byte) (int, error) {
+	return 0, errors.New("injected failure")
+}
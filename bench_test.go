@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBench(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, RelativeLocation: true}))
+	defer server.Close()
+
+	tests := []struct {
+		testName    string
+		failureRate float64
+	}{
+		{"no failure", 0},
+		{"with failures", 0.5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			cfg := benchConfig{
+				URL:         server.URL + "/files",
+				Clients:     4,
+				Uploads:     2,
+				FileSize:    4 * 1024,
+				ChunkSize:   1024,
+				FailureRate: test.failureRate,
+			}
+			result, err := bench(cfg)
+			if err != nil {
+				t.Fatalf("Fail to run bench. error=%v", err)
+			}
+			if result.Failures != 0 {
+				t.Errorf("bench does not complete every upload. got=%s", result)
+			}
+			if result.Uploads != int64(cfg.Clients*cfg.Uploads) {
+				t.Errorf("bench does not make %d uploads. got=%d", cfg.Clients*cfg.Uploads, result.Uploads)
+			}
+			if result.Bytes != int64(cfg.Clients*cfg.Uploads*cfg.FileSize) {
+				t.Errorf("bench does not count the bytes uploaded. got=%d", result.Bytes)
+			}
+			if result.Percentile(50) <= 0 || result.Percentile(50) > result.Percentile(99) {
+				t.Errorf("bench does not report latency percentiles. got=%s", result)
+			}
+		})
+	}
+}
+
+func TestBenchPercentile(t *testing.T) {
+	result := &benchResult{}
+	for i := 1; i <= 100; i++ {
+		result.latencies = append(result.latencies, time.Duration(i)*time.Millisecond)
+	}
+	tests := []struct {
+		p        float64
+		expected time.Duration
+	}{
+		{0, time.Millisecond},
+		{50, 50 * time.Millisecond},
+		{99, 99 * time.Millisecond},
+		{100, 100 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if got := result.Percentile(test.p); got != test.expected {
+			t.Errorf("Percentile(%v) does not return %v. got=%v", test.p, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// the units of ByteSize, SI ones are powers of 1000 and IEC ones of 1024
+var byteUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// ByteSize is a size in bytes read from a human readable value, i.e., 50GB,
+// 1.5GiB or 1048576, in the flags and in the config file
+type ByteSize int64
+
+// parseByteSize parses a number of bytes followed by an optional unit, see
+// byteUnits, ignoring case and the spaces between them
+func parseByteSize(value string) (ByteSize, error) {
+	value = strings.TrimSpace(value)
+	i := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(value)
+	}
+	n, err := strconv.ParseFloat(value[:i], 64)
+	unit, ok := byteUnits[strings.ToLower(strings.TrimSpace(value[i:]))]
+	if err != nil || !ok || n*unit >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return ByteSize(n * unit), nil
+}
+
+func (s *ByteSize) String() string {
+	if s == nil {
+		return "0"
+	}
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *ByteSize) Set(value string) error {
+	size, err := parseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*s = size
+	return nil
+}
+
+// UnmarshalJSON reads a number of bytes or a human readable string
+func (s *ByteSize) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		value = string(data)
+	}
+	return s.Set(value)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected ByteSize
+		valid    bool
+	}{
+		{"1048576", 1048576, true},
+		{"50GB", 50e9, true},
+		{"50 gb", 50e9, true},
+		{"1.5GiB", 3 << 29, true},
+		{"512KiB", 512 << 10, true},
+		{"10B", 10, true},
+		{"10XB", 0, false},
+		{"GB", 0, false},
+		{"-1GB", 0, false},
+		{"100000000TB", 0, false},
+	}
+
+	for _, test := range tests {
+		got, err := parseByteSize(test.value)
+		if (err == nil) != test.valid || got != test.expected {
+			t.Errorf("parseByteSize(%s) does not return %d. got=%d error=%v", test.value, test.expected, got, err)
+		}
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	config := &ServerConfig{
+		UploadDir: t.TempDir(),
+		MaxSize:   100,
+		Tenants:   map[string]TenantConfig{"a": {MaxSize: 10}},
+	}
+	server := httptest.NewServer(buildServeMux(config))
+	defer server.Close()
+
+	tests := []struct {
+		testName        string
+		host            string
+		length          string
+		expectedMaxSize string
+		expectedStatus  int
+	}{
+		{"Should accept the max size of the server", server.URL + "/files", "100", "100", http.StatusCreated},
+		{"Should refuse past the max size of the server", server.URL + "/files", "101", "100", http.StatusRequestEntityTooLarge},
+		{"Should refuse past the max size of the tenant", server.URL + "/tenants/a/files", "11", "10", http.StatusRequestEntityTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodOptions, test.host, nil)
+			if err != nil {
+				t.Fatalf("Fail to create OPTIONS request. error=%v", err)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute OPTIONS request. error=%v", err)
+			}
+			res.Body.Close()
+			if got := res.Header.Get(HEADER_TUS_MAX_SIZE); got != test.expectedMaxSize {
+				t.Errorf("OPTIONS does not return Tus-Max-Size %s. got=%s", test.expectedMaxSize, got)
+			}
+
+			req, err = http.NewRequest(http.MethodPost, test.host, nil)
+			if err != nil {
+				t.Fatalf("Fail to create test data. Error=%v", err)
+			}
+			req.Header.Set(HEADER_UPLOAD_LENGTH, test.length)
+			res, err = http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute POST request. error=%v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != test.expectedStatus {
+				t.Errorf("POST does not return %d. got=%d", test.expectedStatus, res.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// METADATA_CALLBACK_URL is the metadata key of the URL POSTed the completed
+// event of the upload
+const METADATA_CALLBACK_URL = "callback_url"
+
+// how long the delivery of a callback may take
+const callbackTimeout = 10 * time.Second
+
+// callbacks POSTs the completed event of an upload to the callback_url of
+// its metadata. The URL must be http or https on a host of the allowlist so
+// the server can't be made to POST into the network it runs in. Redirects
+// are not followed for the same reason. The delivery runs in the background,
+// a failed one is logged and dropped.
+type callbacks struct {
+	allowed []string // host, host:port or *.domain
+	client  *http.Client
+	format  eventFormat
+}
+
+// newCallbacks returns the callbacks of config.CallbackHosts, nil when there
+// is none and the callback_url metadata is ignored
+func newCallbacks(config *ServerConfig) *callbacks {
+	if len(config.CallbackHosts) <= 0 {
+		return nil
+	}
+	return &callbacks{
+		allowed: config.CallbackHosts,
+		format:  newEventFormat(config, config.EventFormat),
+		client: &http.Client{
+			Timeout: callbackTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// validate checks the callback_url of metadata, if any, against the
+// allowlist
+func (c *callbacks) validate(metadata string) error {
+	if c == nil {
+		return nil
+	}
+	callback, ok := parseMetadata(metadata)[METADATA_CALLBACK_URL]
+	if !ok {
+		return nil
+	}
+	u, err := url.Parse(callback)
+	if err != nil {
+		return fmt.Errorf("Invalid callback url %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("Invalid callback url scheme %q", u.Scheme)
+	}
+	if !c.allows(u) {
+		return fmt.Errorf("callback host %q is not allowed", u.Host)
+	}
+	return nil
+}
+
+func (c *callbacks) allows(u *url.URL) bool {
+	host := strings.ToLower(u.Host)
+	hostname := strings.ToLower(u.Hostname())
+	for _, allowed := range c.allowed {
+		allowed = strings.ToLower(allowed)
+		if domain, ok := strings.CutPrefix(allowed, "*."); ok {
+			if strings.HasSuffix(hostname, "."+domain) {
+				return true
+			}
+			continue
+		}
+		if allowed == host || allowed == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+// fire POSTs the completed event of f to its callback_url without waiting
+func (c *callbacks) fire(f *File) {
+	if c == nil {
+		return
+	}
+	callback, ok := parseMetadata(f.metadata())[METADATA_CALLBACK_URL]
+	if !ok {
+		return
+	}
+	event := newUploadEvent(EVENT_COMPLETED, f)
+	go func() {
+		if err := c.post(callback, event); err != nil {
+			slog.Error("Fail to deliver callback", slog.String("id", event.Upload.ID), slog.String("url", callback), slog.Any("Error", err))
+		}
+	}()
+}
+
+func (c *callbacks) post(callback string, event *UploadEvent) error {
+	encoded, err := c.format.encode(event)
+	if encoded.payload == nil || err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, callback, bytes.NewReader(encoded.payload))
+	if err != nil {
+		return err
+	}
+	encoded.setHeaders(req.Header)
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return errors.New("callback answered " + res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func callbackMetadata(callback string) string {
+	return METADATA_CALLBACK_URL + " " + base64.StdEncoding.EncodeToString([]byte(callback))
+}
+
+func TestCallbackValidate(t *testing.T) {
+	c := newCallbacks(&ServerConfig{CallbackHosts: []string{"hooks.example.com", "*.example.org", "10.0.0.1:8080"}})
+	tests := []struct {
+		testName    string
+		metadata    string
+		expectError bool
+	}{
+		{"no callback", "filename YS50eHQ=", false},
+		{"allowed host", callbackMetadata("https://hooks.example.com/done"), false},
+		{"allowed host any port", callbackMetadata("https://hooks.example.com:8443/done"), false},
+		{"allowed subdomain", callbackMetadata("http://a.b.example.org/done"), false},
+		{"wildcard does not allow the domain", callbackMetadata("http://example.org/done"), true},
+		{"allowed host and port", callbackMetadata("http://10.0.0.1:8080/done"), false},
+		{"other port", callbackMetadata("http://10.0.0.1:9090/done"), true},
+		{"other host", callbackMetadata("https://hooks.example.com.evil.com/done"), true},
+		{"not http", callbackMetadata("file:///etc/passwd"), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			if err := c.validate(test.metadata); (err != nil) != test.expectError {
+				t.Errorf("validate does not return error=%v. got=%v", test.expectError, err)
+			}
+		})
+	}
+}
+
+func TestCallback(t *testing.T) {
+	delivered := make(chan UploadEvent, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event UploadEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("Fail to decode callback. error=%v", err)
+		}
+		delivered <- event
+	}))
+	defer callback.Close()
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, RelativeLocation: true, CallbackHosts: []string{"127.0.0.1"}}))
+	defer server.Close()
+	host := server.URL + "/files"
+
+	tests := []struct {
+		testName       string
+		callback       string
+		expectedStatus int
+	}{
+		{"allowed", callback.URL + "/done", http.StatusCreated},
+		{"not allowed", "http://localhost/done", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, host, nil)
+			if err != nil {
+				t.Fatalf("Fail to create test data. Error=%v", err)
+			}
+			req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+			req.Header.Set(HEADER_UPLOAD_METADATA, callbackMetadata(test.callback))
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute POST request. error=%v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != test.expectedStatus {
+				t.Fatalf("POST with callback %s does not return %v. got=%v", test.callback, test.expectedStatus, res.StatusCode)
+			}
+			if res.StatusCode != http.StatusCreated {
+				return
+			}
+
+			fileId := filepath.Base(res.Header.Get(HEADER_LOCATION))
+			patchUpload(t, host, fileId, 0, content[:4])
+			select {
+			case event := <-delivered:
+				t.Fatalf("the callback is delivered before the upload completes. got=%+v", event)
+			default:
+			}
+			patchUpload(t, host, fileId, 4, content[4:10])
+			select {
+			case event := <-delivered:
+				if event.Type != EVENT_COMPLETED || event.Upload.ID != fileId || event.Upload.Offset != 10 {
+					t.Errorf("the callback does not POST the completed upload. got=%+v", event)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Fail to receive callback")
+			}
+		})
+	}
+}
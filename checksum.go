@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+)
+
+const HEADER_UPLOAD_CHECKSUM = "Upload-Checksum"
+
+// checksum is the running SHA-256 of the committed bytes of an upload, fed
+// as the PATCH bodies stream through so the digest of a complete upload is
+// known without reading it back. The hash state is kept in the File along
+// with the rest of the upload state.
+type checksum struct {
+	hash   hash.Hash
+	hashed int64 // the number of bytes fed to hash
+}
+
+func newChecksum() *checksum {
+	return &checksum{hash: sha256.New()}
+}
+
+// reset starts the checksum over from no data
+func (c *checksum) reset() {
+	c.hash = sha256.New()
+	c.hashed = 0
+}
+
+// the io.Writer the PATCH body is teed into
+func (c *checksum) Write(p []byte) (int, error) {
+	c.hashed += int64(len(p))
+	return c.hash.Write(p)
+}
+
+// header returns the value of Upload-Checksum, in the format of the tus
+// checksum extension
+func (c *checksum) header() string {
+	return "sha256 " + base64.StdEncoding.EncodeToString(c.hash.Sum(nil))
+}
+
+// track tees body into the checksum of f and returns the function to call
+// once the body has been written with the offset it started at. The hash
+// sees everything read from the body while only a prefix of it may be
+// committed, i.e., on a failed write or a failed fsync in the strict modes,
+// the hash is then rewound and fed the committed bytes from disk.
+func (c *checksum) track(body io.Reader) (io.Reader, func(path string, start, committed int)) {
+	snapshot, err := c.hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		// never happens with crypto/sha256
+		panic(err)
+	}
+	hashedBefore := c.hashed
+
+	return io.TeeReader(body, c), func(path string, start, committed int) {
+		if c.hashed-hashedBefore == int64(committed-start) {
+			return
+		}
+		c.hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(snapshot)
+		c.hashed = hashedBefore
+		if err := c.hashRange(path, int64(start), int64(committed-start)); err != nil {
+			// the upload will be reported without a checksum rather than a
+			// wrong one
+			c.hash = nil
+		}
+	}
+}
+
+func (c *checksum) hashRange(path string, offset, n int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(c, io.NewSectionReader(file, offset, n))
+	return err
+}
+
+// valid reports whether the checksum covers every committed byte
+func (c *checksum) valid() bool {
+	return c != nil && c.hash != nil
+}
+
+// setChecksumHeader sets Upload-Checksum once the upload is complete, and
+// the checksum has seen all of it, which it has not on an instance sharing
+// the upload with the one that completed it, see ServerConfig.SharedStorage
+func setChecksumHeader(w http.ResponseWriter, f *File) {
+	if offset := f.offset(); offset >= f.Size && f.checksum.valid() && f.checksum.hashed == int64(offset) {
+		w.Header().Set(HEADER_UPLOAD_CHECKSUM, f.checksum.header())
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func expectedChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256 " + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestChecksum(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, Checksum: true}))
+	defer server.Close()
+	host := server.URL + "/files"
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	fileId := createUpload(t, host, len(data))
+
+	head := func() string {
+		t.Helper()
+		res, err := http.Head(fmt.Sprintf("%s/%s", host, fileId))
+		if err != nil {
+			t.Fatalf("Fail to execute HEAD request. error=%v", err)
+		}
+		res.Body.Close()
+		return res.Header.Get(HEADER_UPLOAD_CHECKSUM)
+	}
+
+	patchUpload(t, host, fileId, 0, string(data[:3000]))
+	if got := head(); len(got) > 0 {
+		t.Errorf("HEAD returns a checksum before the upload is complete. got=%s", got)
+	}
+	patchUpload(t, host, fileId, 3000, string(data[3000:]))
+	if got := head(); got != expectedChecksum(data) {
+		t.Errorf("HEAD does not return %s. got=%s", expectedChecksum(data), got)
+	}
+}
+
+func TestChecksumSettle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	data := []byte("committed+dropped")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+
+	tests := []struct {
+		testName  string
+		committed int
+	}{
+		{"everything committed", len(data)},
+		{"prefix committed", len("committed")},
+		{"nothing committed", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			c := newChecksum()
+			body, settle := c.track(bytes.NewReader(data))
+			if _, err := io.Copy(io.Discard, body); err != nil {
+				t.Fatalf("Fail to read body. error=%v", err)
+			}
+			settle(path, 0, test.committed)
+
+			if got := c.header(); got != expectedChecksum(data[:test.committed]) {
+				t.Errorf("checksum does not cover the committed bytes only. got=%s", got)
+			}
+			if c.hashed != int64(test.committed) {
+				t.Errorf("checksum does not count %d bytes. got=%d", test.committed, c.hashed)
+			}
+		})
+	}
+}
+
+func TestChecksumFailedWrite(t *testing.T) {
+	f := &File{ID: uuid.New(), Size: 4 * CHUNK_SIZE, fsync: syncPolicy{mode: FSYNC_CHUNK}, checksum: newChecksum()}
+	if err := f.create(); err != nil {
+		t.Fatalf("Fail to create file. error=%v", err)
+	}
+	if err := f.write(context.Background(), &failingReader{n: CHUNK_SIZE + 100}); err == nil {
+		t.Fatalf("write does not fail")
+	}
+
+	written, err := os.ReadFile(f.path())
+	if err != nil {
+		t.Fatalf("Fail to read file. error=%v", err)
+	}
+	if len(written) != f.Offset {
+		t.Fatalf("write does not keep the file at the offset. size=%d offset=%d", len(written), f.Offset)
+	}
+	if got := f.checksum.header(); got != expectedChecksum(written) {
+		t.Errorf("checksum does not match the committed bytes. expected=%s got=%s", expectedChecksum(written), got)
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"resumable-upload/tusclient"
+)
+
+// metadataFlag collects the repeated key=value metadata flags of the client
+// subcommands
+type metadataFlag map[string]string
+
+func (m metadataFlag) String() string {
+	return encodeMetadata(m)
+}
+
+func (m metadataFlag) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok || len(k) <= 0 {
+		return fmt.Errorf("metadata %q is not key=value", value)
+	}
+	m[k] = v
+	return nil
+}
+
+// parseInterspersed parses args with flags allowing the flags after the
+// positional arguments, i.e., upload a.txt --endpoint URL, and returns the
+// positional ones
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) <= 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// progressBar renders the tusclient progress reports on a line of w
+type progressBar struct {
+	w    io.Writer
+	done bool
+}
+
+const progressBarWidth = 30
+
+func (b *progressBar) report(p tusclient.Progress) {
+	rate := formatBytes(int64(p.Rate)) + "/s"
+	if p.Total < 0 {
+		fmt.Fprintf(b.w, "\r%s %s   ", formatBytes(p.Sent), rate)
+		return
+	}
+	filled := progressBarWidth
+	percent := 100.0
+	if p.Total > 0 {
+		filled = int(p.Sent * progressBarWidth / p.Total)
+		percent = float64(p.Sent) * 100 / float64(p.Total)
+	}
+	fmt.Fprintf(b.w, "\r[%s%s] %5.1f%% %s/%s %s   ", strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled),
+		percent, formatBytes(p.Sent), formatBytes(p.Total), rate)
+	if p.Sent >= p.Total && !b.done {
+		b.done = true
+		fmt.Fprintln(b.w)
+	}
+}
+
+// formatBytes formats n in the largest binary unit under it
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// clientFlags are the flags of the subcommands speaking to a server
+type clientFlags struct {
+	endpoint string
+	chunk    int64
+	retries  int
+	quiet    bool
+	store    string
+	limit    rateFlag
+	checksum listFlag
+
+	header       headerFlag
+	token        string
+	tokenFile    string
+	apiKey       string
+	apiKeyHeader string
+	cert         string
+	key          string
+	caCert       string
+}
+
+// headerFlag collects the repeated "Name: value" header flags
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	return fmt.Sprint(http.Header(h))
+}
+
+func (h headerFlag) Set(value string) error {
+	name, v, ok := strings.Cut(value, ":")
+	if !ok || len(strings.TrimSpace(name)) <= 0 {
+		return fmt.Errorf("header %q is not Name: value", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(name), strings.TrimSpace(v))
+	return nil
+}
+
+// rateFlag is a byte rate flag, i.e., 5MB/s, 512KiB/s or 1000000
+type rateFlag int64
+
+func (r *rateFlag) String() string {
+	if r == nil || *r <= 0 {
+		return ""
+	}
+	return formatBytes(int64(*r)) + "/s"
+}
+
+func (r *rateFlag) Set(value string) error {
+	number := strings.TrimSuffix(strings.TrimSpace(value), "/s")
+	unit := int64(1)
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"B", 1},
+	} {
+		if n, ok := strings.CutSuffix(number, u.suffix); ok {
+			number, unit = strings.TrimSpace(n), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid rate %q", value)
+	}
+	*r = rateFlag(n * float64(unit))
+	return nil
+}
+
+// defaultStorePath is the file the client subcommands keep the URLs of the
+// uploads in progress in by default, empty without a user cache directory
+func defaultStorePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "resumable-upload", "uploads.json")
+}
+
+func (c *clientFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&c.endpoint, "endpoint", "http://localhost:8080/files", "the creation endpoint of the server")
+	flags.Int64Var(&c.chunk, "chunk", tusclient.DEFAULT_CHUNK_SIZE, "the size of every PATCH in bytes")
+	flags.IntVar(&c.retries, "retries", 5, "how many times a failed chunk is retried in a row")
+	flags.BoolVar(&c.quiet, "quiet", false, "do not show the progress")
+	flags.Var(&c.limit, "limit", "the upload bandwidth, i.e., 5MB/s, unlimited by default")
+	flags.Var(&c.checksum, "checksum", "the checksum algorithms of the chunks by preference, i.e., sha256,sha1, the first one the server supports is used")
+	flags.Var(c.header, "header", "a Name: value header of every request, repeatable")
+	flags.StringVar(&c.token, "token", "", "the bearer token of every request")
+	flags.StringVar(&c.tokenFile, "token-file", "", "the file of the bearer token, read again for every request so it may be refreshed during the upload")
+	flags.StringVar(&c.apiKey, "api-key", "", "the API key of every request, sent in --api-key-header")
+	flags.StringVar(&c.apiKeyHeader, "api-key-header", "X-API-Key", "the header of the API key")
+	flags.StringVar(&c.cert, "cert", "", "the PEM client certificate for a server requiring mutual TLS")
+	flags.StringVar(&c.key, "key", "", "the PEM key of the client certificate")
+	flags.StringVar(&c.caCert, "cacert", "", "the PEM certificates of a private CA to trust")
+	flags.StringVar(&c.store, "store", defaultStorePath(), "the file keeping the URLs of the uploads in progress by fingerprint, empty keeps none")
+}
+
+func (c *clientFlags) client(stderr io.Writer) (*tusclient.Client, error) {
+	client := tusclient.New(c.endpoint)
+	client.Header = http.Header(c.header)
+	switch {
+	case len(c.tokenFile) > 0:
+		client.Credentials = tusclient.TokenSource(func(context.Context) (string, error) {
+			token, err := os.ReadFile(c.tokenFile)
+			return strings.TrimSpace(string(token)), err
+		})
+	case len(c.token) > 0:
+		client.Credentials = tusclient.BearerToken(c.token)
+	case len(c.apiKey) > 0:
+		client.Credentials = tusclient.APIKey(c.apiKeyHeader, c.apiKey)
+	}
+	if len(c.cert) > 0 || len(c.key) > 0 || len(c.caCert) > 0 {
+		httpClient, err := tusclient.NewTLSHTTPClient(c.cert, c.key, c.caCert)
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient = httpClient
+	}
+	client.ChunkSize = c.chunk
+	client.Retries = c.retries
+	client.MaxBandwidth = int64(c.limit)
+	client.ChecksumAlgorithms = c.checksum
+	if len(c.store) > 0 {
+		client.Store = tusclient.NewFileStore(c.store)
+	}
+	if !c.quiet {
+		client.OnProgress = (&progressBar{w: stderr}).report
+	}
+	return client, nil
+}
+
+// runUpload parses the arguments of the upload subcommand, uploads the file,
+// or the standard input for -, and prints the upload URL
+func runUpload(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	cfg := clientFlags{header: headerFlag{}}
+	metadata := metadataFlag{}
+	flags := flag.NewFlagSet("upload", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	cfg.register(flags)
+	flags.Var(metadata, "metadata", "a key=value metadata of the upload, repeatable")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: upload <file|-> [--endpoint URL] [--metadata key=value]...")
+	}
+
+	client, err := cfg.client(stderr)
+	if err != nil {
+		return err
+	}
+	var upload *tusclient.Upload
+	if positional[0] == "-" {
+		upload, err = uploadStdin(ctx, client, stdin, metadata)
+	} else {
+		upload, err = client.UploadFile(ctx, positional[0], metadata)
+	}
+	if err != nil {
+		if upload != nil && positional[0] != "-" {
+			fmt.Fprintf(stderr, "the upload %s is interrupted at %d, resume it with: resume %s %s\n", upload.URL, upload.Offset, upload.URL, positional[0])
+		}
+		return err
+	}
+	fmt.Fprintln(stdout, upload.URL)
+	return nil
+}
+
+// runResume parses the arguments of the resume subcommand, finds the offset
+// of the upload given by its URL, or by the fingerprint of its source in the
+// store, and sends the rest of the file from there
+func runResume(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	cfg := clientFlags{header: headerFlag{}}
+	flags := flag.NewFlagSet("resume", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	cfg.register(flags)
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return errors.New("usage: resume <upload-url|fingerprint> <file> [--endpoint URL]")
+	}
+
+	client, err := cfg.client(stderr)
+	if err != nil {
+		return err
+	}
+	url, fingerprint := positional[0], ""
+	if !strings.Contains(url, "://") {
+		if client.Store == nil {
+			return errors.New("resume of a fingerprint needs a --store")
+		}
+		fingerprint = url
+		if url, err = client.Store.Get(fingerprint); err != nil {
+			return err
+		}
+		if len(url) <= 0 {
+			return fmt.Errorf("no upload of fingerprint %s in %s", fingerprint, cfg.store)
+		}
+	}
+	file, err := os.Open(positional[1])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	upload, err := client.Resume(ctx, url)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "resuming %s at %d of %d\n", upload.URL, upload.Offset, upload.Size)
+	if err := upload.Upload(ctx, file); err != nil {
+		return err
+	}
+	if len(fingerprint) > 0 {
+		if err := client.Store.Delete(fingerprint); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(stdout, upload.URL)
+	return nil
+}
+
+// uploadStdin streams stdin with a deferred length, or spools it to a
+// temporary file first for a server without the creation-defer-length
+// extension
+func uploadStdin(ctx context.Context, client *tusclient.Client, stdin io.Reader, metadata map[string]string) (*tusclient.Upload, error) {
+	upload, err := client.UploadStream(ctx, stdin, metadata)
+	if !errors.Is(err, tusclient.ErrDeferLengthUnsupported) {
+		return upload, err
+	}
+	spool, err := os.CreateTemp("", "tus-stdin-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	if _, err := io.Copy(spool, stdin); err != nil {
+		return nil, err
+	}
+	return client.UploadFingerprinted(ctx, "", spool, metadata)
+}
+
+// runClient runs a client subcommand with the standard streams until it
+// completes or an interrupt
+func runClient(run func(context.Context, []string, io.Reader, io.Writer, io.Writer) error, args []string) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	return run(ctx, args, os.Stdin, os.Stdout, os.Stderr)
+}
+
+// adminFlags are the flags of the subcommands speaking to the admin API
+type adminFlags struct {
+	server string
+	token  string
+}
+
+func (a *adminFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&a.server, "server", "http://localhost:8080", "the root URL of the server, the admin API is under /admin")
+	flags.StringVar(&a.token, "token", "", "the admin token of the server")
+}
+
+// get decodes the JSON answer of the admin API to a GET of path into v
+func (a *adminFlags) get(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(a.server, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(res.Body).Decode(v)
+	case http.StatusNotFound:
+		return fmt.Errorf("GET %s answered 404, the upload or the admin API does not exist", path)
+	default:
+		return fmt.Errorf("GET %s answered %d", path, res.StatusCode)
+	}
+}
+
+// formatAge formats the time since t, - for a zero t
+func formatAge(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return time.Since(t).Round(time.Second).String()
+}
+
+// runList parses the arguments of the list subcommand and prints the uploads
+// of the server with their state, offset and age
+func runList(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	cfg := adminFlags{}
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	cfg.register(flags)
+	metadata, contains := metadataFlag{}, metadataFlag{}
+	state := flags.String("state", "", "list the uploads of these states only, comma separated")
+	flags.Var(metadata, "metadata", "list the uploads whose metadata key has the value, key=value, repeatable")
+	flags.Var(contains, "contains", "list the uploads whose metadata key contains the value ignoring case, key=value, repeatable")
+	search := flags.String("search", "", "list the uploads whose id or any metadata value contains this text, ignoring case")
+	olderThan := flags.Duration("older-than", 0, "list the uploads last written before this duration ago")
+	newerThan := flags.Duration("newer-than", 0, "list the uploads last written within this duration")
+	limit := flags.Int("limit", 0, "list this many uploads at most, 0 lists them all")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// the server filters the uploads
+	query := url.Values{}
+	if len(*state) > 0 {
+		query.Set("state", *state)
+	}
+	for k, v := range metadata {
+		query.Set("metadata."+k, v)
+	}
+	for k, v := range contains {
+		query.Set("metadata."+k+"~", v)
+	}
+	if len(*search) > 0 {
+		query.Set("q", *search)
+	}
+	if *olderThan > 0 {
+		query.Set("older_than", olderThan.String())
+	}
+	if *newerThan > 0 {
+		query.Set("newer_than", newerThan.String())
+	}
+	if *limit > 0 {
+		query.Set("limit", strconv.Itoa(*limit))
+	}
+	path := "/admin/uploads"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var uploads []uploadSummary
+	if err := cfg.get(ctx, path, &uploads); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tOFFSET\tSIZE\tAGE\tFILENAME")
+	for _, u := range uploads {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n", u.ID, u.State, u.Offset, u.Size, formatAge(u.Activity), u.Metadata["filename"])
+	}
+	return w.Flush()
+}
+
+// runInspect parses the arguments of the inspect subcommand and prints all
+// about an upload of the server
+func runInspect(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	cfg := adminFlags{}
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	cfg.register(flags)
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: inspect <id> [--server URL] [--token TOKEN]")
+	}
+
+	var u uploadSummary
+	if err := cfg.get(ctx, "/admin/uploads/"+url.PathEscape(positional[0]), &u); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "id:\t%s\n", u.ID)
+	fmt.Fprintf(w, "state:\t%s\n", u.State)
+	fmt.Fprintf(w, "offset:\t%d of %d\n", u.Offset, u.Size)
+	fmt.Fprintf(w, "path:\t%s\n", u.Path)
+	if !u.Created.IsZero() {
+		fmt.Fprintf(w, "created:\t%s\n", u.Created.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "age:\t%s\n", formatAge(u.Activity))
+	for _, k := range slices.Sorted(maps.Keys(u.Metadata)) {
+		fmt.Fprintf(w, "metadata %s:\t%s\n", k, u.Metadata[k])
+	}
+	return w.Flush()
+}
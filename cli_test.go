@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"resumable-upload/tusclient"
+)
+
+func TestRunUpload(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, RelativeLocation: true}))
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(path, []byte(content[:10]), 0644); err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+
+	tests := []struct {
+		testName string
+		args     []string
+		stdin    string
+		expected string
+	}{
+		{"file", []string{path, "--endpoint", server.URL + "/files", "--metadata", "owner=me", "--store="}, "", content[:10]},
+		{"stdin", []string{"--endpoint", server.URL + "/files", "--store=", "-"}, content[:20], content[:20]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			if err := runUpload(context.Background(), test.args, strings.NewReader(test.stdin), stdout, stderr); err != nil {
+				t.Fatalf("Fail to run upload. error=%v stderr=%s", err, stderr)
+			}
+			url := strings.TrimSpace(stdout.String())
+			if got := downloadUpload(t, url); got != test.expected {
+				t.Errorf("the upload does not hold the data. got=%s", got)
+			}
+			if !strings.Contains(stderr.String(), "100.0%") {
+				t.Errorf("upload does not show the progress. got=%q", stderr)
+			}
+		})
+	}
+
+	if err := runUpload(context.Background(), []string{"a", "b"}, nil, &bytes.Buffer{}, &bytes.Buffer{}); err == nil {
+		t.Errorf("upload of two files does not fail")
+	}
+}
+
+func TestRunResume(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, RelativeLocation: true}))
+	defer server.Close()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(path, []byte(content[:10]), 0644); err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+	storePath := filepath.Join(dir, "uploads.json")
+
+	tests := []struct {
+		testName    string
+		fingerprint bool
+	}{
+		{"by url", false},
+		{"by fingerprint", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			client := tusclient.New(server.URL + "/files")
+			upload, err := client.Create(context.Background(), 10, nil)
+			if err != nil {
+				t.Fatalf("Fail to create upload. error=%v", err)
+			}
+			// the first 4 bytes made it before the interruption
+			i := strings.LastIndex(upload.URL, "/")
+			patchUpload(t, upload.URL[:i], upload.URL[i+1:], 0, content[:4])
+			target := upload.URL
+			if test.fingerprint {
+				target = "fingerprint"
+				tusclient.NewFileStore(storePath).Set(target, upload.URL)
+			}
+
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			if err := runResume(context.Background(), []string{target, path, "--store", storePath}, nil, stdout, stderr); err != nil {
+				t.Fatalf("Fail to run resume. error=%v stderr=%s", err, stderr)
+			}
+			if !strings.Contains(stderr.String(), "at 4 of 10") {
+				t.Errorf("resume does not continue from the offset. got=%q", stderr)
+			}
+			if got := downloadUpload(t, strings.TrimSpace(stdout.String())); got != content[:10] {
+				t.Errorf("the upload does not hold the data. got=%s", got)
+			}
+			if url, _ := tusclient.NewFileStore(storePath).Get("fingerprint"); len(url) > 0 {
+				t.Errorf("a resumed fingerprint is not dropped from the store. got=%s", url)
+			}
+		})
+	}
+
+	if err := runResume(context.Background(), []string{"unknown", path, "--store", storePath}, nil, &bytes.Buffer{}, &bytes.Buffer{}); err == nil {
+		t.Errorf("resume of an unknown fingerprint does not fail")
+	}
+}
+
+func TestRunListInspect(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: t.TempDir(), RelativeLocation: true, AdminToken: "secret"}))
+	defer server.Close()
+	client := tusclient.New(server.URL + "/files")
+	upload, err := client.Create(context.Background(), 10, map[string]string{"filename": "a.txt"})
+	if err != nil {
+		t.Fatalf("Fail to create upload. error=%v", err)
+	}
+	id := upload.URL[strings.LastIndex(upload.URL, "/")+1:]
+	patchUpload(t, server.URL+"/files", id, 0, content[:4])
+
+	stdout := &bytes.Buffer{}
+	if err := runList(context.Background(), []string{"--server", server.URL, "--token", "secret"}, nil, stdout, &bytes.Buffer{}); err != nil {
+		t.Fatalf("Fail to run list. error=%v", err)
+	}
+	if !strings.Contains(stdout.String(), id) || !strings.Contains(stdout.String(), "a.txt") {
+		t.Errorf("list does not show the upload. got=%s", stdout)
+	}
+	stdout.Reset()
+	if err := runList(context.Background(), []string{"--server", server.URL, "--token", "secret", "--metadata", "filename=b.txt"}, nil, stdout, &bytes.Buffer{}); err != nil {
+		t.Fatalf("Fail to run list. error=%v", err)
+	}
+	if strings.Contains(stdout.String(), id) {
+		t.Errorf("list does not filter the uploads by metadata. got=%s", stdout)
+	}
+	stdout.Reset()
+	if err := runList(context.Background(), []string{"--server", server.URL, "--token", "secret", "--contains", "filename=A.T", "--state", "uploading"}, nil, stdout, &bytes.Buffer{}); err != nil {
+		t.Fatalf("Fail to run list. error=%v", err)
+	}
+	if !strings.Contains(stdout.String(), id) {
+		t.Errorf("list does not find the upload by its filename. got=%s", stdout)
+	}
+
+	stdout.Reset()
+	if err := runInspect(context.Background(), []string{id, "--server", server.URL, "--token", "secret"}, nil, stdout, &bytes.Buffer{}); err != nil {
+		t.Fatalf("Fail to run inspect. error=%v", err)
+	}
+	if !strings.Contains(stdout.String(), "4 of 10") || !strings.Contains(stdout.String(), "metadata filename:  a.txt") {
+		t.Errorf("inspect does not show the upload. got=%s", stdout)
+	}
+
+	if err := runInspect(context.Background(), []string{"unknown", "--server", server.URL, "--token", "secret"}, nil, &bytes.Buffer{}, &bytes.Buffer{}); err == nil {
+		t.Errorf("inspect of an unknown upload does not fail")
+	}
+	if err := runList(context.Background(), []string{"--server", server.URL, "--token", "wrong"}, nil, &bytes.Buffer{}, &bytes.Buffer{}); err == nil {
+		t.Errorf("list with a wrong token does not fail")
+	}
+}
+
+func TestRateFlag(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int64
+	}{
+		{"5MB/s", 5000000},
+		{"512KiB/s", 512 * 1024},
+		{"1.5 MB", 1500000},
+		{"1000", 1000},
+	}
+
+	for _, test := range tests {
+		var r rateFlag
+		if err := r.Set(test.value); err != nil || int64(r) != test.expected {
+			t.Errorf("rateFlag.Set(%s) does not return %d. got=%d error=%v", test.value, test.expected, r, err)
+		}
+	}
+	var r rateFlag
+	if err := r.Set("fast"); err == nil {
+		t.Errorf("an invalid rate does not fail")
+	}
+}
+
+func TestRunUploadCredentials(t *testing.T) {
+	mux := buildServeMux(&ServerConfig{UploadDir: tempUploadDir, RelativeLocation: true})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("X-Team") != "storage" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	tokenFile := filepath.Join(dir, "token")
+	os.WriteFile(path, []byte(content[:10]), 0644)
+	os.WriteFile(tokenFile, []byte("secret\n"), 0600)
+
+	tests := []struct {
+		testName    string
+		args        []string
+		expectError bool
+	}{
+		{"token", []string{"--token", "secret", "--header", "X-Team: storage"}, false},
+		{"token file", []string{"--token-file", tokenFile, "--header", "X-Team: storage"}, false},
+		{"no header", []string{"--token", "secret"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			args := append([]string{path, "--endpoint", server.URL + "/files", "--store=", "--quiet"}, test.args...)
+			err := runUpload(context.Background(), args, nil, &bytes.Buffer{}, &bytes.Buffer{})
+			if test.expectError != (err != nil) {
+				t.Errorf("upload does not return an error: %v. got=%v", test.expectError, err)
+			}
+		})
+	}
+}
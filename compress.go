@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// STEP_COMPRESS compresses the data file of the complete upload at rest with
+// zstd, the downloads decompress it. It must be the last step, the other
+// steps read the data file uncompressed. The uploads finalized into FinalDir
+// are left uncompressed for the consumers of the final directory.
+const STEP_COMPRESS = "compress"
+
+const (
+	// the extension of a compressed data file, next to where it was
+	COMPRESSED_EXTENSION = ".zst"
+	// the decompressed size of the frames of a compressed data file, a read
+	// decompresses the frames it covers only
+	COMPRESSED_FRAME_SIZE = 1024 * 1024
+
+	// the seek table of the zstd seekable format, see
+	// https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md
+	seekTableSkippableMagic = 0x184D2A5E
+	seekTableFooterMagic    = 0x8F92EAB1
+	seekTableFooterSize     = 9
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+
+	errNotSeekable = errors.New("not a seekable zstd file")
+)
+
+// compressStep replaces the data file by a seekable zstd file of independent
+// frames of COMPRESSED_FRAME_SIZE bytes, followed by their seek table, so a
+// range of a download decompresses the frames it covers only
+type compressStep struct{}
+
+func (compressStep) Name() string { return STEP_COMPRESS }
+
+func (compressStep) Process(ctx context.Context, f *File) error {
+	// the final file and its sidecar are handed to the consumers as they are
+	if f.isCompressed() || f.finalized() {
+		return nil
+	}
+	src := f.path()
+	dst := src + COMPRESSED_EXTENSION
+	if err := compressFile(ctx, src, dst, f.fsync.syncs()); err != nil {
+		return err
+	}
+
+	// the downloads switch to the compressed file before the data file goes
+	f.mu.Lock()
+	f.compressed = true
+	f.mu.Unlock()
+	if f.persist {
+		if err := f.saveInfo(); err != nil {
+			return err
+		}
+	}
+	if f.handles != nil {
+		f.handles.close(src)
+	}
+	if err := os.Remove(src); err != nil {
+		return err
+	}
+	// the sidecar names the data file gone, the digest stays in the state
+	if err := os.Remove(src + DIGEST_EXTENSION); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if f.fsync.syncs() {
+		return syncDir(filepath.Dir(src))
+	}
+	return nil
+}
+
+// compressFile writes the seekable zstd file of src at dst, through a
+// temporary file renamed once complete
+func compressFile(ctx context.Context, src, dst string, sync bool) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	var table []byte
+	frames := uint32(0)
+	buf := make([]byte, COMPRESSED_FRAME_SIZE)
+	var frame []byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			frame = zstdEncoder.EncodeAll(buf[:n], frame[:0])
+			if _, err := out.Write(frame); err != nil {
+				return err
+			}
+			table = binary.LittleEndian.AppendUint32(table, uint32(len(frame)))
+			table = binary.LittleEndian.AppendUint32(table, uint32(n))
+			frames++
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// the seek table is a skippable frame, plain zstd tools ignore it
+	seekTable := binary.LittleEndian.AppendUint32(nil, seekTableSkippableMagic)
+	seekTable = binary.LittleEndian.AppendUint32(seekTable, uint32(len(table)+seekTableFooterSize))
+	seekTable = append(seekTable, table...)
+	seekTable = binary.LittleEndian.AppendUint32(seekTable, frames)
+	seekTable = append(seekTable, 0) // no checksums
+	seekTable = binary.LittleEndian.AppendUint32(seekTable, seekTableFooterMagic)
+	if _, err := out.Write(seekTable); err != nil {
+		return err
+	}
+	if sync {
+		if err := out.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// seekableFile reads a seekable zstd file as its decompressed data
+type seekableFile struct {
+	file   *os.File
+	starts []int64 // the compressed offset of every frame, and the end of the last one
+	ends   []int64 // the decompressed end of every frame
+	size   int64
+
+	mu     sync.Mutex
+	cached int // the frame decoded in data, -1 for none
+	data   []byte
+}
+
+// readSeekTable returns the reader of the seekable zstd file, from its seek
+// table
+func readSeekTable(file *os.File) (*seekableFile, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	footer := make([]byte, seekTableFooterSize)
+	if stat.Size() < seekTableFooterSize+8 {
+		return nil, errNotSeekable
+	}
+	if _, err := file.ReadAt(footer, stat.Size()-seekTableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != seekTableFooterMagic {
+		return nil, errNotSeekable
+	}
+	frames := int64(binary.LittleEndian.Uint32(footer))
+	entrySize := int64(8)
+	if footer[4]&0x80 != 0 {
+		entrySize = 12
+	}
+	tableStart := stat.Size() - seekTableFooterSize - frames*entrySize
+	if tableStart < 8 {
+		return nil, errNotSeekable
+	}
+	table := make([]byte, frames*entrySize)
+	if _, err := file.ReadAt(table, tableStart); err != nil {
+		return nil, err
+	}
+
+	s := &seekableFile{file: file, cached: -1, starts: []int64{0}}
+	for i := range frames {
+		entry := table[i*entrySize:]
+		s.starts = append(s.starts, s.starts[i]+int64(binary.LittleEndian.Uint32(entry)))
+		s.size += int64(binary.LittleEndian.Uint32(entry[4:]))
+		s.ends = append(s.ends, s.size)
+	}
+	if s.starts[frames] != tableStart-8 {
+		return nil, errNotSeekable
+	}
+	return s, nil
+}
+
+// ReadAt reads the decompressed data at off, decompressing the frames it
+// covers
+func (s *seekableFile) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		if off >= s.size {
+			return n, io.EOF
+		}
+		i := sort.Search(len(s.ends), func(i int) bool { return s.ends[i] > off })
+		if err := s.decode(i); err != nil {
+			return n, err
+		}
+		start := s.ends[i] - int64(len(s.data))
+		copied := copy(p[n:], s.data[off-start:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// decode decompresses frame i into data, under mu
+func (s *seekableFile) decode(i int) error {
+	if s.cached == i {
+		return nil
+	}
+	compressed := make([]byte, s.starts[i+1]-s.starts[i])
+	if _, err := s.file.ReadAt(compressed, s.starts[i]); err != nil {
+		return err
+	}
+	data, err := zstdDecoder.DecodeAll(compressed, s.data[:0])
+	if err != nil {
+		s.cached = -1
+		return err
+	}
+	s.data, s.cached = data, i
+	return nil
+}
+
+func (s *seekableFile) Size() int64 {
+	return s.size
+}
+
+func (s *seekableFile) Close() error {
+	return s.file.Close()
+}
+
+// isCompressed reports whether the data file was compressed by the compress
+// step
+func (f *File) isCompressed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.compressed
+}
+
+// storedPath returns the path of the data file as stored, compressed or not
+func (f *File) storedPath() string {
+	if f.isCompressed() {
+		return f.path() + COMPRESSED_EXTENSION
+	}
+	return f.path()
+}
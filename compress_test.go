@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressibleData returns n bytes of log lines
+func compressibleData(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < n; i++ {
+		fmt.Fprintf(&buf, "2024-01-01T00:00:00Z INFO request %d served in %dms\n", i, i%97)
+	}
+	return buf.Bytes()[:n]
+}
+
+func TestCompressFile(t *testing.T) {
+	dir := t.TempDir()
+	data := compressibleData(2*COMPRESSED_FRAME_SIZE + 12345)
+	src := filepath.Join(dir, "data")
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+	dst := src + COMPRESSED_EXTENSION
+	if err := compressFile(context.Background(), src, dst, false); err != nil {
+		t.Fatalf("Fail to compress file. error=%v", err)
+	}
+	stat, _ := os.Stat(dst)
+	if stat.Size()*5 > int64(len(data)) {
+		t.Errorf("the file is not compressed. got=%d of %d bytes", stat.Size(), len(data))
+	}
+
+	file, err := os.Open(dst)
+	if err != nil {
+		t.Fatalf("Fail to open compressed file. error=%v", err)
+	}
+	defer file.Close()
+	seekable, err := readSeekTable(file)
+	if err != nil {
+		t.Fatalf("Fail to read seek table. error=%v", err)
+	}
+	if seekable.Size() != int64(len(data)) {
+		t.Errorf("the seek table does not hold the size. got=%d", seekable.Size())
+	}
+	tests := []struct {
+		testName string
+		offset   int
+		length   int
+	}{
+		{"start", 0, 100},
+		{"across frames", COMPRESSED_FRAME_SIZE - 50, 100},
+		{"end", len(data) - 10, 10},
+		{"all", 0, len(data)},
+	}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			p := make([]byte, test.length)
+			if _, err := seekable.ReadAt(p, int64(test.offset)); err != nil && err != io.EOF {
+				t.Fatalf("Fail to read. error=%v", err)
+			}
+			if !bytes.Equal(p, data[test.offset:test.offset+test.length]) {
+				t.Errorf("ReadAt does not return the data at %d", test.offset)
+			}
+		})
+	}
+
+	// the seek table is skipped by plain zstd readers
+	decoder, _ := zstd.NewReader(nil)
+	defer decoder.Close()
+	compressed, _ := os.ReadFile(dst)
+	if plain, err := decoder.DecodeAll(compressed, nil); err != nil || !bytes.Equal(plain, data) {
+		t.Errorf("a plain zstd reader does not decompress the file. error=%v", err)
+	}
+}
+
+func TestCompressStep(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	dir := t.TempDir()
+	config := &ServerConfig{UploadDir: dir, RelativeLocation: true, PersistState: true, ProcessingSteps: []string{STEP_CHECKSUM, STEP_COMPRESS}, Checksum: true}
+	server := httptest.NewServer(buildServeMux(config))
+	defer server.Close()
+	host := server.URL + "/files"
+	data := string(compressibleData(4096))
+
+	fileId := createUpload(t, host, len(data))
+	patchUpload(t, host, fileId, 0, data)
+	path := filepath.Join(dir, fileId)
+	if !waitFor(t, func() bool { _, err := os.Stat(path); return os.IsNotExist(err) }) {
+		t.Fatalf("the data file is not compressed")
+	}
+	if _, err := os.Stat(path + COMPRESSED_EXTENSION); err != nil {
+		t.Fatalf("the compressed file is missing. error=%v", err)
+	}
+	if got := downloadUpload(t, host+"/"+fileId); got != data {
+		t.Errorf("GET does not return the decompressed data. got=%d bytes", len(got))
+	}
+	req, _ := http.NewRequest(http.MethodGet, host+"/"+fileId, nil)
+	req.Header.Set("Range", "bytes=100-199")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute GET request. error=%v", err)
+	}
+	part, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent || string(part) != data[100:200] {
+		t.Errorf("GET of a range does not return the decompressed range. got=%d %s", res.StatusCode, part)
+	}
+
+	// the compressed upload is loaded back as is
+	storage := newStorage()
+	newFile := func(id uuid.UUID, size int, metadata string) *File {
+		return &File{ID: id, Size: size, Metadata: metadata, persist: true, dir: dir}
+	}
+	if _, err := loadUploads(dir, storage, newFile); err != nil {
+		t.Fatalf("Fail to load uploads. error=%v", err)
+	}
+	if f := storage.Get(fileId); f == nil || !f.isCompressed() || f.offset() != len(data) {
+		t.Errorf("the compressed upload is not loaded. got=%v", f)
+	}
+
+	if _, err := newPipeline(&ServerConfig{ProcessingSteps: []string{STEP_COMPRESS, STEP_CHECKSUM}}, newMemoryLocker()); err == nil {
+		t.Errorf("a step after compress does not fail")
+	}
+}
+
+func TestCompressStepDigest(t *testing.T) {
+	tests := []struct {
+		testName   string
+		finalized  bool
+		compressed bool
+	}{
+		{"Should compress the upload and remove its sidecar", false, true},
+		{"Should leave the finalized upload and its sidecar", true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			dir := t.TempDir()
+			data := compressibleData(4096)
+			f := &File{ID: uuid.New(), Size: len(data), dir: dir, digests: true}
+			if test.finalized {
+				f.final = filepath.Join(t.TempDir(), "final.log")
+			}
+			if err := os.WriteFile(f.path(), data, 0644); err != nil {
+				t.Fatalf("Fail to create test data. error=%v", err)
+			}
+			sum := sha256.Sum256(data)
+			f.digest = sum[:]
+			if err := f.writeDigest(); err != nil {
+				t.Fatalf("Fail to create test data. error=%v", err)
+			}
+
+			if err := (compressStep{}).Process(context.Background(), f); err != nil {
+				t.Fatalf("Fail to compress the upload. error=%v", err)
+			}
+			if f.isCompressed() != test.compressed {
+				t.Errorf("compressStep does not leave the upload compressed=%v. got=%v", test.compressed, f.isCompressed())
+			}
+			sidecar, err := os.ReadFile(f.path() + DIGEST_EXTENSION)
+			if test.compressed {
+				if !os.IsNotExist(err) {
+					t.Errorf("the sidecar of the removed data file is left. got=%q", sidecar)
+				}
+				return
+			}
+			stored, err := os.ReadFile(f.path())
+			if err != nil {
+				t.Fatalf("Fail to read the final file. error=%v", err)
+			}
+			if stored := sha256.Sum256(stored); string(sidecar) != hex.EncodeToString(stored[:])+"  final.log\n" {
+				t.Errorf("the sidecar does not describe the final file. got=%q", sidecar)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HEADER_ORIGIN                         = "Origin"
+	HEADER_VARY                           = "Vary"
+	HEADER_ACCESS_CONTROL_ALLOW_ORIGIN    = "Access-Control-Allow-Origin"
+	HEADER_ACCESS_CONTROL_ALLOW_METHODS   = "Access-Control-Allow-Methods"
+	HEADER_ACCESS_CONTROL_ALLOW_HEADERS   = "Access-Control-Allow-Headers"
+	HEADER_ACCESS_CONTROL_ALLOW_CREDS     = "Access-Control-Allow-Credentials"
+	HEADER_ACCESS_CONTROL_EXPOSE_HEADERS  = "Access-Control-Expose-Headers"
+	HEADER_ACCESS_CONTROL_MAX_AGE         = "Access-Control-Max-Age"
+	HEADER_ACCESS_CONTROL_REQUEST_METHOD  = "Access-Control-Request-Method"
+	HEADER_ACCESS_CONTROL_REQUEST_HEADERS = "Access-Control-Request-Headers"
+)
+
+// the methods and headers browsers need to speak tus, on top of the ones
+// configured in CORSConfig
+var (
+	corsAllowedMethods = []string{
+		http.MethodOptions,
+		http.MethodGet,
+		http.MethodPost,
+		http.MethodHead,
+		http.MethodPatch,
+	}
+	corsAllowedHeaders = []string{
+		"Authorization",
+		"Origin",
+		"X-Requested-With",
+		HEADER_CONTENT_TYPE,
+		HEADER_TUS_RESUMABLE,
+		HEADER_UPLOAD_LENGTH,
+		HEADER_UPLOAD_OFFSET,
+		HEADER_UPLOAD_METADATA,
+		HEADER_IDEMPOTENCY_KEY,
+		HEADER_UPLOAD_ALIAS,
+		HEADER_UPLOAD_POLICY,
+		HEADER_UPLOAD_EXPIRES,
+		HEADER_REPR_DIGEST,
+		HEADER_CONTENT_ENCODING,
+	}
+	corsExposedHeaders = []string{
+		HEADER_LOCATION,
+		HEADER_TUS_RESUMABLE,
+		HEADER_TUS_VERSION,
+		HEADER_TUS_EXTENSION,
+		HEADER_TUS_MAX_SIZE,
+		HEADER_UPLOAD_LENGTH,
+		HEADER_UPLOAD_OFFSET,
+		HEADER_UPLOAD_METADATA,
+		HEADER_RETRY_AFTER,
+		HEADER_RATELIMIT_LIMIT,
+		HEADER_RATELIMIT_REMAINING,
+		HEADER_RATELIMIT_RESET,
+		HEADER_CONTENT_DISPOSITION,
+		HEADER_UPLOAD_CHECKSUM,
+		HEADER_REPR_DIGEST,
+		HEADER_ETAG,
+		HEADER_UPLOAD_STATE,
+		HEADER_UPLOAD_CREATED,
+		HEADER_UPLOAD_ACTIVITY,
+		HEADER_UPLOAD_PAUSED,
+		HEADER_UPLOAD_EXPIRES,
+		HEADER_TRANSCODE_JOB,
+		HEADER_UPLOAD_ALIAS,
+	}
+)
+
+type CORSConfig struct {
+	AllowedOrigins   []string      // the origins allowed to call the tus endpoints, "*" allows any origin, empty disables CORS
+	AllowedHeaders   []string      // extra request headers allowed on top of the tus ones
+	ExposedHeaders   []string      // extra response headers exposed on top of the tus ones
+	AllowCredentials bool          // whether cookies and authorization headers may be sent cross origin
+	MaxAge           time.Duration // how long browsers may cache the preflight response
+}
+
+// corsHandler adds the CORS headers to every response of next and answers
+// the preflight requests itself
+type corsHandler struct {
+	next           http.Handler
+	config         *CORSConfig
+	allowedMethods string
+	allowedHeaders string
+	exposedHeaders string
+}
+
+func newCORSHandler(next http.Handler, config *CORSConfig) *corsHandler {
+	return &corsHandler{
+		next:           next,
+		config:         config,
+		allowedMethods: strings.Join(corsAllowedMethods, ", "),
+		allowedHeaders: strings.Join(append(slices.Clone(corsAllowedHeaders), config.AllowedHeaders...), ", "),
+		exposedHeaders: strings.Join(append(slices.Clone(corsExposedHeaders), config.ExposedHeaders...), ", "),
+	}
+}
+
+func (h *corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get(HEADER_ORIGIN)
+	if len(origin) <= 0 {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Add(HEADER_VARY, HEADER_ORIGIN)
+	allowedOrigin, allowed := h.allowOrigin(origin)
+	if !allowed {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set(HEADER_ACCESS_CONTROL_ALLOW_ORIGIN, allowedOrigin)
+	if h.config.AllowCredentials {
+		w.Header().Set(HEADER_ACCESS_CONTROL_ALLOW_CREDS, "true")
+	}
+
+	// preflight
+	if r.Method == http.MethodOptions && len(r.Header.Get(HEADER_ACCESS_CONTROL_REQUEST_METHOD)) > 0 {
+		w.Header().Add(HEADER_VARY, HEADER_ACCESS_CONTROL_REQUEST_METHOD)
+		w.Header().Add(HEADER_VARY, HEADER_ACCESS_CONTROL_REQUEST_HEADERS)
+		w.Header().Set(HEADER_ACCESS_CONTROL_ALLOW_METHODS, h.allowedMethods)
+		w.Header().Set(HEADER_ACCESS_CONTROL_ALLOW_HEADERS, h.allowedHeaders)
+		if h.config.MaxAge > 0 {
+			w.Header().Set(HEADER_ACCESS_CONTROL_MAX_AGE, strconv.Itoa(int(h.config.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set(HEADER_ACCESS_CONTROL_EXPOSE_HEADERS, h.exposedHeaders)
+	h.next.ServeHTTP(w, r)
+}
+
+// allowOrigin returns the value of Access-Control-Allow-Origin for origin.
+// A wildcard is echoed back as the origin when credentials are allowed since
+// browsers reject "*" for credentialed requests.
+func (h *corsHandler) allowOrigin(origin string) (string, bool) {
+	for _, allowed := range h.config.AllowedOrigins {
+		if allowed == "*" {
+			if h.config.AllowCredentials {
+				return origin, true
+			}
+			return "*", true
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{
+		UploadDir: tempUploadDir,
+		CORS: &CORSConfig{
+			AllowedOrigins: []string{"https://app.example.com"},
+			ExposedHeaders: []string{"X-Custom"},
+			MaxAge:         10 * time.Minute,
+		},
+	}))
+	defer server.Close()
+	host := fmt.Sprintf("%s/files", server.URL)
+
+	tests := []struct {
+		testName               string
+		method                 string
+		url                    string
+		headers                map[string]string
+		expectedResponseStatus int
+		expectedResponseHeader map[string]string
+		expectedMissingHeaders []string
+	}{
+		{
+			testName: "Should answer preflight for creation",
+			method:   http.MethodOptions,
+			url:      host,
+			headers: map[string]string{
+				HEADER_ORIGIN:                         "https://app.example.com",
+				HEADER_ACCESS_CONTROL_REQUEST_METHOD:  http.MethodPost,
+				HEADER_ACCESS_CONTROL_REQUEST_HEADERS: "upload-length, tus-resumable",
+			},
+			expectedResponseStatus: http.StatusNoContent,
+			expectedResponseHeader: map[string]string{
+				HEADER_ACCESS_CONTROL_ALLOW_ORIGIN: "https://app.example.com",
+				HEADER_ACCESS_CONTROL_MAX_AGE:      "600",
+			},
+		},
+		{
+			testName: "Should answer preflight for an upload",
+			method:   http.MethodOptions,
+			url:      host + "/some-id",
+			headers: map[string]string{
+				HEADER_ORIGIN:                        "https://app.example.com",
+				HEADER_ACCESS_CONTROL_REQUEST_METHOD: http.MethodPatch,
+			},
+			expectedResponseStatus: http.StatusNoContent,
+			expectedResponseHeader: map[string]string{
+				HEADER_ACCESS_CONTROL_ALLOW_ORIGIN: "https://app.example.com",
+			},
+		},
+		{
+			testName: "Should expose tus headers on actual requests",
+			method:   http.MethodOptions,
+			url:      host,
+			headers: map[string]string{
+				HEADER_ORIGIN: "https://app.example.com",
+			},
+			expectedResponseStatus: http.StatusNoContent,
+			expectedResponseHeader: map[string]string{
+				HEADER_ACCESS_CONTROL_ALLOW_ORIGIN: "https://app.example.com",
+				HEADER_TUS_VERSION:                 TUS_PROTOCOL_VERSION,
+			},
+		},
+		{
+			testName: "Should not allow unknown origins",
+			method:   http.MethodOptions,
+			url:      host,
+			headers: map[string]string{
+				HEADER_ORIGIN: "https://evil.example.com",
+			},
+			expectedResponseStatus: http.StatusNoContent,
+			expectedMissingHeaders: []string{
+				HEADER_ACCESS_CONTROL_ALLOW_ORIGIN,
+				HEADER_ACCESS_CONTROL_EXPOSE_HEADERS,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, nil)
+			if err != nil {
+				t.Fatalf("Fail to create request. error=%v", err)
+			}
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute request. error=%v", err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tt.expectedResponseStatus {
+				t.Errorf("%s %s does not return %v. got=%v", tt.method, tt.url, tt.expectedResponseStatus, res.StatusCode)
+			}
+			for k, v := range tt.expectedResponseHeader {
+				if res.Header.Get(k) != v {
+					t.Errorf("%s %s does not return correct value for header %v, expected=%v. got=%v", tt.method, tt.url, k, v, res.Header.Get(k))
+				}
+			}
+			for _, k := range tt.expectedMissingHeaders {
+				if len(res.Header.Get(k)) > 0 {
+					t.Errorf("%s %s should not return header %v. got=%v", tt.method, tt.url, k, res.Header.Get(k))
+				}
+			}
+		})
+	}
+
+	// the exposed headers include the tus ones and the configured ones
+	req, _ := http.NewRequest(http.MethodOptions, host, nil)
+	req.Header.Set(HEADER_ORIGIN, "https://app.example.com")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute request. error=%v", err)
+	}
+	res.Body.Close()
+	exposed := res.Header.Get(HEADER_ACCESS_CONTROL_EXPOSE_HEADERS)
+	for _, h := range []string{HEADER_UPLOAD_OFFSET, HEADER_LOCATION, "X-Custom"} {
+		if !strings.Contains(exposed, h) {
+			t.Errorf("%s does not contain %s. got=%s", HEADER_ACCESS_CONTROL_EXPOSE_HEADERS, h, exposed)
+		}
+	}
+}
+
+func TestCORSRoutes(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	server := httptest.NewServer(buildServeMux(&ServerConfig{
+		UploadDir:  t.TempDir(),
+		AdminToken: "secret",
+		Demo:       true,
+		Tenants:    map[string]TenantConfig{"acme": {}},
+		CORS:       &CORSConfig{AllowedOrigins: []string{"https://app.example.com"}},
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		testName               string
+		method                 string
+		path                   string
+		expectedResponseStatus int
+	}{
+		{"demo", http.MethodGet, "/demo", http.StatusOK},
+		{"openapi", http.MethodGet, "/openapi.json", http.StatusOK},
+		{"tenant", http.MethodPost, "/tenants/acme/files", http.StatusCreated},
+		{"admin", http.MethodGet, "/admin/uploads", http.StatusOK},
+		{"dashboard", http.MethodGet, "/admin/", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, server.URL+test.path, nil)
+			if err != nil {
+				t.Fatalf("Fail to create request. error=%v", err)
+			}
+			req.Header.Set(HEADER_ORIGIN, "https://app.example.com")
+			req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+			req.Header.Set("Authorization", "Bearer secret")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute request. error=%v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != test.expectedResponseStatus {
+				t.Errorf("%s %s does not return %v. got=%v", test.method, test.path, test.expectedResponseStatus, res.StatusCode)
+			}
+			if res.Header.Get(HEADER_ACCESS_CONTROL_ALLOW_ORIGIN) != "https://app.example.com" {
+				t.Errorf("%s %s does not allow the origin. got=%q", test.method, test.path, res.Header.Get(HEADER_ACCESS_CONTROL_ALLOW_ORIGIN))
+			}
+		})
+	}
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/admin/stats", nil)
+	if err != nil {
+		t.Fatalf("Fail to create request. error=%v", err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute request. error=%v", err)
+	}
+	defer res.Body.Close()
+	var stats struct {
+		Traffic []trafficBucket `json:"traffic"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		t.Fatalf("Fail to decode the stats. error=%v", err)
+	}
+	requests := 0
+	for _, bucket := range stats.Traffic {
+		requests += bucket.Requests
+	}
+	if requests < len(tests) {
+		t.Errorf("the traffic stats do not count the requests. got=%d", requests)
+	}
+}
+
+func TestCORSAllowedHeaders(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, CORS: &CORSConfig{AllowedOrigins: []string{"*"}}}))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodOptions, server.URL+"/files", nil)
+	if err != nil {
+		t.Fatalf("Fail to create OPTIONS request. error=%v", err)
+	}
+	req.Header.Set(HEADER_ORIGIN, "https://app.example.com")
+	req.Header.Set(HEADER_ACCESS_CONTROL_REQUEST_METHOD, http.MethodPost)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute OPTIONS request. error=%v", err)
+	}
+	res.Body.Close()
+	allowed := res.Header.Get(HEADER_ACCESS_CONTROL_ALLOW_HEADERS)
+	for _, header := range []string{HEADER_UPLOAD_POLICY, HEADER_UPLOAD_EXPIRES, HEADER_REPR_DIGEST, HEADER_CONTENT_ENCODING} {
+		if !strings.Contains(allowed, header) {
+			t.Errorf("the preflight does not allow %s. got=%s", header, allowed)
+		}
+	}
+}
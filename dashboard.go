@@ -0,0 +1,141 @@
+package main
+
+import (
+	_ "embed"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//go:embed dashboard/index.html
+var dashboardPage []byte
+
+const (
+	// the span of a bucket of the traffic stats
+	TRAFFIC_BUCKET = 10 * time.Second
+	// the number of buckets kept, 10 minutes of traffic
+	TRAFFIC_BUCKETS = 60
+)
+
+// trafficBucket is the traffic of the server during TRAFFIC_BUCKET
+type trafficBucket struct {
+	Time         time.Time `json:"time"`
+	Requests     int       `json:"requests"`
+	Bytes        int64     `json:"bytes"`         // the bytes of the request bodies read
+	ClientErrors int       `json:"client_errors"` // the 4xx answers
+	ServerErrors int       `json:"server_errors"` // the 5xx answers
+}
+
+// trafficStats keeps the traffic of the last TRAFFIC_BUCKETS buckets for the
+// throughput and error rate graphs of the admin dashboard
+type trafficStats struct {
+	mu      sync.Mutex
+	buckets [TRAFFIC_BUCKETS]trafficBucket
+}
+
+func newTrafficStats() *trafficStats {
+	return &trafficStats{}
+}
+
+// bucket returns the bucket of now, reset when it held an older span, under mu
+func (s *trafficStats) bucket(now time.Time) *trafficBucket {
+	start := now.Truncate(TRAFFIC_BUCKET)
+	b := &s.buckets[(start.UnixNano()/int64(TRAFFIC_BUCKET))%TRAFFIC_BUCKETS]
+	if !b.Time.Equal(start) {
+		*b = trafficBucket{Time: start}
+	}
+	return b
+}
+
+func (s *trafficStats) add(bytes int64, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.bucket(time.Now())
+	b.Bytes += bytes
+	if status > 0 {
+		b.Requests++
+	}
+	switch {
+	case status >= 500:
+		b.ServerErrors++
+	case status >= 400:
+		b.ClientErrors++
+	}
+}
+
+// snapshot returns the buckets of the last TRAFFIC_BUCKETS spans up to now,
+// oldest first, the ones without traffic included
+func (s *trafficStats) snapshot(now time.Time) []trafficBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	end := now.Truncate(TRAFFIC_BUCKET)
+	buckets := make([]trafficBucket, 0, TRAFFIC_BUCKETS)
+	for i := TRAFFIC_BUCKETS - 1; i >= 0; i-- {
+		start := end.Add(-time.Duration(i) * TRAFFIC_BUCKET)
+		b := s.buckets[(start.UnixNano()/int64(TRAFFIC_BUCKET))%TRAFFIC_BUCKETS]
+		if !b.Time.Equal(start) {
+			b = trafficBucket{Time: start}
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// record counts the requests handled by next, their status and the bytes of
+// their bodies. The bytes are counted as they are read so a long PATCH shows
+// in the throughput while it streams.
+func (s *trafficStats) record(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &countingBody{ReadCloser: r.Body, stats: s}
+		}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		s.add(0, recorder.status)
+	})
+}
+
+// statusRecorder remembers the status written to a ResponseWriter
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the deadlines of the connection
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// countingBody adds the bytes read from a request body to the stats
+type countingBody struct {
+	io.ReadCloser
+	stats *trafficStats
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.stats.add(int64(n), 0)
+	}
+	return n, err
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"log/slog"
+	"net/http"
+)
+
+//go:embed demo/index.html
+var demoFS embed.FS
+
+var demoPage = template.Must(template.ParseFS(demoFS, "demo/index.html"))
+
+// registerDemo serves at /demo a page uploading to the tus endpoint at
+// basePath from the browser, with pause and resume, so the server can be
+// tried without writing a client
+func registerDemo(mux *http.ServeMux, basePath string) {
+	mux.HandleFunc("GET /demo", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HEADER_CONTENT_TYPE, "text/html; charset=utf-8")
+		if err := demoPage.Execute(w, struct{ Endpoint string }{basePath}); err != nil {
+			slog.Error("Fail to render demo page", slog.Any("Error", err))
+		}
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDemo(t *testing.T) {
+	tests := []struct {
+		testName       string
+		demo           bool
+		expectedStatus int
+	}{
+		{"enabled", true, http.StatusOK},
+		{"disabled", false, http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, BasePath: "/uploads/", Demo: test.demo}))
+			defer server.Close()
+			res, err := http.Get(server.URL + "/demo")
+			if err != nil {
+				t.Fatalf("Fail to execute GET request. error=%v", err)
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			if res.StatusCode != test.expectedStatus {
+				t.Fatalf("GET /demo does not return %v. got=%v", test.expectedStatus, res.StatusCode)
+			}
+			if test.demo && !strings.Contains(string(body), `const endpoint = "/uploads";`) {
+				t.Errorf("the demo page does not upload to the base path. got=%s", body)
+			}
+		})
+	}
+}
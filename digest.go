@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// HEADER_REPR_DIGEST carries the SHA-256 of a complete upload, as in RFC 9530
+const HEADER_REPR_DIGEST = "Repr-Digest"
+
+// the extension of the sha256sum file written next to the data of a complete
+// upload
+const DIGEST_EXTENSION = ".sha256"
+
+// errInvalidDigest is returned for a Repr-Digest whose sha-256 is malformed
+var errInvalidDigest = errors.New("invalid sha-256 digest")
+
+// recordDigest records the SHA-256 of a complete upload, from the running
+// checksum when it has seen all of it or else from the data on disk, and
+// writes it to a sidecar file next to the data in the format of sha256sum so
+// the consumers of the final directory can check it with sha256sum -c. The
+// digest is persisted with the state of the upload by the caller.
+func (f *File) recordDigest() error {
+	if !f.digests || f.state() != UPLOAD_STATE_COMPLETED || f.isCompressed() || len(f.sha256()) > 0 {
+		return nil
+	}
+	var sum []byte
+	if f.checksum.valid() && f.checksum.hashed == int64(f.Size) {
+		sum = f.checksum.hash.Sum(nil)
+	} else {
+		c := newChecksum()
+		if err := c.hashRange(f.path(), 0, int64(f.Size)); err != nil {
+			return err
+		}
+		sum = c.hash.Sum(nil)
+	}
+	f.mu.Lock()
+	f.digest = sum
+	f.mu.Unlock()
+	f.dedup.add(f)
+	return f.writeDigest()
+}
+
+// writeDigest writes the sidecar file of the digest next to the data file,
+// replacing it atomically
+func (f *File) writeDigest() error {
+	path := f.path()
+	line := hex.EncodeToString(f.sha256()) + "  " + filepath.Base(path) + "\n"
+	tmp := path + DIGEST_EXTENSION + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(line)
+	if err == nil && f.fsync.syncs() {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = replaceFile(tmp, path+DIGEST_EXTENSION)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// moveDigest rewrites the sidecar file next to the data file moved from src,
+// since it names the data file, and removes the one left next to src
+func (f *File) moveDigest(src string) error {
+	if len(f.sha256()) <= 0 {
+		return nil
+	}
+	if err := f.writeDigest(); err != nil {
+		return err
+	}
+	if err := os.Remove(src + DIGEST_EXTENSION); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// sha256 returns the recorded digest of the upload, nil until it is complete
+func (f *File) sha256() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.digest
+}
+
+// setDigestHeader sets Repr-Digest once the digest of the upload is
+// recorded. Unlike Upload-Checksum it is persisted, so every instance sharing
+// the upload sends it.
+func setDigestHeader(w http.ResponseWriter, f *File) {
+	if sum := f.sha256(); len(sum) > 0 {
+		w.Header().Set(HEADER_REPR_DIGEST, "sha-256=:"+base64.StdEncoding.EncodeToString(sum)+":")
+	}
+}
+
+// parseReprDigest returns the SHA-256 of a Repr-Digest header, nil when it
+// carries none. The other algorithms are ignored.
+func parseReprDigest(header string) ([]byte, error) {
+	for _, member := range strings.Split(header, ",") {
+		alg, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(alg), "sha-256") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			return nil, errInvalidDigest
+		}
+		sum, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err != nil || len(sum) != sha256.Size {
+			return nil, errInvalidDigest
+		}
+		return sum, nil
+	}
+	return nil, nil
+}
+
+// digestIndex indexes the complete uploads by owner, digest and size. A
+// creation declaring the digest of its data gets the upload of its owner
+// holding the same data instead of uploading it again. The anonymous uploads
+// are not indexed, they are not downloaded.
+type digestIndex struct {
+	mu      sync.Mutex
+	uploads map[digestKey]*File
+}
+
+type digestKey struct {
+	owner string // the subject of the policy of the creation, see checkOwner
+	sum   [sha256.Size]byte
+	size  int
+}
+
+func newDigestIndex() *digestIndex {
+	return &digestIndex{uploads: make(map[digestKey]*File)}
+}
+
+// key returns the key of f, false when it is not indexed
+func (d *digestIndex) key(f *File) (digestKey, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if d == nil || f.anonymous || len(f.digest) != sha256.Size {
+		return digestKey{}, false
+	}
+	return digestKey{owner: f.owner, sum: [sha256.Size]byte(f.digest), size: f.Size}, true
+}
+
+// add indexes f once its digest is recorded, an upload of the same data
+// indexed already is kept
+func (d *digestIndex) add(f *File) {
+	key, ok := d.key(f)
+	if !ok || f.state() != UPLOAD_STATE_COMPLETED || f.finished() {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if existing := d.uploads[key]; existing == nil || existing.finished() {
+		d.uploads[key] = f
+	}
+}
+
+// remove drops f from the index once its data is removed
+func (d *digestIndex) remove(f *File) {
+	key, ok := d.key(f)
+	if !ok {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.uploads[key] == f {
+		delete(d.uploads, key)
+	}
+}
+
+// find returns the complete upload of owner of size bytes whose digest is
+// sum, nil when there is none
+func (d *digestIndex) find(owner string, sum []byte, size int) *File {
+	if d == nil || len(sum) != sha256.Size {
+		return nil
+	}
+	key := digestKey{owner: owner, sum: [sha256.Size]byte(sum), size: size}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f := d.uploads[key]
+	if f != nil && f.finished() {
+		delete(d.uploads, key)
+		return nil
+	}
+	return f
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDigest(t *testing.T) {
+	tests := []struct {
+		testName string
+		checksum bool
+		finalDir bool
+	}{
+		{"Should record the running checksum", true, false},
+		{"Should hash the data on disk without a running checksum", false, false},
+		{"Should write the sidecar next to the finalized data", true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			defer func() { uploadDir = tempUploadDir }()
+			config := &ServerConfig{UploadDir: t.TempDir(), PersistState: true, Checksum: test.checksum, Digest: true}
+			if test.finalDir {
+				config.FinalDir = t.TempDir()
+			}
+			server := httptest.NewServer(buildServeMux(config))
+			defer server.Close()
+			host := server.URL + "/files"
+
+			data := content[:10]
+			sum := sha256.Sum256([]byte(data))
+			expected := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+
+			fileId := createUpload(t, host, len(data))
+			patchUpload(t, host, fileId, 0, data[:4])
+			head := func() string {
+				t.Helper()
+				res, err := http.Head(fmt.Sprintf("%s/%s", host, fileId))
+				if err != nil {
+					t.Fatalf("Fail to execute HEAD request. error=%v", err)
+				}
+				res.Body.Close()
+				return res.Header.Get(HEADER_REPR_DIGEST)
+			}
+			if got := head(); len(got) > 0 {
+				t.Errorf("HEAD returns a digest before the upload is complete. got=%s", got)
+			}
+			patchUpload(t, host, fileId, 4, data[4:])
+
+			if got := head(); got != expected {
+				t.Errorf("HEAD does not return %s. got=%s", expected, got)
+			}
+			res, err := http.Get(fmt.Sprintf("%s/%s", host, fileId))
+			if err != nil {
+				t.Fatalf("Fail to execute GET request. error=%v", err)
+			}
+			res.Body.Close()
+			if got := res.Header.Get(HEADER_REPR_DIGEST); got != expected {
+				t.Errorf("GET does not return %s. got=%s", expected, got)
+			}
+
+			dir := config.UploadDir
+			if test.finalDir {
+				dir = config.FinalDir
+			}
+			sidecar, err := os.ReadFile(filepath.Join(dir, fileId+DIGEST_EXTENSION))
+			if err != nil {
+				t.Fatalf("Fail to read the digest file. error=%v", err)
+			}
+			if line := hex.EncodeToString(sum[:]) + "  " + fileId + "\n"; string(sidecar) != line {
+				t.Errorf("the digest file is not in the sha256sum format, expected=%q. got=%q", line, sidecar)
+			}
+			info, err := readInfo(filepath.Join(config.UploadDir, fileId+INFO_EXTENSION))
+			if err != nil {
+				t.Fatalf("Fail to read the info file. error=%v", err)
+			}
+			if info.SHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("the info file does not record the digest. got=%s", info.SHA256)
+			}
+		})
+	}
+}
+
+func TestDigestDeduplication(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, Digest: true}))
+	defer server.Close()
+	host := server.URL + "/files"
+
+	data := content[:10]
+	sum := sha256.Sum256([]byte(data))
+	digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+	fileId := createUpload(t, host, len(data))
+	patchUpload(t, host, fileId, 0, data)
+
+	other := sha256.Sum256([]byte("other"))
+	tests := []struct {
+		testName         string
+		length           int
+		digest           string
+		expectedStatus   int
+		expectedExisting bool
+	}{
+		{"Should return the complete upload of the same digest", len(data), digest, http.StatusCreated, true},
+		{"Should accept the other algorithms along sha-256", len(data), "md5=:AAAA:, " + digest, http.StatusCreated, true},
+		{"Should create an upload of another digest", len(data), "sha-256=:" + base64.StdEncoding.EncodeToString(other[:]) + ":", http.StatusCreated, false},
+		{"Should create an upload of another length", len(data) + 1, digest, http.StatusCreated, false},
+		{"Should reject a malformed digest", len(data), "sha-256=:AAAA:", http.StatusBadRequest, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, host, nil)
+			if err != nil {
+				t.Fatalf("Fail to create test data. Error=%v", err)
+			}
+			req.Header.Set(HEADER_UPLOAD_LENGTH, strconv.Itoa(test.length))
+			req.Header.Set(HEADER_REPR_DIGEST, test.digest)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute POST request. error=%v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != test.expectedStatus {
+				t.Fatalf("POST does not return %d. got=%d", test.expectedStatus, res.StatusCode)
+			}
+			existing := strings.HasSuffix(res.Header.Get(HEADER_LOCATION), "/"+fileId)
+			if existing != test.expectedExisting {
+				t.Errorf("POST does not return the existing upload %v. got=%s", test.expectedExisting, res.Header.Get(HEADER_LOCATION))
+			}
+			if offset := res.Header.Get(HEADER_UPLOAD_OFFSET); test.expectedExisting && offset != strconv.Itoa(len(data)) {
+				t.Errorf("POST does not return the offset of the complete upload. got=%s", offset)
+			}
+		})
+	}
+}
+
+func TestDigestDeduplicationOwner(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, Digest: true, PolicySecret: "secret", AnonymousUploads: true, RelativeLocation: true}))
+	defer server.Close()
+	host := server.URL + "/files"
+	alice, _ := signPolicy("secret", uploadPolicy{Subject: "alice"})
+	bob, _ := signPolicy("secret", uploadPolicy{Subject: "bob"})
+
+	data := content[20:30]
+	sum := sha256.Sum256([]byte(data))
+	digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+	request := func(method, url, policy string, header map[string]string, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Fail to create test data. Error=%v", err)
+		}
+		if len(policy) > 0 {
+			req.Header.Set(HEADER_UPLOAD_POLICY, policy)
+		}
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to execute %s request. error=%v", method, err)
+		}
+		res.Body.Close()
+		return res
+	}
+	// the complete uploads of alice and of an anonymous client
+	for _, policy := range []string{alice, ""} {
+		res := request(http.MethodPost, host, policy, map[string]string{HEADER_UPLOAD_LENGTH: "10"}, "")
+		res = request(http.MethodPatch, server.URL+res.Header.Get(HEADER_LOCATION), policy, map[string]string{HEADER_CONTENT_TYPE: CONTENT_TYPE_OFFSET_OCTET_STREAM, HEADER_UPLOAD_OFFSET: "0"}, data)
+		if res.StatusCode != http.StatusNoContent {
+			t.Fatalf("Fail to complete upload. status=%d", res.StatusCode)
+		}
+	}
+
+	tests := []struct {
+		testName         string
+		policy           string
+		expectedExisting bool
+	}{
+		{"Should return the upload of the same owner", alice, true},
+		{"Should not return the upload of another owner", bob, false},
+		{"Should not return an upload to an anonymous creation", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			res := request(http.MethodPost, host, test.policy, map[string]string{HEADER_UPLOAD_LENGTH: "10", HEADER_REPR_DIGEST: digest}, "")
+			if res.StatusCode != http.StatusCreated {
+				t.Fatalf("POST does not return 201. got=%d", res.StatusCode)
+			}
+			if existing := len(res.Header.Get(HEADER_UPLOAD_OFFSET)) > 0; existing != test.expectedExisting {
+				t.Errorf("POST does not return the existing upload %v. got=%s", test.expectedExisting, res.Header.Get(HEADER_LOCATION))
+			}
+		})
+	}
+}
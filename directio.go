@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// the alignment O_DIRECT requires for the buffer address, the write size and
+// the file offset. 4096 satisfies every common logical block size.
+const directIOAlignment = 4096
+
+var errDirectIOUnsupported = errors.New("direct IO is not supported")
+
+// directChunkPool holds CHUNK_SIZE buffers aligned to directIOAlignment
+var directChunkPool = sync.Pool{
+	New: func() any {
+		buff := alignedBuffer(CHUNK_SIZE, directIOAlignment)
+		return &buff
+	},
+}
+
+// alignedBuffer returns a buffer of size bytes starting at an address
+// aligned to align
+func alignedBuffer(size, align int) []byte {
+	buff := make([]byte, size+align)
+	shift := int(uintptr(unsafe.Pointer(&buff[0])) & uintptr(align-1))
+	if shift != 0 {
+		shift = align - shift
+	}
+	return buff[shift : shift+size]
+}
+
+// writeDirect writes body to the file at path starting at offset, bypassing
+// the page cache. Only whole aligned blocks can be written with O_DIRECT so
+// the unaligned head up to the next block boundary and the unaligned tail of
+// the body go through a regular handle. It returns the number of bytes
+// written, or errDirectIOUnsupported when the platform or the filesystem
+// doesn't support direct IO, in which case nothing has been written.
+func writeDirect(path string, offset int64, body io.Reader) (int64, error) {
+	direct, err := openDirect(path)
+	if err != nil {
+		return 0, err
+	}
+	defer direct.Close()
+	buffered, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer buffered.Close()
+
+	buffp := directChunkPool.Get().(*[]byte)
+	defer directChunkPool.Put(buffp)
+	buff := *buffp
+
+	var written int64
+	if head := (directIOAlignment - offset%directIOAlignment) % directIOAlignment; head > 0 {
+		n, err := io.ReadFull(body, buff[:head])
+		if _, werr := buffered.WriteAt(buff[:n], offset); werr != nil {
+			return written, werr
+		}
+		written += int64(n)
+		if err != nil {
+			return written, ignoreEOF(err)
+		}
+	}
+
+	for {
+		n, err := io.ReadFull(body, buff)
+		aligned := n - n%directIOAlignment
+		if aligned > 0 {
+			if _, werr := direct.WriteAt(buff[:aligned], offset+written); werr != nil {
+				return written, werr
+			}
+			written += int64(aligned)
+		}
+		if aligned < n {
+			if _, werr := buffered.WriteAt(buff[aligned:n], offset+written); werr != nil {
+				return written, werr
+			}
+			written += int64(n - aligned)
+		}
+		if err != nil {
+			return written, ignoreEOF(err)
+		}
+	}
+}
+
+// ignoreEOF turns the end of the body, including a short last read, into a
+// nil error
+func ignoreEOF(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	return err
+}
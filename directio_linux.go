@@ -0,0 +1,17 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// openDirect opens path for writing with O_DIRECT. Filesystems without direct
+// IO support, i.e., tmpfs, reject the flag with EINVAL.
+func openDirect(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|syscall.O_DIRECT, 0644)
+	if errors.Is(err, syscall.EINVAL) {
+		return nil, errDirectIOUnsupported
+	}
+	return file, err
+}
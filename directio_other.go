@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// openDirect always reports direct IO as unsupported outside of linux
+func openDirect(path string) (*os.File, error) {
+	return nil, errDirectIOUnsupported
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/google/uuid"
+)
+
+func TestDirectIOWrite(t *testing.T) {
+	// chunks crossing block boundaries in every possible way
+	chunks := []int{
+		100,
+		5000,
+		directIOAlignment,
+		3*directIOAlignment + 7,
+		CHUNK_SIZE + 123,
+		directIOAlignment - 1,
+		0,
+		2 * CHUNK_SIZE,
+	}
+	total := 0
+	for _, c := range chunks {
+		total += c
+	}
+	data := make([]byte, total)
+	rand.Read(data)
+
+	f := &File{ID: uuid.New(), Size: total, directIO: true}
+	if err := f.create(); err != nil {
+		t.Fatalf("Fail to create file. error=%v", err)
+	}
+
+	offset := 0
+	for _, c := range chunks {
+		if err := f.write(context.Background(), bytes.NewReader(data[offset:offset+c])); err != nil {
+			t.Fatalf("Fail to write chunk of %d bytes at %d. error=%v", c, offset, err)
+		}
+		offset += c
+		if f.Offset != offset {
+			t.Fatalf("write does not set the correct offset, expected=%d. got=%d", offset, f.Offset)
+		}
+	}
+
+	written, err := os.ReadFile(f.path())
+	if err != nil {
+		t.Fatalf("Fail to read file. error=%v", err)
+	}
+	if !bytes.Equal(written, data) {
+		t.Errorf("direct IO write does not write the same bytes, expected %d bytes. got=%d", len(data), len(written))
+	}
+}
+
+func TestAlignedBuffer(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		buff := alignedBuffer(CHUNK_SIZE, directIOAlignment)
+		if len(buff) != CHUNK_SIZE {
+			t.Errorf("alignedBuffer does not return the requested size, expected=%d. got=%d", CHUNK_SIZE, len(buff))
+		}
+		if addr := uintptr(unsafe.Pointer(&buff[0])); addr%directIOAlignment != 0 {
+			t.Errorf("alignedBuffer is not aligned. address=%x", addr)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// errReplayMismatch is returned when a retried PATCH carries bytes that
+// differ from the ones committed at the same offset
+var errReplayMismatch = errors.New("retried data does not match the committed data")
+
+// committedRange is the range of the data file committed by a write
+type committedRange struct {
+	offset int
+	length int
+}
+
+// skipCommitted returns the reader of the bytes of a PATCH at offset that are
+// not committed yet. A client retrying a PATCH whose response it never got,
+// but which committed part or all of its body, sends it again at the offset
+// of the first attempt. The bytes overlapping the last write are compared
+// with the data on disk and dropped, the reader fails with errReplayMismatch
+// when they differ. It returns false for an offset that is neither the
+// current one nor within the last write. The caller must hold the write lock.
+func (f *File) skipCommitted(offset int, body io.Reader) (io.Reader, bool) {
+	current := f.offset()
+	if offset == current {
+		return body, true
+	}
+	if offset > current || offset < f.lastWrite.offset || f.lastWrite.offset+f.lastWrite.length != current {
+		return nil, false
+	}
+	return &replayReader{path: f.path(), offset: int64(offset), skip: int64(current - offset), r: body}, true
+}
+
+// replayReader checks the first skip bytes of r against the data file at
+// offset before passing the rest of r through
+type replayReader struct {
+	path   string
+	offset int64
+	skip   int64
+	r      io.Reader
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	if r.skip > 0 {
+		if err := r.compare(); err != nil {
+			return 0, err
+		}
+	}
+	return r.r.Read(p)
+}
+
+// compare reads and checks the bytes to skip, a body ending before them is
+// a retry of a prefix of the last write and is returned as io.EOF
+func (r *replayReader) compare() error {
+	file, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buff := chunkPool.Get().(*[]byte)
+	defer chunkPool.Put(buff)
+	half := len(*buff) / 2
+	sent, committed := (*buff)[:half], (*buff)[half:]
+	for r.skip > 0 {
+		n, err := r.r.Read(sent[:min(int64(half), r.skip)])
+		if n > 0 {
+			if _, rerr := file.ReadAt(committed[:n], r.offset); rerr != nil {
+				return rerr
+			}
+			if !bytes.Equal(sent[:n], committed[:n]) {
+				return errReplayMismatch
+			}
+			r.offset += int64(n)
+			r.skip -= int64(n)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOffsetConflict answers 409 to a PATCH at requested that the upload
+// can't take at its offset, with the offset in Upload-Offset and in the
+// problem details so the client resumes from it without a HEAD
+func writeOffsetConflict(w http.ResponseWriter, offset, requested int, detail string) {
+	w.Header().Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(offset))
+	writeProblem(w, http.StatusConflict, "Upload-Offset mismatch", fmt.Sprintf("%s, resume at %d", detail, offset), map[string]any{"offset": offset, "requested_offset": requested})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRetriedPatch(t *testing.T) {
+	tests := []struct {
+		testName               string
+		offset                 int
+		data                   string
+		expectedResponseStatus int
+		expectedOffset         int
+	}{
+		{"Should accept the same PATCH again", 4, content[4:8], http.StatusNoContent, 8},
+		{"Should accept a prefix of the last PATCH", 4, content[4:6], http.StatusNoContent, 8},
+		{"Should append the bytes past the committed ones", 6, content[6:10], http.StatusNoContent, 10},
+		{"Should reject different data at a committed offset", 4, "xxxx", http.StatusConflict, 8},
+		{"Should reject an offset before the last PATCH", 2, content[2:8], http.StatusConflict, 8},
+		{"Should reject an offset past the current one", 9, content[9:10], http.StatusConflict, 8},
+	}
+
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir}))
+	defer server.Close()
+	host := server.URL + "/files"
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			fileId := createUpload(t, host, 10)
+			patchUpload(t, host, fileId, 0, content[:4])
+			patchUpload(t, host, fileId, 4, content[4:8])
+
+			req, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("%s/%s", host, fileId), strings.NewReader(test.data))
+			if err != nil {
+				t.Fatalf("Fail to create PATCH request. error=%v", err)
+			}
+			req.Header.Set(HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM)
+			req.Header.Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(test.offset))
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute PATCH request. error=%v", err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != test.expectedResponseStatus {
+				t.Errorf("PATCH /files/%s does not return %v. got=%v", fileId, test.expectedResponseStatus, res.StatusCode)
+			}
+			if res.StatusCode == http.StatusConflict {
+				var problem struct {
+					Offset int `json:"offset"`
+				}
+				if err := json.NewDecoder(res.Body).Decode(&problem); err != nil || problem.Offset != test.expectedOffset {
+					t.Errorf("the conflict does not tell the offset %d. got=%d error=%v", test.expectedOffset, problem.Offset, err)
+				}
+				if offset := res.Header.Get(HEADER_UPLOAD_OFFSET); offset != strconv.Itoa(test.expectedOffset) {
+					t.Errorf("the conflict does not return Upload-Offset %d. got=%s", test.expectedOffset, offset)
+				}
+			}
+
+			data, err := os.ReadFile(fmt.Sprintf("%s/%s", tempUploadDir, fileId))
+			if err != nil {
+				t.Fatalf("Fail to read upload. error=%v", err)
+			}
+			if string(data) != content[:test.expectedOffset] {
+				t.Errorf("PATCH /files/%s does not leave the expected data. got=%q", fileId, data)
+			}
+		})
+	}
+}
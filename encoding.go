@@ -0,0 +1,211 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	HEADER_CONTENT_ENCODING = "Content-Encoding"
+	// HEADER_ACCEPT_ENCODING answers OPTIONS with the Content-Encodings of
+	// the PATCH bodies the server decodes, see RFC 7694
+	HEADER_ACCEPT_ENCODING = "Accept-Encoding"
+	HEADER_ETAG            = "ETag"
+	HEADER_IF_NONE_MATCH   = "If-None-Match"
+	HEADER_IF_MODIFIED     = "If-Modified-Since"
+
+	CONTENT_ENCODING_GZIP = "gzip"
+	CONTENT_ENCODING_ZSTD = "zstd"
+)
+
+var (
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+	// errCorruptEncoding is returned by a read of a body that can't be decoded
+	errCorruptEncoding = errors.New("corrupt encoded body")
+)
+
+// decodeBody returns the reader of the decoded body of a PATCH sent with
+// Content-Encoding encoding. The upload holds the decoded bytes, the offsets
+// count them.
+func decodeBody(encoding string, body io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case CONTENT_ENCODING_GZIP, "x-gzip":
+		return &gzipBody{body: body}, nil
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, encoding)
+	}
+}
+
+// maxEncodedSize returns the most bytes a body sent with Content-Encoding
+// encoding takes to carry n decoded bytes. A gzip body adds its header,
+// trailer and the empty blocks some encoders flush on close, and 5 bytes per
+// block stored as is when the data does not compress.
+func maxEncodedSize(encoding string, n int64) int64 {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case CONTENT_ENCODING_GZIP, "x-gzip":
+		return n + 5*(n/16384+1) + 64
+	default:
+		return n
+	}
+}
+
+// gzipBody decompresses body, it reads the gzip header on its first read so
+// the body is not read before the upload is locked
+type gzipBody struct {
+	body io.Reader
+	r    *gzip.Reader
+}
+
+func (g *gzipBody) Read(p []byte) (int, error) {
+	if g.r == nil {
+		r, err := gzip.NewReader(g.body)
+		if err != nil {
+			return 0, corruptEncoding(err)
+		}
+		g.r = r
+	}
+	n, err := g.r.Read(p)
+	return n, corruptEncoding(err)
+}
+
+// corruptEncoding wraps the decoding errors of err in errCorruptEncoding, a
+// truncated body is left as io.ErrUnexpectedEOF like a dropped connection
+func corruptEncoding(err error) error {
+	var corrupt flate.CorruptInputError
+	if errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) || errors.As(err, &corrupt) {
+		return fmt.Errorf("%w: %w", errCorruptEncoding, err)
+	}
+	return err
+}
+
+// downloadETag returns the strong ETag of the download of the size bytes of
+// a data file last modified at modtime, suffixed with the Content-Encoding of
+// a compressed download as the compressed bytes are another representation
+func downloadETag(modtime time.Time, size int64, encoding string) string {
+	etag := strconv.FormatInt(modtime.UnixNano(), 16) + "-" + strconv.FormatInt(size, 16)
+	if len(encoding) > 0 {
+		etag += "-" + encoding
+	}
+	return `"` + etag + `"`
+}
+
+// compressible reports whether the downloads of contentType are worth
+// compressing, i.e., text, JSON and XML but not images or archives which are
+// compressed already
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/xml", "application/javascript", "application/yaml", "application/x-yaml", "application/sql":
+		return true
+	default:
+		return false
+	}
+}
+
+// negotiateEncoding returns the Content-Encoding a download is compressed
+// with per the Accept-Encoding header of its request, zstd or gzip, the one
+// with the higher q and zstd on a tie. It returns "" when the client accepts
+// neither.
+func negotiateEncoding(header string) string {
+	q := map[string]float64{}
+	for _, member := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(member, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != CONTENT_ENCODING_ZSTD && name != CONTENT_ENCODING_GZIP {
+			continue
+		}
+		q[name] = 1
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(key) != "q" {
+				continue
+			}
+			if weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				q[name] = weight
+			}
+		}
+	}
+	if q[CONTENT_ENCODING_ZSTD] > 0 && q[CONTENT_ENCODING_ZSTD] >= q[CONTENT_ENCODING_GZIP] {
+		return CONTENT_ENCODING_ZSTD
+	}
+	if q[CONTENT_ENCODING_GZIP] > 0 {
+		return CONTENT_ENCODING_GZIP
+	}
+	return ""
+}
+
+// notModified reports whether the conditional request r already holds the
+// download of etag last modified at modtime, If-None-Match taking precedence
+// over If-Modified-Since
+func notModified(r *http.Request, etag string, modtime time.Time) bool {
+	if match := r.Header.Get(HEADER_IF_NONE_MATCH); len(match) > 0 {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get(HEADER_IF_MODIFIED))
+	return err == nil && !modtime.Truncate(time.Second).After(since)
+}
+
+// serveEncoded serves content compressed with encoding. The compressed length
+// is not known before it is sent so the response has no Content-Length, and
+// Range is ignored since its offsets would count the compressed bytes. The
+// Repr-Digest of the decoded bytes is dropped as it is not the one of this
+// representation.
+func serveEncoded(w http.ResponseWriter, r *http.Request, encoding string, modtime time.Time, size int64, content io.Reader) {
+	etag := downloadETag(modtime, size, encoding)
+	w.Header().Set(HEADER_ETAG, etag)
+	w.Header().Del(HEADER_REPR_DIGEST)
+	if notModified(r, etag, modtime) {
+		w.Header().Del(HEADER_CONTENT_TYPE)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set(HEADER_CONTENT_ENCODING, encoding)
+	w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+
+	var encoder io.WriteCloser
+	switch encoding {
+	case CONTENT_ENCODING_ZSTD:
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			slog.Error("Fail to create zstd encoder", slog.Any("Error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		encoder = zw
+	default:
+		encoder = gzip.NewWriter(w)
+	}
+	// the status is sent before the body, a failed copy can only cut it
+	if _, err := io.Copy(encoder, content); err != nil {
+		slog.Warn("Fail to send compressed download", slog.String("encoding", encoding), slog.Any("Error", err))
+		return
+	}
+	if err := encoder.Close(); err != nil {
+		slog.Warn("Fail to send compressed download", slog.String("encoding", encoding), slog.Any("Error", err))
+	}
+}
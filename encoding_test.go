@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func gzipData(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatalf("Fail to compress test data. error=%v", err)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestGzipPatch(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, RelativeLocation: true}))
+	defer server.Close()
+	host := server.URL + "/files"
+
+	req, _ := http.NewRequest(http.MethodOptions, host, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute OPTIONS request. error=%v", err)
+	}
+	res.Body.Close()
+	if got := res.Header.Get(HEADER_ACCEPT_ENCODING); got != CONTENT_ENCODING_GZIP {
+		t.Errorf("OPTIONS does not advertise gzip. got=%s", got)
+	}
+
+	fileId := createUpload(t, host, 10)
+	tests := []struct {
+		testName       string
+		encoding       string
+		offset         int
+		body           []byte
+		expectedStatus int
+		expectedOffset string
+	}{
+		{"gzip", "gzip", 0, gzipData(t, content[:6]), http.StatusNoContent, "6"},
+		{"corrupt", "gzip", 6, []byte("not gzip"), http.StatusBadRequest, "6"},
+		{"unsupported", "br", 6, []byte(content[6:10]), http.StatusUnsupportedMediaType, ""},
+		{"identity", "identity", 6, []byte(content[6:8]), http.StatusNoContent, "8"},
+		{"gzip at decoded offset", "gzip", 8, gzipData(t, content[8:10]), http.StatusNoContent, "10"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPatch, host+"/"+fileId, bytes.NewReader(test.body))
+			if err != nil {
+				t.Fatalf("Fail to create PATCH request. error=%v", err)
+			}
+			req.Header.Set(HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM)
+			req.Header.Set(HEADER_CONTENT_ENCODING, test.encoding)
+			req.Header.Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(test.offset))
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute PATCH request. error=%v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != test.expectedStatus {
+				t.Errorf("PATCH does not return %d. got=%d", test.expectedStatus, res.StatusCode)
+			}
+			if got := res.Header.Get(HEADER_UPLOAD_OFFSET); got != test.expectedOffset {
+				t.Errorf("PATCH does not return the decoded offset %s. got=%s", test.expectedOffset, got)
+			}
+		})
+	}
+	if got := downloadUpload(t, host+"/"+fileId); got != content[:10] {
+		t.Errorf("the upload does not hold the decoded data. got=%s", got)
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		testName string
+		header   string
+		expected string
+	}{
+		{"none", "", ""},
+		{"gzip", "gzip, deflate", CONTENT_ENCODING_GZIP},
+		{"zstd on a tie", "gzip, zstd", CONTENT_ENCODING_ZSTD},
+		{"higher q", "zstd;q=0.5, gzip", CONTENT_ENCODING_GZIP},
+		{"refused", "gzip;q=0, br", ""},
+		{"case", "GZIP ; q=0.8", CONTENT_ENCODING_GZIP},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			if got := negotiateEncoding(test.header); got != test.expected {
+				t.Errorf("negotiateEncoding does not return %q. got=%q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestCompressedDownload(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, CompressDownloads: true}))
+	defer server.Close()
+	host := server.URL + "/files"
+
+	upload := func(filetype string) string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, host, nil)
+		req.Header.Set(HEADER_UPLOAD_LENGTH, strconv.Itoa(len(content)))
+		req.Header.Set(HEADER_UPLOAD_METADATA, "filetype "+base64.StdEncoding.EncodeToString([]byte(filetype)))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to create test data. error=%v", err)
+		}
+		res.Body.Close()
+		fileId := path.Base(res.Header.Get(HEADER_LOCATION))
+		patchUpload(t, host, fileId, 0, content)
+		return fileId
+	}
+	text := upload("text/plain; charset=utf-8")
+	image := upload("image/png")
+
+	tests := []struct {
+		testName         string
+		fileId           string
+		header           map[string]string
+		expectedStatus   int
+		expectedEncoding string
+	}{
+		{"zstd", text, map[string]string{HEADER_ACCEPT_ENCODING: "gzip, zstd"}, http.StatusOK, CONTENT_ENCODING_ZSTD},
+		{"gzip", text, map[string]string{HEADER_ACCEPT_ENCODING: "gzip"}, http.StatusOK, CONTENT_ENCODING_GZIP},
+		{"refused", text, map[string]string{HEADER_ACCEPT_ENCODING: "gzip;q=0"}, http.StatusOK, ""},
+		{"range ignored", text, map[string]string{HEADER_ACCEPT_ENCODING: "gzip", "Range": "bytes=0-9"}, http.StatusOK, CONTENT_ENCODING_GZIP},
+		{"identity range", text, map[string]string{HEADER_ACCEPT_ENCODING: "identity", "Range": "bytes=0-9"}, http.StatusPartialContent, ""},
+		{"not compressible", image, map[string]string{HEADER_ACCEPT_ENCODING: "gzip"}, http.StatusOK, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, host+"/"+test.fileId, nil)
+			for key, value := range test.header {
+				req.Header.Set(key, value)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute GET request. error=%v", err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != test.expectedStatus {
+				t.Fatalf("GET does not return %d. got=%d", test.expectedStatus, res.StatusCode)
+			}
+			if got := res.Header.Get(HEADER_CONTENT_ENCODING); got != test.expectedEncoding {
+				t.Errorf("GET is not sent with the %q encoding. got=%q", test.expectedEncoding, got)
+			}
+			etag := res.Header.Get(HEADER_ETAG)
+			if len(test.expectedEncoding) <= 0 {
+				if strings.Contains(etag, "-gzip") || strings.Contains(etag, "-zstd") {
+					t.Errorf("GET of the decoded bytes has the ETag of a compressed one. got=%s", etag)
+				}
+				return
+			}
+
+			// net/http sets the length of the compressed bytes when they fit
+			// its buffer
+			if res.ContentLength == int64(len(content)) {
+				t.Errorf("GET sends the Content-Length of the decoded bytes. got=%d", res.ContentLength)
+			}
+			if !strings.HasSuffix(etag, "-"+test.expectedEncoding+`"`) {
+				t.Errorf("GET does not send the ETag of the compressed bytes. got=%s", etag)
+			}
+			if vary := res.Header.Values(HEADER_VARY); !slices.Contains(vary, HEADER_ACCEPT_ENCODING) {
+				t.Errorf("GET does not vary on %s. got=%v", HEADER_ACCEPT_ENCODING, vary)
+			}
+			var decoded io.Reader
+			if test.expectedEncoding == CONTENT_ENCODING_ZSTD {
+				zr, err := zstd.NewReader(res.Body)
+				if err != nil {
+					t.Fatalf("Fail to read zstd body. error=%v", err)
+				}
+				defer zr.Close()
+				decoded = zr
+			} else if decoded, err = gzip.NewReader(res.Body); err != nil {
+				t.Fatalf("Fail to read gzip body. error=%v", err)
+			}
+			if data, err := io.ReadAll(decoded); err != nil {
+				t.Fatalf("Fail to decode GET body. error=%v", err)
+			} else if string(data) != content {
+				t.Errorf("GET does not send the upload compressed. got=%s", data)
+			}
+
+			// the client revalidates its compressed copy
+			req.Header.Set(HEADER_IF_NONE_MATCH, etag)
+			revalidated, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute GET request. error=%v", err)
+			}
+			revalidated.Body.Close()
+			if revalidated.StatusCode != http.StatusNotModified {
+				t.Errorf("GET with the ETag of the compressed bytes does not return %d. got=%d", http.StatusNotModified, revalidated.StatusCode)
+			}
+		})
+	}
+}
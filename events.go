@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const (
+	// EVENT_CREATED is published once an upload is created
+	EVENT_CREATED = "created"
+	// EVENT_COMPLETED is published once an upload is complete and finalized
+	EVENT_COMPLETED = "completed"
+	// EVENT_TERMINATED is published once an upload is terminated
+	EVENT_TERMINATED = "terminated"
+)
+
+// UploadEvent is the payload published on the upload lifecycle
+type UploadEvent struct {
+	Type   string      `json:"type"` // see EVENT_*
+	Time   time.Time   `json:"time"`
+	Upload EventUpload `json:"upload"`
+	Job    string      `json:"job,omitempty"` // the id of the job of a transcode event
+
+	sha256 []byte // the SHA-256 of the complete upload, for the s3 format
+	owner  string // see File.owner, for the s3 format
+}
+
+type EventUpload struct {
+	ID       string            `json:"id"`
+	Size     int               `json:"size"`
+	Offset   int               `json:"offset"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	State    string            `json:"state"`
+	Path     string            `json:"path"`
+	Checksum string            `json:"checksum,omitempty"` // the Upload-Checksum of a complete upload
+}
+
+// EventPublisher publishes the upload events to a message broker
+type EventPublisher interface {
+	Publish(ctx context.Context, event *UploadEvent) error
+}
+
+// events publishes to every configured EventPublisher in the background, a
+// failed publication is logged and dropped
+type events struct {
+	publishers []EventPublisher
+	timeout    time.Duration
+}
+
+// newEvents returns the publishers of the config, nil when there is none
+func newEvents(config *ServerConfig) *events {
+	var publishers []EventPublisher
+	if len(config.NATSAddress) > 0 {
+		publishers = append(publishers, newNATSPublisher(config.NATSAddress, config.NATSSubjectPrefix, newEventFormat(config, config.EventFormat)))
+	}
+	if len(config.KafkaBrokers) > 0 {
+		publishers = append(publishers, newKafkaPublisher(config.KafkaBrokers, config.KafkaTopic, newEventFormat(config, config.KafkaFormat)))
+	}
+	if len(config.AMQPURL) > 0 {
+		publishers = append(publishers, newAMQPPublisher(config.AMQPURL, config.AMQPExchange, config.AMQPRoutingKey, newEventFormat(config, config.EventFormat)))
+	}
+	if len(publishers) <= 0 {
+		return nil
+	}
+	timeout := config.EventTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &events{publishers: publishers, timeout: timeout}
+}
+
+// setHeaders sets the content type of the event on header, and its
+// attributes as ce-* headers in the binary mode of CloudEvents, for the
+// events POSTed
+func (e encodedEvent) setHeaders(header http.Header) {
+	header.Set(HEADER_CONTENT_TYPE, e.contentType)
+	for _, name := range slices.Sorted(maps.Keys(e.attributes)) {
+		if name != "datacontenttype" {
+			header.Set("ce-"+name, e.attributes[name])
+		}
+	}
+}
+
+// publish publishes the event kind of upload f without waiting
+func (e *events) publish(kind string, f *File) {
+	if e == nil {
+		return
+	}
+	event := newUploadEvent(kind, f)
+	for _, publisher := range e.publishers {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+			defer cancel()
+			if err := publisher.Publish(ctx, event); err != nil {
+				slog.Error("Fail to publish upload event", slog.String("type", kind), slog.String("id", event.Upload.ID), slog.Any("Error", err))
+			}
+		}()
+	}
+}
+
+func newUploadEvent(kind string, f *File) *UploadEvent {
+	event := &UploadEvent{
+		Type: kind,
+		Time: time.Now().UTC(),
+		Upload: EventUpload{
+			ID:       f.ID.String(),
+			Size:     f.Size,
+			Offset:   f.offset(),
+			Metadata: parseMetadata(f.metadata()),
+			State:    f.state(),
+			Path:     f.path(),
+		},
+	}
+	if event.Upload.Offset >= f.Size && f.checksum.valid() {
+		event.Upload.Checksum = f.checksum.header()
+	}
+	event.sha256, event.owner = f.sha256(), f.owner
+	return event
+}
+
+// marshal returns the JSON payload of the event
+func (e *UploadEvent) marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// eventFormat encodes the events for the publishers, the notify step and the
+// callbacks, see EVENT_FORMAT_*
+type eventFormat struct {
+	name   string
+	bucket string // the bucket of the s3 events
+	source string // the source of the CloudEvents
+}
+
+// newEventFormat returns the format name of config, json when it is unknown
+func newEventFormat(config *ServerConfig, name string) eventFormat {
+	switch name {
+	case EVENT_FORMAT_AVRO, EVENT_FORMAT_S3, EVENT_FORMAT_CLOUDEVENTS, EVENT_FORMAT_CLOUDEVENTS_BINARY:
+	default:
+		name = EVENT_FORMAT_JSON
+	}
+	bucket := config.EventBucket
+	if len(bucket) <= 0 {
+		bucket = "uploads"
+	}
+	source := config.EventSource
+	if len(source) <= 0 {
+		source = normalizeBasePath(config.BasePath)
+	}
+	return eventFormat{name: name, bucket: bucket, source: source}
+}
+
+// encodedEvent is the payload of an event and its content type, with the
+// CloudEvents attributes the transport carries in its headers in the binary
+// mode
+type encodedEvent struct {
+	payload     []byte // nil for an event the format has no shape for, which is not sent
+	contentType string
+	attributes  map[string]string // see cloudEventAttributes
+}
+
+// encode returns the encoding of event in the format
+func (f eventFormat) encode(event *UploadEvent) (encodedEvent, error) {
+	var err error
+	encoded := encodedEvent{contentType: "application/json"}
+	switch f.name {
+	case EVENT_FORMAT_AVRO:
+		encoded.payload, encoded.contentType = event.marshalAvro(), "avro/binary"
+	case EVENT_FORMAT_S3:
+		encoded.payload, err = event.marshalS3(f.bucket)
+	case EVENT_FORMAT_CLOUDEVENTS:
+		encoded.payload, err = event.marshalCloudEvent(f.source)
+		encoded.contentType = "application/cloudevents+json"
+	case EVENT_FORMAT_CLOUDEVENTS_BINARY:
+		encoded.payload, err = event.marshal()
+		encoded.attributes = cloudEventAttributes(event, f.source)
+	default:
+		encoded.payload, err = event.marshal()
+	}
+	return encoded, err
+}
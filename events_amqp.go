@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// amqpPublisher publishes the events as persistent messages to an
+// exchange and waits for the broker to confirm each of them. The
+// connection is opened on the first event and reopened after a failure.
+type amqpPublisher struct {
+	url        string
+	exchange   string
+	routingKey string // {type} is replaced by the type of the event
+	format     eventFormat
+
+	mu      sync.Mutex // serializes the publications on the channel
+	conn    *amqp.Connection
+	channel *amqp.Channel
+}
+
+func newAMQPPublisher(url, exchange, routingKey string, format eventFormat) *amqpPublisher {
+	if len(exchange) <= 0 {
+		exchange = "uploads"
+	}
+	if len(routingKey) <= 0 {
+		routingKey = "uploads.{type}"
+	}
+	return &amqpPublisher{url: url, exchange: exchange, routingKey: routingKey, format: format}
+}
+
+func (p *amqpPublisher) key(event *UploadEvent) string {
+	return strings.ReplaceAll(p.routingKey, "{type}", event.Type)
+}
+
+func (p *amqpPublisher) Publish(ctx context.Context, event *UploadEvent) error {
+	encoded, err := p.format.encode(event)
+	if encoded.payload == nil || err != nil {
+		return err
+	}
+	// the attributes of the binary mode are application properties
+	var headers amqp.Table
+	if len(encoded.attributes) > 0 {
+		headers = amqp.Table{}
+		for name, value := range encoded.attributes {
+			if name != "datacontenttype" {
+				headers["cloudEvents:"+name] = value
+			}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	channel, err := p.open()
+	if err != nil {
+		return err
+	}
+	confirmation, err := channel.PublishWithDeferredConfirmWithContext(ctx, p.exchange, p.key(event), false, false, amqp.Publishing{
+		ContentType:  encoded.contentType,
+		Headers:      headers,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    event.Upload.ID + "." + event.Type,
+		Timestamp:    event.Time,
+		Type:         event.Type,
+		Body:         encoded.payload,
+	})
+	if err != nil {
+		p.close()
+		return err
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		p.close()
+		return err
+	}
+	if !acked {
+		return errors.New("the broker nacked the event")
+	}
+	return nil
+}
+
+// open returns the channel in confirm mode, connecting when there is none.
+// It must be called with the lock held.
+func (p *amqpPublisher) open() (*amqp.Channel, error) {
+	if p.channel != nil && !p.channel.IsClosed() {
+		return p.channel, nil
+	}
+	p.close()
+	conn, err := amqp.Dial(p.url)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := conn.Channel()
+	if err == nil {
+		err = channel.Confirm(false)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.conn, p.channel = conn, channel
+	return channel, nil
+}
+
+// close drops the connection, it must be called with the lock held
+func (p *amqpPublisher) close() {
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.conn, p.channel = nil, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestAMQPRoutingKey(t *testing.T) {
+	tests := []struct {
+		testName   string
+		routingKey string
+		kind       string
+		expected   string
+	}{
+		{"Should default to uploads.<type>", "", EVENT_COMPLETED, "uploads.completed"},
+		{"Should replace the type", "tus.{type}.v1", EVENT_CREATED, "tus.created.v1"},
+		{"Should keep a fixed key", "uploads", EVENT_COMPLETED, "uploads"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			publisher := newAMQPPublisher("amqp://localhost", "", test.routingKey, eventFormat{})
+			if got := publisher.key(&UploadEvent{Type: test.kind}); got != test.expected {
+				t.Errorf("key does not return %s. got=%s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestAMQPPublisherUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fail to listen. error=%v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	publisher := newAMQPPublisher("amqp://guest:guest@"+address, "", "", eventFormat{})
+	if err := publisher.Publish(context.Background(), &UploadEvent{Type: EVENT_COMPLETED}); err == nil {
+		t.Errorf("Publish does not fail when the broker is unreachable")
+	}
+	if publisher.conn != nil {
+		t.Errorf("Publish keeps a connection to an unreachable broker")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	// EVENT_FORMAT_CLOUDEVENTS encodes the events in the structured mode of
+	// CloudEvents 1.0, the attributes and the JSON event as data in one
+	// application/cloudevents+json payload
+	EVENT_FORMAT_CLOUDEVENTS = "cloudevents"
+	// EVENT_FORMAT_CLOUDEVENTS_BINARY encodes the events in the binary mode
+	// of CloudEvents 1.0, the JSON event is the payload and the attributes
+	// are carried by the headers of the transport: ce-* for HTTP, ce_* for
+	// Kafka and cloudEvents:* for AMQP. NATS falls back to the structured
+	// mode, its PUB carries no headers.
+	EVENT_FORMAT_CLOUDEVENTS_BINARY = "cloudevents-binary"
+
+	// CLOUDEVENTS_TYPE_PREFIX prefixes the type of the events, i.e.,
+	// io.tus.upload.completed
+	CLOUDEVENTS_TYPE_PREFIX = "io.tus.upload."
+)
+
+// cloudEventAttributes returns the context attributes of event from source,
+// its subject is the id of the upload. Each upload has one event of a type
+// so the id, the upload id and the type, is the same on a retry.
+func cloudEventAttributes(event *UploadEvent, source string) map[string]string {
+	return map[string]string{
+		"specversion":     "1.0",
+		"id":              event.Upload.ID + "." + event.Type,
+		"source":          source,
+		"type":            CLOUDEVENTS_TYPE_PREFIX + event.Type,
+		"subject":         event.Upload.ID,
+		"time":            event.Time.UTC().Format(time.RFC3339Nano),
+		"datacontenttype": "application/json",
+	}
+}
+
+// marshalCloudEvent returns the structured CloudEvent of event from source
+func (e *UploadEvent) marshalCloudEvent(source string) ([]byte, error) {
+	envelope := map[string]any{}
+	for name, value := range cloudEventAttributes(e, source) {
+		envelope[name] = value
+	}
+	envelope["data"] = e
+	return json.Marshal(envelope)
+}
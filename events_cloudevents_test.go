@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCloudEvent(t *testing.T) {
+	f := &File{ID: [16]byte{1}, Size: 10, Offset: 10}
+	event := newUploadEvent(EVENT_COMPLETED, f)
+	event.Time = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		testName            string
+		config              *ServerConfig
+		format              string
+		expectedContentType string
+		expectedSource      string
+	}{
+		{"structured", &ServerConfig{BasePath: "/files/"}, EVENT_FORMAT_CLOUDEVENTS, "application/cloudevents+json", "/files"},
+		{"binary", &ServerConfig{EventSource: "https://tus.example.com"}, EVENT_FORMAT_CLOUDEVENTS_BINARY, "application/json", "https://tus.example.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			encoded, err := newEventFormat(test.config, test.format).encode(event)
+			if err != nil {
+				t.Fatalf("Fail to encode the event. error=%v", err)
+			}
+			if encoded.contentType != test.expectedContentType {
+				t.Errorf("encode does not return the content type %s. got=%s", test.expectedContentType, encoded.contentType)
+			}
+
+			attributes := encoded.attributes
+			var data UploadEvent
+			if test.format == EVENT_FORMAT_CLOUDEVENTS {
+				if attributes != nil {
+					t.Errorf("encode returns attributes in the structured mode. got=%v", attributes)
+				}
+				var envelope struct {
+					SpecVersion string      `json:"specversion"`
+					ID          string      `json:"id"`
+					Source      string      `json:"source"`
+					Type        string      `json:"type"`
+					Subject     string      `json:"subject"`
+					Time        string      `json:"time"`
+					Data        UploadEvent `json:"data"`
+				}
+				if err := json.Unmarshal(encoded.payload, &envelope); err != nil {
+					t.Fatalf("Fail to parse the CloudEvent. error=%v payload=%s", err, encoded.payload)
+				}
+				attributes = map[string]string{"specversion": envelope.SpecVersion, "id": envelope.ID, "source": envelope.Source, "type": envelope.Type, "subject": envelope.Subject, "time": envelope.Time}
+				data = envelope.Data
+			} else if err := json.Unmarshal(encoded.payload, &data); err != nil {
+				t.Fatalf("Fail to parse the event. error=%v payload=%s", err, encoded.payload)
+			}
+
+			expected := map[string]string{
+				"specversion": "1.0",
+				"id":          f.ID.String() + ".completed",
+				"source":      test.expectedSource,
+				"type":        "io.tus.upload.completed",
+				"subject":     f.ID.String(),
+				"time":        "2024-05-01T10:00:00Z",
+			}
+			for name, value := range expected {
+				if attributes[name] != value {
+					t.Errorf("the CloudEvent does not have the %s %s. got=%s", name, value, attributes[name])
+				}
+			}
+			if data.Type != EVENT_COMPLETED || data.Upload.ID != f.ID.String() {
+				t.Errorf("the CloudEvent does not carry the event. got=%+v", data)
+			}
+		})
+	}
+}
+
+func TestCloudEventHeaders(t *testing.T) {
+	f := &File{ID: [16]byte{1}, Size: 10, Offset: 10}
+	format := newEventFormat(&ServerConfig{}, EVENT_FORMAT_CLOUDEVENTS_BINARY)
+	encoded, err := format.encode(newUploadEvent(EVENT_TERMINATED, f))
+	if err != nil {
+		t.Fatalf("Fail to encode the event. error=%v", err)
+	}
+
+	header := http.Header{}
+	encoded.setHeaders(header)
+	if header.Get("ce-type") != "io.tus.upload.terminated" || header.Get("ce-subject") != f.ID.String() || header.Get("ce-specversion") != "1.0" {
+		t.Errorf("setHeaders does not set the ce-* headers. got=%v", header)
+	}
+	if header.Get(HEADER_CONTENT_TYPE) != "application/json" || len(header.Values("ce-datacontenttype")) > 0 {
+		t.Errorf("setHeaders does not carry the data content type as Content-Type. got=%v", header)
+	}
+
+	message, produced, err := newKafkaPublisher([]string{"127.0.0.1:9092"}, "", format).message(newUploadEvent(EVENT_COMPLETED, f))
+	if err != nil || !produced {
+		t.Fatalf("Fail to build the message. error=%v", err)
+	}
+	headers := map[string]string{}
+	for _, h := range message.Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	if headers["content-type"] != "application/json" || headers["ce_type"] != "io.tus.upload.completed" || headers["ce_id"] != f.ID.String()+".completed" {
+		t.Errorf("message does not carry the ce_* headers. got=%v", headers)
+	}
+
+	if publisher := newNATSPublisher("127.0.0.1:4222", "", format); publisher.format.name != EVENT_FORMAT_CLOUDEVENTS {
+		t.Errorf("the NATS publisher does not fall back to the structured mode. got=%s", publisher.format.name)
+	}
+}
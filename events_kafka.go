@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// EVENT_FORMAT_JSON encodes the events as JSON
+	EVENT_FORMAT_JSON = "json"
+	// EVENT_FORMAT_AVRO encodes the events in the Avro single object
+	// encoding of uploadEventAvroSchema
+	EVENT_FORMAT_AVRO = "avro"
+)
+
+// kafkaPublisher produces the completed and terminated events to a topic,
+// keyed by the upload id so the events of an upload land on one partition in
+// order. The record carries the format in its content-type header.
+type kafkaPublisher struct {
+	writer *kafka.Writer
+	format eventFormat
+}
+
+func newKafkaPublisher(brokers []string, topic string, format eventFormat) *kafkaPublisher {
+	if len(topic) <= 0 {
+		topic = "uploads"
+	}
+	return &kafkaPublisher{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			// the events are produced one at a time, don't wait for a batch
+			BatchTimeout: 10 * time.Millisecond,
+		},
+		format: format,
+	}
+}
+
+// message returns the record of event, false for the events not produced
+func (p *kafkaPublisher) message(event *UploadEvent) (kafka.Message, bool, error) {
+	if event.Type != EVENT_COMPLETED && event.Type != EVENT_TERMINATED {
+		return kafka.Message{}, false, nil
+	}
+	encoded, err := p.format.encode(event)
+	if encoded.payload == nil || err != nil {
+		return kafka.Message{}, false, err
+	}
+	headers := []kafka.Header{{Key: "content-type", Value: []byte(encoded.contentType)}}
+	// the attributes of the binary mode are ce_* headers
+	for _, name := range slices.Sorted(maps.Keys(encoded.attributes)) {
+		if name != "datacontenttype" {
+			headers = append(headers, kafka.Header{Key: "ce_" + name, Value: []byte(encoded.attributes[name])})
+		}
+	}
+	return kafka.Message{
+		Key:     []byte(event.Upload.ID),
+		Value:   encoded.payload,
+		Time:    event.Time,
+		Headers: headers,
+	}, true, nil
+}
+
+func (p *kafkaPublisher) Publish(ctx context.Context, event *UploadEvent) error {
+	message, ok, err := p.message(event)
+	if !ok || err != nil {
+		return err
+	}
+	return p.writer.WriteMessages(ctx, message)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestKafkaMessage(t *testing.T) {
+	tests := []struct {
+		testName            string
+		format              string
+		kind                string
+		expectedProduced    bool
+		expectedContentType string
+	}{
+		{"Should produce a completed event as JSON", EVENT_FORMAT_JSON, EVENT_COMPLETED, true, "application/json"},
+		{"Should produce a terminated event as Avro", EVENT_FORMAT_AVRO, EVENT_TERMINATED, true, "avro/binary"},
+		{"Should default to JSON", "", EVENT_COMPLETED, true, "application/json"},
+		{"Should not produce a created event", EVENT_FORMAT_JSON, EVENT_CREATED, false, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			publisher := newKafkaPublisher([]string{"127.0.0.1:9092"}, "", newEventFormat(&ServerConfig{}, test.format))
+			f := &File{ID: [16]byte{1}, Size: 10, Offset: 10}
+			event := newUploadEvent(test.kind, f)
+			message, produced, err := publisher.message(event)
+			if err != nil {
+				t.Fatalf("Fail to build the message. error=%v", err)
+			}
+			if produced != test.expectedProduced {
+				t.Fatalf("message does not return produced=%v. got=%v", test.expectedProduced, produced)
+			}
+			if !produced {
+				return
+			}
+			if publisher.writer.Topic != "uploads" {
+				t.Errorf("the publisher does not default to the uploads topic. got=%s", publisher.writer.Topic)
+			}
+			if string(message.Key) != f.ID.String() {
+				t.Errorf("message is not keyed by the upload id. got=%s", message.Key)
+			}
+			if len(message.Headers) != 1 || string(message.Headers[0].Value) != test.expectedContentType {
+				t.Errorf("message does not have the content-type %s. got=%v", test.expectedContentType, message.Headers)
+			}
+			switch test.expectedContentType {
+			case "avro/binary":
+				if !bytes.Equal(message.Value, event.marshalAvro()) {
+					t.Errorf("message does not carry the Avro event")
+				}
+			default:
+				var decoded UploadEvent
+				if err := json.Unmarshal(message.Value, &decoded); err != nil || decoded.Upload.ID != f.ID.String() {
+					t.Errorf("message does not carry the JSON event. got=%s", message.Value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const natsDialTimeout = 2 * time.Second
+
+// natsPublisher publishes the events as JSON on <prefix>.<type>, e.g.,
+// uploads.completed. It speaks the NATS text protocol on a new connection
+// per event, which is rare enough to not be worth keeping one open, and
+// waits for the PONG following the PUB so an event the server refused is
+// reported.
+type natsPublisher struct {
+	address string
+	prefix  string
+	format  eventFormat
+}
+
+func newNATSPublisher(address, prefix string, format eventFormat) *natsPublisher {
+	if len(prefix) <= 0 {
+		prefix = "uploads"
+	}
+	// PUB carries no headers for the attributes of the binary mode
+	if format.name == EVENT_FORMAT_CLOUDEVENTS_BINARY {
+		format.name = EVENT_FORMAT_CLOUDEVENTS
+	}
+	return &natsPublisher{address: strings.TrimPrefix(address, "nats://"), prefix: prefix, format: format}
+}
+
+func (p *natsPublisher) subject(kind string) string {
+	return p.prefix + "." + kind
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, event *UploadEvent) error {
+	encoded, err := p.format.encode(event)
+	if encoded.payload == nil || err != nil {
+		return err
+	}
+	payload := encoded.payload
+	dialer := net.Dialer{Timeout: natsDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", p.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(natsDialTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	r := bufio.NewReader(conn)
+	// the server greets with INFO
+	if line, err := r.ReadString('\n'); err != nil {
+		return err
+	} else if !strings.HasPrefix(line, "INFO") {
+		return fmt.Errorf("Invalid nats greeting %q", line)
+	}
+	command := fmt.Appendf(nil, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"resumable-upload\"}\r\nPUB %s %d\r\n", p.subject(event.Type), len(payload))
+	command = append(command, payload...)
+	command = append(command, "\r\nPING\r\n"...)
+	if _, err := conn.Write(command); err != nil {
+		return err
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("nats error " + strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+		// +OK, PING or an INFO update
+		if line == "PING" {
+			if _, err := conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		}
+	}
+}
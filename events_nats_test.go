@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// natsMessage is a message received by fakeNATS
+type natsMessage struct {
+	subject string
+	payload []byte
+}
+
+// fakeNATS serves the subset of the NATS protocol the publisher uses and
+// refuses the subjects in denied
+type fakeNATS struct {
+	listener net.Listener
+	messages chan natsMessage
+	denied   string
+}
+
+func newFakeNATS(t *testing.T) *fakeNATS {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fail to listen. error=%v", err)
+	}
+	n := &fakeNATS{listener: listener, messages: make(chan natsMessage, 16)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go n.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return n
+}
+
+func (n *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.Write([]byte("INFO {\"server_id\":\"fake\"}\r\n"))
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return
+			}
+			if fields[1] == n.denied {
+				conn.Write([]byte("-ERR 'Permissions Violation for Publish'\r\n"))
+				continue
+			}
+			n.messages <- natsMessage{subject: fields[1], payload: payload[:size]}
+		case "PING":
+			conn.Write([]byte("PONG\r\n"))
+		}
+	}
+}
+
+func (n *fakeNATS) next(t *testing.T) natsMessage {
+	t.Helper()
+	select {
+	case message := <-n.messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event published")
+		return natsMessage{}
+	}
+}
+
+func TestNATSPublisher(t *testing.T) {
+	tests := []struct {
+		testName    string
+		prefix      string
+		denied      string
+		expectError bool
+	}{
+		{"Should publish under the default prefix", "", "", false},
+		{"Should publish under the configured prefix", "tus", "", false},
+		{"Should report a refused publication", "", "uploads.completed", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			nats := newFakeNATS(t)
+			nats.denied = test.denied
+			publisher := newNATSPublisher("nats://"+nats.listener.Addr().String(), test.prefix, eventFormat{})
+
+			f := &File{ID: [16]byte{1}, Size: 10, Offset: 10, State: UPLOAD_STATE_COMPLETED}
+			err := publisher.Publish(context.Background(), newUploadEvent(EVENT_COMPLETED, f))
+			if test.expectError != (err != nil) {
+				t.Fatalf("Publish does not return the expected error. got=%v", err)
+			}
+			if test.expectError {
+				return
+			}
+			message := nats.next(t)
+			expected := publisher.prefix + ".completed"
+			if message.subject != expected {
+				t.Errorf("Publish does not publish to %s. got=%s", expected, message.subject)
+			}
+			var event UploadEvent
+			if err := json.Unmarshal(message.payload, &event); err != nil {
+				t.Fatalf("Publish does not publish JSON. error=%v", err)
+			}
+			if event.Type != EVENT_COMPLETED || event.Upload.ID != f.ID.String() || event.Upload.State != UPLOAD_STATE_COMPLETED {
+				t.Errorf("Publish does not publish the event. got=%+v", event)
+			}
+		})
+	}
+}
+
+func TestUploadEvents(t *testing.T) {
+	nats := newFakeNATS(t)
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, NATSAddress: nats.listener.Addr().String()}))
+	defer server.Close()
+	host := server.URL + "/files"
+
+	fileId := createUpload(t, host, 10)
+	if message := nats.next(t); message.subject != "uploads.created" {
+		t.Errorf("POST /files does not publish uploads.created. got=%s", message.subject)
+	}
+	patchUpload(t, host, fileId, 0, content[:10])
+	if message := nats.next(t); message.subject != "uploads.completed" {
+		t.Errorf("PATCH /files/%s does not publish uploads.completed. got=%s", fileId, message.subject)
+	}
+}
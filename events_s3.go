@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"strconv"
+)
+
+// EVENT_FORMAT_S3 encodes the completed and terminated events as the
+// ObjectCreated and ObjectRemoved notifications of S3, see s3Event
+const EVENT_FORMAT_S3 = "s3"
+
+// s3Event is the shape of the S3 event notifications, see
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/notification-content-structure.html,
+// so the consumers of S3 notifications take the events of the uploads as is.
+// The key of an upload is its id and its eTag the hex SHA-256 of its data
+// when it is recorded, see ServerConfig.Digest.
+type s3Event struct {
+	Records []s3EventRecord `json:"Records"`
+}
+
+type s3EventRecord struct {
+	EventVersion      string            `json:"eventVersion"`
+	EventSource       string            `json:"eventSource"`
+	AWSRegion         string            `json:"awsRegion"`
+	EventTime         string            `json:"eventTime"`
+	EventName         string            `json:"eventName"`
+	UserIdentity      s3Identity        `json:"userIdentity"` // the owner of the upload, see checkOwner
+	RequestParameters map[string]string `json:"requestParameters"`
+	ResponseElements  map[string]string `json:"responseElements"`
+	S3                s3Entity          `json:"s3"`
+}
+
+type s3Identity struct {
+	PrincipalID string `json:"principalId"`
+}
+
+type s3Entity struct {
+	SchemaVersion   string   `json:"s3SchemaVersion"`
+	ConfigurationID string   `json:"configurationId"`
+	Bucket          s3Bucket `json:"bucket"`
+	Object          s3Object `json:"object"`
+}
+
+type s3Bucket struct {
+	Name          string     `json:"name"`
+	OwnerIdentity s3Identity `json:"ownerIdentity"`
+	ARN           string     `json:"arn"`
+}
+
+type s3Object struct {
+	Key       string `json:"key"`
+	Size      int    `json:"size,omitempty"` // left out of the removals like S3 does
+	ETag      string `json:"eTag,omitempty"`
+	Sequencer string `json:"sequencer"`
+}
+
+// marshalS3 returns the S3 notification of the event in bucket, nil for a
+// created event which S3 has no notification for
+func (e *UploadEvent) marshalS3(bucket string) ([]byte, error) {
+	object := s3Object{
+		Key:       url.QueryEscape(e.Upload.ID),
+		Sequencer: strconv.FormatInt(e.Time.UnixNano(), 16),
+	}
+	var name string
+	switch e.Type {
+	case EVENT_COMPLETED:
+		name = "ObjectCreated:Put"
+		object.Size = e.Upload.Size
+		object.ETag = hex.EncodeToString(e.sha256)
+	case EVENT_TERMINATED:
+		name = "ObjectRemoved:Delete"
+	default:
+		return nil, nil
+	}
+	return json.Marshal(s3Event{Records: []s3EventRecord{{
+		EventVersion:      "2.1",
+		EventSource:       "aws:s3",
+		EventTime:         e.Time.UTC().Format("2006-01-02T15:04:05.000Z"),
+		EventName:         name,
+		UserIdentity:      s3Identity{PrincipalID: e.owner},
+		RequestParameters: map[string]string{},
+		ResponseElements:  map[string]string{},
+		S3: s3Entity{
+			SchemaVersion:   "1.0",
+			ConfigurationID: "resumable-upload",
+			Bucket:          s3Bucket{Name: bucket, ARN: "arn:aws:s3:::" + bucket},
+			Object:          object,
+		},
+	}}})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+func TestS3Event(t *testing.T) {
+	sum := make([]byte, 32)
+	sum[0] = 0xab
+	tests := []struct {
+		testName     string
+		kind         string
+		expectedName string
+		expectedSize int
+		expectedETag string
+	}{
+		{"completed", EVENT_COMPLETED, "ObjectCreated:Put", 10, hex.EncodeToString(sum)},
+		{"terminated", EVENT_TERMINATED, "ObjectRemoved:Delete", 0, ""},
+		{"created", EVENT_CREATED, "", 0, ""},
+	}
+	format := newEventFormat(&ServerConfig{EventBucket: "drops"}, EVENT_FORMAT_S3)
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			f := &File{ID: [16]byte{1}, Size: 10, Offset: 10, digest: sum, owner: "alice"}
+			encoded, err := format.encode(newUploadEvent(test.kind, f))
+			if err != nil {
+				t.Fatalf("Fail to encode the event. error=%v", err)
+			}
+			if len(test.expectedName) <= 0 {
+				if encoded.payload != nil {
+					t.Errorf("encode does not leave out the event. got=%s", encoded.payload)
+				}
+				return
+			}
+			if encoded.contentType != "application/json" {
+				t.Errorf("encode does not return the JSON content type. got=%s", encoded.contentType)
+			}
+			payload := encoded.payload
+
+			var event s3Event
+			if err := json.Unmarshal(payload, &event); err != nil || len(event.Records) != 1 {
+				t.Fatalf("Fail to parse the S3 event. error=%v payload=%s", err, payload)
+			}
+			record := event.Records[0]
+			if record.EventSource != "aws:s3" || record.EventName != test.expectedName {
+				t.Errorf("the event is not the %s notification of S3. got=%s %s", test.expectedName, record.EventSource, record.EventName)
+			}
+			if record.S3.Bucket.Name != "drops" || record.S3.Bucket.ARN != "arn:aws:s3:::drops" {
+				t.Errorf("the event is not in the configured bucket. got=%+v", record.S3.Bucket)
+			}
+			if object := record.S3.Object; object.Key != f.ID.String() || object.Size != test.expectedSize || object.ETag != test.expectedETag {
+				t.Errorf("the object of the event is not the upload. got=%+v", object)
+			}
+			if record.UserIdentity.PrincipalID != "alice" {
+				t.Errorf("the event is not from the owner of the upload. got=%s", record.UserIdentity.PrincipalID)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// errFinished is returned when ending an upload already terminated or expired
+var errFinished = errors.New("upload is finished")
+
+// errInvalidExpires is returned for an Upload-Expires a creation can't ask for
+var errInvalidExpires = errors.New("Upload-Expires is not a future HTTP date")
+
+// expirer removes the uploads not completed ExpireAfter after their last
+// write, see File.timestamps, or at the expiration they asked for, and the
+// complete ones per the RetentionRules.
+// Instances sharing an UploadDir share its uploads, the sweep is a cluster
+// wide job only their leader runs, see leaderElection. It also ends the
+// uploads for the admin API, see end.
+type expirer struct {
+	after     time.Duration
+	retention []RetentionRule
+	trash     time.Duration // how long the finished uploads are kept in the trash, 0 removes them at once
+	dir       string
+	shared    bool // the uploads are found from the info files of dir instead of the storage
+	storage   *Storage
+	lookup    func(id string) *File
+	locker    Locker
+	handles   *fileHandleCache
+	quota     *storageQuota
+	election  *leaderElection
+}
+
+// run sweeps every interval while the instance leads
+func (e *expirer) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if e.election.lead() {
+			e.sweep(time.Now())
+		}
+	}
+}
+
+// sweep expires the uploads due at now, see expiresAt, and purges the trash,
+// it returns how many it expired
+func (e *expirer) sweep(now time.Time) int {
+	expired := 0
+	for _, f := range e.uploads() {
+		if e.expiresAt(f).IsZero() {
+			continue
+		}
+		ok, err := e.expire(f, now)
+		if err != nil {
+			slog.Error("Fail to expire upload", slog.String("id", f.ID.String()), slog.Any("Error", err))
+		} else if ok {
+			expired++
+		}
+	}
+	if expired > 0 {
+		slog.Info("Expired uploads", slog.Int("count", expired))
+	}
+	e.purgeTrash(now)
+	return expired
+}
+
+// expiresAt returns when f expires, zero when it does not. While it is not
+// completed it expires at the expiration it asked for or else after idle
+// after its last write, once it is per the retention rule matching its
+// metadata. A paused upload or one under legal hold does not expire.
+func (e *expirer) expiresAt(f *File) time.Time {
+	if f.isPaused() || f.onHold() {
+		return time.Time{}
+	}
+	_, active := f.timestamps()
+	if f.state() == UPLOAD_STATE_COMPLETED {
+		if after := retention(e.retention, parseMetadata(f.metadata())); after > 0 {
+			return active.Add(after)
+		}
+		return time.Time{}
+	}
+	if expires := f.expiry(); !expires.IsZero() {
+		return expires
+	}
+	if e.after > 0 {
+		return active.Add(e.after)
+	}
+	return time.Time{}
+}
+
+// requestedExpiry returns the expiration a creation asks for in its
+// Upload-Expires, lowered to max after now, zero when it asks for none or
+// max is 0
+func requestedExpiry(header string, max time.Duration, now time.Time) (time.Time, error) {
+	if len(header) <= 0 || max <= 0 {
+		return time.Time{}, nil
+	}
+	expires, err := http.ParseTime(header)
+	if err != nil || !expires.After(now) {
+		return time.Time{}, errInvalidExpires
+	}
+	if latest := now.Add(max); expires.After(latest) {
+		return latest, nil
+	}
+	return expires, nil
+}
+
+// expiring reports whether the incomplete uploads of config may expire
+func expiring(config *ServerConfig) bool {
+	return config.ExpireAfter > 0 || config.MaxExpireAfter > 0 || (config.AnonymousUploads && config.AnonymousExpireAfter > 0)
+}
+
+// setExpiresHeader sets Upload-Expires while the upload is not completed
+// and expires
+func setExpiresHeader(w http.ResponseWriter, e *expirer, f *File) {
+	if f.state() == UPLOAD_STATE_COMPLETED {
+		return
+	}
+	if expires := e.expiresAt(f); !expires.IsZero() {
+		w.Header().Set(HEADER_UPLOAD_EXPIRES, expires.UTC().Format(http.TimeFormat))
+	}
+}
+
+// expiry returns the expiration the upload asked for at its creation, see
+// requestedExpiry
+func (f *File) expiry() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.expires
+}
+
+// uploads returns the uploads to check, the ones of every instance when the
+// directory is shared
+func (e *expirer) uploads() []*File {
+	if !e.shared {
+		return e.storage.Files()
+	}
+	var files []*File
+	err := filepath.WalkDir(e.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(path, INFO_EXTENSION) {
+			return err
+		}
+		id, err := uuid.Parse(strings.TrimSuffix(entry.Name(), INFO_EXTENSION))
+		if err != nil {
+			return nil
+		}
+		if f := e.lookup(id.String()); f != nil {
+			files = append(files, f)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Fail to list shared uploads", slog.String("dir", e.dir), slog.Any("Error", err))
+	}
+	return files
+}
+
+// expire removes the data and the info file of f when it is due at now, see
+// expiresAt. Once they are removed the upload is dropped from the storage,
+// it answers 404 Not Found like an unknown one. An upload being written is
+// locked and left to the next sweep.
+func (e *expirer) expire(f *File, now time.Time) (bool, error) {
+	if f.finished() {
+		return false, nil
+	}
+	lock, err := e.locker.TryLock(f.ID.String())
+	if err != nil {
+		if errors.Is(err, errLocked) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer lock.Unlock()
+
+	// an upload whose data is gone expires whatever its last write
+	_, err = os.Stat(f.storedPath())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	if expires := e.expiresAt(f); err == nil && (expires.IsZero() || expires.After(now)) {
+		return false, nil
+	}
+	if err := e.remove(f, UPLOAD_STATE_EXPIRED); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// end moves f to the finished state, terminated or expired, whatever its
+// age, for the admin API. It returns errLocked while the upload is written.
+func (e *expirer) end(f *File, state string) error {
+	lock, err := e.locker.TryLock(f.ID.String())
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return e.remove(f, state)
+}
+
+// remove moves f to the finished state and removes its data and info file,
+// under the lock of the upload. With a TrashRetention they are kept in the
+// trash instead, see purge and restore.
+func (e *expirer) remove(f *File, state string) error {
+	if f.finished() {
+		return errFinished
+	}
+	if f.onHold() {
+		return errHeld
+	}
+	previous := f.state()
+	if err := f.transition(state); err != nil {
+		return err
+	}
+	if e.trash > 0 {
+		f.mu.Lock()
+		f.trashed, f.trashedFrom = time.Now(), previous
+		f.mu.Unlock()
+		if e.handles != nil {
+			e.handles.close(f.storedPath())
+		}
+		if f.persist {
+			return f.saveInfo()
+		}
+		return nil
+	}
+	return e.erase(f)
+}
+
+// erase removes the data and the info file of f, releases its quota and
+// drops it from the storage. A final data file another upload was finalized
+// over is left to that upload, see ownsFinal.
+func (e *expirer) erase(f *File) error {
+	path := f.storedPath()
+	if e.handles != nil {
+		e.handles.close(path)
+	}
+	e.quota.release(f.Size)
+	f.dedup.remove(f)
+	var paths []string
+	if f.ownsFinal() {
+		paths = append(paths, path, f.path()+DIGEST_EXTENSION)
+	}
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := f.removeState(); err != nil {
+		return err
+	}
+	if e.storage != nil {
+		e.storage.Delete(f.ID.String())
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRequestedExpiry(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		testName      string
+		header        string
+		max           time.Duration
+		expected      time.Time
+		expectedError bool
+	}{
+		{"Should keep the expiration within the max", now.Add(time.Hour).Format(http.TimeFormat), 24 * time.Hour, now.Add(time.Hour), false},
+		{"Should lower the expiration to the max", now.Add(48 * time.Hour).Format(http.TimeFormat), 24 * time.Hour, now.Add(24 * time.Hour), false},
+		{"Should ignore a missing header", "", 24 * time.Hour, time.Time{}, false},
+		{"Should ignore the header without a max", now.Add(time.Hour).Format(http.TimeFormat), 0, time.Time{}, false},
+		{"Should reject a past date", now.Add(-time.Hour).Format(http.TimeFormat), 24 * time.Hour, time.Time{}, true},
+		{"Should reject a malformed date", "tomorrow", 24 * time.Hour, time.Time{}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			got, err := requestedExpiry(test.header, test.max, now)
+			if (err != nil) != test.expectedError {
+				t.Fatalf("requestedExpiry does not fail %v. error=%v", test.expectedError, err)
+			}
+			if !got.Equal(test.expected) {
+				t.Errorf("requestedExpiry does not return %v. got=%v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestUploadExpires(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: t.TempDir(), ExpireAfter: time.Hour, MaxExpireAfter: 30 * 24 * time.Hour, RelativeLocation: true}))
+	defer server.Close()
+	host := server.URL + "/files"
+
+	expires := time.Now().Add(7 * 24 * time.Hour).UTC().Truncate(time.Second)
+	req, err := http.NewRequest(http.MethodPost, host, nil)
+	if err != nil {
+		t.Fatalf("Fail to create test data. Error=%v", err)
+	}
+	req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+	req.Header.Set(HEADER_UPLOAD_EXPIRES, expires.Format(http.TimeFormat))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute POST request. error=%v", err)
+	}
+	res.Body.Close()
+	if got := res.Header.Get(HEADER_UPLOAD_EXPIRES); got != expires.Format(http.TimeFormat) {
+		t.Errorf("POST does not return the requested expiration. got=%s", got)
+	}
+	requested := path.Base(res.Header.Get(HEADER_LOCATION))
+
+	idle := createUpload(t, host, 10)
+	for id, expected := range map[string]time.Duration{requested: 7 * 24 * time.Hour, idle: time.Hour} {
+		res, err := http.Head(fmt.Sprintf("%s/%s", host, id))
+		if err != nil {
+			t.Fatalf("Fail to execute HEAD request. error=%v", err)
+		}
+		res.Body.Close()
+		got, err := http.ParseTime(res.Header.Get(HEADER_UPLOAD_EXPIRES))
+		if err != nil || time.Until(got) > expected || time.Until(got) < expected-time.Minute {
+			t.Errorf("HEAD of %s does not expire in %v. got=%s", id, expected, res.Header.Get(HEADER_UPLOAD_EXPIRES))
+		}
+	}
+
+	req.Header.Set(HEADER_UPLOAD_EXPIRES, "tomorrow")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute POST request. error=%v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST with an invalid Upload-Expires does not return 400. got=%d", res.StatusCode)
+	}
+}
+
+func TestExpirerRequestedExpiry(t *testing.T) {
+	dir := t.TempDir()
+	locker, err := newLocker(&ServerConfig{})
+	if err != nil {
+		t.Fatalf("Fail to create locker. error=%v", err)
+	}
+	storage := newStorage()
+	e := &expirer{after: time.Hour, dir: dir, storage: storage, locker: locker}
+
+	now := time.Now()
+	upload := func(expires time.Time) *File {
+		t.Helper()
+		f := &File{ID: uuid.New(), Size: 10, Offset: 5, State: UPLOAD_STATE_UPLOADING, dir: dir, expires: expires}
+		f.created, f.active = now, now
+		if err := os.WriteFile(f.path(), []byte(content[:5]), 0644); err != nil {
+			t.Fatalf("Fail to create test data. error=%v", err)
+		}
+		storage.Put(f.ID.String(), f)
+		return f
+	}
+	transfer := upload(now.Add(10 * time.Minute))
+	backup := upload(now.Add(30 * 24 * time.Hour))
+	idle := upload(time.Time{})
+
+	if expired := e.sweep(now.Add(20 * time.Minute)); expired != 1 || transfer.state() != UPLOAD_STATE_EXPIRED {
+		t.Errorf("sweep does not expire the upload at its requested expiration. got=%d", expired)
+	}
+	if expired := e.sweep(now.Add(2 * time.Hour)); expired != 1 || idle.state() != UPLOAD_STATE_EXPIRED {
+		t.Errorf("sweep does not expire the idle upload. got=%d", expired)
+	}
+	if backup.finished() {
+		t.Errorf("sweep expires the upload before its requested expiration")
+	}
+	for _, f := range []*File{transfer, idle} {
+		if got := storage.Get(f.ID.String()); got != nil {
+			t.Errorf("the expired upload is not removed from the storage. got=%v", got)
+		}
+	}
+	if storage.Get(backup.ID.String()) == nil {
+		t.Errorf("sweep removes the pending upload from the storage")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// zeroReader is an endless source of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// failingReader returns n bytes then fails
+type failingReader struct {
+	n int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, fmt.Errorf("connection reset")
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	r.n -= len(p)
+	return len(p), nil
+}
+
+func TestFileWrite(t *testing.T) {
+	tests := []struct {
+		testName       string
+		body           io.Reader
+		expectError    bool
+		expectedOffset int
+	}{
+		{
+			testName:       "Should write the whole body",
+			body:           io.LimitReader(zeroReader{}, int64(3*CHUNK_SIZE+10)),
+			expectedOffset: 3*CHUNK_SIZE + 10,
+		},
+		{
+			testName:       "Should write an empty body",
+			body:           io.LimitReader(zeroReader{}, 0),
+			expectedOffset: 0,
+		},
+		{
+			testName:       "Should keep the bytes read before an error",
+			body:           &failingReader{n: CHUNK_SIZE + 100},
+			expectError:    true,
+			expectedOffset: CHUNK_SIZE + 100,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			f := &File{ID: uuid.New()}
+			if err := f.create(); err != nil {
+				t.Fatalf("Fail to create file. error=%v", err)
+			}
+
+			err := f.write(context.Background(), tt.body)
+			if tt.expectError != (err != nil) {
+				t.Errorf("write does not return the expected error. got=%v", err)
+			}
+			if f.Offset != tt.expectedOffset {
+				t.Errorf("write does not set the correct offset, expected=%d. got=%d", tt.expectedOffset, f.Offset)
+			}
+
+			info, err := os.Stat(f.path())
+			if err != nil {
+				t.Fatalf("Fail to stat file. error=%v", err)
+			}
+			if int(info.Size()) != tt.expectedOffset {
+				t.Errorf("write does not write the correct size, expected=%d. got=%d", tt.expectedOffset, info.Size())
+			}
+		})
+	}
+}
+
+// cancellingReader is an endless body cancelling its request after n bytes
+type cancellingReader struct {
+	n      int
+	cancel context.CancelFunc
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	if r.n > 0 && len(p) > r.n {
+		p = p[:r.n]
+	}
+	clear(p)
+	r.n -= len(p)
+	if r.n <= 0 {
+		r.cancel()
+	}
+	return len(p), nil
+}
+
+func TestFileWriteCancel(t *testing.T) {
+	tests := []struct {
+		testName string
+		file     *File
+	}{
+		{"buffered", &File{}},
+		{"direct IO", &File{directIO: true}},
+		{"io_uring", &File{ioURing: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			f := tt.file
+			f.ID = uuid.New()
+			f.Size = 4 * CHUNK_SIZE
+			if err := f.create(); err != nil {
+				t.Fatalf("Fail to create file. error=%v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			err := f.write(ctx, &cancellingReader{n: CHUNK_SIZE + 100, cancel: cancel})
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("write does not stop on cancellation. got=%v", err)
+			}
+			if f.Offset != CHUNK_SIZE+100 {
+				t.Errorf("write does not commit the bytes read before the cancellation, expected=%d. got=%d", CHUNK_SIZE+100, f.Offset)
+			}
+
+			// the upload is not left locked
+			if err := f.write(context.Background(), io.LimitReader(zeroReader{}, 10)); err != nil {
+				t.Errorf("write after a cancellation fails. error=%v", err)
+			}
+		})
+	}
+}
+
+// bufferedLoopWrite is the former bufio based read loop of File.write, kept
+// as the baseline of BenchmarkFileWrite
+func bufferedLoopWrite(file *os.File, body io.Reader) (int, error) {
+	reader := bufio.NewReader(body)
+	buff := make([]byte, CHUNK_SIZE)
+	written := 0
+	for {
+		n, err := reader.Read(buff)
+		if _, werr := file.Write(buff[:n]); werr != nil {
+			return written, werr
+		}
+		written += n
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+var benchmarkSizes = []int{
+	CHUNK_SIZE,
+	64 * CHUNK_SIZE,
+	MAX_SIZE,
+}
+
+func BenchmarkFileWrite(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("CopyBuffer/%dMiB", size/CHUNK_SIZE), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				f := &File{ID: uuid.New()}
+				if err := f.create(); err != nil {
+					b.Fatalf("Fail to create file. error=%v", err)
+				}
+				if err := f.write(context.Background(), io.LimitReader(zeroReader{}, int64(size))); err != nil {
+					b.Fatalf("Fail to write file. error=%v", err)
+				}
+				os.Remove(f.path())
+			}
+		})
+
+		b.Run(fmt.Sprintf("BufferedLoop/%dMiB", size/CHUNK_SIZE), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				path := filepath.Join(uploadDir, uuid.NewString())
+				file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+				if err != nil {
+					b.Fatalf("Fail to create file. error=%v", err)
+				}
+				if _, err := bufferedLoopWrite(file, io.LimitReader(zeroReader{}, int64(size))); err != nil {
+					b.Fatalf("Fail to write file. error=%v", err)
+				}
+				file.Close()
+				os.Remove(path)
+			}
+		})
+	}
+}
+
+// BenchmarkFileWriteParallel measures the allocations of many concurrent
+// small PATCHes, where the chunk buffer dominates
+func BenchmarkFileWriteParallel(b *testing.B) {
+	size := 4 * 1024
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.RunParallel(func(pb *testing.PB) {
+		f := &File{ID: uuid.New()}
+		if err := f.create(); err != nil {
+			b.Errorf("Fail to create file. error=%v", err)
+			return
+		}
+		defer os.Remove(f.path())
+
+		for pb.Next() {
+			if err := f.write(context.Background(), io.LimitReader(zeroReader{}, int64(size))); err != nil {
+				b.Errorf("Fail to write file. error=%v", err)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// FINALIZE_COLLISION_RENAME finalizes under the first free name among
+	// name, name-1, name-2... when the name is taken
+	FINALIZE_COLLISION_RENAME = "rename"
+	// FINALIZE_COLLISION_OVERWRITE replaces the file already holding the name
+	FINALIZE_COLLISION_OVERWRITE = "overwrite"
+	// FINALIZE_COLLISION_FAIL leaves the upload in UploadDir when the name is
+	// taken
+	FINALIZE_COLLISION_FAIL = "fail"
+)
+
+// the number of suffixed names tried by the rename collision policy
+const finalizeMaxAttempts = 1000
+
+// windowsReserved are the device names windows won't create a file under,
+// with any extension
+var windowsReserved = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+// finalName returns the name of the complete upload in the final directory,
+// the base name of its filename metadata or its id when there is none usable.
+// The name is made valid on windows wherever the server runs so an upload
+// gets the same name on every platform.
+func (f *File) finalName() string {
+	name := path.Base(strings.ReplaceAll(parseMetadata(f.metadata())["filename"], "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	// windows drops the trailing dots and spaces
+	name = strings.TrimRight(name, ". ")
+	stem, _, _ := strings.Cut(name, ".")
+	if len(name) <= 0 || name == "/" || slices.Contains(windowsReserved, strings.ToUpper(strings.TrimSpace(stem))) {
+		return f.ID.String()
+	}
+	return name
+}
+
+// finalize moves the data file of a complete upload out of UploadDir into
+// its final directory so the consumers watching it never see a half written
+// file. The move is a single rename, or a hard link then an unlink when the
+// name must not be clobbered. A final directory on another filesystem gets a
+// hidden copy first, see copyToDir, which is moved in place the same way. The
+// info file stays in UploadDir and records the final path. The data file must
+// not be open for writing anymore.
+func (f *File) finalize() error {
+	if len(f.finalDir) <= 0 || f.state() != UPLOAD_STATE_COMPLETED || f.finalized() {
+		return nil
+	}
+	return f.moveTo(f.finalDir)
+}
+
+// moveTo moves the data file into dir under its final name, applying the
+// collision policy, see finalize
+func (f *File) moveTo(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	src := f.path()
+	dst, err := f.place(src, dir)
+	if isCrossDevice(err) {
+		var tmp string
+		if tmp, err = f.copyToDir(src, dir); err == nil {
+			if dst, err = f.place(tmp, dir); err != nil {
+				os.Remove(tmp)
+			} else if rerr := os.Remove(src); rerr != nil {
+				// the upload is final all the same, only the space is lost
+				slog.Error("Fail to remove the staged data of upload", slog.String("id", f.ID.String()), slog.Any("Error", rerr))
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	var stamp string
+	if stat, err := os.Stat(dst); err == nil {
+		stamp = fileStamp(stat)
+	}
+	f.mu.Lock()
+	f.final, f.finalStamp = dst, stamp
+	f.mu.Unlock()
+	if err := f.moveDigest(src); err != nil {
+		return err
+	}
+	if f.fsync.syncs() {
+		return errors.Join(syncDir(dir), syncDir(filepath.Dir(src)))
+	}
+	return nil
+}
+
+// place moves src into dir under the final name of the upload, applying the
+// collision policy, it returns the path it moved src to
+func (f *File) place(src, dir string) (string, error) {
+	name := f.finalName()
+	dst := filepath.Join(dir, name)
+	switch f.collision {
+	case FINALIZE_COLLISION_OVERWRITE:
+		return dst, replaceFile(src, dst)
+	case FINALIZE_COLLISION_FAIL:
+		return dst, moveNoClobber(src, dst)
+	}
+	ext := filepath.Ext(name)
+	for i := 1; ; i++ {
+		err := moveNoClobber(src, dst)
+		if err == nil {
+			return dst, nil
+		}
+		if !errors.Is(err, fs.ErrExist) || i >= finalizeMaxAttempts {
+			return "", err
+		}
+		dst = filepath.Join(dir, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), i, ext))
+	}
+}
+
+// copyToDir copies the data file at src into dir under a hidden name, .<id>,
+// the consumers of dir are expected to skip, and returns its path. It is
+// synced with the policy before it is moved in place.
+func (f *File) copyToDir(src, dir string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	tmp := filepath.Join(dir, "."+f.ID.String())
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil && f.fsync.syncs() {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// fileStamp returns what tells the file stat describes from another file
+// moved to its path later, its inode, where there is one, size and
+// modification time
+func fileStamp(stat fs.FileInfo) string {
+	return fmt.Sprintf("%d:%d:%d", fileIndex(stat), stat.Size(), stat.ModTime().UnixNano())
+}
+
+// ownsFinal reports whether the final data file is still the one the upload
+// was finalized to, not the file of another upload finalized over it under
+// the overwrite policy, see fileStamp. The uploads finalized before the stamp
+// was recorded and the compressed ones, whose file is not overwritten, own
+// it.
+func (f *File) ownsFinal() bool {
+	f.mu.Lock()
+	path, stamp, compressed := f.final, f.finalStamp, f.compressed
+	f.mu.Unlock()
+
+	if len(path) <= 0 || len(stamp) <= 0 || compressed {
+		return true
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return true
+	}
+	return fileStamp(stat) == stamp
+}
+
+// finalized reports whether the data file was moved out of UploadDir
+func (f *File) finalized() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.final) > 0
+}
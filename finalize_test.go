@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestFinalName(t *testing.T) {
+	tests := []struct {
+		testName string
+		filename string
+		expected string
+	}{
+		{"plain name", "a.txt", "a.txt"},
+		{"unix path", "../../etc/passwd", "passwd"},
+		{"windows path", "C:\\Users\\me\\a.txt", "a.txt"},
+		{"parent dir", "..", "01000000-0000-0000-0000-000000000000"},
+		{"no filename", "", "01000000-0000-0000-0000-000000000000"},
+		{"windows reserved characters", "a:b?.txt", "a_b_.txt"},
+		{"windows trailing dots", "a.txt. .", "a.txt"},
+		{"windows device name", "con.tar.gz", "01000000-0000-0000-0000-000000000000"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			f := &File{ID: [16]byte{1}}
+			if len(test.filename) > 0 {
+				f.Metadata = "filename " + base64.StdEncoding.EncodeToString([]byte(test.filename))
+			}
+			if got := f.finalName(); got != test.expected {
+				t.Errorf("finalName does not return %s. got=%s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestFinalizeCollision(t *testing.T) {
+	tests := []struct {
+		testName    string
+		collision   string
+		expected    string
+		expectError bool
+	}{
+		{"rename", FINALIZE_COLLISION_RENAME, "a-1.txt", false},
+		{"overwrite", FINALIZE_COLLISION_OVERWRITE, "a.txt", false},
+		{"fail", FINALIZE_COLLISION_FAIL, "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			defer func() { uploadDir = tempUploadDir }()
+			uploadDir = t.TempDir()
+			finalDir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(finalDir, "a.txt"), []byte("taken"), 0644); err != nil {
+				t.Fatalf("Fail to create test data. error=%v", err)
+			}
+
+			f := &File{
+				ID:        [16]byte{1},
+				Size:      10,
+				Metadata:  "filename " + base64.StdEncoding.EncodeToString([]byte("a.txt")),
+				finalDir:  finalDir,
+				collision: test.collision,
+			}
+			if err := f.create(); err != nil {
+				t.Fatalf("Fail to create file. error=%v", err)
+			}
+			if err := f.write(context.Background(), strings.NewReader(content[:10])); err != nil {
+				t.Fatalf("Fail to write file. error=%v", err)
+			}
+
+			if test.expectError {
+				if f.path() != f.stagingPath() {
+					t.Errorf("finalize does not leave the upload in UploadDir. got=%s", f.path())
+				}
+				test.expected = "a.txt"
+			} else if got := f.path(); got != filepath.Join(finalDir, test.expected) {
+				t.Errorf("finalize does not move the upload to %s. got=%s", test.expected, got)
+			}
+			if _, err := os.Stat(f.stagingPath()); test.expectError != (err == nil) {
+				t.Errorf("finalize does not handle the staging file as expected. error=%v", err)
+			}
+			data, err := os.ReadFile(f.path())
+			if err != nil {
+				t.Fatalf("Fail to read finalized file. error=%v", err)
+			}
+			if string(data) != content[:10] {
+				t.Errorf("finalize does not keep the data. got=%s", data)
+			}
+			if data, _ := os.ReadFile(filepath.Join(finalDir, "a.txt")); test.collision != FINALIZE_COLLISION_OVERWRITE && string(data) != "taken" {
+				t.Errorf("finalize does not keep the file holding the name. got=%s", data)
+			}
+		})
+	}
+}
+
+func TestFinalizeConcurrentCollision(t *testing.T) {
+	tests := []struct {
+		testName          string
+		collision         string
+		expectedFinalized int
+		expectedFiles     int
+	}{
+		{"rename", FINALIZE_COLLISION_RENAME, 8, 8},
+		{"overwrite", FINALIZE_COLLISION_OVERWRITE, 8, 1},
+		{"fail", FINALIZE_COLLISION_FAIL, 1, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			dir := t.TempDir()
+			finalDir := t.TempDir()
+			files := make([]*File, 8)
+			for i := range files {
+				files[i] = &File{ID: uuid.New(), Size: 10, Offset: 10, State: UPLOAD_STATE_COMPLETED, Metadata: "filename " + base64.StdEncoding.EncodeToString([]byte("a.txt")), dir: dir, finalDir: finalDir, collision: test.collision}
+				if err := os.WriteFile(files[i].path(), []byte(content[i:i+10]), 0644); err != nil {
+					t.Fatalf("Fail to create test data. error=%v", err)
+				}
+			}
+
+			var wg sync.WaitGroup
+			for _, f := range files {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					f.finalize()
+				}()
+			}
+			wg.Wait()
+
+			// the overwritten uploads are erased without the file replacing
+			// theirs
+			finalized, owners := 0, 0
+			for i, f := range files {
+				if f.finalized() {
+					finalized++
+				}
+				if !f.ownsFinal() {
+					if err := (&expirer{}).erase(f); err != nil {
+						t.Errorf("Fail to erase upload %d. error=%v", i, err)
+					}
+					continue
+				}
+				if f.finalized() {
+					owners++
+				}
+				data, err := os.ReadFile(f.path())
+				if err != nil || string(data) != content[i:i+10] {
+					t.Errorf("the upload %d does not keep its data. got=%s error=%v", i, data, err)
+				}
+			}
+			if finalized != test.expectedFinalized {
+				t.Errorf("finalize does not finalize %d uploads. got=%d", test.expectedFinalized, finalized)
+			}
+			if owners != test.expectedFiles {
+				t.Errorf("%d uploads do not own their final file. got=%d", test.expectedFiles, owners)
+			}
+			if entries, _ := os.ReadDir(finalDir); len(entries) != test.expectedFiles {
+				t.Errorf("the final directory does not hold %d files. got=%d", test.expectedFiles, len(entries))
+			}
+		})
+	}
+}
+
+func TestFinalize(t *testing.T) {
+	dir := t.TempDir()
+	finalDir := t.TempDir()
+	defer func() { uploadDir = tempUploadDir }()
+	config := &ServerConfig{UploadDir: dir, FinalDir: finalDir, PersistState: true, RelativeLocation: true}
+
+	server := httptest.NewServer(buildServeMux(config))
+	host := server.URL + "/files"
+	req, err := http.NewRequest(http.MethodPost, host, nil)
+	if err != nil {
+		t.Fatalf("Fail to create test data. Error=%v", err)
+	}
+	req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+	req.Header.Set(HEADER_UPLOAD_METADATA, "filename "+base64.StdEncoding.EncodeToString([]byte("a.txt")))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to create test data. Error=%v", err)
+	}
+	res.Body.Close()
+	fileId := filepath.Base(res.Header.Get(HEADER_LOCATION))
+
+	// nothing shows up in the final directory until the upload is complete
+	patchUpload(t, host, fileId, 0, content[:4])
+	if _, err := os.Stat(filepath.Join(finalDir, "a.txt")); err == nil {
+		t.Errorf("an incomplete upload is finalized")
+	}
+	patchUpload(t, host, fileId, 4, content[4:10])
+	data, err := os.ReadFile(filepath.Join(finalDir, "a.txt"))
+	if err != nil {
+		t.Fatalf("Fail to read finalized file. error=%v", err)
+	}
+	if string(data) != content[:10] {
+		t.Errorf("the finalized file does not hold the upload. got=%s", data)
+	}
+	server.Close()
+
+	// the finalized upload is still served, after a restart too
+	server = httptest.NewServer(buildServeMux(config))
+	defer server.Close()
+	res, err = http.Get(server.URL + "/files/" + fileId)
+	if err != nil {
+		t.Fatalf("Fail to execute GET request. error=%v", err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != content[:10] {
+		t.Errorf("GET /files/%s does not serve the finalized upload. got=%v %s", fileId, res.StatusCode, body)
+	}
+}
+
+func TestFinalizeOverwrite(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	dir := t.TempDir()
+	finalDir := t.TempDir()
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: dir, FinalDir: finalDir, FinalizeCollision: FINALIZE_COLLISION_OVERWRITE, AdminToken: "secret", PersistState: true, RelativeLocation: true}))
+	defer server.Close()
+	host := server.URL + "/files"
+	create := func() string {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, host, nil)
+		if err != nil {
+			t.Fatalf("Fail to create test data. Error=%v", err)
+		}
+		req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+		req.Header.Set(HEADER_UPLOAD_METADATA, "filename "+base64.StdEncoding.EncodeToString([]byte("a.txt")))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to create test data. Error=%v", err)
+		}
+		res.Body.Close()
+		return filepath.Base(res.Header.Get(HEADER_LOCATION))
+	}
+	get := func(fileId string) (int, string) {
+		t.Helper()
+		res, err := http.Get(host + "/" + fileId)
+		if err != nil {
+			t.Fatalf("Fail to execute GET request. error=%v", err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	first, second := create(), create()
+	patchUpload(t, host, first, 0, content[:10])
+	patchUpload(t, host, second, 0, content[10:20])
+	if status, _ := get(first); status != http.StatusGone {
+		t.Errorf("GET of the overwritten upload does not return 410. got=%d", status)
+	}
+	if status, body := get(second); status != http.StatusOK || body != content[10:20] {
+		t.Errorf("GET of the overwriting upload does not serve its data. got=%d %s", status, body)
+	}
+
+	// terminating the overwritten upload leaves the final file
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/admin/uploads/"+first, nil)
+	if err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute DELETE request. error=%v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE of the overwritten upload does not return 204. got=%d", res.StatusCode)
+	}
+	if status, body := get(second); status != http.StatusOK || body != content[10:20] {
+		t.Errorf("the overwriting upload does not keep its data once the other is terminated. got=%d %s", status, body)
+	}
+}
+
+func TestFinalizeAcrossFilesystems(t *testing.T) {
+	dir := t.TempDir()
+	finalDir, err := os.MkdirTemp("/dev/shm", "final")
+	if err != nil {
+		t.Skipf("no other filesystem to finalize to. error=%v", err)
+	}
+	defer os.RemoveAll(finalDir)
+	probe := filepath.Join(dir, "probe")
+	if err := os.WriteFile(probe, nil, 0644); err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+	if err := os.Link(probe, filepath.Join(finalDir, "probe")); !isCrossDevice(err) {
+		t.Skipf("%s is on the filesystem of %s", finalDir, dir)
+	}
+
+	f := &File{ID: uuid.New(), Size: 10, Offset: 10, State: UPLOAD_STATE_COMPLETED, Metadata: "filename " + base64.StdEncoding.EncodeToString([]byte("a.txt")), dir: dir, finalDir: finalDir}
+	if err := os.WriteFile(f.path(), []byte(content[:10]), 0644); err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+	if err := f.finalize(); err != nil {
+		t.Fatalf("Fail to finalize upload. error=%v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(finalDir, "a.txt"))
+	if err != nil || string(data) != content[:10] {
+		t.Errorf("the finalized file does not hold the upload. got=%s error=%v", data, err)
+	}
+	if f.path() != filepath.Join(finalDir, "a.txt") {
+		t.Errorf("the upload does not record its final path. got=%s", f.path())
+	}
+	if _, err := os.Stat(f.stagingPath()); !os.IsNotExist(err) {
+		t.Errorf("the staged data is not removed. error=%v", err)
+	}
+	if entries, _ := os.ReadDir(finalDir); len(entries) != 1 {
+		t.Errorf("the copy is left in the final directory. got=%v", entries)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	HEADER_FORWARDED          = "Forwarded"
+	HEADER_X_FORWARDED_PROTO  = "X-Forwarded-Proto"
+	HEADER_X_FORWARDED_HOST   = "X-Forwarded-Host"
+	HEADER_X_FORWARDED_PREFIX = "X-Forwarded-Prefix"
+)
+
+// trustedProxies is the list of networks whose forwarding headers are honored
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a list of IPs or CIDRs, invalid entries are
+// logged and skipped
+func parseTrustedProxies(values []string) trustedProxies {
+	var proxies trustedProxies
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				slog.Error("Invalid trusted proxy", slog.String("proxy", v))
+				continue
+			}
+			if ip.To4() != nil {
+				v = v + "/32"
+			} else {
+				v = v + "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			slog.Error("Invalid trusted proxy", slog.String("proxy", v), slog.Any("Error", err))
+			continue
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies
+}
+
+// trusts reports whether the request comes directly from a trusted proxy
+func (p trustedProxies) trusts(r *http.Request) bool {
+	if len(p) <= 0 {
+		return false
+	}
+	ip := net.ParseIP(clientAddress(r))
+	if ip == nil {
+		return false
+	}
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// locationBuilder builds the absolute URL of an upload from the static
+// server config, overridden by the forwarding headers of trusted proxies.
+// When relative is set only the path is returned, which the tus protocol
+// allows and which leaves the host resolution to the client.
+type locationBuilder struct {
+	protocol string
+	host     string
+	port     int
+	basePath string
+	proxies  trustedProxies
+	relative bool
+}
+
+func (b *locationBuilder) location(r *http.Request, id string) string {
+	protocol := b.protocol
+	host := fmt.Sprintf("%s:%d", b.host, b.port)
+	var prefix string
+
+	if b.proxies.trusts(r) {
+		forwardedProto, forwardedHost := parseForwarded(r.Header.Get(HEADER_FORWARDED))
+		if len(forwardedProto) <= 0 {
+			forwardedProto = firstHeaderValue(r.Header.Get(HEADER_X_FORWARDED_PROTO))
+		}
+		if len(forwardedHost) <= 0 {
+			forwardedHost = firstHeaderValue(r.Header.Get(HEADER_X_FORWARDED_HOST))
+		}
+		if len(forwardedProto) > 0 {
+			protocol = forwardedProto
+		}
+		if len(forwardedHost) > 0 {
+			host = forwardedHost
+		}
+		prefix = strings.TrimRight(firstHeaderValue(r.Header.Get(HEADER_X_FORWARDED_PREFIX)), "/")
+		if len(prefix) > 0 && !strings.HasPrefix(prefix, "/") {
+			prefix = "/" + prefix
+		}
+	}
+
+	if b.relative {
+		return fmt.Sprintf("%s%s/%s", prefix, b.basePath, id)
+	}
+	return fmt.Sprintf("%s://%s%s%s/%s", protocol, host, prefix, b.basePath, id)
+}
+
+// parseForwarded returns the proto and host of the first element of a RFC
+// 7239 Forwarded header, i.e., the one added by the proxy facing the client
+func parseForwarded(forwarded string) (proto, host string) {
+	element := firstHeaderValue(forwarded)
+	for _, pair := range strings.Split(element, ";") {
+		k, v, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found {
+			continue
+		}
+		v = strings.Trim(v, `"`)
+		switch strings.ToLower(k) {
+		case "proto":
+			proto = v
+		case "host":
+			host = v
+		}
+	}
+	return proto, host
+}
+
+// firstHeaderValue returns the first entry of a comma separated header value
+func firstHeaderValue(value string) string {
+	first, _, _ := strings.Cut(value, ",")
+	return strings.TrimSpace(first)
+}
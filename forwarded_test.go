@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLocationBuilder(t *testing.T) {
+	builder := &locationBuilder{
+		protocol: "http",
+		host:     "localhost",
+		port:     8080,
+		basePath: "/files",
+		proxies:  parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"}),
+	}
+
+	tests := []struct {
+		testName         string
+		remoteAddr       string
+		headers          map[string]string
+		expectedLocation string
+	}{
+		{
+			testName:         "Should use the static config without forwarding headers",
+			remoteAddr:       "10.1.2.3:5000",
+			expectedLocation: "http://localhost:8080/files/id",
+		},
+		{
+			testName:   "Should use X-Forwarded-* from a trusted proxy",
+			remoteAddr: "10.1.2.3:5000",
+			headers: map[string]string{
+				HEADER_X_FORWARDED_PROTO:  "https",
+				HEADER_X_FORWARDED_HOST:   "uploads.example.com",
+				HEADER_X_FORWARDED_PREFIX: "/api/",
+			},
+			expectedLocation: "https://uploads.example.com/api/files/id",
+		},
+		{
+			testName:   "Should prefer Forwarded over X-Forwarded-*",
+			remoteAddr: "192.168.1.1:5000",
+			headers: map[string]string{
+				HEADER_FORWARDED:         `for=192.0.2.60;proto=https;host="uploads.example.com:8443", for=10.0.0.1;proto=http`,
+				HEADER_X_FORWARDED_PROTO: "http",
+				HEADER_X_FORWARDED_HOST:  "other.example.com",
+			},
+			expectedLocation: "https://uploads.example.com:8443/files/id",
+		},
+		{
+			testName:   "Should use the first entry of a forwarding chain",
+			remoteAddr: "10.1.2.3:5000",
+			headers: map[string]string{
+				HEADER_X_FORWARDED_PROTO: "https, http",
+				HEADER_X_FORWARDED_HOST:  "uploads.example.com, internal",
+			},
+			expectedLocation: "https://uploads.example.com/files/id",
+		},
+		{
+			testName:   "Should ignore forwarding headers from untrusted clients",
+			remoteAddr: "203.0.113.7:5000",
+			headers: map[string]string{
+				HEADER_X_FORWARDED_PROTO: "https",
+				HEADER_X_FORWARDED_HOST:  "evil.example.com",
+			},
+			expectedLocation: "http://localhost:8080/files/id",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, "http://localhost:8080/files", nil)
+			if err != nil {
+				t.Fatalf("Fail to create request. error=%v", err)
+			}
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			if location := builder.location(req, "id"); location != tt.expectedLocation {
+				t.Errorf("location is not correct, expected=%s. got=%s", tt.expectedLocation, location)
+			}
+		})
+	}
+}
+
+func TestRelativeLocation(t *testing.T) {
+	builder := &locationBuilder{
+		protocol: "http",
+		host:     "localhost",
+		port:     8080,
+		basePath: "/files",
+		proxies:  parseTrustedProxies([]string{"10.0.0.0/8"}),
+		relative: true,
+	}
+
+	tests := []struct {
+		testName         string
+		remoteAddr       string
+		headers          map[string]string
+		expectedLocation string
+	}{
+		{
+			testName:         "Should return the path only",
+			remoteAddr:       "203.0.113.7:5000",
+			expectedLocation: "/files/id",
+		},
+		{
+			testName:   "Should keep the prefix of a trusted proxy",
+			remoteAddr: "10.1.2.3:5000",
+			headers: map[string]string{
+				HEADER_X_FORWARDED_HOST:   "uploads.example.com",
+				HEADER_X_FORWARDED_PREFIX: "/api",
+			},
+			expectedLocation: "/api/files/id",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, "http://localhost:8080/files", nil)
+			if err != nil {
+				t.Fatalf("Fail to create request. error=%v", err)
+			}
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			if location := builder.location(req, "id"); location != tt.expectedLocation {
+				t.Errorf("location is not correct, expected=%s. got=%s", tt.expectedLocation, location)
+			}
+		})
+	}
+}
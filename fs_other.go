@@ -0,0 +1,54 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// openAppend opens the data file at path for appending
+func openAppend(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// syncDir fsyncs the directory at path so the entries created or renamed in
+// it are durable
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// replaceFile renames src to dst, replacing dst atomically
+func replaceFile(src, dst string) error {
+	return os.Rename(src, dst)
+}
+
+// moveNoClobber moves src to dst, failing with fs.ErrExist when dst exists.
+// A rename would silently replace dst, the link fails instead.
+func moveNoClobber(src, dst string) error {
+	if err := os.Link(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// isCrossDevice reports whether err is a rename or a link failing since its
+// paths are on different filesystems
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
+
+// fileIndex returns the inode of the file stat describes
+func fileIndex(stat fs.FileInfo) uint64 {
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		return uint64(sys.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// a file opened elsewhere without FILE_SHARE_DELETE, e.g., by a GET or a
+// virus scanner, can't be renamed until it is closed
+const (
+	renameAttempts = 50
+	renameDelay    = 20 * time.Millisecond
+)
+
+// openAppend opens the data file at path for writing. O_APPEND isn't used
+// since it drops FILE_WRITE_DATA on windows, which SetEndOfFile needs to
+// truncate uncommitted bytes, the writer seeks to the end instead.
+func openAppend(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// syncDir is a no-op, directories can't be flushed on windows and NTFS
+// journals the renames itself
+func syncDir(path string) error {
+	return nil
+}
+
+// replaceFile renames src to dst, replacing dst atomically. It retries while
+// either file is open elsewhere.
+func replaceFile(src, dst string) error {
+	return retryRename(func() error {
+		return os.Rename(src, dst)
+	})
+}
+
+// moveNoClobber moves src to dst, failing with fs.ErrExist when dst exists.
+// MoveFileEx without MOVEFILE_REPLACE_EXISTING refuses to replace dst.
+func moveNoClobber(src, dst string) error {
+	from, err := windows.UTF16PtrFromString(src)
+	if err != nil {
+		return err
+	}
+	to, err := windows.UTF16PtrFromString(dst)
+	if err != nil {
+		return err
+	}
+	return retryRename(func() error {
+		if err := windows.MoveFileEx(from, to, 0); err != nil {
+			return &os.LinkError{Op: "rename", Old: src, New: dst, Err: err}
+		}
+		return nil
+	})
+}
+
+// isCrossDevice reports whether err is a rename failing since its paths are
+// on different volumes
+func isCrossDevice(err error) bool {
+	return errors.Is(err, windows.ERROR_NOT_SAME_DEVICE)
+}
+
+func retryRename(rename func() error) error {
+	var err error
+	for range renameAttempts {
+		if err = rename(); !errors.Is(err, windows.ERROR_SHARING_VIOLATION) && !errors.Is(err, windows.ERROR_ACCESS_DENIED) {
+			return err
+		}
+		time.Sleep(renameDelay)
+	}
+	return err
+}
+
+// fileIndex returns 0, the file index of windows is only read from an open
+// handle and the size and modification time tell the files apart
+func fileIndex(stat fs.FileInfo) uint64 {
+	return 0
+}
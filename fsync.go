@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+)
+
+const (
+	// FSYNC_NEVER leaves flushing to the OS
+	FSYNC_NEVER = "never"
+	// FSYNC_CHUNK fsyncs after every chunk written to the file
+	FSYNC_CHUNK = "chunk"
+	// FSYNC_BYTES fsyncs every FsyncBytes written and at the end of a PATCH
+	FSYNC_BYTES = "bytes"
+	// FSYNC_COMPLETION fsyncs once when the upload is complete
+	FSYNC_COMPLETION = "completion"
+)
+
+// syncPolicy decides when the data written to an upload is fsynced. In the
+// strict modes, chunk and bytes, the committed offset never advances past
+// data that hasn't been fsynced.
+type syncPolicy struct {
+	mode       string
+	everyBytes int64
+}
+
+func newSyncPolicy(mode string, everyBytes int) syncPolicy {
+	switch mode {
+	case FSYNC_CHUNK, FSYNC_COMPLETION:
+	case FSYNC_BYTES:
+		if everyBytes <= 0 {
+			everyBytes = CHUNK_SIZE
+		}
+	default:
+		mode = FSYNC_NEVER
+	}
+	return syncPolicy{mode: mode, everyBytes: int64(everyBytes)}
+}
+
+func (p syncPolicy) strict() bool {
+	return p.mode == FSYNC_CHUNK || p.mode == FSYNC_BYTES
+}
+
+// syncs reports whether the policy fsyncs at all, the zero policy doesn't
+func (p syncPolicy) syncs() bool {
+	return len(p.mode) > 0 && p.mode != FSYNC_NEVER
+}
+
+// syncWriter writes to file and fsyncs it according to the policy. onSync is
+// called with the number of durable bytes after every successful fsync.
+type syncWriter struct {
+	file    *os.File
+	policy  syncPolicy
+	written int64
+	synced  int64
+	onSync  func(synced int64)
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	switch w.policy.mode {
+	case FSYNC_CHUNK:
+		err = w.sync()
+	case FSYNC_BYTES:
+		if w.written-w.synced >= w.policy.everyBytes {
+			err = w.sync()
+		}
+	}
+	return n, err
+}
+
+// sync makes everything written so far durable
+func (w *syncWriter) sync() error {
+	if w.synced == w.written {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.synced = w.written
+	if w.onSync != nil {
+		w.onSync(w.synced)
+	}
+	return nil
+}
+
+// syncPath fsyncs the file at path, fsync applies to the file itself so it
+// flushes the data written through any other handle
+func syncPath(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSyncWriter(t *testing.T) {
+	tests := []struct {
+		testName      string
+		policy        syncPolicy
+		expectedSyncs []int64
+	}{
+		{
+			testName:      "Should never sync",
+			policy:        newSyncPolicy(FSYNC_NEVER, 0),
+			expectedSyncs: nil,
+		},
+		{
+			testName:      "Should sync every chunk",
+			policy:        newSyncPolicy(FSYNC_CHUNK, 0),
+			expectedSyncs: []int64{5, 10, 15, 20, 25},
+		},
+		{
+			testName:      "Should sync every N bytes",
+			policy:        newSyncPolicy(FSYNC_BYTES, 10),
+			expectedSyncs: []int64{10, 20},
+		},
+		{
+			testName:      "Should sync on completion only",
+			policy:        newSyncPolicy(FSYNC_COMPLETION, 0),
+			expectedSyncs: nil,
+		},
+		{
+			testName:      "Should default unknown policies to never",
+			policy:        newSyncPolicy("sometimes", 0),
+			expectedSyncs: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			file, err := os.Create(filepath.Join(t.TempDir(), "upload"))
+			if err != nil {
+				t.Fatalf("Fail to create file. error=%v", err)
+			}
+			defer file.Close()
+
+			var syncs []int64
+			writer := &syncWriter{file: file, policy: tt.policy, onSync: func(synced int64) {
+				syncs = append(syncs, synced)
+			}}
+			for i := 0; i < 5; i++ {
+				if _, err := writer.Write([]byte("12345")); err != nil {
+					t.Fatalf("Fail to write. error=%v", err)
+				}
+			}
+
+			if !reflect.DeepEqual(syncs, tt.expectedSyncs) {
+				t.Errorf("syncWriter does not sync at the expected offsets, expected=%v. got=%v", tt.expectedSyncs, syncs)
+			}
+		})
+	}
+}
+
+func TestFileWriteFsyncPolicy(t *testing.T) {
+	for _, mode := range []string{FSYNC_NEVER, FSYNC_CHUNK, FSYNC_BYTES, FSYNC_COMPLETION} {
+		for _, directIO := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s direct=%v", mode, directIO), func(t *testing.T) {
+				f := &File{ID: uuid.New(), Size: 2*CHUNK_SIZE + 10, directIO: directIO, fsync: newSyncPolicy(mode, 1000)}
+				if err := f.create(); err != nil {
+					t.Fatalf("Fail to create file. error=%v", err)
+				}
+
+				expected := strings.Repeat("a", f.Size)
+				for _, chunk := range []string{expected[:CHUNK_SIZE+3], expected[CHUNK_SIZE+3:]} {
+					if err := f.write(context.Background(), strings.NewReader(chunk)); err != nil {
+						t.Fatalf("Fail to write. error=%v", err)
+					}
+				}
+				if f.Offset != f.Size {
+					t.Errorf("write does not set the correct offset, expected=%d. got=%d", f.Size, f.Offset)
+				}
+
+				file, err := os.Open(f.path())
+				if err != nil {
+					t.Fatalf("Fail to open file. error=%v", err)
+				}
+				defer file.Close()
+				written, _ := io.ReadAll(file)
+				if string(written) != expected {
+					t.Errorf("write does not write the same bytes, expected %d bytes. got=%d", len(expected), len(written))
+				}
+			})
+		}
+	}
+}
@@ -1,5 +1,22 @@
 module resumable-upload
 
-go 1.23.3
+go 1.24.0
 
-require github.com/google/uuid v1.6.0 // indirect
+require github.com/google/uuid v1.6.0
+
+require (
+	github.com/klauspost/compress v1.15.9
+	github.com/rabbitmq/amqp091-go v1.10.0
+	github.com/segmentio/kafka-go v0.4.47
+	golang.org/x/image v0.24.0
+	golang.org/x/sys v0.30.0
+	google.golang.org/grpc v1.72.2
+	google.golang.org/protobuf v1.36.5
+)
+
+require (
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
+	golang.org/x/net v0.35.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20250218202821-56aae31c358a // indirect
+)
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"container/list"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// fileHandleCache keeps the data files of active uploads open across PATCH
+// requests so clients sending many small chunks don't pay an open and a
+// close per request. At most max handles are kept open, the least recently
+// used idle one is closed to make room, and handles unused for idleTimeout
+// are closed in the background.
+type fileHandleCache struct {
+	mu          sync.Mutex
+	max         int
+	idleTimeout time.Duration
+	handles     map[string]*cachedHandle
+	lru         *list.List // of *cachedHandle, most recently used first
+	janitor     bool
+}
+
+type cachedHandle struct {
+	path     string
+	file     *os.File
+	inUse    int
+	lastUsed time.Time
+	element  *list.Element
+}
+
+func newFileHandleCache(max int, idleTimeout time.Duration) *fileHandleCache {
+	return &fileHandleCache{
+		max:         max,
+		idleTimeout: idleTimeout,
+		handles:     make(map[string]*cachedHandle),
+		lru:         list.New(),
+	}
+}
+
+// acquire returns an append handle to path and the function to call once the
+// caller is done with it. When the cache is full of handles in use the file
+// is opened for this caller only and closed on release.
+func (c *fileHandleCache) acquire(path string) (*os.File, func(), error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if h, ok := c.handles[path]; ok {
+		h.inUse++
+		c.lru.MoveToFront(h.element)
+		return h.file, func() { c.release(h) }, nil
+	}
+
+	file, err := openAppend(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(c.handles) >= c.max && !c.evictIdle() {
+		return file, func() { file.Close() }, nil
+	}
+
+	h := &cachedHandle{path: path, file: file, inUse: 1}
+	h.element = c.lru.PushFront(h)
+	c.handles[path] = h
+	if !c.janitor {
+		c.janitor = true
+		go c.closeIdle()
+	}
+	return file, func() { c.release(h) }, nil
+}
+
+func (c *fileHandleCache) release(h *cachedHandle) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h.inUse--
+	h.lastUsed = time.Now()
+}
+
+// evictIdle closes the least recently used handle not in use, it must be
+// called with the lock held
+func (c *fileHandleCache) evictIdle() bool {
+	for e := c.lru.Back(); e != nil; e = e.Prev() {
+		h := e.Value.(*cachedHandle)
+		if h.inUse <= 0 {
+			c.remove(h)
+			return true
+		}
+	}
+	return false
+}
+
+// remove closes the handle and forgets it, it must be called with the lock
+// held
+func (c *fileHandleCache) remove(h *cachedHandle) {
+	if err := h.file.Close(); err != nil {
+		slog.Error("Fail to close upload file", slog.String("path", h.path), slog.Any("Error", err))
+	}
+	c.lru.Remove(h.element)
+	delete(c.handles, h.path)
+}
+
+// close closes the cached handle of path, if any, i.e., when the upload is
+// complete. A handle still in use is closed on its next idle sweep.
+func (c *fileHandleCache) close(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if h, ok := c.handles[path]; ok && h.inUse <= 0 {
+		c.remove(h)
+	}
+}
+
+// closeIdle runs in the background while there are cached handles and closes
+// the ones idle for longer than idleTimeout
+func (c *fileHandleCache) closeIdle() {
+	ticker := time.NewTicker(c.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.mu.Lock()
+		now := time.Now()
+		for e := c.lru.Back(); e != nil; {
+			prev := e.Prev()
+			h := e.Value.(*cachedHandle)
+			if h.inUse <= 0 && now.Sub(h.lastUsed) >= c.idleTimeout {
+				c.remove(h)
+			}
+			e = prev
+		}
+		if len(c.handles) <= 0 {
+			c.janitor = false
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Len returns the number of cached open handles
+func (c *fileHandleCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.handles)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileHandleCache(t *testing.T) {
+	dir := t.TempDir()
+	cache := newFileHandleCache(2, 100*time.Millisecond)
+	first := filepath.Join(dir, "first")
+	second := filepath.Join(dir, "second")
+	third := filepath.Join(dir, "third")
+
+	// the same handle is reused across acquisitions
+	file, release, err := cache.acquire(first)
+	if err != nil {
+		t.Fatalf("Fail to acquire handle. error=%v", err)
+	}
+	release()
+	reused, release, err := cache.acquire(first)
+	if err != nil {
+		t.Fatalf("Fail to acquire handle. error=%v", err)
+	}
+	release()
+	if reused != file {
+		t.Errorf("acquire does not reuse the open handle")
+	}
+
+	// the least recently used idle handle makes room for a new one
+	_, releaseSecond, err := cache.acquire(second)
+	if err != nil {
+		t.Fatalf("Fail to acquire handle. error=%v", err)
+	}
+	_, releaseThird, err := cache.acquire(third)
+	if err != nil {
+		t.Fatalf("Fail to acquire handle. error=%v", err)
+	}
+	if cache.Len() != 2 {
+		t.Errorf("cache does not cap the open handles, expected=2. got=%d", cache.Len())
+	}
+	if _, ok := cache.handles[first]; ok {
+		t.Errorf("cache does not evict the least recently used handle")
+	}
+
+	// handles in use are never evicted, the extra one is not cached
+	uncached, releaseUncached, err := cache.acquire(first)
+	if err != nil {
+		t.Fatalf("Fail to acquire handle. error=%v", err)
+	}
+	if _, err := uncached.Write([]byte("data")); err != nil {
+		t.Errorf("Fail to write to uncached handle. error=%v", err)
+	}
+	releaseUncached()
+	if cache.Len() != 2 {
+		t.Errorf("cache evicts handles in use, expected=2. got=%d", cache.Len())
+	}
+	releaseSecond()
+	releaseThird()
+
+	// idle handles are closed in the background
+	time.Sleep(300 * time.Millisecond)
+	if cache.Len() != 0 {
+		t.Errorf("cache does not close idle handles. got=%d", cache.Len())
+	}
+}
+
+func TestFileHandleCacheClose(t *testing.T) {
+	cache := newFileHandleCache(2, time.Minute)
+	path := filepath.Join(t.TempDir(), "upload")
+
+	_, release, err := cache.acquire(path)
+	if err != nil {
+		t.Fatalf("Fail to acquire handle. error=%v", err)
+	}
+	cache.close(path)
+	if cache.Len() != 1 {
+		t.Errorf("close closes a handle in use")
+	}
+	release()
+	cache.close(path)
+	if cache.Len() != 0 {
+		t.Errorf("close does not close the idle handle")
+	}
+}
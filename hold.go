@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+var (
+	// errHeld is returned when ending or purging an upload under legal hold
+	errHeld = errors.New("upload is under legal hold")
+	// errNotRecorded is returned when a hold change can't be recorded, it is
+	// rolled back
+	errNotRecorded = errors.New("hold change is not recorded")
+)
+
+// onHold reports whether the upload is under legal hold, see hold
+func (f *File) onHold() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.legalHold
+}
+
+// hold puts f under legal hold or releases it for the admin API. An upload
+// under hold is not terminated, expired or purged from the trash until it is
+// released. It returns errFinished once its data is removed and errLocked
+// while the upload is written. The change is recorded with record, e.g., in
+// the audit log, once it is persisted, a change that can't be persisted is
+// not recorded and one that can't be recorded is rolled back, so the log
+// holds every change made and only those.
+func (e *expirer) hold(f *File, held bool, record func() error) error {
+	lock, err := e.locker.TryLock(f.ID.String())
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if f.finished() && f.trashedAt().IsZero() {
+		return errFinished
+	}
+	f.mu.Lock()
+	previous := f.legalHold
+	f.legalHold = held
+	f.mu.Unlock()
+	restore := func() {
+		f.mu.Lock()
+		f.legalHold = previous
+		f.mu.Unlock()
+	}
+	if f.persist {
+		if err := f.saveInfo(); err != nil {
+			restore()
+			return err
+		}
+	}
+	if err := record(); err != nil {
+		restore()
+		if f.persist {
+			if err := f.saveInfo(); err != nil {
+				slog.Error("Fail to roll back unrecorded hold change", slog.String("id", f.ID.String()), slog.Bool("held", held), slog.Any("Error", err))
+			}
+		}
+		return fmt.Errorf("%w: %w", errNotRecorded, err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestLegalHold(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	dir := t.TempDir()
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: dir, AdminToken: "secret", RelativeLocation: true, PersistState: true, AuditLog: auditPath}))
+	defer server.Close()
+	host := server.URL + "/files"
+	adminRequest := func(method, path, body string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Fail to create test data. error=%v", err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to execute %s request. error=%v", method, err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	fileId := createUpload(t, host, 10)
+	if status := adminRequest(http.MethodPost, "/admin/uploads/"+fileId+"/hold", `{"reason": "case 42"}`); status != http.StatusNoContent {
+		t.Fatalf("hold does not return 204. got=%d", status)
+	}
+	if status := adminRequest(http.MethodDelete, "/admin/uploads/"+fileId, ""); status != http.StatusConflict {
+		t.Errorf("DELETE of a held upload does not return 409. got=%d", status)
+	}
+	if status := adminRequest(http.MethodPost, "/admin/uploads/"+fileId+"/expire", ""); status != http.StatusConflict {
+		t.Errorf("expire of a held upload does not return 409. got=%d", status)
+	}
+	info, err := readInfo(filepath.Join(dir, fileId+INFO_EXTENSION))
+	if err != nil {
+		t.Fatalf("Fail to read upload info. error=%v", err)
+	}
+	if !info.LegalHold {
+		t.Errorf("the info of a held upload does not record the hold")
+	}
+
+	if status := adminRequest(http.MethodPost, "/admin/uploads/"+fileId+"/release", ""); status != http.StatusNoContent {
+		t.Fatalf("release does not return 204. got=%d", status)
+	}
+	if status := adminRequest(http.MethodDelete, "/admin/uploads/"+fileId, ""); status != http.StatusNoContent {
+		t.Errorf("DELETE of a released upload does not return 204. got=%d", status)
+	}
+
+	file, err := os.Open(auditPath)
+	if err != nil {
+		t.Fatalf("Fail to open audit log. error=%v", err)
+	}
+	defer file.Close()
+	var entries []auditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Fail to parse audit entry. error=%v", err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 2 || entries[0].Action != AUDIT_HOLD || entries[0].Reason != "case 42" || entries[1].Action != AUDIT_RELEASE || entries[0].ID != fileId {
+		t.Errorf("the audit log does not record the hold changes. got=%+v", entries)
+	}
+}
+
+func TestHeldTrash(t *testing.T) {
+	dir := t.TempDir()
+	locker, err := newLocker(&ServerConfig{})
+	if err != nil {
+		t.Fatalf("Fail to create locker. error=%v", err)
+	}
+	storage := newStorage()
+	e := &expirer{after: time.Minute, trash: time.Hour, dir: dir, storage: storage, locker: locker}
+
+	f := &File{ID: uuid.New(), Size: 5, State: UPLOAD_STATE_COMPLETED, dir: dir}
+	if err := os.WriteFile(f.path(), []byte(content[:5]), 0644); err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+	storage.Put(f.ID.String(), f)
+	if err := e.end(f, UPLOAD_STATE_TERMINATED); err != nil {
+		t.Fatalf("Fail to terminate upload. error=%v", err)
+	}
+	if err := e.hold(f, true, func() error { return nil }); err != nil {
+		t.Fatalf("Fail to hold trashed upload. error=%v", err)
+	}
+	e.sweep(time.Now().Add(2 * time.Hour))
+	if _, err := os.Stat(f.path()); err != nil {
+		t.Errorf("sweep purges a held upload. error=%v", err)
+	}
+	if err := e.hold(f, false, func() error { return nil }); err != nil {
+		t.Fatalf("Fail to release upload. error=%v", err)
+	}
+	e.sweep(time.Now().Add(2 * time.Hour))
+	if _, err := os.Stat(f.path()); !os.IsNotExist(err) {
+		t.Errorf("sweep does not purge a released upload. error=%v", err)
+	}
+}
+
+func TestHoldNotRecorded(t *testing.T) {
+	locker, err := newLocker(&ServerConfig{})
+	if err != nil {
+		t.Fatalf("Fail to create locker. error=%v", err)
+	}
+	e := &expirer{locker: locker}
+	tests := []struct {
+		testName  string
+		file      *File
+		recordErr error
+		recorded  bool
+	}{
+		// the entry is not recorded, the change is rolled back
+		{"audit", &File{ID: uuid.New(), State: UPLOAD_STATE_COMPLETED, dir: t.TempDir()}, errors.New("disk full"), true},
+		{"audit persisted", &File{ID: uuid.New(), State: UPLOAD_STATE_COMPLETED, persist: true, dir: t.TempDir()}, errors.New("disk full"), true},
+		// the change is not persisted, it is not recorded
+		{"persist", &File{ID: uuid.New(), State: UPLOAD_STATE_COMPLETED, persist: true, dir: filepath.Join(t.TempDir(), "missing")}, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			recorded := false
+			record := func() error {
+				recorded = true
+				return test.recordErr
+			}
+			if err := e.hold(test.file, true, record); err == nil {
+				t.Errorf("hold does not fail")
+			}
+			if recorded != test.recorded {
+				t.Errorf("hold does not record the change=%v. got=%v", test.recorded, recorded)
+			}
+			if test.file.onHold() {
+				t.Errorf("hold applies the failed change")
+			}
+			if info, err := readInfo(test.file.infoPath()); err == nil && info.LegalHold {
+				t.Errorf("hold leaves the failed change persisted")
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// HOOK_PRE_CREATE runs before an upload is created, rejecting it fails
+	// the creation
+	HOOK_PRE_CREATE = "pre-create"
+	// HOOK_POST_CREATE runs once an upload is created
+	HOOK_POST_CREATE = "post-create"
+	// HOOK_POST_RECEIVE runs after every PATCH that wrote data
+	HOOK_POST_RECEIVE = "post-receive"
+	// HOOK_POST_FINISH runs once an upload is complete and finalized
+	HOOK_POST_FINISH = "post-finish"
+)
+
+// HookEvent is the payload handed to the hooks, its JSON encoding is the one
+// of tusd so existing hook scripts can be reused
+type HookEvent struct {
+	Upload      HookUpload
+	HTTPRequest HookRequest
+}
+
+type HookUpload struct {
+	ID             string // empty in pre-create
+	Size           int64
+	SizeIsDeferred bool
+	Offset         int64
+	MetaData       map[string]string
+	IsPartial      bool
+	IsFinal        bool
+	PartialUploads []string
+	Storage        map[string]string // the type and path of the data file
+}
+
+type HookRequest struct {
+	Method     string
+	URI        string
+	RemoteAddr string
+	Header     http.Header
+}
+
+// HookResponse is the answer of a hook, only pre-create may reject or change
+// the upload
+type HookResponse struct {
+	RejectUpload   bool
+	HTTPResponse   HookHTTPResponse // sent to the client when the upload is rejected
+	ChangeFileInfo HookFileInfoChanges
+}
+
+type HookHTTPResponse struct {
+	StatusCode int // defaults to 400
+	Header     map[string]string
+	Body       string
+}
+
+type HookFileInfoChanges struct {
+	MetaData map[string]string // replaces the metadata of the upload when not nil
+	Storage  map[string]string // STORAGE_DIR sets the final directory of the upload, over StorageRoutes
+	MaxSize  int64             // the maximum size of the upload when below the one of the server and of its policy, see uploadPolicy
+}
+
+// HookHandler runs the hooks of the upload lifecycle, see HOOK_*
+type HookHandler interface {
+	// InvokeHook runs hook for event, an error is a failure of the hook
+	// itself, not a rejection
+	InvokeHook(ctx context.Context, hook string, event *HookEvent) (*HookResponse, error)
+}
+
+// hooks calls the HookHandler of the server, pre-create blocks the request
+// while the other hooks run in the background like in tusd
+type hooks struct {
+	handler HookHandler
+	timeout time.Duration
+}
+
+// newHooks returns the hooks of the config, nil when none is configured.
+// HooksGRPC takes precedence over HooksDir.
+func newHooks(config *ServerConfig) (*hooks, error) {
+	timeout := config.HookTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	switch {
+	case len(config.HooksGRPC) > 0:
+		handler, err := newGRPCHooks(config.HooksGRPC)
+		if err != nil {
+			return nil, err
+		}
+		return &hooks{handler: handler, timeout: timeout}, nil
+	case len(config.HooksDir) > 0:
+		return &hooks{handler: &execHooks{dir: config.HooksDir}, timeout: timeout}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// run invokes hook and waits for its response
+func (h *hooks) run(ctx context.Context, hook string, event *HookEvent) (*HookResponse, error) {
+	if h == nil {
+		return &HookResponse{}, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	response, err := h.handler.InvokeHook(ctx, hook, event)
+	if err != nil {
+		return nil, fmt.Errorf("Error running %s hook %w", hook, err)
+	}
+	if response == nil {
+		response = &HookResponse{}
+	}
+	return response, nil
+}
+
+// fire invokes hook without waiting, its errors are logged and its response
+// ignored
+func (h *hooks) fire(hook string, event *HookEvent) {
+	if h == nil {
+		return
+	}
+	go func() {
+		if _, err := h.run(context.Background(), hook, event); err != nil {
+			slog.Error("Fail to run hook", slog.String("hook", hook), slog.String("id", event.Upload.ID), slog.Any("Error", err))
+		}
+	}()
+}
+
+// newHookEvent builds the event of upload f for request r, f has no ID yet
+// in pre-create
+func newHookEvent(r *http.Request, f *File) *HookEvent {
+	event := &HookEvent{
+		Upload: HookUpload{
+			Size:     int64(f.Size),
+			Offset:   int64(f.offset()),
+			MetaData: parseMetadata(f.metadata()),
+		},
+		HTTPRequest: HookRequest{
+			Method:     r.Method,
+			URI:        r.RequestURI,
+			RemoteAddr: r.RemoteAddr,
+			Header:     r.Header.Clone(),
+		},
+	}
+	if f.ID != uuid.Nil {
+		event.Upload.ID = f.ID.String()
+		event.Upload.Storage = map[string]string{"Type": "filestore", "Path": f.path()}
+	}
+	return event
+}
+
+// writeHookResponse answers a request rejected by a hook
+func writeHookResponse(w http.ResponseWriter, response HookHTTPResponse) {
+	for k, v := range response.Header {
+		w.Header().Set(k, v)
+	}
+	w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+	status := response.StatusCode
+	if status <= 0 {
+		status = http.StatusBadRequest
+	}
+	w.WriteHeader(status)
+	io.WriteString(w, response.Body)
+}
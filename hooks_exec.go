@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// execHooks runs the executable named after the hook in dir, the layout of
+// the tusd hooks directory. The event is written as JSON on its stdin and
+// TUS_ID, TUS_SIZE and TUS_OFFSET are set in its environment. A non-zero exit
+// code rejects the upload with a 400 whose body is the stdout of the
+// executable. A hook without executable is skipped.
+type execHooks struct {
+	dir string
+}
+
+func (h *execHooks) InvokeHook(ctx context.Context, hook string, event *HookEvent) (*HookResponse, error) {
+	path := filepath.Join(h.dir, hook)
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Dir = h.dir
+	cmd.Env = append(os.Environ(),
+		"TUS_ID="+event.Upload.ID,
+		"TUS_SIZE="+strconv.FormatInt(event.Upload.Size, 10),
+		"TUS_OFFSET="+strconv.FormatInt(event.Upload.Offset, 10),
+	)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && ctx.Err() == nil {
+		return &HookResponse{
+			RejectUpload: true,
+			HTTPResponse: HookHTTPResponse{StatusCode: http.StatusBadRequest, Body: strings.TrimSpace(string(output))},
+		}, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func writeHook(t *testing.T, dir, hook, script string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, hook), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatalf("Fail to write hook. error=%v", err)
+	}
+}
+
+func TestExecHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test hooks are shell scripts")
+	}
+	hooksDir := t.TempDir()
+	// pre-create rejects the uploads named reject.txt
+	writeHook(t, hooksDir, HOOK_PRE_CREATE, `grep -q '"filename":"reject.txt"' && { echo "not allowed"; exit 1; }; exit 0`)
+	writeHook(t, hooksDir, HOOK_POST_FINISH, `cat > event.tmp && mv event.tmp "finished-$TUS_ID-$TUS_OFFSET.json"`)
+
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, HooksDir: hooksDir}))
+	defer server.Close()
+	host := server.URL + "/files"
+
+	create := func(filename string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, host, nil)
+		if err != nil {
+			t.Fatalf("Fail to create test data. Error=%v", err)
+		}
+		req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+		req.Header.Set(HEADER_UPLOAD_METADATA, "filename "+base64.StdEncoding.EncodeToString([]byte(filename)))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to create test data. Error=%v", err)
+		}
+		return res
+	}
+
+	res := create("reject.txt")
+	message, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest || string(message) != "not allowed" {
+		t.Errorf("POST /files does not return the rejection of the hook. got=%v %s", res.StatusCode, message)
+	}
+
+	res = create("a.txt")
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /files does not return %v. got=%v", http.StatusCreated, res.StatusCode)
+	}
+	fileId := filepath.Base(res.Header.Get(HEADER_LOCATION))
+	patchUpload(t, host, fileId, 0, content[:10])
+
+	// post-finish runs in the background
+	path := filepath.Join(hooksDir, "finished-"+fileId+"-10.json")
+	var data []byte
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if data, _ = os.ReadFile(path); len(data) > 0 {
+			break
+		}
+	}
+	var event HookEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatalf("post-finish does not receive the event. error=%v", err)
+	}
+	if event.Upload.ID != fileId || event.Upload.Offset != 10 || event.Upload.MetaData["filename"] != "a.txt" || event.HTTPRequest.Method != http.MethodPatch {
+		t.Errorf("post-finish does not receive the upload. got=%+v", event)
+	}
+}
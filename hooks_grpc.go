@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"resumable-upload/hookpb"
+)
+
+// grpcHooks calls the InvokeHook method of a hook service implementing
+// hookpb/hook.proto. The connection is plaintext, a service mesh is expected
+// to secure it, and it is established lazily so the server starts while the
+// hook service is down.
+type grpcHooks struct {
+	client hookpb.HookHandlerClient
+}
+
+func newGRPCHooks(address string) (*grpcHooks, error) {
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	return &grpcHooks{client: hookpb.NewHookHandlerClient(conn)}, nil
+}
+
+func (h *grpcHooks) InvokeHook(ctx context.Context, hook string, event *HookEvent) (*HookResponse, error) {
+	header := make(map[string]string, len(event.HTTPRequest.Header))
+	for k, v := range event.HTTPRequest.Header {
+		header[k] = strings.Join(v, ",")
+	}
+	request := &hookpb.HookRequest{
+		Type: hook,
+		Event: &hookpb.Event{
+			Upload: &hookpb.FileInfo{
+				Id:             event.Upload.ID,
+				Size:           event.Upload.Size,
+				SizeIsDeferred: event.Upload.SizeIsDeferred,
+				Offset:         event.Upload.Offset,
+				MetaData:       event.Upload.MetaData,
+				IsPartial:      event.Upload.IsPartial,
+				IsFinal:        event.Upload.IsFinal,
+				PartialUploads: event.Upload.PartialUploads,
+				Storage:        event.Upload.Storage,
+			},
+			HttpRequest: &hookpb.HTTPRequest{
+				Method:     event.HTTPRequest.Method,
+				Uri:        event.HTTPRequest.URI,
+				RemoteAddr: event.HTTPRequest.RemoteAddr,
+				Header:     header,
+			},
+		},
+	}
+
+	reply, err := h.client.InvokeHook(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	response := &HookResponse{RejectUpload: reply.GetRejectUpload()}
+	if httpResponse := reply.GetHttpResponse(); httpResponse != nil {
+		response.HTTPResponse = HookHTTPResponse{
+			StatusCode: int(httpResponse.GetStatusCode()),
+			Header:     httpResponse.GetHeaders(),
+			Body:       httpResponse.GetBody(),
+		}
+	}
+	if metadata := reply.GetChangeFileInfo().GetMetaData(); len(metadata) > 0 {
+		response.ChangeFileInfo.MetaData = metadata
+	}
+	if storage := reply.GetChangeFileInfo().GetStorage(); len(storage) > 0 {
+		response.ChangeFileInfo.Storage = storage
+	}
+	return response, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	"resumable-upload/hookpb"
+)
+
+// fakeHookService rejects the uploads named reject.txt and tags the others
+// with an owner, the uploads are moved to dir when set
+type fakeHookService struct {
+	hookpb.UnimplementedHookHandlerServer
+	dir string
+}
+
+func (s *fakeHookService) InvokeHook(ctx context.Context, request *hookpb.HookRequest) (*hookpb.HookResponse, error) {
+	if request.GetType() != HOOK_PRE_CREATE {
+		return &hookpb.HookResponse{}, nil
+	}
+	metadata := request.GetEvent().GetUpload().GetMetaData()
+	if metadata["filename"] == "reject.txt" {
+		return &hookpb.HookResponse{
+			RejectUpload: true,
+			HttpResponse: &hookpb.HTTPResponse{StatusCode: http.StatusForbidden, Body: "not allowed"},
+		}, nil
+	}
+	metadata["owner"] = request.GetEvent().GetHttpRequest().GetHeader()["X-User"]
+	changes := &hookpb.FileInfoChanges{MetaData: metadata}
+	if len(s.dir) > 0 {
+		changes.Storage = map[string]string{STORAGE_DIR: s.dir}
+	}
+	return &hookpb.HookResponse{ChangeFileInfo: changes}, nil
+}
+
+func TestGRPCHooks(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fail to listen. error=%v", err)
+	}
+	service := grpc.NewServer()
+	hookpb.RegisterHookHandlerServer(service, &fakeHookService{})
+	go service.Serve(listener)
+	defer service.Stop()
+
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, HooksGRPC: listener.Addr().String(), RelativeLocation: true}))
+	defer server.Close()
+	host := server.URL + "/files"
+
+	tests := []struct {
+		testName               string
+		filename               string
+		expectedResponseStatus int
+		expectedBody           string
+		expectedMetadata       map[string]string
+	}{
+		{"Should reject the upload refused by the hook", "reject.txt", http.StatusForbidden, "not allowed", nil},
+		{"Should apply the metadata changed by the hook", "a.txt", http.StatusCreated, "", map[string]string{"filename": "a.txt", "owner": "alice"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, host, nil)
+			if err != nil {
+				t.Fatalf("Fail to create test data. Error=%v", err)
+			}
+			req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+			req.Header.Set(HEADER_UPLOAD_METADATA, "filename "+base64.StdEncoding.EncodeToString([]byte(test.filename)))
+			req.Header.Set("X-User", "alice")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to create test data. Error=%v", err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode != test.expectedResponseStatus || string(body) != test.expectedBody {
+				t.Fatalf("POST /files does not return %v %q. got=%v %q", test.expectedResponseStatus, test.expectedBody, res.StatusCode, body)
+			}
+			if test.expectedMetadata == nil {
+				return
+			}
+
+			res, err = http.Head(server.URL + res.Header.Get(HEADER_LOCATION))
+			if err != nil {
+				t.Fatalf("Fail to execute HEAD request. error=%v", err)
+			}
+			res.Body.Close()
+			if metadata := res.Header.Get(HEADER_UPLOAD_METADATA); metadata != encodeMetadata(test.expectedMetadata) {
+				t.Errorf("HEAD does not return the metadata changed by the hook. got=%s", metadata)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const HEADER_IDEMPOTENCY_KEY = "Idempotency-Key"
+
+// idempotencyCache remembers the upload created for every Idempotency-Key
+// for a window so a client retrying a creation whose response it never got
+// is handed the same upload instead of a new one. Keys are not scoped by
+// client address, which changes precisely on the flaky networks retrying
+// clients are on, they are random values generated by the clients. They are
+// scoped by owner though, see scopeIdempotencyKey, and every tenant has its
+// own cache, so a key reused or guessed by another principal never replays
+// the upload of the first one.
+type idempotencyCache struct {
+	mu        sync.Mutex
+	window    time.Duration
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+}
+
+type idempotencyEntry struct {
+	id       string // empty while the creation is in progress
+	length   int
+	metadata string
+	expires  time.Time
+	done     chan struct{} // closed once the creation is completed or cancelled, see end
+	ended    sync.Once
+}
+
+// end closes done, once whatever completes or cancels the entry
+func (e *idempotencyEntry) end() {
+	e.ended.Do(func() { close(e.done) })
+}
+
+// scopeIdempotencyKey returns the key of the cache for the Idempotency-Key key
+// of a creation by owner, the subject of its policy
+func scopeIdempotencyKey(owner, key string) string {
+	return strconv.Itoa(len(owner)) + ":" + owner + ":" + key
+}
+
+// the outcome of reserving a key
+const (
+	idempotencyNew = iota
+	idempotencyExisting
+	idempotencyMismatch
+	idempotencyInProgress
+)
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		window:  window,
+		entries: make(map[string]*idempotencyEntry),
+	}
+}
+
+// reserve looks the key up for a creation of length and metadata. It returns
+// idempotencyNew with the entry it reserved, the caller must then complete or
+// cancel it, idempotencyExisting with the entry of the upload already created
+// for an identical request, or idempotencyInProgress with the entry of the
+// creation in progress.
+func (c *idempotencyCache) reserve(key string, length int, metadata string) (*idempotencyEntry, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.sweep(now)
+	if entry, ok := c.entries[key]; ok && now.Before(entry.expires) {
+		switch {
+		case entry.length != length || entry.metadata != metadata:
+			return nil, idempotencyMismatch
+		case len(entry.id) <= 0:
+			return entry, idempotencyInProgress
+		default:
+			return entry, idempotencyExisting
+		}
+	}
+	entry := &idempotencyEntry{length: length, metadata: metadata, expires: now.Add(c.window), done: make(chan struct{})}
+	c.entries[key] = entry
+	return entry, idempotencyNew
+}
+
+// complete records the upload created for the entry reserved for key. An
+// entry the key was reserved again for since, once the window ran out during
+// the creation, is another request, possibly of another length or metadata,
+// which is not bound to the upload.
+func (c *idempotencyCache) complete(key string, entry *idempotencyEntry, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries[key] == entry {
+		entry.id = id
+	}
+	entry.end()
+}
+
+// cancel forgets the entry reserved for key whose creation failed so it can
+// be retried. An entry the key was reserved again for since, once the window
+// ran out during the creation, is left alone.
+func (c *idempotencyCache) cancel(key string, entry *idempotencyEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries[key] == entry {
+		delete(c.entries, key)
+	}
+	entry.end()
+}
+
+// wait waits for the creation in progress of entry to be completed or
+// cancelled, for at most timeout or until ctx is done. It returns whether it
+// ended, the key is then reserved again to get its upload. The concurrent
+// creations of a retry storm are coalesced this way into the first one.
+func (c *idempotencyCache) wait(ctx context.Context, entry *idempotencyEntry, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-entry.done:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// sweep drops the expired entries at most once a window, it must be called
+// with the lock held
+func (c *idempotencyCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.window {
+		return
+	}
+	c.lastSweep = now
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, IdempotencyWindow: time.Minute}))
+	defer server.Close()
+	host := server.URL + "/files"
+
+	create := func(key string, length int) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, host, nil)
+		if err != nil {
+			t.Fatalf("Fail to create POST request. error=%v", err)
+		}
+		req.Header.Set(HEADER_UPLOAD_LENGTH, strconv.Itoa(length))
+		if len(key) > 0 {
+			req.Header.Set(HEADER_IDEMPOTENCY_KEY, key)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to execute POST request. error=%v", err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	first := create("retry-1", 10)
+	if first.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /files does not return %v. got=%v", http.StatusCreated, first.StatusCode)
+	}
+
+	tests := []struct {
+		testName               string
+		key                    string
+		length                 int
+		expectedResponseStatus int
+		expectSameLocation     bool
+	}{
+		{"Should return the same upload for a retry", "retry-1", 10, http.StatusCreated, true},
+		{"Should reject a reused key with another length", "retry-1", 20, http.StatusUnprocessableEntity, false},
+		{"Should create another upload for another key", "retry-2", 10, http.StatusCreated, false},
+		{"Should create another upload without a key", "", 10, http.StatusCreated, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			res := create(test.key, test.length)
+			if res.StatusCode != test.expectedResponseStatus {
+				t.Errorf("POST /files does not return %v. got=%v", test.expectedResponseStatus, res.StatusCode)
+			}
+			sameLocation := res.Header.Get(HEADER_LOCATION) == first.Header.Get(HEADER_LOCATION)
+			if res.StatusCode == http.StatusCreated && sameLocation != test.expectSameLocation {
+				t.Errorf("POST /files does not return the expected location. got=%v", res.Header.Get(HEADER_LOCATION))
+			}
+		})
+	}
+}
+
+func TestIdempotencyKeyOwner(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, IdempotencyWindow: time.Minute, PolicySecret: "secret"}))
+	defer server.Close()
+	alice, _ := signPolicy("secret", uploadPolicy{Subject: "alice"})
+	bob, _ := signPolicy("secret", uploadPolicy{Subject: "bob"})
+	create := func(policy string) string {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/files", nil)
+		if err != nil {
+			t.Fatalf("Fail to create POST request. error=%v", err)
+		}
+		req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+		req.Header.Set(HEADER_IDEMPOTENCY_KEY, "retry-1")
+		req.Header.Set(HEADER_UPLOAD_POLICY, policy)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to execute POST request. error=%v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusCreated {
+			t.Fatalf("POST /files does not return %v. got=%v", http.StatusCreated, res.StatusCode)
+		}
+		return res.Header.Get(HEADER_LOCATION)
+	}
+
+	first := create(alice)
+	if retry := create(alice); retry != first {
+		t.Errorf("POST /files does not return the upload of the same owner. got=%s", retry)
+	}
+	if other := create(bob); other == first {
+		t.Errorf("POST /files returns the upload of another owner for the same key")
+	}
+}
+
+func TestIdempotencyCache(t *testing.T) {
+	cache := newIdempotencyCache(50 * time.Millisecond)
+
+	entry, outcome := cache.reserve("key", 10, "")
+	if outcome != idempotencyNew {
+		t.Fatalf("reserve does not reserve a new key. got=%v", outcome)
+	}
+	if _, outcome := cache.reserve("key", 10, ""); outcome != idempotencyInProgress {
+		t.Errorf("reserve does not report a creation in progress. got=%v", outcome)
+	}
+	cache.complete("key", entry, "id")
+	if existing, outcome := cache.reserve("key", 10, ""); outcome != idempotencyExisting || existing.id != "id" {
+		t.Errorf("reserve does not return the created upload. got=%v %v", existing, outcome)
+	}
+
+	// a failed creation can be retried
+	failed, _ := cache.reserve("failed", 10, "")
+	cache.cancel("failed", failed)
+	if _, outcome := cache.reserve("failed", 10, ""); outcome != idempotencyNew {
+		t.Errorf("reserve does not reserve a cancelled key. got=%v", outcome)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, outcome := cache.reserve("key", 10, ""); outcome != idempotencyNew {
+		t.Errorf("reserve does not forget a key after the window. got=%v", outcome)
+	}
+}
+
+func TestIdempotencyCacheOutlivedReservation(t *testing.T) {
+	cache := newIdempotencyCache(20 * time.Millisecond)
+	first, _ := cache.reserve("key", 10, "")
+	// the creation outlives the window, a retry reserves the key again
+	time.Sleep(30 * time.Millisecond)
+	second, outcome := cache.reserve("key", 10, "")
+	if outcome != idempotencyNew || second == first {
+		t.Fatalf("reserve does not reserve the key again after the window. got=%v", outcome)
+	}
+
+	cache.complete("key", first, "first")
+	cache.cancel("key", first)
+	cache.cancel("key", second)
+	cache.cancel("key", second)
+	if !cache.wait(context.Background(), second, time.Second) {
+		t.Errorf("wait does not return for the cancelled reservation")
+	}
+}
+
+func TestIdempotencyCacheWindowExpiresDuringCreation(t *testing.T) {
+	cache := newIdempotencyCache(20 * time.Millisecond)
+	first, _ := cache.reserve("key", 10, "")
+	time.Sleep(30 * time.Millisecond)
+	second, _ := cache.reserve("key", 20, "filename YS50eHQ=")
+
+	// the late completion of the first creation does not bind the key
+	cache.complete("key", first, "first")
+	if entry, outcome := cache.reserve("key", 20, "filename YS50eHQ="); outcome != idempotencyInProgress || entry != second {
+		t.Errorf("reserve does not report the second creation in progress. got=%v %v", entry, outcome)
+	}
+	cache.complete("key", second, "second")
+	if entry, outcome := cache.reserve("key", 20, "filename YS50eHQ="); outcome != idempotencyExisting || entry.id != "second" {
+		t.Errorf("reserve does not return the upload of the second creation. got=%v %v", entry, outcome)
+	}
+}
+
+func TestCoalesceCreations(t *testing.T) {
+	cache := newIdempotencyCache(time.Minute)
+	entry, _ := cache.reserve("key", 10, "")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cache.complete("key", entry, "id")
+	}()
+	if !cache.wait(context.Background(), entry, time.Second) {
+		t.Fatalf("wait does not return once the creation is completed")
+	}
+	if existing, outcome := cache.reserve("key", 10, ""); outcome != idempotencyExisting || existing.id != "id" {
+		t.Errorf("reserve does not return the upload waited for. got=%v %v", existing, outcome)
+	}
+
+	slow, _ := cache.reserve("slow", 10, "")
+	if cache.wait(context.Background(), slow, 20*time.Millisecond) {
+		t.Errorf("wait does not time out while the creation is in progress")
+	}
+	cache.cancel("slow", slow)
+	if !cache.wait(context.Background(), slow, time.Second) {
+		t.Errorf("wait does not return for a cancelled creation")
+	}
+
+	// a retry storm gets one upload
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, IdempotencyWindow: time.Minute, CoalesceCreations: 5 * time.Second}))
+	defer server.Close()
+	locations := make(chan string, 8)
+	var wg sync.WaitGroup
+	for range cap(locations) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodPost, server.URL+"/files", nil)
+			if err != nil {
+				t.Errorf("Fail to create POST request. error=%v", err)
+				return
+			}
+			req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+			req.Header.Set(HEADER_IDEMPOTENCY_KEY, "storm")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("Fail to execute POST request. error=%v", err)
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusCreated {
+				t.Errorf("POST /files does not return %v. got=%v", http.StatusCreated, res.StatusCode)
+			}
+			locations <- res.Header.Get(HEADER_LOCATION)
+		}()
+	}
+	wg.Wait()
+	close(locations)
+	first := <-locations
+	for location := range locations {
+		if location != first {
+			t.Errorf("the coalesced creations do not return the same location. got=%s and %s", first, location)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+import "errors"
+
+// the number of chunk writes kept in flight by an io_uring write, each with
+// its own CHUNK_SIZE buffer
+const ioURingQueueDepth = 8
+
+var errIOURingUnsupported = errors.New("io_uring is not supported")
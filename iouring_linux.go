@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// the subset of linux/io_uring.h needed to submit writes
+const (
+	ioringOffSQRing       = 0
+	ioringOffCQRing       = 0x8000000
+	ioringOffSQEs         = 0x10000000
+	ioringFeatSingleMmap  = 1 << 0
+	ioringEnterGetEvents  = 1 << 0
+	ioringOpWrite         = 23
+	ioURingSQESize        = 64
+	ioURingCQESize        = 16
+	ioURingSQArrayEntSize = 4
+)
+
+type ioURingSQRingOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioURingCQRingOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioURingParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  ioURingSQRingOffsets
+	cqOff                                                                  ioURingCQRingOffsets
+}
+
+type ioURingSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+type ioURingCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// ioURing is a minimal io_uring instance used to submit batches of writes
+type ioURing struct {
+	fd      int
+	sqRing  []byte
+	cqRing  []byte
+	sqesMem []byte
+
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray []uint32
+	sqes    []ioURingSQE
+
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   []ioURingCQE
+}
+
+func newIOURing(entries uint32) (*ioURing, error) {
+	var params ioURingParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		// seccomp profiles usually disable io_uring with EPERM or ENOSYS
+		return nil, errors.Join(errIOURingUnsupported, errno)
+	}
+
+	r := &ioURing{fd: int(fd)}
+	sqSize := int(params.sqOff.array + params.sqEntries*ioURingSQArrayEntSize)
+	cqSize := int(params.cqOff.cqes + params.cqEntries*ioURingCQESize)
+	if params.features&ioringFeatSingleMmap != 0 {
+		sqSize = max(sqSize, cqSize)
+	}
+
+	var err error
+	if r.sqRing, err = unix.Mmap(r.fd, ioringOffSQRing, sqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.cqRing = r.sqRing
+	if params.features&ioringFeatSingleMmap == 0 {
+		if r.cqRing, err = unix.Mmap(r.fd, ioringOffCQRing, cqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	if r.sqesMem, err = unix.Mmap(r.fd, ioringOffSQEs, int(params.sqEntries)*ioURingSQESize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.array])), params.sqEntries)
+	r.sqes = unsafe.Slice((*ioURingSQE)(unsafe.Pointer(&r.sqesMem[0])), params.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*ioURingCQE)(unsafe.Pointer(&r.cqRing[params.cqOff.cqes])), params.cqEntries)
+	return r, nil
+}
+
+// queueWrite queues a write of buff at off without submitting it. buff must
+// stay referenced until its completion has been reaped.
+func (r *ioURing) queueWrite(fd int, buff []byte, off int64, userData uint64) {
+	tail := *r.sqTail
+	idx := tail & r.sqMask
+	r.sqes[idx] = ioURingSQE{
+		opcode:   ioringOpWrite,
+		fd:       int32(fd),
+		off:      uint64(off),
+		addr:     uint64(uintptr(unsafe.Pointer(&buff[0]))),
+		len:      uint32(len(buff)),
+		userData: userData,
+	}
+	r.sqArray[idx] = idx
+	// publish the entry to the kernel
+	atomic.StoreUint32(r.sqTail, tail+1)
+}
+
+// submitAndWait submits the queued entries and waits for at least
+// minComplete completions in a single syscall
+func (r *ioURing) submitAndWait(toSubmit, minComplete uint32) error {
+	for {
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), uintptr(minComplete), ioringEnterGetEvents, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
+
+// reap calls fn for every available completion
+func (r *ioURing) reap(fn func(cqe ioURingCQE)) {
+	head := *r.cqHead
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail; head++ {
+		fn(r.cqes[head&r.cqMask])
+	}
+	atomic.StoreUint32(r.cqHead, head)
+}
+
+func (r *ioURing) Close() error {
+	if r.sqesMem != nil {
+		unix.Munmap(r.sqesMem)
+	}
+	if r.cqRing != nil && &r.cqRing[0] != &r.sqRing[0] {
+		unix.Munmap(r.cqRing)
+	}
+	if r.sqRing != nil {
+		unix.Munmap(r.sqRing)
+	}
+	return unix.Close(r.fd)
+}
+
+type ioURingSlot struct {
+	buff []byte
+	off  int64
+	n    int
+	res  int32
+	done bool
+}
+
+// writeIOURing writes body to the file at path starting at offset through
+// io_uring. Chunks are read into a queue of pooled buffers and their writes
+// are submitted in batches of ioURingQueueDepth with a single syscall, while
+// the next chunks are read. Writes may complete out of order so the returned
+// count is the contiguous prefix written from offset, anything written past a
+// failed write is truncated away.
+func writeIOURing(path string, offset int64, body io.Reader) (int64, error) {
+	ring, err := newIOURing(ioURingQueueDepth)
+	if err != nil {
+		return 0, err
+	}
+	defer ring.Close()
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	fd := int(file.Fd())
+
+	var slots [ioURingQueueDepth]ioURingSlot
+	var buffers [ioURingQueueDepth]*[]byte
+	var abandoned bool
+	for i := range slots {
+		buffers[i] = chunkPool.Get().(*[]byte)
+		slots[i].buff = *buffers[i]
+	}
+	defer func() {
+		// the kernel may still read from the buffers of abandoned writes,
+		// they are left to the GC instead of being reused
+		if abandoned {
+			return
+		}
+		for _, buff := range buffers {
+			chunkPool.Put(buff)
+		}
+	}()
+
+	var committed int64
+	var readErr, writeErr error
+	next := offset
+	// slots are used as a queue in submission order: first is the oldest
+	// write not committed yet and inflight the number of writes queued
+	first, inflight, queued := 0, 0, uint32(0)
+
+	for {
+		for readErr == nil && writeErr == nil && inflight < ioURingQueueDepth {
+			slot := &slots[(first+inflight)%ioURingQueueDepth]
+			n, err := io.ReadFull(body, slot.buff)
+			if n > 0 {
+				*slot = ioURingSlot{buff: slot.buff, off: next, n: n}
+				ring.queueWrite(fd, slot.buff[:n], next, uint64((first+inflight)%ioURingQueueDepth))
+				next += int64(n)
+				inflight++
+				queued++
+			}
+			if err != nil {
+				readErr = err
+			}
+		}
+		if inflight <= 0 {
+			break
+		}
+
+		if err := ring.submitAndWait(queued, 1); err != nil {
+			// the kernel may have taken some of the entries, give up on them
+			writeErr = err
+			abandoned = true
+			break
+		}
+		queued = 0
+		ring.reap(func(cqe ioURingCQE) {
+			slot := &slots[cqe.userData]
+			slot.res = cqe.res
+			slot.done = true
+		})
+
+		for inflight > 0 && slots[first].done {
+			slot := &slots[first]
+			switch {
+			case writeErr != nil:
+			case slot.res < 0:
+				writeErr = unix.Errno(-slot.res)
+			case int(slot.res) < slot.n:
+				committed += int64(slot.res)
+				writeErr = io.ErrShortWrite
+			default:
+				committed += int64(slot.n)
+			}
+			slot.done = false
+			first = (first + 1) % ioURingQueueDepth
+			inflight--
+		}
+	}
+
+	if writeErr != nil {
+		// drop whatever landed after the first failed write
+		file.Truncate(offset + committed)
+		return committed, writeErr
+	}
+	return committed, ignoreEOF(readErr)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func skipWithoutIOURing(tb testing.TB) {
+	tb.Helper()
+	ring, err := newIOURing(ioURingQueueDepth)
+	if errors.Is(err, errIOURingUnsupported) {
+		tb.Skipf("io_uring is not available. error=%v", err)
+	}
+	if err != nil {
+		tb.Fatalf("Fail to set up io_uring. error=%v", err)
+	}
+	ring.Close()
+}
+
+func TestIOURingWrite(t *testing.T) {
+	skipWithoutIOURing(t)
+
+	// more chunks than the queue depth, with short ones in between
+	chunks := []int{
+		100,
+		ioURingQueueDepth*CHUNK_SIZE + 17,
+		0,
+		CHUNK_SIZE - 1,
+		3*CHUNK_SIZE + 5,
+	}
+	total := 0
+	for _, c := range chunks {
+		total += c
+	}
+	data := make([]byte, total)
+	rand.Read(data)
+
+	f := &File{ID: uuid.New(), Size: total, ioURing: true}
+	if err := f.create(); err != nil {
+		t.Fatalf("Fail to create file. error=%v", err)
+	}
+
+	offset := 0
+	for _, c := range chunks {
+		if err := f.write(context.Background(), bytes.NewReader(data[offset:offset+c])); err != nil {
+			t.Fatalf("Fail to write chunk of %d bytes at %d. error=%v", c, offset, err)
+		}
+		offset += c
+		if f.Offset != offset {
+			t.Fatalf("write does not set the correct offset, expected=%d. got=%d", offset, f.Offset)
+		}
+	}
+
+	written, err := os.ReadFile(f.path())
+	if err != nil {
+		t.Fatalf("Fail to read file. error=%v", err)
+	}
+	if !bytes.Equal(written, data) {
+		t.Errorf("io_uring write does not write the same bytes, expected %d bytes. got=%d", len(data), len(written))
+	}
+}
+
+func TestIOURingWriteReadError(t *testing.T) {
+	skipWithoutIOURing(t)
+
+	f := &File{ID: uuid.New(), Size: 10 * CHUNK_SIZE, ioURing: true}
+	if err := f.create(); err != nil {
+		t.Fatalf("Fail to create file. error=%v", err)
+	}
+
+	// the bytes read before the error are committed
+	err := f.write(context.Background(), io.MultiReader(io.LimitReader(zeroReader{}, int64(2*CHUNK_SIZE+10)), &failingReader{}))
+	if err == nil {
+		t.Errorf("write does not return the read error")
+	}
+	if f.Offset != 2*CHUNK_SIZE+10 {
+		t.Errorf("write does not commit the bytes read before the error, expected=%d. got=%d", 2*CHUNK_SIZE+10, f.Offset)
+	}
+}
+
+func BenchmarkIOURingWrite(b *testing.B) {
+	skipWithoutIOURing(b)
+
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%dMiB", size/CHUNK_SIZE), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				f := &File{ID: uuid.New(), ioURing: true}
+				if err := f.create(); err != nil {
+					b.Fatalf("Fail to create file. error=%v", err)
+				}
+				if err := f.write(context.Background(), io.LimitReader(zeroReader{}, int64(size))); err != nil {
+					b.Fatalf("Fail to write file. error=%v", err)
+				}
+				os.Remove(f.path())
+			}
+		})
+	}
+}
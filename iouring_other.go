@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "io"
+
+// writeIOURing always reports io_uring as unsupported outside of linux
+func writeIOURing(path string, offset int64, body io.Reader) (int64, error) {
+	return 0, errIOURingUnsupported
+}
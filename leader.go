@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// LEADER_LOCK_ID is the lock of the Locker the leader of the instances
+// sharing it holds, suffixed with the tenant for the tenants. It can't collide
+// with the ids of the uploads.
+const LEADER_LOCK_ID = "leader"
+
+// leaderElection elects the instance running the cluster wide jobs, i.e.,
+// the expiration sweep, among the ones sharing a Locker: the leader is the
+// instance holding LEADER_LOCK_ID. The lock is released when the leader dies,
+// by the kernel for the file locker or with the TTL of the redis locker, and
+// the next instance calling lead takes it over. With the memory locker every
+// instance is its own leader.
+type leaderElection struct {
+	locker Locker
+	id     string
+	lock   Lock // held while leading, only lead touches it
+}
+
+func newLeaderElection(config *ServerConfig, locker Locker) *leaderElection {
+	id := LEADER_LOCK_ID
+	if len(config.tenant) > 0 {
+		id += "-" + config.tenant
+	}
+	return &leaderElection{locker: locker, id: id}
+}
+
+// heldLock is a Lock that may be lost without Unlock, i.e., a redis lock
+// whose key expired
+type heldLock interface {
+	held() bool
+}
+
+// lead reports whether the instance leads, taking the leadership when nobody
+// holds it. It must be called from a single goroutine.
+func (e *leaderElection) lead() bool {
+	if e.lock != nil {
+		if h, ok := e.lock.(heldLock); !ok || h.held() {
+			return true
+		}
+		slog.Warn("Leadership lost")
+		e.lock = nil
+	}
+	lock, err := e.locker.TryLock(e.id)
+	if err != nil {
+		if !errors.Is(err, errLocked) {
+			slog.Error("Fail to run for leader", slog.Any("Error", err))
+		}
+		return false
+	}
+	slog.Info("Elected leader of the cluster wide jobs", slog.String("lock", e.id))
+	e.lock = lock
+	return true
+}
+
+// resign releases the leadership, if held
+func (e *leaderElection) resign() {
+	if e.lock == nil {
+		return
+	}
+	if err := e.lock.Unlock(); err != nil {
+		slog.Error("Fail to release the leadership", slog.Any("Error", err))
+	}
+	e.lock = nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestLeaderElection(t *testing.T) {
+	redis := newFakeRedis(t)
+	fileLocker, err := newFileLocker(t.TempDir())
+	if err != nil {
+		t.Fatalf("Fail to create file locker. error=%v", err)
+	}
+	redisLocker, err := newRedisLocker(redis.listener.Addr().String(), 300*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Fail to create redis locker. error=%v", err)
+	}
+
+	tests := []struct {
+		testName string
+		locker   Locker
+	}{
+		{"file", fileLocker},
+		{"redis", redisLocker},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			a := newLeaderElection(&ServerConfig{}, test.locker)
+			b := newLeaderElection(&ServerConfig{}, test.locker)
+			if !a.lead() || !a.lead() {
+				t.Fatalf("the first instance is not elected")
+			}
+			if b.lead() {
+				t.Errorf("a second instance leads with the first")
+			}
+			tenant := newLeaderElection(&ServerConfig{tenant: "a"}, test.locker)
+			if !tenant.lead() {
+				t.Errorf("a tenant is not elected apart from the server")
+			}
+			tenant.resign()
+
+			a.resign()
+			if !b.lead() {
+				t.Errorf("the second instance does not take over a resigned leader")
+			}
+			b.resign()
+		})
+	}
+}
+
+func TestLeaderElectionLost(t *testing.T) {
+	redis := newFakeRedis(t)
+	locker, err := newRedisLocker(redis.listener.Addr().String(), 150*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Fail to create redis locker. error=%v", err)
+	}
+	e := newLeaderElection(&ServerConfig{}, locker)
+	if !e.lead() {
+		t.Fatalf("the instance is not elected")
+	}
+
+	// the key is taken over, i.e., after the instance was partitioned away
+	redis.mu.Lock()
+	redis.values[redisLockPrefix+LEADER_LOCK_ID] = "other"
+	redis.mu.Unlock()
+	if !waitFor(t, func() bool { return !e.lock.(heldLock).held() }) {
+		t.Fatalf("the lost lock is still held")
+	}
+	if e.lead() {
+		t.Errorf("the instance leads after losing its lock")
+	}
+}
+
+func TestExpirer(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	dir := t.TempDir()
+	config := &ServerConfig{UploadDir: dir, RelativeLocation: true, SharedStorage: true, Locker: LOCKER_FILE, LockDir: t.TempDir()}
+	server := httptest.NewServer(buildServeMux(config))
+	defer server.Close()
+	host := server.URL + "/files"
+
+	partial := createUpload(t, host, 10)
+	patchUpload(t, host, partial, 0, content[:5])
+	complete := createUpload(t, host, 5)
+	patchUpload(t, host, complete, 0, content[:5])
+
+	// another instance of the directory sweeps
+	locker, err := newLocker(config)
+	if err != nil {
+		t.Fatalf("Fail to create file locker. error=%v", err)
+	}
+	storage := newStorage()
+	newFile := func(id uuid.UUID, size int, metadata string) *File {
+		return &File{ID: id, Size: size, Metadata: metadata, persist: true, dir: dir}
+	}
+	e := &expirer{
+		after:    time.Hour,
+		dir:      dir,
+		shared:   true,
+		storage:  storage,
+		lookup:   (&sharedUploads{storage: storage, newFile: newFile}).get,
+		locker:   locker,
+		election: newLeaderElection(config, locker),
+	}
+
+	if expired := e.sweep(time.Now()); expired != 0 {
+		t.Errorf("sweep expires recent uploads. got=%d", expired)
+	}
+	lock, err := locker.TryLock(partial)
+	if err != nil {
+		t.Fatalf("Fail to lock upload. error=%v", err)
+	}
+	if expired := e.sweep(time.Now().Add(2 * time.Hour)); expired != 0 {
+		t.Errorf("sweep expires an upload being written. got=%d", expired)
+	}
+	lock.Unlock()
+	if expired := e.sweep(time.Now().Add(2 * time.Hour)); expired != 1 {
+		t.Errorf("sweep does not expire the incomplete upload only. got=%d", expired)
+	}
+
+	if f := storage.Get(partial); f != nil {
+		t.Errorf("the expired upload is not removed from the storage. got=%v", f)
+	}
+	if _, err := os.Stat(filepath.Join(dir, partial)); !os.IsNotExist(err) {
+		t.Errorf("the data of the expired upload is not removed. error=%v", err)
+	}
+	for id, status := range map[string]int{partial: http.StatusNotFound, complete: http.StatusOK} {
+		res, err := http.Head(host + "/" + id)
+		if err != nil {
+			t.Fatalf("Fail to execute HEAD request. error=%v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Errorf("HEAD of %s does not return %d. got=%d", id, status, res.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// uploadLimiter bounds the number of simultaneously active PATCH streams,
+// both globally and per client. A zero limit means unlimited.
+type uploadLimiter struct {
+	mu           sync.Mutex
+	max          int
+	maxPerClient int
+	active       int
+	perClient    map[string]int
+}
+
+func newUploadLimiter(max, maxPerClient int) *uploadLimiter {
+	return &uploadLimiter{
+		max:          max,
+		maxPerClient: maxPerClient,
+		perClient:    make(map[string]int),
+	}
+}
+
+// acquire reserves an upload slot for the client, it returns false when
+// either the global or the client limit has been reached
+func (l *uploadLimiter) acquire(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.max > 0 && l.active >= l.max {
+		return false
+	}
+	if l.maxPerClient > 0 && l.perClient[client] >= l.maxPerClient {
+		return false
+	}
+	l.active++
+	l.perClient[client]++
+	return true
+}
+
+func (l *uploadLimiter) release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active--
+	l.perClient[client]--
+	if l.perClient[client] <= 0 {
+		delete(l.perClient, client)
+	}
+}
+
+// remaining returns the tightest of the global and the client limits and
+// the uploads the client may still start under it, a zero limit is unlimited
+func (l *uploadLimiter) remaining(client string) (int, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit, remaining := 0, 0
+	if l.max > 0 {
+		limit, remaining = l.max, max(l.max-l.active, 0)
+	}
+	if left := max(l.maxPerClient-l.perClient[client], 0); l.maxPerClient > 0 && (limit <= 0 || left < remaining) {
+		limit, remaining = l.maxPerClient, left
+	}
+	return limit, remaining
+}
+
+// setHeaders sets Retry-After and the X-RateLimit headers on the refusal of
+// a request of client so it backs off until a slot is likely free. The slots
+// free up as the uploads end, the reset is retryAfter seconds.
+func (l *uploadLimiter) setHeaders(w http.ResponseWriter, client string, retryAfter int) {
+	w.Header().Set(HEADER_RETRY_AFTER, strconv.Itoa(retryAfter))
+	if limit, remaining := l.remaining(client); limit > 0 {
+		w.Header().Set(HEADER_RATELIMIT_LIMIT, strconv.Itoa(limit))
+		w.Header().Set(HEADER_RATELIMIT_REMAINING, strconv.Itoa(remaining))
+		w.Header().Set(HEADER_RATELIMIT_RESET, strconv.Itoa(retryAfter))
+	}
+}
+
+// clientAddress identifies the client of the request by its remote IP
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// memoryBudget bounds the total size of the write buffers held by the PATCH
+// streams in flight. A stream waits for its buffers to fit in the budget
+// before reading its body, which applies backpressure to the clients through
+// TCP flow control instead of growing the heap. Waiters are served in order
+// so large requests aren't starved by small ones.
+type memoryBudget struct {
+	mu      sync.Mutex
+	max     int
+	used    int
+	waiters *list.List // of *memoryWaiter
+}
+
+type memoryWaiter struct {
+	n     int
+	ready chan struct{}
+}
+
+func newMemoryBudget(max int) *memoryBudget {
+	return &memoryBudget{max: max, waiters: list.New()}
+}
+
+// acquire reserves n bytes of the budget, waiting until they fit or ctx is
+// done. It returns the number of bytes to release, n is capped to the whole
+// budget so a single request can always proceed.
+func (b *memoryBudget) acquire(ctx context.Context, n int) (int, error) {
+	n = min(n, b.max)
+
+	b.mu.Lock()
+	if b.used+n <= b.max && b.waiters.Len() <= 0 {
+		b.used += n
+		b.mu.Unlock()
+		return n, nil
+	}
+	w := &memoryWaiter{n: n, ready: make(chan struct{})}
+	element := b.waiters.PushBack(w)
+	b.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return n, nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		select {
+		case <-w.ready:
+			// granted in the meantime, give it back
+			b.mu.Unlock()
+			b.release(n)
+		default:
+			b.waiters.Remove(element)
+			// the next waiters may fit now
+			b.notify()
+			b.mu.Unlock()
+		}
+		return 0, ctx.Err()
+	}
+}
+
+func (b *memoryBudget) release(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= n
+	b.notify()
+}
+
+// notify grants the waiters at the front of the queue that fit, it must be
+// called with the lock held
+func (b *memoryBudget) notify() {
+	for e := b.waiters.Front(); e != nil; e = b.waiters.Front() {
+		w := e.Value.(*memoryWaiter)
+		if b.used+w.n > b.max {
+			return
+		}
+		b.used += w.n
+		b.waiters.Remove(e)
+		close(w.ready)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	budget := newMemoryBudget(100)
+	ctx := context.Background()
+
+	first, err := budget.acquire(ctx, 60)
+	if err != nil || first != 60 {
+		t.Fatalf("acquire does not reserve 60 bytes. got=%d error=%v", first, err)
+	}
+
+	// the second request does not fit and waits for the first one
+	granted := make(chan int)
+	go func() {
+		n, err := budget.acquire(ctx, 60)
+		if err != nil {
+			t.Errorf("acquire fails. error=%v", err)
+		}
+		granted <- n
+	}()
+	select {
+	case <-granted:
+		t.Fatalf("acquire does not wait for the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	budget.release(first)
+	select {
+	case n := <-granted:
+		budget.release(n)
+	case <-time.After(time.Second):
+		t.Fatalf("release does not wake the waiting acquire")
+	}
+
+	// larger than the whole budget is capped
+	if n, err := budget.acquire(ctx, 1000); err != nil || n != 100 {
+		t.Errorf("acquire does not cap the reservation to the budget. got=%d error=%v", n, err)
+	} else {
+		budget.release(n)
+	}
+	if budget.used != 0 {
+		t.Errorf("budget is not fully released. used=%d", budget.used)
+	}
+}
+
+func TestMemoryBudgetCancel(t *testing.T) {
+	budget := newMemoryBudget(100)
+	held, _ := budget.acquire(context.Background(), 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := budget.acquire(ctx, 10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire does not return when the context is done. got=%v", err)
+	}
+
+	// the cancelled waiter does not hold the queue
+	budget.release(held)
+	n, err := budget.acquire(context.Background(), 10)
+	if err != nil || n != 10 {
+		t.Errorf("acquire does not succeed after a cancelled waiter. got=%d error=%v", n, err)
+	}
+}
+
+func TestUploadLimiterRemaining(t *testing.T) {
+	tests := []struct {
+		testName          string
+		max               int
+		maxPerClient      int
+		expectedLimit     int
+		expectedRemaining int
+	}{
+		{"Should report the global limit", 3, 0, 3, 1},
+		{"Should report the client limit", 0, 2, 2, 1},
+		{"Should report the tightest limit", 4, 2, 2, 1},
+		{"Should report no limit", 0, 0, 0, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			l := newUploadLimiter(test.max, test.maxPerClient)
+			l.acquire("a")
+			l.acquire("b")
+			limit, remaining := l.remaining("a")
+			if limit != test.expectedLimit || remaining != test.expectedRemaining {
+				t.Errorf("remaining does not return %d, %d. got=%d, %d", test.expectedLimit, test.expectedRemaining, limit, remaining)
+			}
+		})
+	}
+}
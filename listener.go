@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errConnectionRefused is returned by the first read of a queued connection
+// that got no slot, it was answered with a 503
+var errConnectionRefused = errors.New("connection refused, no free slot")
+
+const (
+	// CONNECTION_OVERFLOW_QUEUE keeps an accepted connection waiting for a free
+	// slot up to the configured queue timeout before refusing it
+	CONNECTION_OVERFLOW_QUEUE = "queue"
+	// CONNECTION_OVERFLOW_REFUSE refuses the connection right away when all
+	// slots are taken
+	CONNECTION_OVERFLOW_REFUSE = "refuse"
+
+	// the response written to a refused connection before closing it, so
+	// clients see a proper 503 instead of a reset connection
+	refusedConnectionResponse = "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+	refusedConnectionTimeout  = 1 * time.Second
+	// the connections refused at once, the ones beyond are closed without a
+	// response so a flood of them does not pile up goroutines
+	maxRefusingConnections = 64
+
+	LISTENER_NETWORK_TCP  = "tcp"
+	LISTENER_NETWORK_UNIX = "unix"
+)
+
+// ListenerConfig describes one of the addresses the server listens on. All
+// the listeners serve the same handler.
+type ListenerConfig struct {
+	Network     string // tcp or unix, defaults to tcp
+	Address     string // host:port for tcp, the socket path for unix
+	TLSCertFile string // serve HTTPS when both the certificate and the key are set
+	TLSKeyFile  string
+}
+
+func (c ListenerConfig) String() string {
+	scheme := "http"
+	if c.tls() {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s+%s://%s", scheme, c.network(), c.Address)
+}
+
+func (c ListenerConfig) network() string {
+	if len(c.Network) <= 0 {
+		return LISTENER_NETWORK_TCP
+	}
+	return c.Network
+}
+
+func (c ListenerConfig) tls() bool {
+	return len(c.TLSCertFile) > 0 && len(c.TLSKeyFile) > 0
+}
+
+// listen opens the listener described by the config, wrapping it in TLS when
+// a certificate is configured
+func listen(c ListenerConfig) (net.Listener, error) {
+	if c.network() == LISTENER_NETWORK_UNIX {
+		// remove the stale socket left by a previous unclean shutdown
+		if err := os.Remove(c.Address); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen(c.network(), c.Address)
+	if err != nil {
+		return nil, err
+	}
+	if !c.tls() {
+		return listener, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return tls.NewListener(listener, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}), nil
+}
+
+// limitListener is a net.Listener that accepts at most cap(sem) simultaneous
+// connections, similar to golang.org/x/net/netutil.LimitListener. The
+// semaphore may be shared by several listeners to apply a single limit
+// across all of them. Unlike netutil it does not leave the overflowing
+// connections waiting in the kernel backlog forever, they are either queued
+// briefly or refused. A queued connection waits for its slot on its first
+// read, see limitListenerConn, so Accept goes on with the connections behind
+// it, e.g., on a slot freed in the meantime. At most cap(queue) connections
+// wait at once, the ones beyond are refused, so the waiting connections
+// don't exhaust the file descriptors either. The queue may be shared like
+// the semaphore.
+type limitListener struct {
+	net.Listener
+	sem          chan struct{}
+	queue        chan struct{}
+	overflow     string
+	queueTimeout time.Duration
+	refusing     chan struct{} // the slots of the connections being refused, see refuse
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+func newLimitListener(l net.Listener, sem, queue chan struct{}, overflow string, queueTimeout time.Duration) *limitListener {
+	if overflow != CONNECTION_OVERFLOW_REFUSE {
+		overflow = CONNECTION_OVERFLOW_QUEUE
+	}
+	return &limitListener{
+		Listener:     l,
+		sem:          sem,
+		queue:        queue,
+		overflow:     overflow,
+		queueTimeout: queueTimeout,
+		refusing:     make(chan struct{}, maxRefusingConnections),
+		done:         make(chan struct{}),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		limited := &limitListenerConn{Conn: conn, listener: l, closed: make(chan struct{})}
+		select {
+		case l.sem <- struct{}{}:
+			limited.held.Store(true)
+			return limited, nil
+		default:
+		}
+		if l.overflow == CONNECTION_OVERFLOW_QUEUE && l.queueTimeout > 0 {
+			select {
+			case l.queue <- struct{}{}:
+				limited.waiting.Store(true)
+				return limited, nil
+			default:
+			}
+		}
+		l.refuse(conn)
+	}
+}
+
+// wait waits at most queueTimeout for a free slot, or until closed is
+// closed, and reports whether it got one
+func (l *limitListener) wait(closed chan struct{}) bool {
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-l.done:
+	case <-closed:
+	}
+	return false
+}
+
+func (l *limitListener) release() {
+	<-l.sem
+}
+
+// refuse answers the connection with a 503 and closes it in the background,
+// or closes it right away when maxRefusingConnections are being refused
+// already
+func (l *limitListener) refuse(conn net.Conn) {
+	select {
+	case l.refusing <- struct{}{}:
+	default:
+		conn.Close()
+		return
+	}
+	go func() {
+		defer func() { <-l.refusing }()
+		defer conn.Close()
+		answerRefused(conn)
+	}()
+}
+
+// answerRefused answers the connection with a 503. The response is written
+// once the request has arrived, clients treat a response received before
+// their request as an error instead of as its response.
+func answerRefused(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(refusedConnectionTimeout))
+	conn.Read(make([]byte, 4096))
+	conn.Write([]byte(refusedConnectionResponse))
+}
+
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+// limitListenerConn is a connection accepted by limitListener, holding a
+// slot until it is closed. A queued connection waits for its slot on its
+// first read, the server reads the request first, and is answered with a 503
+// when it gets none.
+type limitListenerConn struct {
+	net.Conn
+	listener  *limitListener
+	held      atomic.Bool // the connection holds a slot
+	waiting   atomic.Bool // the connection holds a place in the queue until it gets a slot or gives up
+	queued    sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *limitListenerConn) Read(b []byte) (int, error) {
+	c.queued.Do(func() {
+		if c.held.Load() {
+			return
+		}
+		held := c.listener.wait(c.closed)
+		c.leaveQueue()
+		if !held {
+			return
+		}
+		c.held.Store(true)
+		// the slot is released here when Close ran during the wait
+		select {
+		case <-c.closed:
+			if c.held.Swap(false) {
+				c.listener.release()
+			}
+		default:
+		}
+	})
+	if !c.held.Load() {
+		c.closeOnce.Do(func() {
+			close(c.closed)
+			answerRefused(c.Conn)
+		})
+		return 0, errConnectionRefused
+	}
+	return c.Conn.Read(b)
+}
+
+// leaveQueue gives back the place of the connection in the queue
+func (c *limitListenerConn) leaveQueue() {
+	if c.waiting.Swap(false) {
+		<-c.listener.queue
+	}
+}
+
+func (c *limitListenerConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	err := c.Conn.Close()
+	c.leaveQueue()
+	if c.held.Swap(false) {
+		c.listener.release()
+	}
+	return err
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for localhost and
+// returns the paths to the certificate and key files
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Fail to generate key. error=%v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Fail to create certificate. error=%v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Fail to marshal key. error=%v", err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Fail to write certificate. error=%v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("Fail to write key. error=%v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestMultipleListeners(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir)
+	socket := filepath.Join(dir, "upload.sock")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /fast", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	server := NewServer(&ServerConfig{
+		ShutdownTimeoutSeconds: 1,
+		Listeners: []ListenerConfig{
+			{Network: LISTENER_NETWORK_TCP, Address: "localhost:9093"},
+			{Network: LISTENER_NETWORK_TCP, Address: "localhost:9094", TLSCertFile: certFile, TLSKeyFile: keyFile},
+			{Network: LISTENER_NETWORK_UNIX, Address: socket},
+		},
+	}, mux)
+	go func() {
+		if err := server.Start(); err != nil {
+			t.Errorf("Fail to start server. error=%v", err)
+		}
+	}()
+	defer server.Shutdown()
+
+	// wait for the server to be ready
+	time.Sleep(100 * time.Millisecond)
+
+	tests := []struct {
+		testName string
+		url      string
+		client   *http.Client
+	}{
+		{
+			testName: "Should serve plain HTTP",
+			url:      "http://localhost:9093/fast",
+			client:   http.DefaultClient,
+		},
+		{
+			testName: "Should serve HTTPS",
+			url:      "https://localhost:9094/fast",
+			client: &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}},
+		},
+		{
+			testName: "Should serve on a unix socket",
+			url:      "http://unix/fast",
+			client: &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			res, err := tt.client.Get(tt.url)
+			if err != nil {
+				t.Fatalf("Fail to execute request. error=%v", err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("GET %s does not return %v. got=%v", tt.url, http.StatusOK, res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestListenerConfigString(t *testing.T) {
+	tests := []struct {
+		config   ListenerConfig
+		expected string
+	}{
+		{ListenerConfig{Address: ":8080"}, "http+tcp://:8080"},
+		{ListenerConfig{Address: ":443", TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"}, "https+tcp://:443"},
+		{ListenerConfig{Network: LISTENER_NETWORK_UNIX, Address: "/run/upload.sock"}, "http+unix:///run/upload.sock"},
+	}
+
+	for _, tt := range tests {
+		if got := fmt.Sprint(tt.config); got != tt.expected {
+			t.Errorf("ListenerConfig.String() is not correct, expected=%s. got=%s", tt.expected, got)
+		}
+	}
+}
+
+func TestLimitListenerQueue(t *testing.T) {
+	inner, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Fail to listen. error=%v", err)
+	}
+	queue := make(chan struct{}, 1)
+	listener := newLimitListener(inner, make(chan struct{}, 1), queue, CONNECTION_OVERFLOW_QUEUE, 2*time.Second)
+	defer listener.Close()
+	accept := func() net.Conn {
+		t.Helper()
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, _ := listener.Accept()
+			accepted <- conn
+		}()
+		select {
+		case conn := <-accepted:
+			return conn
+		case <-time.After(time.Second):
+			t.Fatalf("Accept blocks on a connection waiting for a slot")
+			return nil
+		}
+	}
+	dial := func() net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatalf("Fail to open connection. error=%v", err)
+		}
+		return conn
+	}
+
+	first := dial()
+	defer first.Close()
+	held := accept()
+	// the queued connections don't keep the ones behind them from being
+	// accepted
+	second, third := dial(), dial()
+	defer second.Close()
+	defer third.Close()
+	queued := accept()
+
+	// the connections beyond the queue are refused
+	go listener.Accept()
+	third.SetDeadline(time.Now().Add(time.Second))
+	third.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	if data, _ := io.ReadAll(third); !strings.Contains(string(data), "503") {
+		t.Errorf("a connection beyond the queue is not refused. got=%s", data)
+	}
+
+	second.Write([]byte("ping"))
+	read := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 4)
+		n, _ := queued.Read(buf)
+		read <- string(buf[:n])
+	}()
+	time.Sleep(100 * time.Millisecond)
+	held.Close()
+	select {
+	case got := <-read:
+		if got != "ping" {
+			t.Errorf("the queued connection does not read its data once a slot is free. got=%s", got)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the queued connection does not get the released slot")
+	}
+	if len(queue) != 0 {
+		t.Errorf("the queued connection does not leave the queue once it gets a slot. got=%d", len(queue))
+	}
+	queued.Close()
+}
+
+func TestLimitListenerRefusing(t *testing.T) {
+	inner, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Fail to listen. error=%v", err)
+	}
+	listener := newLimitListener(inner, make(chan struct{}, 1), make(chan struct{}, 1), CONNECTION_OVERFLOW_REFUSE, 0)
+	defer listener.Close()
+	for range maxRefusingConnections {
+		listener.refusing <- struct{}{}
+	}
+
+	// beyond maxRefusingConnections the connection is closed without a 503
+	client, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("Fail to open connection. error=%v", err)
+	}
+	defer client.Close()
+	conn, err := inner.Accept()
+	if err != nil {
+		t.Fatalf("Fail to accept connection. error=%v", err)
+	}
+	listener.refuse(conn)
+	client.SetDeadline(time.Now().Add(time.Second))
+	client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	if data, _ := io.ReadAll(client); len(data) > 0 {
+		t.Errorf("a connection beyond the refusal cap is answered. got=%s", data)
+	}
+}
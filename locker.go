@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// LOCKER_MEMORY locks the uploads within the process
+	LOCKER_MEMORY = "memory"
+	// LOCKER_FILE locks the uploads with flock on lock files, for instances
+	// on the same host or sharing a filesystem with working flock
+	LOCKER_FILE = "file"
+	// LOCKER_LOCKFILE locks the uploads by creating lock files exclusively,
+	// for instances sharing a network filesystem without working flock,
+	// i.e., NFS or SMB
+	LOCKER_LOCKFILE = "lockfile"
+	// LOCKER_REDIS locks the uploads with expiring keys in redis, for
+	// instances on different hosts
+	LOCKER_REDIS = "redis"
+)
+
+// errLocked is returned by TryLock when another writer holds the lock
+var errLocked = errors.New("upload is locked")
+
+// Locker hands out the exclusive write locks of the uploads. A PATCH holds
+// the lock of its upload while it writes so two writers, in the same process
+// or in different instances sharing the upload store, never append to the
+// same upload at once.
+type Locker interface {
+	// TryLock takes the lock of the upload id without waiting, it returns
+	// errLocked when the lock is held elsewhere
+	TryLock(id string) (Lock, error)
+}
+
+type Lock interface {
+	Unlock() error
+}
+
+// newLocker returns the Locker of the given kind, defaulting to memory or to
+// lockfile on a NetworkFS
+func newLocker(config *ServerConfig) (Locker, error) {
+	dir := config.LockDir
+	if len(dir) <= 0 && len(config.UploadDir) > 0 {
+		dir = filepath.Join(config.UploadDir, ".locks")
+	} else if len(dir) <= 0 {
+		dir = filepath.Join(uploadDir, ".locks")
+	}
+	kind := config.Locker
+	if len(kind) <= 0 && config.NetworkFS {
+		kind = LOCKER_LOCKFILE
+	}
+	switch kind {
+	case LOCKER_FILE:
+		return newFileLocker(dir)
+	case LOCKER_LOCKFILE:
+		return newLockFileLocker(dir, config.LockTTL)
+	case LOCKER_REDIS:
+		return newRedisLocker(config.RedisAddress, config.LockTTL)
+	default:
+		return newMemoryLocker(), nil
+	}
+}
+
+// memoryLocker is the Locker of a single instance
+type memoryLocker struct {
+	mu     sync.Mutex
+	locked map[string]struct{}
+}
+
+func newMemoryLocker() *memoryLocker {
+	return &memoryLocker{locked: make(map[string]struct{})}
+}
+
+func (l *memoryLocker) TryLock(id string) (Lock, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.locked[id]; ok {
+		return nil, errLocked
+	}
+	l.locked[id] = struct{}{}
+	return &memoryLock{locker: l, id: id}, nil
+}
+
+type memoryLock struct {
+	locker *memoryLocker
+	id     string
+}
+
+func (l *memoryLock) Unlock() error {
+	l.locker.mu.Lock()
+	defer l.locker.mu.Unlock()
+
+	delete(l.locker.locked, l.id)
+	return nil
+}
+
+// fileLocker locks an upload with an exclusive flock on <dir>/<id>.lock. The
+// lock is released by the kernel when the process dies, the lock files are
+// left in place since removing them would race with the next writer.
+type fileLocker struct {
+	dir string
+}
+
+func newFileLocker(dir string) (*fileLocker, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileLocker{dir: dir}, nil
+}
+
+func (l *fileLocker) TryLock(id string) (Lock, error) {
+	file, err := os.OpenFile(filepath.Join(l.dir, id+".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := tryFlock(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &fileLock{file: file}, nil
+}
+
+type fileLock struct {
+	file *os.File
+}
+
+func (l *fileLock) Unlock() error {
+	// closing the last descriptor releases the flock
+	return l.file.Close()
+}
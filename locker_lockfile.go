@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lockFileLocker locks an upload by creating <dir>/<id>.lock exclusively,
+// which NFS and SMB do atomically unlike flock. The lock file holds the
+// random token of its owner, who refreshes its mtime while the lock is held,
+// a lock file not refreshed for the TTL was left by a crashed instance and is
+// taken over.
+type lockFileLocker struct {
+	dir string
+	ttl time.Duration
+}
+
+func newLockFileLocker(dir string, ttl time.Duration) (*lockFileLocker, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	return &lockFileLocker{dir: dir, ttl: ttl}, nil
+}
+
+func (l *lockFileLocker) TryLock(id string) (Lock, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	lock := &lockFile{
+		locker: l,
+		path:   filepath.Join(l.dir, id+".lock"),
+		token:  []byte(hex.EncodeToString(token)),
+		done:   make(chan struct{}),
+	}
+
+	err := lock.create()
+	if errors.Is(err, fs.ErrExist) && l.takeOver(lock.path, string(lock.token)) {
+		err = lock.create()
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return nil, errLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	go lock.refresh()
+	return lock, nil
+}
+
+// takeOver removes the lock file at path when it is stale, it returns
+// whether it did. The lock file is renamed away first, then put back when it
+// turns out to be fresh, i.e., another instance took it over in between.
+func (l *lockFileLocker) takeOver(path, token string) bool {
+	if !l.stale(path) {
+		return false
+	}
+	stale := path + "." + token
+	if err := os.Rename(path, stale); err != nil {
+		return errors.Is(err, fs.ErrNotExist)
+	}
+	if !l.stale(stale) {
+		moveNoClobber(stale, path)
+		return false
+	}
+	slog.Warn("Take over stale upload lock", slog.String("path", path))
+	os.Remove(stale)
+	return true
+}
+
+// stale reports whether the lock file at path was not refreshed for the TTL
+func (l *lockFileLocker) stale(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && time.Since(stat.ModTime()) > l.ttl
+}
+
+type lockFile struct {
+	locker   *lockFileLocker
+	path     string
+	token    []byte
+	done     chan struct{}
+	doneOnce sync.Once
+	lost     atomic.Bool // the lock file was taken over since
+}
+
+// create creates the lock file holding the token, failing with fs.ErrExist
+// when it exists
+func (l *lockFile) create() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(l.token)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(l.path)
+	}
+	return err
+}
+
+// owned reports whether the lock file still holds the token
+func (l *lockFile) owned() bool {
+	data, err := os.ReadFile(l.path)
+	return err == nil && bytes.Equal(data, l.token)
+}
+
+// refresh touches the lock file every third of the TTL until Unlock
+func (l *lockFile) refresh() {
+	ticker := time.NewTicker(l.locker.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			if !l.owned() {
+				slog.Error("Upload lock lost", slog.String("path", l.path))
+				l.lost.Store(true)
+				return
+			}
+			now := time.Now()
+			if err := os.Chtimes(l.path, now, now); err != nil {
+				slog.Error("Fail to refresh upload lock", slog.String("path", l.path), slog.Any("Error", err))
+			}
+		}
+	}
+}
+
+func (l *lockFile) held() bool {
+	return !l.lost.Load()
+}
+
+func (l *lockFile) Unlock() error {
+	l.doneOnce.Do(func() { close(l.done) })
+	if !l.owned() {
+		return nil
+	}
+	return os.Remove(l.path)
+}
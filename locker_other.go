@@ -0,0 +1,13 @@
+//go:build !unix && !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// tryFlock reports file locks as unsupported where there is no flock
+func tryFlock(file *os.File) error {
+	return errors.New("file locks are not supported on this platform")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	redisLockPrefix = "tus:lock:"
+
+	// the lock is only released or refreshed by its owner, identified by
+	// the random token stored as the value of the key
+	redisUnlockScript  = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+	redisRefreshScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+)
+
+// redisLocker locks an upload with SET NX on an expiring key so a crashed
+// instance can't hold a lock forever. The key is refreshed while the lock is
+// held, a writer stalled for longer than the TTL loses its lock.
+type redisLocker struct {
+	client *redisClient
+	ttl    time.Duration
+}
+
+func newRedisLocker(address string, ttl time.Duration) (*redisLocker, error) {
+	if len(address) <= 0 {
+		return nil, errors.New("the redis locker needs RedisAddress")
+	}
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	return &redisLocker{client: &redisClient{address: address}, ttl: ttl}, nil
+}
+
+func (l *redisLocker) TryLock(id string) (Lock, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	lock := &redisLock{
+		locker: l,
+		key:    redisLockPrefix + id,
+		token:  hex.EncodeToString(token),
+		done:   make(chan struct{}),
+	}
+
+	reply, err := l.client.do("SET", lock.key, lock.token, "NX", "PX", strconv.FormatInt(l.ttl.Milliseconds(), 10))
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, errLocked
+	}
+	go lock.refresh()
+	return lock, nil
+}
+
+type redisLock struct {
+	locker   *redisLocker
+	key      string
+	token    string
+	done     chan struct{}
+	doneOnce sync.Once
+	lost     atomic.Bool // the key expired or was taken over since
+}
+
+// refresh extends the TTL of the key every third of it until Unlock
+func (l *redisLock) refresh() {
+	ticker := time.NewTicker(l.locker.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			reply, err := l.locker.client.do("EVAL", redisRefreshScript, "1", l.key, l.token, strconv.FormatInt(l.locker.ttl.Milliseconds(), 10))
+			if err != nil {
+				slog.Error("Fail to refresh upload lock", slog.String("key", l.key), slog.Any("Error", err))
+				continue
+			}
+			if reply != int64(1) {
+				slog.Error("Upload lock lost", slog.String("key", l.key))
+				l.lost.Store(true)
+				return
+			}
+		}
+	}
+}
+
+func (l *redisLock) held() bool {
+	return !l.lost.Load()
+}
+
+func (l *redisLock) Unlock() error {
+	l.doneOnce.Do(func() { close(l.done) })
+	_, err := l.locker.client.do("EVAL", redisUnlockScript, "1", l.key, l.token)
+	return err
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves the subset of redis the redis locker, the redis state
+// store and the progress broadcasting use
+type fakeRedis struct {
+	listener  net.Listener
+	mu        sync.Mutex
+	values    map[string]string
+	expires   map[string]time.Time
+	published [][2]string // the channel and the message of every PUBLISH
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fail to listen. error=%v", err)
+	}
+	r := &fakeRedis{listener: listener, values: map[string]string{}, expires: map[string]time.Time{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		request, err := readRESP(reader)
+		if err != nil {
+			return
+		}
+		args := make([]string, 0)
+		for _, arg := range request.([]any) {
+			args = append(args, arg.(string))
+		}
+		conn.Write([]byte(r.handle(args)))
+	}
+}
+
+func (r *fakeRedis) handle(args []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := ""
+	switch args[0] {
+	case "SET":
+		key = args[1]
+	case "EVAL":
+		key = args[3]
+	}
+	if expire, ok := r.expires[key]; ok && time.Now().After(expire) {
+		delete(r.values, key)
+		delete(r.expires, key)
+	}
+
+	switch {
+	case args[0] == "GET":
+		value, ok := r.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case args[0] == "DEL":
+		delete(r.values, args[1])
+		return ":1\r\n"
+	case args[0] == "SET" && len(args) == 3:
+		r.values[key] = args[2]
+		return "+OK\r\n"
+	case args[0] == "PUBLISH":
+		r.published = append(r.published, [2]string{args[1], args[2]})
+		return ":0\r\n"
+	case args[0] == "SET":
+		if _, ok := r.values[key]; ok {
+			return "$-1\r\n"
+		}
+		ttl, _ := time.ParseDuration(args[5] + "ms")
+		r.values[key] = args[2]
+		r.expires[key] = time.Now().Add(ttl)
+		return "+OK\r\n"
+	case args[0] == "EVAL" && r.values[key] != args[4]:
+		return ":0\r\n"
+	case args[0] == "EVAL" && args[1] == redisUnlockScript:
+		delete(r.values, key)
+		delete(r.expires, key)
+		return ":1\r\n"
+	case args[0] == "EVAL" && args[1] == redisRefreshScript:
+		ttl, _ := time.ParseDuration(args[5] + "ms")
+		r.expires[key] = time.Now().Add(ttl)
+		return ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestLocker(t *testing.T) {
+	redis := newFakeRedis(t)
+	fileLocker, err := newFileLocker(t.TempDir())
+	if err != nil {
+		t.Fatalf("Fail to create file locker. error=%v", err)
+	}
+	redisLocker, err := newRedisLocker(redis.listener.Addr().String(), 300*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Fail to create redis locker. error=%v", err)
+	}
+	lockFileLocker, err := newLockFileLocker(t.TempDir(), 300*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Fail to create lockfile locker. error=%v", err)
+	}
+
+	tests := []struct {
+		testName string
+		locker   Locker
+	}{
+		{"memory", newMemoryLocker()},
+		{"file", fileLocker},
+		{"redis", redisLocker},
+		{"lockfile", lockFileLocker},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			lock, err := test.locker.TryLock("upload")
+			if err != nil {
+				t.Fatalf("TryLock does not take a free lock. error=%v", err)
+			}
+			if _, err := test.locker.TryLock("upload"); !errors.Is(err, errLocked) {
+				t.Errorf("TryLock does not return errLocked for a held lock. got=%v", err)
+			}
+			other, err := test.locker.TryLock("other")
+			if err != nil {
+				t.Errorf("TryLock does not take the lock of another upload. error=%v", err)
+			} else {
+				other.Unlock()
+			}
+
+			if err := lock.Unlock(); err != nil {
+				t.Errorf("Unlock fails. error=%v", err)
+			}
+			lock, err = test.locker.TryLock("upload")
+			if err != nil {
+				t.Fatalf("TryLock does not take a released lock. error=%v", err)
+			}
+			lock.Unlock()
+		})
+	}
+}
+
+func TestRedisLockRefresh(t *testing.T) {
+	redis := newFakeRedis(t)
+	locker, err := newRedisLocker(redis.listener.Addr().String(), 150*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Fail to create redis locker. error=%v", err)
+	}
+
+	lock, err := locker.TryLock("upload")
+	if err != nil {
+		t.Fatalf("TryLock does not take a free lock. error=%v", err)
+	}
+	defer lock.Unlock()
+
+	// held past its TTL the key is kept alive by the refresh
+	time.Sleep(400 * time.Millisecond)
+	if _, err := locker.TryLock("upload"); !errors.Is(err, errLocked) {
+		t.Errorf("the lock expires while held. got=%v", err)
+	}
+}
+
+func TestLockFileLocker(t *testing.T) {
+	dir := t.TempDir()
+	locker, err := newLockFileLocker(dir, 150*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Fail to create lockfile locker. error=%v", err)
+	}
+
+	lock, err := locker.TryLock("upload")
+	if err != nil {
+		t.Fatalf("TryLock does not take a free lock. error=%v", err)
+	}
+	// held past its TTL the lock file is kept fresh by the refresh
+	time.Sleep(400 * time.Millisecond)
+	if _, err := locker.TryLock("upload"); !errors.Is(err, errLocked) {
+		t.Errorf("the lock expires while held. got=%v", err)
+	}
+	lock.Unlock()
+
+	// the lock file left by a crashed instance is taken over once stale
+	path := filepath.Join(dir, "crashed.lock")
+	if err := os.WriteFile(path, []byte("token"), 0644); err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+	if _, err := locker.TryLock("crashed"); !errors.Is(err, errLocked) {
+		t.Errorf("TryLock takes a fresh lock file over. got=%v", err)
+	}
+	old := time.Now().Add(-time.Second)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+	lock, err = locker.TryLock("crashed")
+	if err != nil {
+		t.Fatalf("TryLock does not take a stale lock file over. error=%v", err)
+	}
+	defer lock.Unlock()
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("the stale lock file is left behind. got=%v", entries)
+	}
+}
+
+func TestFileLockerAcrossPatches(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, Locker: LOCKER_FILE, LockDir: t.TempDir()}))
+	defer server.Close()
+	host := server.URL + "/files"
+
+	// the lock of the first PATCH is released for the next one
+	fileId := createUpload(t, host, 10)
+	patchUpload(t, host, fileId, 0, content[:5])
+	patchUpload(t, host, fileId, 5, content[5:10])
+}
@@ -4,16 +4,21 @@ package main
 // use tus.io protocol
 
 import (
-	"bufio"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
+	"maps"
+	"mime"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -35,39 +40,72 @@ const (
 	CONTENT_TYPE_OFFSET_OCTET_STREAM     = "application/offset+octet-stream"
 
 	//	headers
-	HEADER_TUS_RESUMABLE   = "Tus-Resumable"
-	HEADER_TUS_VERSION     = "Tus-Version"
-	HEADER_TUS_EXTENSION   = "Tus-Extension"
-	HEADER_TUS_MAX_SIZE    = "Tus-Max-Size"
-	HEADER_LOCATION        = "Location"
-	HEADER_UPLOAD_LENGTH   = "Upload-Length"
-	HEADER_UPLOAD_OFFSET   = "Upload-Offset"
-	HEADER_CONTENT_LENGTH  = "Content-Length"
-	HEADER_CONTENT_TYPE    = "Content-Type"
-	HEADER_UPLOAD_METADATA = "Upload-Metadata"
+	HEADER_TUS_RESUMABLE       = "Tus-Resumable"
+	HEADER_TUS_VERSION         = "Tus-Version"
+	HEADER_TUS_EXTENSION       = "Tus-Extension"
+	HEADER_TUS_MAX_SIZE        = "Tus-Max-Size"
+	HEADER_LOCATION            = "Location"
+	HEADER_UPLOAD_LENGTH       = "Upload-Length"
+	HEADER_UPLOAD_OFFSET       = "Upload-Offset"
+	HEADER_CONTENT_LENGTH      = "Content-Length"
+	HEADER_CONTENT_TYPE        = "Content-Type"
+	HEADER_UPLOAD_METADATA     = "Upload-Metadata"
+	HEADER_RETRY_AFTER         = "Retry-After"
+	HEADER_RATELIMIT_LIMIT     = "X-RateLimit-Limit"
+	HEADER_RATELIMIT_REMAINING = "X-RateLimit-Remaining"
+	HEADER_RATELIMIT_RESET     = "X-RateLimit-Reset"
+	HEADER_CONTENT_DISPOSITION = "Content-Disposition"
+	HEADER_UPLOAD_CREATED      = "Upload-Created"
+	HEADER_UPLOAD_ACTIVITY     = "Upload-Last-Activity"
+	HEADER_UPLOAD_EXPIRES      = "Upload-Expires"
+
+	CONTENT_TYPE_OCTET_STREAM = "application/octet-stream"
 )
 
 func main() {
-	cfg := &ServerConfig{
-		UploadDir:              "upload",
-		Host:                   "localhost",
-		Port:                   8080,
-		Protocol:               "http",
-		ShutdownTimeoutSeconds: 10,
-		ReadTimeout:            60 * time.Second,
-		WriteTimeout:           60 * time.Second,
-		IdleTimeout:            30 * time.Second,
+	// the server is the default subcommand, started with its flags alone
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
-	mux := buildServeMux(cfg)
-	server := NewServer(cfg, mux)
-
-	server.Start()
 
-	// starting the app
-	// slog.Info("running app at :1080")
-	// if err := http.ListenAndServe(":1080", mux); err != nil {
-	// 	panic(err)
-	// }
+	var err error
+	switch command {
+	case "serve":
+		if err = runServe(args); err != nil {
+			slog.Error("Fail to run the server", slog.Any("Error", err))
+		}
+	case "bench":
+		if err = runBench(args); err != nil {
+			slog.Error("Fail to run the benchmark", slog.Any("Error", err))
+		}
+	case "upload":
+		if err = runClient(runUpload, args); err != nil {
+			slog.Error("Fail to upload", slog.Any("Error", err))
+		}
+	case "resume":
+		if err = runClient(runResume, args); err != nil {
+			slog.Error("Fail to resume the upload", slog.Any("Error", err))
+		}
+	case "router":
+		if err = runRouter(args); err != nil {
+			slog.Error("Fail to run the router", slog.Any("Error", err))
+		}
+	case "list":
+		if err = runClient(runList, args); err != nil {
+			slog.Error("Fail to list the uploads", slog.Any("Error", err))
+		}
+	case "inspect":
+		if err = runClient(runInspect, args); err != nil {
+			slog.Error("Fail to inspect the upload", slog.Any("Error", err))
+		}
+	default:
+		err = fmt.Errorf("unknown command %s", command)
+		slog.Error("usage: [serve|router|bench|upload|resume|list|inspect] [flags]", slog.Any("Error", err))
+	}
+	if err != nil {
+		os.Exit(1)
+	}
 }
 
 type FileInitResponse struct {
@@ -75,11 +113,59 @@ type FileInitResponse struct {
 }
 
 type File struct {
-	ID       uuid.UUID
-	Size     int
-	Offset   int
-	mu       sync.Mutex
-	Metadata string
+	ID          uuid.UUID
+	Size        int
+	Offset      int
+	mu          sync.Mutex // guards Offset and Metadata, which HEAD and GET read while a PATCH or a processing step writes
+	Metadata    string
+	State       string           // see UPLOAD_STATE_*, guarded by mu
+	handles     *fileHandleCache // keeps the data file open across PATCHes, nil opens it on every write
+	directIO    bool             // write with O_DIRECT, bypassing the page cache, when supported
+	ioURing     bool             // write through io_uring when supported
+	networkFS   bool             // the data file is on a network filesystem, it is written at the offset, see sizeCheckedWriter
+	fsync       syncPolicy       // when the written data is fsynced
+	preallocate bool             // reserve the disk space of Size at creation
+	sharded     bool             // the data file is stored in a hashed subdirectory, see shardPath
+	checksum    *checksum        // the running SHA-256 of the committed bytes, nil when disabled
+	persist     bool             // the state is saved in an info file after every change, see saveInfo
+	finalDir    string           // the directory the complete data file is moved to, empty keeps it in UploadDir
+	collision   string           // what finalize does when the final name is taken, see FINALIZE_COLLISION_*
+	final       string           // the path of the data file once finalized, guarded by mu
+	finalStamp  string           // the identity of the final data file, guarded by mu, see fileStamp
+	lastWrite   committedRange   // the range committed by the last PATCH, guarded by the write lock, see skipCommitted
+	transcoding string           // the id of the transcode job of the upload, guarded by mu, see transcodeStep
+	maxSize     int              // the size the upload may not grow past, set by its policy or pre-create hook, 0 is unlimited
+	compressed  bool             // the data file is stored compressed next to path, guarded by mu, see compressStep
+	paused      bool             // the upload refuses the PATCHes and does not expire, guarded by mu, see pause
+	expires     time.Time        // the expiration asked for at creation, zero expires it ExpireAfter after its last write, guarded by mu, see requestedExpiry
+	digests     bool             // record the SHA-256 of the upload once complete, see recordDigest
+	dedup       *digestIndex     // indexes the upload once its digest is recorded, nil without Digest
+	states      *redisStateStore // where the state of the upload is persisted, nil is its info file, see ServerConfig.StateStore
+	digest      []byte           // the SHA-256 of the complete upload, guarded by mu
+	created     time.Time        // when the upload was created, guarded by mu
+	active      time.Time        // the last write of the upload, its creation before any, guarded by mu
+	urlExpires  int64            // the unix time the signed URL of the upload expires, 0 when its URL is not signed, see checkUploadURL
+	owner       string           // the subject of the policy of the creation, empty when it has none, see checkOwner
+	anonymous   bool             // the creation sent no policy, its upload is not downloaded, see ServerConfig.AnonymousUploads
+	trashed     time.Time        // when the upload was terminated or expired into the trash, zero when it is not in it, guarded by mu, see expirer.remove
+	trashedFrom string           // the state the upload was trashed in, guarded by mu
+	legalHold   bool             // the upload is not terminated, expired or purged until it is released, guarded by mu, see expirer.hold
+	aliasName   string           // the name of the upload, guarded by mu, see aliasIndex
+	sniffed     string           // the content type sniffed from the data of the complete upload, guarded by mu, see detectMIMEType
+	dir         string           // the UploadDir of the server or tenant holding the upload, empty is the global uploadDir
+}
+
+// directIOFallback and ioURingFallback log only once that their write path
+// falls back to buffered writes
+var directIOFallback, ioURingFallback sync.Once
+
+// chunkPool holds the CHUNK_SIZE buffers used to write PATCH bodies so
+// concurrent uploads reuse them instead of allocating one per request
+var chunkPool = sync.Pool{
+	New: func() any {
+		buff := make([]byte, CHUNK_SIZE)
+		return &buff
+	},
 }
 
 func (f *File) calculateOffset(contentLength int) {
@@ -89,86 +175,444 @@ func (f *File) calculateOffset(contentLength int) {
 	f.Offset = f.Offset + contentLength
 }
 
+// offset returns the committed offset, it may be called during a write
+func (f *File) offset() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.Offset
+}
+
+// metadata returns the Upload-Metadata of the upload
+func (f *File) metadata() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.Metadata
+}
+
+func (f *File) setMetadata(metadata string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Metadata = metadata
+}
+
+func (f *File) setOffset(offset int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Offset = offset
+}
+
+// touch records a write of the upload now, its creation too with created
+func (f *File) touch(created bool) {
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if created {
+		f.created = now
+	}
+	f.active = now
+}
+
+// timestamps returns when the upload was created and last written
+func (f *File) timestamps() (time.Time, time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.created, f.active
+}
+
+// bufferSize returns the memory a write holds in buffers while it runs
+func (f *File) bufferSize() int {
+	if f.ioURing && !f.directIO {
+		return ioURingQueueDepth * CHUNK_SIZE
+	}
+	return CHUNK_SIZE
+}
+
+// path returns the path of the data file, in UploadDir until it is
+// finalized
+func (f *File) path() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.final) > 0 {
+		return f.final
+	}
+	return f.stagingPath()
+}
+
+// stagingPath returns the path of the data file in UploadDir
+func (f *File) stagingPath() string {
+	dir := f.dir
+	if len(dir) <= 0 {
+		dir = uploadDir
+	}
+	return shardPath(dir, f.ID.String(), f.sharded)
+}
+
 func (f *File) create() error {
-	path := filepath.Join(uploadDir, f.ID.String())
+	f.touch(true)
+	path := f.path()
+	if f.sharded {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+	}
 	file, err := os.Create(path)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
+
+	if f.preallocate && f.Size > 0 {
+		if err = preallocate(file, int64(f.Size)); err != nil {
+			file.Close()
+			os.Remove(path)
+			return err
+		}
+	}
+	file.Close()
+	// an empty upload is complete right away
+	f.advanceState()
+	if err = f.finalize(); err != nil {
+		slog.Error("Fail to finalize upload", slog.String("id", f.ID.String()), slog.Any("Error", err))
+	}
+	if err = f.recordDigest(); err != nil {
+		slog.Error("Fail to record upload digest", slog.String("id", f.ID.String()), slog.Any("Error", err))
+	}
+	if err = f.detectMIMEType(); err != nil {
+		slog.Error("Fail to detect upload MIME type", slog.String("id", f.ID.String()), slog.Any("Error", err))
+	}
+	if f.persist {
+		if err = f.saveInfo(); err != nil {
+			os.Remove(f.path())
+			return err
+		}
+	}
 	return nil
 }
 
-func (f *File) write(body io.Reader) error {
-	f.mu.Lock()
-	defer f.mu.Unlock()
+// write appends body to the data file and advances the offset by the bytes
+// committed. It stops at the next read once ctx is done, i.e., when the
+// client went away, keeping what was committed so far. The caller must hold
+// the write lock of the upload, see Locker.
+func (f *File) write(ctx context.Context, body io.Reader) error {
+	// deferred first to run last, once the offset and the checksum account
+	// for the committed data
+	defer func() {
+		f.touch(false)
+		if err := f.advanceState(); err != nil {
+			slog.Error("Fail to advance upload state", slog.String("id", f.ID.String()), slog.Any("Error", err))
+		}
+		// a failed finalize leaves the complete upload in UploadDir, it is
+		// retried at the next start up
+		if err := f.finalize(); err != nil {
+			slog.Error("Fail to finalize upload", slog.String("id", f.ID.String()), slog.Any("Error", err))
+		}
+		if err := f.recordDigest(); err != nil {
+			slog.Error("Fail to record upload digest", slog.String("id", f.ID.String()), slog.Any("Error", err))
+		}
+		if err := f.detectMIMEType(); err != nil {
+			slog.Error("Fail to detect upload MIME type", slog.String("id", f.ID.String()), slog.Any("Error", err))
+		}
+		if !f.persist {
+			return
+		}
+		if err := f.saveInfo(); err != nil {
+			slog.Error("Fail to persist upload state", slog.String("id", f.ID.String()), slog.Any("Error", err))
+		}
+	}()
+
+	body = &contextReader{ctx: ctx, r: body}
 
 	// write to temp file, assumption is the file
 	// has been created when POST /files
-	path := filepath.Join(uploadDir, f.ID.String())
-	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	path := f.path()
+	start := f.Offset
+	if f.checksum.valid() {
+		var settle func(path string, start, committed int)
+		body, settle = f.checksum.track(body)
+		defer func() { settle(path, start, f.Offset) }()
+	}
+
+	if f.directIO {
+		n, err := writeDirect(path, int64(f.Offset), body)
+		if !errors.Is(err, errDirectIOUnsupported) {
+			return f.commitWhole(path, n, err)
+		}
+		directIOFallback.Do(func() {
+			slog.Warn("Direct IO is not supported, falling back to buffered writes", slog.String("dir", filepath.Dir(path)))
+		})
+	} else if f.ioURing {
+		n, err := writeIOURing(path, int64(f.Offset), body)
+		if !errors.Is(err, errIOURingUnsupported) {
+			return f.commitWhole(path, n, err)
+		}
+		ioURingFallback.Do(func() {
+			slog.Warn("io_uring is not supported, falling back to buffered writes", slog.Any("Error", err))
+		})
+	}
+
+	file, release, err := f.open(path)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	// a no-op with O_APPEND, the windows handles are opened without it, see
+	// openAppend. On a network filesystem the data goes at the offset.
+	if f.networkFS {
+		_, err = file.Seek(int64(start), io.SeekStart)
+	} else {
+		_, err = file.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		release()
+		return err
+	}
+	defer func() {
+		release()
+		// a complete upload won't be written anymore
+		if f.handles != nil && f.Offset >= f.Size {
+			f.handles.close(path)
+		}
+	}()
 
-	// write per 1024 * 1024 byte
-	reader := bufio.NewReader(body)
-	buff := make([]byte, CHUNK_SIZE)
+	// in the strict fsync modes the offset advances as the data becomes
+	// durable, so HEAD during a long PATCH reports the durable progress
+	writer := &syncWriter{file: file, policy: f.fsync}
+	if f.fsync.strict() {
+		writer.onSync = func(synced int64) {
+			f.setOffset(start + int(synced))
+		}
+	}
 
-	for {
-		n, err := reader.Read(buff)
-		if err != nil {
-			if err != io.EOF {
-				return fmt.Errorf("Error reading data %v", err)
-			}
+	// write per 1024 * 1024 byte. The syncWriter is a plain io.Writer so
+	// io.CopyBuffer uses our buffer instead of falling back to
+	// os.File.ReadFrom with its own one.
+	buff := chunkPool.Get().(*[]byte)
+	defer chunkPool.Put(buff)
+	var dst io.Writer = writer
+	if f.networkFS {
+		dst = &sizeCheckedWriter{w: writer, file: file, offset: int64(start)}
+	}
+	n, err := io.CopyBuffer(dst, body, *buff)
 
-			// write the last chunk
-			if err = f.writeToFile(file, buff[:n]); err != nil {
-				return err
-			}
-			break
+	if f.fsync.strict() {
+		// the bytes written before an error are kept when they can be made
+		// durable, otherwise they are dropped so the file never holds more
+		// than the committed offset
+		if serr := writer.sync(); serr != nil {
+			file.Truncate(int64(start) + writer.synced)
+			err = errors.Join(err, serr)
 		}
-		if err = f.writeToFile(file, buff[:n]); err != nil {
-			return err
+		f.setOffset(start + int(writer.synced))
+	} else {
+		// the bytes written before an error are kept so the offset reflects
+		// everything that is on disk
+		f.setOffset(start + int(n))
+		if f.fsync.mode == FSYNC_COMPLETION && f.Offset >= f.Size {
+			if serr := writer.sync(); serr != nil {
+				err = errors.Join(err, serr)
+			}
 		}
 	}
+	if err != nil {
+		return fmt.Errorf("Error writing data %w", err)
+	}
 
 	return nil
 }
 
-func (f *File) writeToFile(file *os.File, buff []byte) error {
-	if _, err := file.Write(buff); err != nil {
-		return fmt.Errorf("Error writing data to file %v", err)
+// contextReader fails the reads once ctx is done so the write paths stop
+// without reading the rest of the body
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// commitWhole advances the offset by the n bytes written by one of the
+// alternative write paths. They bypass the syncWriter so the whole PATCH is
+// made durable at once according to the fsync policy.
+func (f *File) commitWhole(path string, n int64, err error) error {
+	if f.fsync.strict() || (f.fsync.mode == FSYNC_COMPLETION && f.Offset+int(n) >= f.Size) {
+		if serr := syncPath(path); serr != nil {
+			if f.fsync.strict() {
+				// nothing of this PATCH is durable, drop it so the next
+				// append starts at the committed offset
+				os.Truncate(path, int64(f.Offset))
+				n = 0
+			}
+			err = errors.Join(err, serr)
+		}
+	}
+	f.setOffset(f.Offset + int(n))
+	if err != nil {
+		return fmt.Errorf("Error writing data %w", err)
 	}
-	f.Offset = f.Offset + len(buff)
 	return nil
 }
 
-type Storage map[string]*File
+// open returns the append handle of the data file and the function releasing
+// it, the handle comes from the cache when there is one
+func (f *File) open(path string) (*os.File, func(), error) {
+	if f.handles != nil {
+		return f.handles.acquire(path)
+	}
+	open := openAppend
+	if f.networkFS {
+		open = openAt
+	}
+	file, err := open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, func() { file.Close() }, nil
+}
 
 type ServerConfig struct {
-	UploadDir              string // the directory wher all file is being uploaded to
+	UploadDir              string      // the directory wher all file is being uploaded to
+	UploadDirMode          string      // the octal permissions UploadDir is created with when missing at start up, i.e., 0750, defaults to 0755
+	ShardUploadDir         bool        // store uploads in hashed subdirectories of UploadDir, i.e., ab/cd/<id>, moving existing flat uploads at start up
+	BasePath               string      // the path the tus endpoints are served under, defaults to /files
+	TrustedProxies         []string    // IPs or CIDRs of the proxies whose Forwarded and X-Forwarded-* headers are used to build the Location
+	RelativeLocation       bool        // return a relative Location, i.e., /files/{id}, instead of an absolute URL
+	CORS                   *CORSConfig // cross origin settings for browser clients, nil disables CORS
 	Host                   string
 	Port                   int
 	Protocol               string
+	Listeners              []ListenerConfig // the addresses to listen on, defaults to a single tcp listener on Host:Port
 	ShutdownTimeoutSeconds int
 	ReadTimeout            time.Duration
 	WriteTimeout           time.Duration
 	ReadHeaderTimeout      time.Duration
 	IdleTimeout            time.Duration
+	MaxConnections         int           // the maximum number of simultaneous connections, 0 means unlimited
+	ConnectionOverflow     string        // what to do with connections above MaxConnections, queue or refuse
+	ConnectionQueueTimeout time.Duration // how long an overflowing connection waits for a free slot when queued
+	ConnectionQueueSize    int           // the overflowing connections queued at once, the ones beyond are refused, defaults to MaxConnections
+	MaxUploads             int           // the maximum number of simultaneously active PATCH streams, 0 means unlimited
+	MaxUploadsPerClient    int           // the maximum number of simultaneously active PATCH streams per client IP, 0 means unlimited
+	MaxStorage             int64         // the total size in bytes of the uploads held, creations beyond it are rejected, 0 means unlimited
+	IdempotencyWindow      time.Duration // how long a creation with an Idempotency-Key is answered with the same upload, 0 disables it
+	CoalesceCreations      time.Duration // how long a creation waits for the one in progress with the same Idempotency-Key to answer with its upload, i.e., the near simultaneous POSTs of a retry storm, 0 answers 409 at once
+	UploadRetryAfter       time.Duration // the Retry-After sent when an upload is rejected because of the limits above
+	MaxBufferMemory        int           // the total bytes of write buffers shared by all PATCH streams, PATCHes beyond it wait before reading their body, 0 means unlimited
+	MaxBandwidth           int           // the server wide ingress bandwidth in bytes per second shared by all PATCH streams, 0 means unlimited
+	BandwidthBurst         int           // the number of bytes that can be read at once above MaxBandwidth, defaults to MaxBandwidth
+	ChunkTolerance         ByteSize      // the bytes a PATCH body may carry past the remaining length of its upload before it is cut with 413, i.e., for the overhead of a gzip body, the decoded data may never go past the length
+	MaxPatchDuration       time.Duration // a PATCH is cut after this long, its bytes received are committed and it answers 204 with their offset so the client sends the rest in another PATCH, 0 is unlimited
+	MinTransferRate        int           // PATCH streams slower than this many bytes per second for a whole MinTransferRateWindow are aborted, 0 disables it
+	MinTransferRateWindow  time.Duration // the window the transfer rate is measured over, defaults to 30 seconds
+	MaxOpenFiles           int           // the maximum number of upload files kept open across PATCHes, 0 opens and closes the file on every PATCH
+	FileIdleTimeout        time.Duration // how long an unused upload file is kept open, defaults to 30 seconds
+	DirectIO               bool          // write uploads with O_DIRECT to keep them out of the page cache, falls back to buffered writes where unsupported
+	IOURing                bool          // experimental, write uploads through io_uring on linux, batching chunk writes, ignored with DirectIO
+	FsyncPolicy            string        // when uploads are fsynced: chunk, bytes, completion or never, defaults to never
+	FsyncBytes             int           // the number of bytes between two fsyncs with the bytes policy, defaults to CHUNK_SIZE
+	Preallocate            bool          // reserve the disk space of Upload-Length at creation, rejecting with 507 when the disk is full
+	Locker                 string        // how uploads are locked while written: memory, file, lockfile or redis, defaults to memory, lockfile with NetworkFS. Instances sharing the upload store need file, lockfile or redis
+	LockDir                string        // the directory of the lock files of the file and lockfile lockers, defaults to UploadDir/.locks
+	RedisAddress           string        // the host:port of the redis server of the redis locker and state store
+	LockTTL                time.Duration // how long a redis lock or a lock file of the lockfile locker outlives a crashed instance, defaults to 30 seconds
+	NetworkFS              bool          // the UploadDir is on NFS or SMB: the data is written at the offset of the upload instead of appended, after checking the size of the data file before every chunk, with no cached handle, see sizeCheckedWriter. DirectIO, IOURing and MaxOpenFiles are ignored
+	ProgressRedis          bool          // publish the progress of the uploads to the redis channels tus:progress:<id> on RedisAddress
+	ProgressInterval       time.Duration // the time between two progress messages of an upload, defaults to 1 second
+	VerifyOffset           bool          // HEAD checks the offset against the size of the data on disk and reconciles them when they diverged
+	PersistState           bool          // save the state of every upload in an info file next to its data and reload the uploads at start up
+	SharedStorage          bool          // the UploadDir is shared by several instances, any of which serves any upload from its shared state, see sharedUploads. It implies PersistState and needs the file or redis Locker
+	StateStore             string        // where the instances of SharedStorage keep the state of the uploads: file, the info files next to their data, or redis, at RedisAddress, defaults to file
+	Checksum               bool          // keep a running SHA-256 of every upload, sent as Upload-Checksum once it is complete
+	Digest                 bool          // record the SHA-256 of the complete uploads in their state and a .sha256 file next to their data, sent as Repr-Digest by HEAD and GET
+	CompressDownloads      bool          // the GETs of the text, JSON and XML uploads are sent compressed with zstd or gzip to the clients accepting it, without Range support
+	FinalDir               string        // complete uploads are moved to this directory, named after their filename metadata, empty keeps them in UploadDir, the staging directory. On another filesystem the data is copied then removed from UploadDir
+	FinalizeCollision      string        // what to do when the final name is taken: rename with a -N suffix, overwrite or fail, which rejects the name and leaves the upload in UploadDir, defaults to rename. The name is taken atomically, the uploads completing at once under the same name don't clobber each other
+	StrictStorageRoutes    bool          // a creation whose metadata has a key of the StorageRoutes matching none of its routes is rejected, the routes of a key are the allowlist of its values, i.e., the storage classes
+	HooksDir               string        // the directory of the tusd style hook executables, named after the hooks, see HOOK_*. Empty disables the hooks
+	HooksGRPC              string        // the address of the gRPC hook service, see hookpb/hook.proto, taking precedence over HooksDir
+	HookTimeout            time.Duration // how long a hook may run before it is killed, defaults to 30 seconds
+	NATSAddress            string        // the host:port of the NATS server the upload events are published to, empty disables it
+	NATSSubjectPrefix      string        // the prefix of the NATS subjects, i.e., <prefix>.created, defaults to uploads
+	KafkaBrokers           []string      // the host:port of the Kafka brokers the completed and terminated events are produced to, empty disables it
+	KafkaTopic             string        // the topic of the events, defaults to uploads
+	KafkaFormat            string        // the encoding of the events: json, avro, see uploadEventAvroSchema, s3, see s3Event, cloudevents or cloudevents-binary, see EVENT_FORMAT_CLOUDEVENTS, defaults to json
+	AMQPURL                string        // the amqp:// URL of the broker the upload events are published to, empty disables it
+	AMQPExchange           string        // the exchange of the events, it must exist, defaults to uploads
+	AMQPRoutingKey         string        // the routing key of the events, {type} is replaced by the type of the event, defaults to uploads.{type}
+	EventFormat            string        // the encoding of the events of NATS, AMQP, the notify step and the callbacks: json, avro, s3 for the notifications of S3 which leave out the created events, see s3Event, or the structured cloudevents or cloudevents-binary, see EVENT_FORMAT_CLOUDEVENTS, defaults to json
+	EventBucket            string        // the bucket name of the s3 events, defaults to uploads
+	EventSource            string        // the source of the CloudEvents, defaults to the BasePath
+	EventTimeout           time.Duration // how long the publication of an event may take, defaults to 10 seconds
+	ProcessingSteps        []string      // the steps run in order on the complete uploads in the background: checksum, scan, thumbnail, transcode, move, notify or compress, last, see STEP_*
+	ProcessingWorkers      int           // the number of uploads processed at once, defaults to 4
+	ProcessingRetries      int           // how many times a failed step is retried before its upload goes to the dead letters, defaults to 3
+	ProcessingRetryDelay   time.Duration // the delay before the first retry of a step, doubled on every retry, defaults to 1 second
+	ProcessingTimeout      time.Duration // how long a step may run, defaults to 5 minutes
+	ScanCommand            []string      // the command of the scan step, the path of the upload is appended, i.e., clamdscan --no-summary
+	ThumbnailSizes         []string      // the WIDTHxHEIGHT boxes the thumbnail step fits the images in, defaults to 256x256
+	TranscodeURL           string        // the HTTP endpoint the transcode step POSTs the jobs of the video uploads to
+	TranscodeQueue         string        // publish the transcode jobs on the broker of NATSAddress or AMQPURL instead, see TRANSCODE_QUEUE_*
+	ProcessedDir           string        // the directory the move step moves the uploads to, it must be on the same filesystem as UploadDir
+	NotifyURL              string        // the URL the notify step POSTs the completed event of the uploads to
+	CallbackHosts          []string      // the hosts the callback_url metadata may point to as host, host:port or *.domain, empty ignores callback_url
+	Demo                   bool          // serve a page uploading from the browser at /demo
+	AdminToken             string        // the bearer token of the admin API under /admin, and of the one of each tenant under /tenants/{tenant}/admin unless the tenant has its own, empty disables it
+	MaxSize                ByteSize      // the largest upload in bytes, sent as Tus-Max-Size, i.e., 50GB, defaults to MAX_SIZE
+	PolicySecret           string        // the HMAC-SHA256 key of the Upload-Policy of the creations, see uploadPolicy, and of the signed upload URLs. When set every creation needs a valid policy, and the uploads of a policy with a sub are only reached with a policy of the same sub
+	AnonymousUploads       bool          // with PolicySecret, the creations without a policy are allowed, limited by AnonymousMaxSize and AnonymousExpireAfter, and their uploads are only downloaded by the admins, i.e., for a public drop page
+	AnonymousMaxSize       ByteSize      // the largest anonymous upload, 0 is MaxSize
+	AnonymousExpireAfter   time.Duration // an anonymous upload not completed this long after its creation expires, whatever its Upload-Expires, 0 leaves it to ExpireAfter
+	UploadURLTTL           time.Duration // with PolicySecret, the URLs of the uploads are signed and refused this long after their creation, 0 does not sign them unless the policy has a url_ttl
+	ClusterNodes           []string      // the root URLs of the nodes of a cluster keeping the data on local disks behind the router subcommand, see hashRing
+	ClusterNode            string        // the URL of this node in ClusterNodes, it only creates the ids the router sends to it
+	ExpireAfter            time.Duration // an upload not completed this long after its last write expires, its data is removed, 0 never expires
+	MaxExpireAfter         time.Duration // the latest after its creation a creation may ask its upload to expire with Upload-Expires, instead of ExpireAfter after its last write, later dates are lowered to it. 0 ignores Upload-Expires
+	AuditLog               string        // the file the legal hold changes of the admin API are appended to as JSON lines, see auditLog, empty only logs them
+	TrashRetention         time.Duration // the terminated and expired uploads are kept in the trash this long before their data is removed, the admins may restore them meanwhile, 0 removes it at once
+	SweepInterval          time.Duration // how often the leader of the instances sharing the Locker looks for expired uploads, defaults to a minute, see leaderElection
+	HiddenMetadata         []string      // the metadata keys left out of the Upload-Metadata of HEAD, i.e., set by the hooks, a key ending with * hides the keys it prefixes. They are kept server side
+	MetadataSchemaFile     string        // a JSON MetadataSchema file, over MetadataSchema
+	MetadataEncoding       string        // how the values of Upload-Metadata are decoded: strict or lenient, see METADATA_ENCODING_*, defaults to strict
+	MaxMetadataSize        int           // the maximum size in bytes of the Upload-Metadata header of a creation, 0 is unlimited
+	MaxMetadataKeys        int           // the maximum number of metadata keys of an upload, 0 is unlimited
+	MaxMetadataValueSize   int           // the maximum size in bytes of a decoded metadata value, 0 is unlimited
+
+	MetadataSchema *MetadataSchema         // the metadata keys the creations may carry, nil accepts any
+	StorageRoutes  []StorageRoute          // the rules choosing the final directory of an upload from its metadata, the first matching one wins over FinalDir
+	RetentionRules []RetentionRule         // the rules removing the complete uploads from their metadata, the first matching one wins, see retention
+	Tenants        map[string]TenantConfig // the tenants served under /tenants/{tenant}, each with its own uploads, the other fields are shared
+	tenant         string                  // the tenant served, set on the configs derived from Tenants
 }
 
 var uploadDir = "./temp"
 
 type Server struct {
 	httpServer             *http.Server
+	Listeners              []ListenerConfig
 	ShutdownTimeoutSeconds int
+	MaxConnections         int
+	ConnectionOverflow     string
+	ConnectionQueueTimeout time.Duration
+	ConnectionQueueSize    int
 }
 
 func NewServer(config *ServerConfig, handler *http.ServeMux) *Server {
+	addr := fmt.Sprintf("%s:%d", config.Host, config.Port)
+	listeners := config.Listeners
+	if len(listeners) <= 0 {
+		listeners = []ListenerConfig{{Network: LISTENER_NETWORK_TCP, Address: addr}}
+	}
 	httpServer := &http.Server{
-		Addr:              fmt.Sprintf("%s:%d", config.Host, config.Port),
+		Addr:              addr,
 		Handler:           handler,
 		ReadTimeout:       config.ReadTimeout,
 		WriteTimeout:      config.WriteTimeout,
@@ -177,7 +621,12 @@ func NewServer(config *ServerConfig, handler *http.ServeMux) *Server {
 	}
 	return &Server{
 		httpServer:             httpServer,
+		Listeners:              listeners,
 		ShutdownTimeoutSeconds: config.ShutdownTimeoutSeconds,
+		MaxConnections:         config.MaxConnections,
+		ConnectionOverflow:     config.ConnectionOverflow,
+		ConnectionQueueTimeout: config.ConnectionQueueTimeout,
+		ConnectionQueueSize:    config.ConnectionQueueSize,
 	}
 }
 
@@ -186,15 +635,46 @@ func (s *Server) Start() error {
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
 
-	go func() {
-		slog.Info("Starting server at", slog.String("Addr", s.httpServer.Addr))
-		// The err != http.ErrServerClosed is important. The error is returned when
-		// the Shutdown method is called to initiate gracefule shutdown, which allows
-		// existing requests to completed before closing down.
-		if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			errorChan <- err
+	var sem, queue chan struct{}
+	if s.MaxConnections > 0 {
+		// a single limit shared by all the listeners
+		sem = make(chan struct{}, s.MaxConnections)
+		queueSize := s.ConnectionQueueSize
+		if queueSize <= 0 {
+			queueSize = s.MaxConnections
 		}
-	}()
+		queue = make(chan struct{}, queueSize)
+	}
+
+	var listeners []net.Listener
+	for _, c := range s.Listeners {
+		listener, err := listen(c)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("Fail to start the server. listener=%s error=%v", c, err)
+		}
+		if sem != nil {
+			listener = newLimitListener(listener, sem, queue, s.ConnectionOverflow, s.ConnectionQueueTimeout)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	for i, listener := range listeners {
+		go func() {
+			slog.Info("Starting server at", slog.String("Addr", s.Listeners[i].String()))
+			// The err != http.ErrServerClosed is important. The error is returned when
+			// the Shutdown method is called to initiate gracefule shutdown, which allows
+			// existing requests to completed before closing down.
+			if err := s.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+				select {
+				case errorChan <- err:
+				default:
+				}
+			}
+		}()
+	}
 
 	select {
 	case err := <-errorChan:
@@ -221,7 +701,7 @@ func (s *Server) Shutdown() error {
 func buildServeMux(config *ServerConfig) *http.ServeMux {
 	var host, protocol string
 	port := config.Port
-	storage := make(Storage)
+	storage := newStorage()
 	if len(config.Host) <= 0 {
 		host = "localhost"
 	} else {
@@ -232,23 +712,199 @@ func buildServeMux(config *ServerConfig) *http.ServeMux {
 	} else {
 		protocol = config.Protocol
 	}
+	dir := uploadDir
 	if len(config.UploadDir) > 0 {
-		uploadDir = config.UploadDir
+		dir = config.UploadDir
+	}
+	// the tenants don't change the directory of the server
+	if len(config.tenant) <= 0 {
+		uploadDir = dir
+	}
+	if config.ShardUploadDir {
+		if _, err := migrateToShards(dir); err != nil {
+			slog.Error("Fail to migrate flat uploads to shards", slog.String("dir", dir), slog.Any("Error", err))
+		}
+	}
+	basePath := normalizeBasePath(config.BasePath)
+	locations := &locationBuilder{
+		protocol: protocol,
+		host:     host,
+		port:     port,
+		basePath: basePath,
+		proxies:  parseTrustedProxies(config.TrustedProxies),
+		relative: config.RelativeLocation,
+	}
+	// the location of an upload with a signed URL carries its signature
+	uploadLocation := func(r *http.Request, f *File) string {
+		location := locations.location(r, f.ID.String())
+		if f.urlExpires > 0 {
+			location += "?" + signUploadURL(config.PolicySecret, f.ID.String(), f.urlExpires)
+		}
+		return location
+	}
+	if config.UploadURLTTL > 0 && len(config.PolicySecret) <= 0 {
+		slog.Warn("The upload URLs are not signed without a PolicySecret")
+	}
+	tusMaxSize := effectiveMaxSize(config)
+	retryAfter := int(config.UploadRetryAfter.Seconds())
+	if retryAfter <= 0 {
+		retryAfter = 1
+	}
+	limiter := newUploadLimiter(config.MaxUploads, config.MaxUploadsPerClient)
+	locker, err := newLocker(config)
+	if err != nil {
+		slog.Error("Fail to set up the upload locker, falling back to in-process locks", slog.String("locker", config.Locker), slog.Any("Error", err))
+		locker = newMemoryLocker()
+	}
+	var idempotency *idempotencyCache
+	if config.IdempotencyWindow > 0 {
+		idempotency = newIdempotencyCache(config.IdempotencyWindow)
+	}
+	hooks, err := newHooks(config)
+	if err != nil {
+		slog.Error("Fail to set up the hooks, running without hooks", slog.Any("Error", err))
+	}
+	metadataMax := newMetadataLimits(config)
+	metadataLenient := config.MetadataEncoding == METADATA_ENCODING_LENIENT
+	schema, err := newMetadataSchema(config)
+	if err != nil {
+		slog.Error("Fail to load the metadata schema, accepting any metadata", slog.Any("Error", err))
+	}
+	// the violations of the schema and of the storage routes of a creation
+	metadataViolations := func(metadata map[string]string) []metadataViolation {
+		violations := schema.validate(metadata)
+		if config.StrictStorageRoutes {
+			violations = append(violations, unroutedKeys(config.StorageRoutes, metadata)...)
+		}
+		return violations
+	}
+	events := newEvents(config)
+	callbacks := newCallbacks(config)
+	processing, err := newPipeline(config, locker)
+	if err != nil {
+		slog.Error("Fail to set up the processing pipeline, running without processing", slog.Any("Error", err))
+	}
+	var progress *progressPublisher
+	if config.ProgressRedis && len(config.RedisAddress) > 0 {
+		progress = newProgressPublisher(config.RedisAddress, config.ProgressInterval)
+	}
+	var memory *memoryBudget
+	if config.MaxBufferMemory > 0 {
+		memory = newMemoryBudget(config.MaxBufferMemory)
+	}
+	minTransferRateWindow := config.MinTransferRateWindow
+	if minTransferRateWindow <= 0 {
+		minTransferRateWindow = 30 * time.Second
+	}
+	var handles *fileHandleCache
+	// a handle kept open on a network filesystem misses the changes of the
+	// other clients
+	if config.MaxOpenFiles > 0 && !config.NetworkFS {
+		fileIdleTimeout := config.FileIdleTimeout
+		if fileIdleTimeout <= 0 {
+			fileIdleTimeout = 30 * time.Second
+		}
+		handles = newFileHandleCache(config.MaxOpenFiles, fileIdleTimeout)
+	}
+	fsync := newSyncPolicy(config.FsyncPolicy, config.FsyncBytes)
+	var dedup *digestIndex
+	if config.Digest {
+		dedup = newDigestIndex()
+	}
+	var states *redisStateStore
+	if config.SharedStorage && config.StateStore == STATE_STORE_REDIS {
+		if len(config.RedisAddress) <= 0 {
+			slog.Warn("The redis state store has no RedisAddress, the state is kept in the info files")
+		} else {
+			states = newRedisStateStore(config.RedisAddress)
+		}
+	}
+	newFile := func(id uuid.UUID, size int, metadata string) *File {
+		f := &File{
+			ID:          id,
+			Size:        size,
+			Metadata:    metadata,
+			handles:     handles,
+			directIO:    config.DirectIO && !config.NetworkFS,
+			ioURing:     config.IOURing && !config.NetworkFS,
+			networkFS:   config.NetworkFS,
+			fsync:       fsync,
+			preallocate: config.Preallocate,
+			sharded:     config.ShardUploadDir,
+			persist:     config.PersistState || config.SharedStorage,
+			finalDir:    routeStorage(config.StorageRoutes, parseMetadata(metadata), config.FinalDir),
+			collision:   config.FinalizeCollision,
+			digests:     config.Digest,
+			dedup:       dedup,
+			states:      states,
+			dir:         dir,
+		}
+		if config.Checksum {
+			f.checksum = newChecksum()
+		}
+		return f
+	}
+	newID := newUploadID(config)
+	lookup := storage.Get
+	if config.SharedStorage {
+		if len(config.Locker) <= 0 || config.Locker == LOCKER_MEMORY {
+			slog.Warn("The instances sharing the upload directory don't lock each other out, use the file or redis locker")
+		}
+		lookup = (&sharedUploads{storage: storage, newFile: newFile}).get
+	}
+	// the uploads of a shared directory are loaded on demand instead, a load
+	// reconciling an upload with its data could trim what another instance
+	// is writing
+	if config.PersistState && !config.SharedStorage {
+		if _, err := loadUploads(dir, storage, newFile); err != nil {
+			slog.Error("Fail to load the persisted uploads", slog.String("dir", dir), slog.Any("Error", err))
+		}
+	}
+	quota := newStorageQuota(config.MaxStorage, storage.Size())
+	expiration := &expirer{
+		after:     config.ExpireAfter,
+		retention: config.RetentionRules,
+		trash:     config.TrashRetention,
+		dir:       dir,
+		shared:    config.SharedStorage,
+		storage:   storage,
+		lookup:    lookup,
+		locker:    locker,
+		handles:   handles,
+		quota:     quota,
+		election:  newLeaderElection(config, locker),
+	}
+	if expiring(config) || len(config.RetentionRules) > 0 || config.TrashRetention > 0 {
+		sweepInterval := config.SweepInterval
+		if sweepInterval <= 0 {
+			sweepInterval = time.Minute
+		}
+		go expiration.run(sweepInterval)
+	}
+	aliases := newAliasIndex(lookup, expiration.uploads, config.SharedStorage)
+	var bandwidth *tokenBucket
+	if config.MaxBandwidth > 0 {
+		bandwidth = newTokenBucket(config.MaxBandwidth, config.BandwidthBurst)
 	}
 
 	mux := http.NewServeMux()
 
 	// Options
-	mux.HandleFunc("OPTIONS /files", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("OPTIONS "+basePath, func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
 		w.Header().Set(HEADER_TUS_VERSION, TUS_PROTOCOL_VERSION)
-		w.Header().Set(HEADER_TUS_EXTENSION, "creation")
-		w.Header().Set(HEADER_TUS_MAX_SIZE, strconv.Itoa(int(MAX_SIZE)))
+		extensions := "creation"
+		if expiring(config) {
+			extensions += ",expiration"
+		}
+		w.Header().Set(HEADER_TUS_EXTENSION, extensions)
+		w.Header().Set(HEADER_TUS_MAX_SIZE, strconv.Itoa(tusMaxSize))
+		w.Header().Set(HEADER_ACCEPT_ENCODING, CONTENT_ENCODING_GZIP)
 		w.WriteHeader(http.StatusNoContent)
 	})
 
 	// Creation
-	mux.HandleFunc("POST /files", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("POST "+basePath, func(w http.ResponseWriter, r *http.Request) {
 		uploadLength := r.Header.Get(HEADER_UPLOAD_LENGTH)
 		if len(uploadLength) <= 0 {
 			uploadLength = "0"
@@ -258,64 +914,526 @@ func buildServeMux(config *ServerConfig) *http.ServeMux {
 			slog.Error("Failed to convert upload length", slog.Any("Error", err))
 			w.WriteHeader(http.StatusLengthRequired)
 		}
-		if l > MAX_SIZE {
-			w.Header().Set(HEADER_TUS_MAX_SIZE, strconv.Itoa(MAX_SIZE))
+		if l > tusMaxSize {
+			w.Header().Set(HEADER_TUS_MAX_SIZE, strconv.Itoa(tusMaxSize))
 			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
 			w.WriteHeader(http.StatusRequestEntityTooLarge)
 			return
 		}
 
 		// validate metadata
-		metadata := r.Header.Get(HEADER_UPLOAD_METADATA)
-		if err = validateMetadata(metadata); err != nil {
-			w.Header().Set(HEADER_TUS_MAX_SIZE, strconv.Itoa(MAX_SIZE))
+		metadata, err := validateMetadata(r.Header.Get(HEADER_UPLOAD_METADATA), metadataLenient)
+		if err != nil {
+			w.Header().Set(HEADER_TUS_MAX_SIZE, strconv.Itoa(tusMaxSize))
+			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if status, reason := metadataMax.check(metadata); status > 0 {
+			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+			writeMetadataLimitProblem(w, status, reason)
+			return
+		}
+		if violations := metadataViolations(parseMetadata(metadata)); len(violations) > 0 {
+			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+			writeMetadataProblem(w, violations)
+			return
+		}
+		if err = callbacks.validate(metadata); err != nil {
+			slog.Warn("Rejected callback url", slog.Any("Error", err))
 			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		policy, err := creationPolicy(config, r)
+		if err != nil {
+			slog.Warn("Rejected upload policy", slog.Any("Error", err))
+			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		expires, err := requestedExpiry(r.Header.Get(HEADER_UPLOAD_EXPIRES), config.MaxExpireAfter, time.Now())
+		if err != nil {
+			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+			writeProblem(w, http.StatusBadRequest, "Invalid Upload-Expires", err.Error(), nil)
+			return
+		}
+		alias := r.Header.Get(HEADER_UPLOAD_ALIAS)
+		if len(alias) > 0 {
+			if err := validateAlias(alias); err != nil {
+				w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+				writeProblem(w, http.StatusBadRequest, "Invalid Upload-Alias", err.Error(), nil)
+				return
+			}
+		}
+
+		// the data is already uploaded, it is sent complete at its offset
+		if config.Digest {
+			sum, err := parseReprDigest(r.Header.Get(HEADER_REPR_DIGEST))
+			if err != nil {
+				w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			// an upload is only returned to its owner, never to an
+			// anonymous creation
+			if existing := dedup.find(policy.Subject, sum, l); existing != nil && !policy.anonymous {
+				slog.Info("Deduplicated upload", slog.String("id", existing.ID.String()))
+				w.Header().Set(HEADER_LOCATION, uploadLocation(r, existing))
+				w.Header().Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(existing.Size))
+				w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
 
-		id, err := uuid.NewUUID()
+		// a retried creation gets the upload of the first attempt of the
+		// same owner
+		idempotencyKey := r.Header.Get(HEADER_IDEMPOTENCY_KEY)
+		var reservation *idempotencyEntry
+		created := false
+		if idempotency != nil && len(idempotencyKey) > 0 {
+			idempotencyKey = scopeIdempotencyKey(policy.Subject, idempotencyKey)
+			entry, outcome := idempotency.reserve(idempotencyKey, l, metadata)
+			if outcome == idempotencyInProgress && config.CoalesceCreations > 0 && idempotency.wait(r.Context(), entry, config.CoalesceCreations) {
+				entry, outcome = idempotency.reserve(idempotencyKey, l, metadata)
+			}
+			reservation = entry
+			switch outcome {
+			case idempotencyExisting:
+				location := locations.location(r, entry.id)
+				if f := lookup(entry.id); f != nil {
+					location = uploadLocation(r, f)
+				}
+				w.Header().Set(HEADER_LOCATION, location)
+				w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+				w.WriteHeader(http.StatusCreated)
+				return
+			case idempotencyMismatch:
+				w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				return
+			case idempotencyInProgress:
+				w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			defer func() {
+				if !created {
+					idempotency.cancel(idempotencyKey, reservation)
+				}
+			}()
+		}
+
+		response, err := hooks.run(r.Context(), HOOK_PRE_CREATE, newHookEvent(r, &File{Size: l, Metadata: metadata}))
+		if err != nil {
+			slog.Error("Fail to run hook", slog.String("hook", HOOK_PRE_CREATE), slog.Any("Error", err))
+			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if response.RejectUpload {
+			writeHookResponse(w, response.HTTPResponse)
+			return
+		}
+		if response.ChangeFileInfo.MetaData != nil {
+			metadata = encodeMetadata(response.ChangeFileInfo.MetaData)
+		}
+		maxSize := maxUploadSize(tusMaxSize, policy.MaxSize, int(response.ChangeFileInfo.MaxSize))
+		if l > maxSize {
+			w.Header().Set(HEADER_TUS_MAX_SIZE, strconv.Itoa(maxSize))
+			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if !quota.reserve(l) {
+			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		id, err := newID()
 		if err != nil {
 			slog.Error("Failed to generate new file id", slog.Any("Error", err))
-			w.Header().Set(HEADER_TUS_MAX_SIZE, strconv.Itoa(MAX_SIZE))
+			quota.release(l)
+			w.Header().Set(HEADER_TUS_MAX_SIZE, strconv.Itoa(tusMaxSize))
 			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		f := &File{
-			ID:       id,
-			Size:     l,
-			Metadata: metadata,
+		f := newFile(id, l, metadata)
+		if dir := response.ChangeFileInfo.Storage[STORAGE_DIR]; len(dir) > 0 {
+			f.finalDir = dir
+		}
+		if maxSize < tusMaxSize {
+			f.maxSize = maxSize
+		}
+		f.urlExpires = urlExpiry(config, policy, time.Now())
+		f.owner = policy.Subject
+		f.anonymous = policy.anonymous
+		f.expires = anonymousExpiry(config, policy, expires, time.Now())
+		if len(alias) > 0 {
+			if err = aliases.assign(f, alias); err != nil {
+				quota.release(l)
+				w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+				writeProblem(w, http.StatusConflict, "Upload-Alias taken", err.Error(), map[string]any{"alias": alias})
+				return
+			}
 		}
 		if err = f.create(); err != nil {
 			slog.Error("Failed to create new file", slog.Any("Error", err))
-			w.Header().Set(HEADER_TUS_MAX_SIZE, strconv.Itoa(MAX_SIZE))
+			quota.release(l)
+			aliases.assign(f, "")
+			w.Header().Set(HEADER_TUS_MAX_SIZE, strconv.Itoa(tusMaxSize))
 			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+			if errors.Is(err, errInsufficientStorage) {
+				w.WriteHeader(http.StatusInsufficientStorage)
+				return
+			}
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		storage[id.String()] = f
-		w.Header().Set(HEADER_LOCATION, fmt.Sprintf("%s://%s:%d/files/%s", protocol, host, port, id.String()))
+		storage.Put(id.String(), f)
+		if idempotency != nil && len(idempotencyKey) > 0 {
+			idempotency.complete(idempotencyKey, reservation, id.String())
+			created = true
+		}
+		hooks.fire(HOOK_POST_CREATE, newHookEvent(r, f))
+		events.publish(EVENT_CREATED, f)
+		if f.state() == UPLOAD_STATE_COMPLETED {
+			hooks.fire(HOOK_POST_FINISH, newHookEvent(r, f))
+			events.publish(EVENT_COMPLETED, f)
+			callbacks.fire(f)
+			processing.enqueue(f)
+		}
+		w.Header().Set(HEADER_LOCATION, uploadLocation(r, f))
+		setExpiresHeader(w, expiration, f)
 		w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
 		w.WriteHeader(http.StatusCreated)
 	})
 
+	// Multipart => create a complete upload from a classic form upload for
+	// the clients not speaking tus
+	mux.HandleFunc("POST "+tenantPrefix(config)+"/upload", func(w http.ResponseWriter, r *http.Request) {
+		client := clientAddress(r)
+		if !limiter.acquire(client) {
+			limiter.setHeaders(w, client, retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		defer limiter.release(client)
+		policy, err := creationPolicy(config, r)
+		if err != nil {
+			slog.Warn("Rejected upload policy", slog.Any("Error", err))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		spool, l, fields, err := readMultipartUpload(r, dir, tusMaxSize)
+		if spool != nil {
+			defer os.Remove(spool.Name())
+			defer spool.Close()
+		}
+		if errors.Is(err, errMultipartTooLarge) {
+			w.Header().Set(HEADER_TUS_MAX_SIZE, strconv.Itoa(tusMaxSize))
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			slog.Warn("Fail to read multipart upload", slog.Any("Error", err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		metadata := encodeMetadata(fields)
+		if status, reason := metadataMax.check(metadata); status > 0 {
+			writeMetadataLimitProblem(w, status, reason)
+			return
+		}
+		if _, err = validateMetadata(metadata, false); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if violations := metadataViolations(fields); len(violations) > 0 {
+			writeMetadataProblem(w, violations)
+			return
+		}
+		if err = callbacks.validate(metadata); err != nil {
+			slog.Warn("Rejected callback url", slog.Any("Error", err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		response, err := hooks.run(r.Context(), HOOK_PRE_CREATE, newHookEvent(r, &File{Size: l, Metadata: metadata}))
+		if err != nil {
+			slog.Error("Fail to run hook", slog.String("hook", HOOK_PRE_CREATE), slog.Any("Error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if response.RejectUpload {
+			writeHookResponse(w, response.HTTPResponse)
+			return
+		}
+		if response.ChangeFileInfo.MetaData != nil {
+			metadata = encodeMetadata(response.ChangeFileInfo.MetaData)
+		}
+		maxSize := maxUploadSize(tusMaxSize, policy.MaxSize, int(response.ChangeFileInfo.MaxSize))
+		if l > maxSize {
+			w.Header().Set(HEADER_TUS_MAX_SIZE, strconv.Itoa(maxSize))
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if !quota.reserve(l) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		id, err := newID()
+		if err != nil {
+			slog.Error("Failed to generate new file id", slog.Any("Error", err))
+			quota.release(l)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		f := newFile(id, l, metadata)
+		if dir := response.ChangeFileInfo.Storage[STORAGE_DIR]; len(dir) > 0 {
+			f.finalDir = dir
+		}
+		if maxSize < tusMaxSize {
+			f.maxSize = maxSize
+		}
+		f.urlExpires = urlExpiry(config, policy, time.Now())
+		f.owner = policy.Subject
+		f.anonymous = policy.anonymous
+		if err = f.create(); err != nil {
+			slog.Error("Failed to create new file", slog.Any("Error", err))
+			quota.release(l)
+			if errors.Is(err, errInsufficientStorage) {
+				w.WriteHeader(http.StatusInsufficientStorage)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// nobody else knows the upload yet, it needs no lock
+		if l > 0 {
+			if err = f.write(r.Context(), spool); err != nil || f.offset() < l {
+				slog.Error("Fail to write multipart upload", slog.String("id", id.String()), slog.Any("Error", err))
+				os.Remove(f.path())
+				f.removeState()
+				quota.release(l)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		storage.Put(id.String(), f)
+		hooks.fire(HOOK_POST_CREATE, newHookEvent(r, f))
+		events.publish(EVENT_CREATED, f)
+		hooks.fire(HOOK_POST_FINISH, newHookEvent(r, f))
+		events.publish(EVENT_COMPLETED, f)
+		callbacks.fire(f)
+		processing.enqueue(f)
+
+		location := locations.location(r, id.String())
+		w.Header().Set(HEADER_LOCATION, location)
+		writeJSON(w, http.StatusCreated, map[string]any{"id": id.String(), "location": location, "size": l})
+	})
+
+	// Alias => redirect to the canonical URL of the upload an alias names,
+	// the URL is not signed, the upload is reached with its own credentials
+	mux.HandleFunc("GET "+tenantPrefix(config)+"/aliases/{alias...}", func(w http.ResponseWriter, r *http.Request) {
+		f := aliases.resolve(r.PathValue("alias"))
+		if f == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set(HEADER_LOCATION, locations.location(r, f.ID.String()))
+		w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	})
+
 	// Head => show status
-	mux.HandleFunc("HEAD /files/{id}", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("HEAD "+basePath+"/{id}", func(w http.ResponseWriter, r *http.Request) {
 		fileId := r.PathValue("id")
-		file := storage[fileId]
+		file := lookup(fileId)
 		if file == nil {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		if file.finished() {
+			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if err := checkUploadURL(config.PolicySecret, file, r.URL.Query(), time.Now()); err != nil {
+			slog.Warn("Rejected upload url", slog.String("id", fileId), slog.Any("Error", err))
+			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := checkOwner(config, file, r, time.Now()); err != nil {
+			slog.Warn("Rejected upload access", slog.String("id", fileId), slog.Any("Error", err))
+			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// an upload being written is expected to be ahead of its offset, it
+		// is checked on a later HEAD
+		if config.VerifyOffset {
+			if lock, err := locker.TryLock(fileId); err == nil {
+				err = file.verifyOffset()
+				lock.Unlock()
+				if errors.Is(err, fs.ErrNotExist) {
+					slog.Warn("Upload data is gone", slog.String("id", fileId))
+					storage.Delete(fileId)
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if err != nil {
+					slog.Error("Fail to verify upload offset", slog.String("id", fileId), slog.Any("Error", err))
+				}
+			}
+		}
 		w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
-		w.Header().Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(file.Offset))
-		w.Header().Set(HEADER_UPLOAD_METADATA, file.Metadata)
+		w.Header().Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(file.offset()))
+		w.Header().Set(HEADER_UPLOAD_LENGTH, strconv.Itoa(file.Size))
+		w.Header().Set(HEADER_UPLOAD_METADATA, redactMetadata(file.metadata(), config.HiddenMetadata))
+		w.Header().Set(HEADER_UPLOAD_STATE, file.state())
+		created, active := file.timestamps()
+		w.Header().Set(HEADER_UPLOAD_CREATED, created.UTC().Format(http.TimeFormat))
+		w.Header().Set(HEADER_UPLOAD_ACTIVITY, active.UTC().Format(http.TimeFormat))
+		setExpiresHeader(w, expiration, file)
+		if file.isPaused() {
+			w.Header().Set(HEADER_UPLOAD_PAUSED, "true")
+		}
+		if alias := file.alias(); len(alias) > 0 {
+			w.Header().Set(HEADER_UPLOAD_ALIAS, alias)
+		}
+		if job := file.transcode(); len(job) > 0 {
+			w.Header().Set(HEADER_TRANSCODE_JOB, job)
+		}
+		setChecksumHeader(w, file)
+		setDigestHeader(w, file)
 		w.WriteHeader(http.StatusOK)
 	})
 
+	// Get => download the uploaded bytes
+	mux.HandleFunc("GET "+basePath+"/{id}", func(w http.ResponseWriter, r *http.Request) {
+		fileId := r.PathValue("id")
+		file := lookup(fileId)
+		if file == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if file.finished() {
+			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if err := checkDownload(config, file, r, time.Now()); err != nil {
+			slog.Warn("Rejected upload access", slog.String("id", fileId), slog.Any("Error", err))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// the data of another upload replaced its final file
+		if !file.ownsFinal() {
+			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+
+		// the compressed file stays once the upload is compressed
+		compressed := file.isCompressed()
+		path := file.path()
+		if compressed {
+			path += COMPRESSED_EXTENSION
+		}
+		data, err := os.Open(path)
+		if err != nil {
+			slog.Error("Fail to open file for download", slog.String("id", fileId), slog.Any("Error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer data.Close()
+		info, err := data.Stat()
+		if err != nil {
+			slog.Error("Fail to stat file for download", slog.String("id", fileId), slog.Any("Error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		metadata := parseMetadata(file.metadata())
+		contentType := file.fileType()
+		if len(contentType) <= 0 {
+			contentType = CONTENT_TYPE_OCTET_STREAM
+		}
+		w.Header().Set(HEADER_CONTENT_TYPE, contentType)
+		setDigestHeader(w, file)
+		if filename := metadata["filename"]; len(filename) > 0 {
+			w.Header().Set(HEADER_CONTENT_DISPOSITION, mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+		}
+
+		// serve the *os.File itself once the upload is complete so net/http
+		// can use sendfile, an upload in progress is cut at the committed
+		// offset which requires copying through userspace
+		var content io.ReadSeeker = data
+		size := info.Size()
+		if compressed {
+			seekable, err := readSeekTable(data)
+			if err != nil {
+				slog.Error("Fail to read compressed file for download", slog.String("id", fileId), slog.Any("Error", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			size = seekable.Size()
+			content = io.NewSectionReader(seekable, 0, size)
+		} else if offset := int64(file.offset()); offset < size {
+			size = offset
+			content = io.NewSectionReader(data, 0, size)
+		}
+		if config.CompressDownloads && compressible(contentType) {
+			w.Header().Add(HEADER_VARY, HEADER_ACCEPT_ENCODING)
+			if encoding := negotiateEncoding(r.Header.Get(HEADER_ACCEPT_ENCODING)); len(encoding) > 0 {
+				serveEncoded(w, r, encoding, info.ModTime(), size, content)
+				return
+			}
+		}
+		w.Header().Set(HEADER_ETAG, downloadETag(info.ModTime(), size, ""))
+		http.ServeContent(w, r, "", info.ModTime(), content)
+	})
+
+	// Get => download a thumbnail made by the thumbnail processing step
+	mux.HandleFunc("GET "+basePath+"/{id}/thumbnails/{size}", func(w http.ResponseWriter, r *http.Request) {
+		fileId := r.PathValue("id")
+		size := r.PathValue("size")
+		file := lookup(fileId)
+		if file == nil || len(parseMetadata(file.metadata())[METADATA_THUMBNAIL_PREFIX+size]) <= 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := checkDownload(config, file, r, time.Now()); err != nil {
+			slog.Warn("Rejected upload access", slog.String("id", fileId), slog.Any("Error", err))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		data, err := os.Open(thumbnailPath(file, size))
+		if err != nil {
+			slog.Error("Fail to open thumbnail", slog.String("id", fileId), slog.String("size", size), slog.Any("Error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer data.Close()
+		info, err := data.Stat()
+		if err != nil {
+			slog.Error("Fail to stat thumbnail", slog.String("id", fileId), slog.String("size", size), slog.Any("Error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(HEADER_CONTENT_TYPE, "image/jpeg")
+		http.ServeContent(w, r, "", info.ModTime(), data)
+	})
+
 	// Patch => upload file (maybe in chunk)
-	mux.HandleFunc("PATCH /files/{id}", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("PATCH "+basePath+"/{id}", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
 		contentType := r.Header.Get(HEADER_CONTENT_TYPE)
 		if contentType != CONTENT_TYPE_OFFSET_OCTET_STREAM {
@@ -324,11 +1442,28 @@ func buildServeMux(config *ServerConfig) *http.ServeMux {
 		}
 
 		fileId := r.PathValue("id")
-		file := storage[fileId]
+		file := lookup(fileId)
 		if file == nil {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		if file.finished() {
+			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if err := checkUploadURL(config.PolicySecret, file, r.URL.Query(), time.Now()); err != nil {
+			slog.Warn("Rejected upload url", slog.String("id", fileId), slog.Any("Error", err))
+			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := checkOwner(config, file, r, time.Now()); err != nil {
+			slog.Warn("Rejected upload access", slog.String("id", fileId), slog.Any("Error", err))
+			w.Header().Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
 
 		offsetValue := r.Header.Get(HEADER_UPLOAD_OFFSET)
 		if len(offsetValue) <= 0 {
@@ -341,28 +1476,312 @@ func buildServeMux(config *ServerConfig) *http.ServeMux {
 			return
 		}
 
-		if offset != file.Offset {
-			w.WriteHeader(http.StatusConflict)
+		// concurrent PATCHes would all pass the offset check and append the
+		// same chunk twice, only one may write at a time
+		lock, err := locker.TryLock(fileId)
+		if errors.Is(err, errLocked) {
+			w.WriteHeader(http.StatusLocked)
+			return
+		}
+		if err != nil {
+			slog.Error("Fail to lock upload", slog.String("id", fileId), slog.Any("Error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer func() {
+			if err := lock.Unlock(); err != nil {
+				slog.Error("Fail to unlock upload", slog.String("id", fileId), slog.Any("Error", err))
+			}
+		}()
+		// another instance may have written the upload up to the lock
+		if config.SharedStorage {
+			if err := file.refresh(true); err != nil {
+				slog.Error("Fail to refresh shared upload", slog.String("id", fileId), slog.Any("Error", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if file.isPaused() {
+			writePaused(w, file)
+			return
+		}
+
+		// the offsets count the decoded bytes, a retry is compared with the
+		// committed data once decoded
+		encoding := r.Header.Get(HEADER_CONTENT_ENCODING)
+		// no PATCH carries more than the rest of the upload from its offset,
+		// whatever it declares
+		r.Body = http.MaxBytesReader(w, r.Body, maxEncodedSize(encoding, int64(file.Size-max(offset, 0)))+int64(config.ChunkTolerance))
+		decoded, err := decodeBody(encoding, r.Body)
+		if err != nil {
+			w.Header().Set(HEADER_ACCEPT_ENCODING, CONTENT_ENCODING_GZIP)
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		body, ok := file.skipCommitted(offset, decoded)
+		if !ok {
+			writeOffsetConflict(w, file.offset(), offset, "the PATCH does not start at the offset of the upload")
+			return
+		}
+		// the upload may not grow past the max size of its policy, whatever
+		// its length
+		if file.maxSize > 0 {
+			if r.ContentLength > 0 && len(encoding) <= 0 && offset+int(r.ContentLength) > file.maxSize {
+				w.Header().Set(HEADER_TUS_MAX_SIZE, strconv.Itoa(file.maxSize))
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			body = &sizeLimitedReader{r: body, remaining: int64(file.maxSize - file.offset())}
+		}
+		body = &sizeLimitedReader{r: body, remaining: int64(file.Size - file.offset()), err: errPastLength}
+		// a retry of this PATCH at the same offset is then recognized
+		defer func() {
+			if committed := file.offset() - offset; committed > 0 {
+				file.lastWrite = committedRange{offset: offset, length: committed}
+			}
+		}()
+
+		client := clientAddress(r)
+		if !limiter.acquire(client) {
+			limiter.setHeaders(w, client, retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
 			return
 		}
+		defer limiter.release(client)
+
+		if memory != nil {
+			reserved, err := memory.acquire(r.Context(), file.bufferSize())
+			if err != nil {
+				// the client went away while waiting for buffer memory
+				limiter.setHeaders(w, client, retryAfter)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			defer memory.release(reserved)
+		}
+
+		var watcher *transferRateWatcher
+		if config.MinTransferRate > 0 {
+			controller := http.NewResponseController(w)
+			watcher = newTransferRateWatcher(body, config.MinTransferRate, minTransferRateWindow, func() {
+				// unblock the pending body read
+				controller.SetReadDeadline(time.Now())
+			})
+			defer watcher.Stop()
+			body = watcher
+		}
+		var deadline *requestDeadline
+		if config.MaxPatchDuration > 0 {
+			controller := http.NewResponseController(w)
+			deadline = newRequestDeadline(config.MaxPatchDuration, func() {
+				controller.SetReadDeadline(time.Now())
+			})
+			defer deadline.Stop()
+		}
+		if bandwidth != nil {
+			throttled := newThrottledReader(r.Context(), body, bandwidth)
+			throttled.watcher = watcher
+			body = throttled
+		}
+
+		// a read blocked on a client that went away is unblocked so the
+		// write returns right away
+		stop := context.AfterFunc(r.Context(), func() {
+			http.NewResponseController(w).SetReadDeadline(time.Now())
+		})
+		defer stop()
+
+		body = progress.reader(file, body)
+		before := file.offset()
+		defer func() {
+			if file.offset() == before {
+				return
+			}
+			progress.publish(file, file.offset())
+			hooks.fire(HOOK_POST_RECEIVE, newHookEvent(r, file))
+			// the upload has been finalized by the write
+			if file.offset() >= file.Size {
+				hooks.fire(HOOK_POST_FINISH, newHookEvent(r, file))
+				events.publish(EVENT_COMPLETED, file)
+				callbacks.fire(file)
+				processing.enqueue(file)
+			}
+		}()
 
 		// write to temp file
-		if err = file.write(r.Body); err != nil {
+		if err = file.write(r.Context(), body); err != nil {
+			if errors.Is(err, errReplayMismatch) {
+				slog.Warn("Retried PATCH does not match the committed data", slog.String("id", fileId), slog.Int("offset", offset))
+				writeOffsetConflict(w, file.offset(), offset, "the retried bytes differ from the committed ones")
+				return
+			}
+			if errors.Is(err, errSizeMismatch) {
+				slog.Warn("Upload data diverged from its offset", slog.String("id", fileId), slog.Any("Error", err))
+				if err := file.verifyOffset(); err != nil {
+					slog.Error("Fail to reconcile upload offset", slog.String("id", fileId), slog.Any("Error", err))
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				writeOffsetConflict(w, file.offset(), offset, "the data of the upload changed on disk")
+				return
+			}
+			if errors.Is(err, errUploadTooLarge) {
+				slog.Warn("PATCH exceeds the max size of the upload", slog.String("id", fileId), slog.Int("max_size", file.maxSize))
+				w.Header().Set(HEADER_TUS_MAX_SIZE, strconv.Itoa(file.maxSize))
+				w.Header().Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(file.offset()))
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			var tooLarge *http.MaxBytesError
+			if errors.Is(err, errPastLength) || errors.As(err, &tooLarge) {
+				slog.Warn("PATCH exceeds the length of the upload", slog.String("id", fileId), slog.Int("length", file.Size))
+				w.Header().Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(file.offset()))
+				writeProblem(w, http.StatusRequestEntityTooLarge, "Upload-Length exceeded", fmt.Sprintf("the PATCH carries more than the %d bytes of the upload", file.Size), map[string]any{"offset": file.offset()})
+				return
+			}
+			if errors.Is(err, errCorruptEncoding) {
+				slog.Warn("Fail to decode PATCH body", slog.String("id", fileId), slog.Any("Error", err))
+				w.Header().Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(file.offset()))
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if deadline != nil && deadline.Exceeded() {
+				// the rest of the body is left unread, the connection can't
+				// be reused
+				slog.Info("Cut PATCH at its max duration", slog.String("id", fileId), slog.Int("offset", file.offset()))
+				w.Header().Set("Connection", "close")
+				w.Header().Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(file.offset()))
+				setExpiresHeader(w, expiration, file)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			if watcher != nil && watcher.Evicted() {
+				slog.Info("Abort slow upload", slog.String("id", fileId), slog.Int("offset", file.offset()))
+				w.Header().Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(file.offset()))
+				w.WriteHeader(http.StatusRequestTimeout)
+				return
+			}
+			if r.Context().Err() != nil || errors.Is(err, io.ErrUnexpectedEOF) {
+				// the bytes received before the connection dropped are
+				// committed, the client resumes from the offset of HEAD
+				slog.Info("Client disconnected during PATCH", slog.String("id", fileId), slog.Int("offset", file.offset()))
+				w.Header().Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(file.offset()))
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
 			slog.Error("Fail to write r.Body", slog.Any("Error", err))
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		w.Header().Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(file.Offset))
+		w.Header().Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(file.offset()))
+		setChecksumHeader(w, file)
+		setExpiresHeader(w, expiration, file)
 
 		w.WriteHeader(http.StatusNoContent)
 	})
 
-	return mux
+	traffic := newTrafficStats()
+	var audit *auditLog
+	if len(config.AuditLog) > 0 && len(config.AdminToken) > 0 {
+		if audit, err = newAuditLog(config.AuditLog); err != nil {
+			slog.Error("Fail to open the audit log, the audited actions are only logged", slog.String("path", config.AuditLog), slog.Any("Error", err))
+		}
+	}
+	registerAdmin(mux, tenantPrefix(config), config.AdminToken, storage, lookup, processing, expiration, events, traffic, audit, aliases)
+	registerOpenAPI(mux, config, basePath)
+	registerTenants(mux, config, dir)
+	if config.Demo {
+		registerDemo(mux, basePath)
+	}
+	// the wrappers apply to every route, the traffic of the dashboard is
+	// only recorded with the admin API
+	var handler http.Handler = mux
+	if config.CORS != nil && len(config.CORS.AllowedOrigins) > 0 {
+		handler = newCORSHandler(handler, config.CORS)
+	}
+	if len(config.AdminToken) > 0 {
+		handler = traffic.record(handler)
+	}
+	if handler == http.Handler(mux) {
+		return mux
+	}
+	wrapped := http.NewServeMux()
+	wrapped.Handle("/", handler)
+	return wrapped
+}
+
+// normalizeBasePath returns the base path with a single leading slash and no
+// trailing slash, an empty base path defaults to /files
+func normalizeBasePath(basePath string) string {
+	basePath = strings.Trim(basePath, "/")
+	if len(basePath) <= 0 {
+		basePath = "files"
+	}
+	return "/" + basePath
+}
+
+// the decodings of the values of Upload-Metadata, see decodeMetadataValue
+const (
+	METADATA_ENCODING_STRICT  = "strict"
+	METADATA_ENCODING_LENIENT = "lenient"
+)
+
+// parseMetadata decodes the Upload-Metadata header into its key value pairs,
+// invalid values are skipped since the header was validated at creation
+func parseMetadata(metadata string) map[string]string {
+	decoded := make(map[string]string)
+	for _, pair := range strings.Split(metadata, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if len(k) <= 0 {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		decoded[k] = string(value)
+	}
+	return decoded
 }
 
-func validateMetadata(metadata string) error {
+// encodeMetadata is the inverse of parseMetadata, the keys are sorted
+func encodeMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for _, k := range slices.Sorted(maps.Keys(metadata)) {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(metadata[k])))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// redactMetadata returns metadata without the pairs of the hidden keys, a
+// key ending with * hides the keys it prefixes. The other pairs are kept as
+// sent.
+func redactMetadata(metadata string, hidden []string) string {
+	if len(hidden) <= 0 {
+		return metadata
+	}
+	pairs := []string{}
+	for _, pair := range strings.Split(metadata, ",") {
+		k, _, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if !slices.ContainsFunc(hidden, func(h string) bool {
+			prefix, wildcard := strings.CutSuffix(h, "*")
+			return k == h || (wildcard && strings.HasPrefix(k, prefix))
+		}) {
+			pairs = append(pairs, pair)
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+// validateMetadata checks the keys of Upload-Metadata are ASCII and its values
+// base64, see decodeMetadataValue. It returns metadata with the values
+// accepted leniently encoded again in padded standard base64, the encoding
+// the rest of the server decodes.
+func validateMetadata(metadata string, lenient bool) (string, error) {
 	pairs := strings.Split(metadata, ",")
-	for _, pair := range pairs {
+	normalized := false
+	for i, pair := range pairs {
 		pair = strings.TrimSpace(pair)
 		var k, v string
 		if strings.Contains(pair, " ") {
@@ -375,19 +1794,37 @@ func validateMetadata(metadata string) error {
 
 		// validate base64
 		if v != "" {
-			_, err := base64.StdEncoding.DecodeString(v)
+			value, err := decodeMetadataValue(v, lenient)
 			if err != nil {
-				return err
+				return "", err
+			}
+			if encoded := base64.StdEncoding.EncodeToString(value); encoded != v {
+				pairs[i] = k + " " + encoded
+				normalized = true
 			}
 		}
 
 		// validate key is ASCII chars
 		for s := range k {
 			if s > unicode.MaxASCII {
-				return fmt.Errorf("%c is not ASCII char", s)
+				return "", fmt.Errorf("%c is not ASCII char", s)
 			}
 		}
 	}
 
-	return nil
+	if normalized {
+		return strings.Join(pairs, ","), nil
+	}
+	return metadata, nil
+}
+
+// decodeMetadataValue decodes a value of Upload-Metadata. Strictly it is the
+// padded standard base64 of RFC 4648 the tus protocol asks for, leniently
+// the URL alphabet and the missing padding are accepted too.
+func decodeMetadataValue(value string, lenient bool) ([]byte, error) {
+	if !lenient {
+		return base64.StdEncoding.Strict().DecodeString(value)
+	}
+	value = strings.NewReplacer("-", "+", "_", "/").Replace(strings.TrimRight(value, "="))
+	return base64.RawStdEncoding.DecodeString(value)
 }
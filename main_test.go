@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"log/slog"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -26,7 +30,7 @@ var port = 1071
 
 func TestMain(m *testing.M) {
 	serverAddr = "localhost:1071"
-	tempUploadDir = os.TempDir()
+	tempUploadDir, _ = os.MkdirTemp("", "resumable-upload")
 
 	// run server
 	mux := buildServeMux(&ServerConfig{
@@ -34,11 +38,14 @@ func TestMain(m *testing.M) {
 		Host:      "localhost",
 		Port:      port,
 	})
-	var wg sync.WaitGroup
-	wg.Add(1)
+	// listen before running the tests so the first request does not race
+	// the server start up
+	listener, err := net.Listen("tcp", serverAddr)
+	if err != nil {
+		panic(err)
+	}
 	go func() {
-		defer wg.Done()
-		http.ListenAndServe(serverAddr, mux)
+		http.Serve(listener, mux)
 	}()
 
 	exit := m.Run()
@@ -570,15 +577,19 @@ func TestGracefulShutdown(t *testing.T) {
 				wg.Done()
 				err := server.Start()
 				if err != nil {
-					t.Fatalf("Fail to start server. error=%v", err)
+					t.Errorf("Fail to start server. error=%v", err)
 				}
 			}()
 
 			// walt for the server to be ready
 			time.Sleep(100 * time.Millisecond)
 			var responses []*http.Response
+			var responsesMu sync.Mutex
 			go func() {
-				responses = tt.clientRequest()
+				resp := tt.clientRequest()
+				responsesMu.Lock()
+				responses = resp
+				responsesMu.Unlock()
 			}()
 
 			// shutdown delay
@@ -598,6 +609,8 @@ func TestGracefulShutdown(t *testing.T) {
 			}
 
 			// verify all requests are completed
+			responsesMu.Lock()
+			defer responsesMu.Unlock()
 			for _, resp := range responses {
 				if resp.StatusCode != http.StatusOK {
 					t.Errorf("Status code is not %v. go=%v", http.StatusOK, resp.StatusCode)
@@ -606,3 +619,764 @@ func TestGracefulShutdown(t *testing.T) {
 		})
 	}
 }
+
+func TestConnectionLimit(t *testing.T) {
+	port := 9091
+	host := fmt.Sprintf("http://%s:%d", "localhost", port)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /fast", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		testName               string
+		overflow               string
+		queueTimeout           time.Duration
+		releaseDelay           time.Duration
+		expectedResponseStatus int
+	}{
+		{
+			testName:               "Should refuse connection above the limit",
+			overflow:               CONNECTION_OVERFLOW_REFUSE,
+			expectedResponseStatus: http.StatusServiceUnavailable,
+		},
+		{
+			testName:               "Should queue connection until a slot is released",
+			overflow:               CONNECTION_OVERFLOW_QUEUE,
+			queueTimeout:           2 * time.Second,
+			releaseDelay:           200 * time.Millisecond,
+			expectedResponseStatus: http.StatusOK,
+		},
+		{
+			testName:               "Should refuse queued connection when queue timeout exceeds",
+			overflow:               CONNECTION_OVERFLOW_QUEUE,
+			queueTimeout:           100 * time.Millisecond,
+			expectedResponseStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			server := NewServer(&ServerConfig{
+				Port:                   port,
+				ShutdownTimeoutSeconds: 1,
+				MaxConnections:         1,
+				ConnectionOverflow:     tt.overflow,
+				ConnectionQueueTimeout: tt.queueTimeout,
+			}, mux)
+			go func() {
+				if err := server.Start(); err != nil {
+					t.Errorf("Fail to start server. error=%v", err)
+				}
+			}()
+			defer server.Shutdown()
+
+			// wait for the server to be ready
+			time.Sleep(100 * time.Millisecond)
+
+			// hold the only available slot
+			conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+			if err != nil {
+				t.Fatalf("Fail to open connection. error=%v", err)
+			}
+			defer conn.Close()
+			time.Sleep(50 * time.Millisecond)
+
+			if tt.releaseDelay > 0 {
+				go func() {
+					time.Sleep(tt.releaseDelay)
+					conn.Close()
+				}()
+			}
+
+			client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+			res, err := client.Get(fmt.Sprintf("%s/fast", host))
+			if err != nil {
+				t.Fatalf("Fail to execute request. error=%v", err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != tt.expectedResponseStatus {
+				t.Errorf("GET /fast does not return %v. got=%v", tt.expectedResponseStatus, res.StatusCode)
+			}
+		})
+	}
+}
+
+// createUpload creates a new upload of the given length and returns its id
+func createUpload(t *testing.T, host string, length int) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, host, nil)
+	if err != nil {
+		t.Fatalf("Fail to create test data. Error=%v", err)
+	}
+	req.Header.Set(HEADER_UPLOAD_LENGTH, strconv.Itoa(length))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to create test data. Error=%v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Fail to create test data. Got status=%d", res.StatusCode)
+	}
+
+	location := res.Header.Get(HEADER_LOCATION)
+	return location[strings.LastIndex(location, "/")+1:]
+}
+
+func TestUploadLimit(t *testing.T) {
+	tests := []struct {
+		testName               string
+		config                 *ServerConfig
+		expectedResponseStatus int
+		expectedResponseHeader map[string]string
+	}{
+		{
+			testName: "Should reject upload above the global limit",
+			config: &ServerConfig{
+				UploadDir:        tempUploadDir,
+				MaxUploads:       1,
+				UploadRetryAfter: 3 * time.Second,
+			},
+			expectedResponseStatus: http.StatusTooManyRequests,
+			expectedResponseHeader: map[string]string{
+				HEADER_RETRY_AFTER:         "3",
+				HEADER_RATELIMIT_LIMIT:     "1",
+				HEADER_RATELIMIT_REMAINING: "0",
+				HEADER_RATELIMIT_RESET:     "3",
+			},
+		},
+		{
+			testName: "Should reject upload above the per client limit",
+			config: &ServerConfig{
+				UploadDir:           tempUploadDir,
+				MaxUploadsPerClient: 1,
+			},
+			expectedResponseStatus: http.StatusTooManyRequests,
+			expectedResponseHeader: map[string]string{
+				HEADER_RETRY_AFTER:         "1",
+				HEADER_RATELIMIT_LIMIT:     "1",
+				HEADER_RATELIMIT_REMAINING: "0",
+				HEADER_RATELIMIT_RESET:     "1",
+			},
+		},
+		{
+			testName: "Should accept upload below the limits",
+			config: &ServerConfig{
+				UploadDir:           tempUploadDir,
+				MaxUploads:          2,
+				MaxUploadsPerClient: 2,
+			},
+			expectedResponseStatus: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			server := httptest.NewServer(buildServeMux(tt.config))
+			defer server.Close()
+			host := fmt.Sprintf("%s/files", server.URL)
+
+			// keep the first upload active until the second one is done
+			activeId := createUpload(t, host, 100)
+			reader, writer := io.Pipe()
+			activeDone := make(chan struct{})
+			go func() {
+				defer close(activeDone)
+				req, _ := http.NewRequest(http.MethodPatch, fmt.Sprintf("%s/%s", host, activeId), reader)
+				req.Header.Set(HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM)
+				req.Header.Set(HEADER_UPLOAD_OFFSET, "0")
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Errorf("Fail to execute PATCH request. error=%v", err)
+					return
+				}
+				res.Body.Close()
+			}()
+			writer.Write([]byte(content[:10]))
+			time.Sleep(100 * time.Millisecond)
+
+			fileId := createUpload(t, host, 10)
+			req, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("%s/%s", host, fileId), strings.NewReader(content[:10]))
+			if err != nil {
+				t.Fatalf("Fail to create PATCH request. error=%v", err)
+			}
+			req.Header.Set(HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM)
+			req.Header.Set(HEADER_UPLOAD_OFFSET, "0")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute PATCH request. error=%v", err)
+			}
+			res.Body.Close()
+			writer.Close()
+			<-activeDone
+
+			if res.StatusCode != tt.expectedResponseStatus {
+				t.Errorf("PATCH /files/%s does not return %v. got=%v", fileId, tt.expectedResponseStatus, res.StatusCode)
+			}
+			for k, v := range tt.expectedResponseHeader {
+				if res.Header.Get(k) != v {
+					t.Errorf("PATCH /files does not return correct value for header %v, expected=%v. got=%v", k, v, res.Header.Get(k))
+				}
+			}
+		})
+	}
+}
+
+func TestSlowClientEviction(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{
+		UploadDir:             tempUploadDir,
+		MinTransferRate:       100,
+		MinTransferRateWindow: 200 * time.Millisecond,
+	}))
+	defer server.Close()
+	host := fmt.Sprintf("%s/files", server.URL)
+	fileId := createUpload(t, host, 100)
+
+	// send a few bytes then stall
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	go func() {
+		writer.Write([]byte(content[:10]))
+	}()
+
+	req, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("%s/%s", host, fileId), reader)
+	if err != nil {
+		t.Fatalf("Fail to create PATCH request. error=%v", err)
+	}
+	req.Header.Set(HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM)
+	req.Header.Set(HEADER_UPLOAD_OFFSET, "0")
+
+	start := time.Now()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute PATCH request. error=%v", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("PATCH /files/%s does not return %v. got=%v", fileId, http.StatusRequestTimeout, res.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("PATCH /files/%s is not evicted in time. took=%v", fileId, elapsed)
+	}
+
+	// the bytes received before the eviction are committed
+	req, err = http.NewRequest(http.MethodHead, fmt.Sprintf("%s/%s", host, fileId), nil)
+	if err != nil {
+		t.Fatalf("Fail to create HEAD request. error=%v", err)
+	}
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute HEAD request. error=%v", err)
+	}
+	if uploadOffset := res.Header.Get(HEADER_UPLOAD_OFFSET); uploadOffset != "10" {
+		t.Errorf("HEAD /files/%s does not return the committed offset, expected=10. got=%v", fileId, uploadOffset)
+	}
+}
+
+func TestMaxPatchDuration(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{
+		UploadDir:        tempUploadDir,
+		MaxPatchDuration: 200 * time.Millisecond,
+	}))
+	defer server.Close()
+	host := fmt.Sprintf("%s/files", server.URL)
+	fileId := createUpload(t, host, 100)
+
+	// send part of the body then hold the rest past the deadline
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	go func() {
+		writer.Write([]byte(content[:10]))
+	}()
+
+	req, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("%s/%s", host, fileId), reader)
+	if err != nil {
+		t.Fatalf("Fail to create PATCH request. error=%v", err)
+	}
+	req.Header.Set(HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM)
+	req.Header.Set(HEADER_UPLOAD_OFFSET, "0")
+
+	start := time.Now()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute PATCH request. error=%v", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("PATCH /files/%s does not return %v. got=%v", fileId, http.StatusNoContent, res.StatusCode)
+	}
+	if uploadOffset := res.Header.Get(HEADER_UPLOAD_OFFSET); uploadOffset != "10" {
+		t.Errorf("PATCH /files/%s does not return the committed offset, expected=10. got=%v", fileId, uploadOffset)
+	}
+	if !res.Close {
+		t.Errorf("PATCH /files/%s does not close the connection of the unread body", fileId)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("PATCH /files/%s is not cut in time. took=%v", fileId, elapsed)
+	}
+
+	// the client goes on from the offset
+	patchUpload(t, host, fileId, 10, content[10:20])
+}
+
+func TestPatchPastLength(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir}))
+	defer server.Close()
+	host := fmt.Sprintf("%s/files", server.URL)
+	fileId := createUpload(t, host, 10)
+	patchUpload(t, host, fileId, 0, content[:4])
+
+	// a chunked body does not declare its length up front
+	body := io.MultiReader(strings.NewReader(content[4:20]))
+	req, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("%s/%s", host, fileId), body)
+	if err != nil {
+		t.Fatalf("Fail to create PATCH request. error=%v", err)
+	}
+	req.Header.Set(HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM)
+	req.Header.Set(HEADER_UPLOAD_OFFSET, "4")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute PATCH request. error=%v", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("PATCH /files/%s does not return %v. got=%v", fileId, http.StatusRequestEntityTooLarge, res.StatusCode)
+	}
+	uploadOffset, err := strconv.Atoi(res.Header.Get(HEADER_UPLOAD_OFFSET))
+	if err != nil || uploadOffset > 10 {
+		t.Errorf("PATCH /files/%s does not return an offset within the length. got=%v", fileId, res.Header.Get(HEADER_UPLOAD_OFFSET))
+	}
+	if data, err := os.ReadFile(filepath.Join(tempUploadDir, fileId)); err != nil {
+		t.Fatalf("Fail to read upload data. error=%v", err)
+	} else if len(data) > 10 {
+		t.Errorf("PATCH /files/%s writes past the length of the upload. got=%d", fileId, len(data))
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	tests := []struct {
+		testName             string
+		basePath             string
+		expectedLocationPath string
+	}{
+		{
+			testName:             "Should default to /files",
+			basePath:             "",
+			expectedLocationPath: "/files",
+		},
+		{
+			testName:             "Should serve under a nested prefix",
+			basePath:             "/api/v1/files",
+			expectedLocationPath: "/api/v1/files",
+		},
+		{
+			testName:             "Should normalize slashes",
+			basePath:             "api/v1/files/",
+			expectedLocationPath: "/api/v1/files",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			server := httptest.NewServer(buildServeMux(&ServerConfig{
+				UploadDir: tempUploadDir,
+				BasePath:  tt.basePath,
+			}))
+			defer server.Close()
+
+			host := fmt.Sprintf("%s%s", server.URL, tt.expectedLocationPath)
+			req, err := http.NewRequest(http.MethodPost, host, nil)
+			if err != nil {
+				t.Fatalf("Fail to create POST request. error=%v", err)
+			}
+			req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute POST request. error=%v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusCreated {
+				t.Fatalf("POST %s does not return %v. got=%v", tt.expectedLocationPath, http.StatusCreated, res.StatusCode)
+			}
+
+			location, err := url.Parse(res.Header.Get(HEADER_LOCATION))
+			if err != nil {
+				t.Fatalf("POST %s returns invalid %s. error=%v", tt.expectedLocationPath, HEADER_LOCATION, err)
+			}
+			locationPath, id := path.Split(location.Path)
+			if locationPath != tt.expectedLocationPath+"/" {
+				t.Errorf("POST %s does not return correct %s path, expected=%s. got=%s", tt.expectedLocationPath, HEADER_LOCATION, tt.expectedLocationPath+"/", locationPath)
+			}
+
+			res, err = http.Head(fmt.Sprintf("%s/%s", host, id))
+			if err != nil {
+				t.Fatalf("Fail to execute HEAD request. error=%v", err)
+			}
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("HEAD %s/%s does not return %v. got=%v", tt.expectedLocationPath, id, http.StatusOK, res.StatusCode)
+			}
+		})
+	}
+}
+
+// patchUpload sends data at offset to the upload and fails the test unless
+// the server accepts it
+func patchUpload(t *testing.T, host, fileId string, offset int, data string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("%s/%s", host, fileId), strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Fail to create PATCH request. error=%v", err)
+	}
+	req.Header.Set(HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM)
+	req.Header.Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(offset))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute PATCH request. error=%v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("Fail to PATCH test data. Got status=%d", res.StatusCode)
+	}
+}
+
+func TestGet(t *testing.T) {
+	host := fmt.Sprintf("http://%s/files", serverAddr)
+
+	// a complete upload with metadata
+	req, err := http.NewRequest(http.MethodPost, host, nil)
+	if err != nil {
+		t.Fatalf("Fail to create test data. Error=%v", err)
+	}
+	req.Header.Set(HEADER_UPLOAD_LENGTH, "100")
+	// filename report.txt, filetype text/plain
+	req.Header.Set(HEADER_UPLOAD_METADATA, "filename cmVwb3J0LnR4dA==,filetype dGV4dC9wbGFpbg==")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to create test data. Error=%v", err)
+	}
+	res.Body.Close()
+	location := res.Header.Get(HEADER_LOCATION)
+	completeId := location[strings.LastIndex(location, "/")+1:]
+	patchUpload(t, host, completeId, 0, content[:100])
+
+	// an upload in progress
+	partialId := createUpload(t, host, 100)
+	patchUpload(t, host, partialId, 0, content[:40])
+
+	tests := []struct {
+		testName               string
+		fileId                 string
+		requestHeader          map[string]string
+		expectedResponseStatus int
+		expectedResponseHeader map[string]string
+		expectedBody           string
+	}{
+		{
+			testName:               "Should download a complete upload",
+			fileId:                 completeId,
+			expectedResponseStatus: http.StatusOK,
+			expectedResponseHeader: map[string]string{
+				HEADER_CONTENT_TYPE:        "text/plain",
+				HEADER_CONTENT_DISPOSITION: `attachment; filename=report.txt`,
+				HEADER_CONTENT_LENGTH:      "100",
+			},
+			expectedBody: content[:100],
+		},
+		{
+			testName: "Should download a range",
+			fileId:   completeId,
+			requestHeader: map[string]string{
+				"Range": "bytes=10-19",
+			},
+			expectedResponseStatus: http.StatusPartialContent,
+			expectedResponseHeader: map[string]string{
+				"Content-Range": "bytes 10-19/100",
+			},
+			expectedBody: content[10:20],
+		},
+		{
+			testName:               "Should download the committed bytes of an upload in progress",
+			fileId:                 partialId,
+			expectedResponseStatus: http.StatusOK,
+			expectedResponseHeader: map[string]string{
+				HEADER_CONTENT_TYPE:   CONTENT_TYPE_OCTET_STREAM,
+				HEADER_CONTENT_LENGTH: "40",
+			},
+			expectedBody: content[:40],
+		},
+		{
+			testName:               "Should return not found for unknown upload",
+			fileId:                 "unknown-id",
+			expectedResponseStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%s", host, tt.fileId), nil)
+			if err != nil {
+				t.Fatalf("Fail to create GET request. error=%v", err)
+			}
+			for k, v := range tt.requestHeader {
+				req.Header.Set(k, v)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute GET request. error=%v", err)
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+
+			if res.StatusCode != tt.expectedResponseStatus {
+				t.Errorf("GET /files/%s does not return %v. got=%v", tt.fileId, tt.expectedResponseStatus, res.StatusCode)
+			}
+			for k, v := range tt.expectedResponseHeader {
+				if res.Header.Get(k) != v {
+					t.Errorf("GET /files does not return correct value for header %v, expected=%v. got=%v", k, v, res.Header.Get(k))
+				}
+			}
+			if len(tt.expectedBody) > 0 && string(body) != tt.expectedBody {
+				t.Errorf("GET /files does not return the uploaded bytes, expected=%q. got=%q", tt.expectedBody, body)
+			}
+		})
+	}
+}
+
+func TestDroppedConnection(t *testing.T) {
+	tests := []struct {
+		testName string
+		config   *ServerConfig
+	}{
+		{"buffered", &ServerConfig{UploadDir: tempUploadDir}},
+		{"cached handle", &ServerConfig{UploadDir: tempUploadDir, MaxOpenFiles: 4}},
+		{"fsync per chunk", &ServerConfig{UploadDir: tempUploadDir, FsyncPolicy: FSYNC_CHUNK}},
+		{"direct IO", &ServerConfig{UploadDir: tempUploadDir, DirectIO: true}},
+		{"io_uring", &ServerConfig{UploadDir: tempUploadDir, IOURing: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			server := httptest.NewServer(buildServeMux(test.config))
+			defer server.Close()
+			host := fmt.Sprintf("%s/files", server.URL)
+			fileId := createUpload(t, host, 3*CHUNK_SIZE)
+
+			// announce the whole upload, send part of it and drop the connection
+			sent := CHUNK_SIZE + 5000
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Fatalf("Fail to connect. error=%v", err)
+			}
+			fmt.Fprintf(conn, "PATCH /files/%s HTTP/1.1\r\nHost: %s\r\n%s: %s\r\n%s: 0\r\n%s: %d\r\n\r\n",
+				fileId, server.Listener.Addr(), HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM,
+				HEADER_UPLOAD_OFFSET, HEADER_CONTENT_LENGTH, 3*CHUNK_SIZE)
+			if _, err := conn.Write(make([]byte, sent)); err != nil {
+				t.Fatalf("Fail to send the body. error=%v", err)
+			}
+			conn.Close()
+
+			// the handler sees the drop asynchronously
+			var offset string
+			for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				res, err := http.Head(fmt.Sprintf("%s/%s", host, fileId))
+				if err != nil {
+					t.Fatalf("Fail to execute HEAD request. error=%v", err)
+				}
+				res.Body.Close()
+				if offset = res.Header.Get(HEADER_UPLOAD_OFFSET); offset == strconv.Itoa(sent) {
+					break
+				}
+			}
+			if offset != strconv.Itoa(sent) {
+				t.Fatalf("HEAD /files/%s does not return the bytes received before the drop, expected=%d. got=%s", fileId, sent, offset)
+			}
+
+			// the client resumes from there, once the dropped PATCH has
+			// released the upload
+			for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+				req, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("%s/%s", host, fileId), strings.NewReader(strings.Repeat("a", 3*CHUNK_SIZE-sent)))
+				if err != nil {
+					t.Fatalf("Fail to create PATCH request. error=%v", err)
+				}
+				req.Header.Set(HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM)
+				req.Header.Set(HEADER_UPLOAD_OFFSET, offset)
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("Fail to execute PATCH request. error=%v", err)
+				}
+				res.Body.Close()
+				if res.StatusCode == http.StatusLocked && time.Now().Before(deadline) {
+					continue
+				}
+				if res.StatusCode != http.StatusNoContent {
+					t.Errorf("PATCH /files/%s does not resume the upload. got=%v", fileId, res.StatusCode)
+				}
+				break
+			}
+		})
+	}
+}
+
+func TestConcurrentPatch(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir}))
+	defer server.Close()
+	host := fmt.Sprintf("%s/files", server.URL)
+	fileId := createUpload(t, host, 20)
+
+	newPatch := func(body io.Reader) *http.Request {
+		req, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("%s/%s", host, fileId), body)
+		if err != nil {
+			t.Fatalf("Fail to create PATCH request. error=%v", err)
+		}
+		req.Header.Set(HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM)
+		req.Header.Set(HEADER_UPLOAD_OFFSET, "0")
+		return req
+	}
+
+	// the first PATCH holds the upload while its body trickles in
+	reader, writer := io.Pipe()
+	first := make(chan int)
+	go func() {
+		res, err := http.DefaultClient.Do(newPatch(reader))
+		if err != nil {
+			t.Errorf("Fail to execute PATCH request. error=%v", err)
+			first <- 0
+			return
+		}
+		res.Body.Close()
+		first <- res.StatusCode
+	}()
+	writer.Write([]byte(content[:5]))
+	time.Sleep(50 * time.Millisecond)
+
+	// a retry of the same chunk is rejected instead of appended twice
+	res, err := http.DefaultClient.Do(newPatch(strings.NewReader(content[:10])))
+	if err != nil {
+		t.Fatalf("Fail to execute PATCH request. error=%v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusLocked {
+		t.Errorf("concurrent PATCH /files/%s does not return %v. got=%v", fileId, http.StatusLocked, res.StatusCode)
+	}
+
+	writer.Write([]byte(content[5:10]))
+	writer.Close()
+	if status := <-first; status != http.StatusNoContent {
+		t.Errorf("PATCH /files/%s does not return %v. got=%v", fileId, http.StatusNoContent, status)
+	}
+
+	res, err = http.Head(fmt.Sprintf("%s/%s", host, fileId))
+	if err != nil {
+		t.Fatalf("Fail to execute HEAD request. error=%v", err)
+	}
+	res.Body.Close()
+	if uploadOffset := res.Header.Get(HEADER_UPLOAD_OFFSET); uploadOffset != "10" {
+		t.Errorf("HEAD /files/%s does not return the offset of a single write, expected=10. got=%v", fileId, uploadOffset)
+	}
+}
+
+func TestRedactMetadata(t *testing.T) {
+	metadata := "filename YS50eHQ=,owner MTI=,secret_token c2VjcmV0,secret_key a2V5"
+	tests := []struct {
+		testName string
+		hidden   []string
+		expected string
+	}{
+		{"Should keep everything without hidden keys", nil, metadata},
+		{"Should remove a hidden key", []string{"owner"}, "filename YS50eHQ=,secret_token c2VjcmV0,secret_key a2V5"},
+		{"Should remove the keys of a prefix", []string{"secret_*"}, "filename YS50eHQ=,owner MTI="},
+		{"Should not remove the keys a key prefixes", []string{"secret"}, metadata},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			if got := redactMetadata(metadata, test.hidden); got != test.expected {
+				t.Errorf("redactMetadata does not return %q. got=%q", test.expected, got)
+			}
+		})
+	}
+
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, HiddenMetadata: []string{"owner", "secret_*"}}))
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/files", nil)
+	if err != nil {
+		t.Fatalf("Fail to create test data. Error=%v", err)
+	}
+	req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+	req.Header.Set(HEADER_UPLOAD_METADATA, metadata)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to create test data. Error=%v", err)
+	}
+	res.Body.Close()
+	location := res.Header.Get(HEADER_LOCATION)
+	res, err = http.Head(server.URL + "/files/" + location[strings.LastIndex(location, "/")+1:])
+	if err != nil {
+		t.Fatalf("Fail to execute HEAD request. error=%v", err)
+	}
+	res.Body.Close()
+	if got := res.Header.Get(HEADER_UPLOAD_METADATA); got != "filename YS50eHQ=" {
+		t.Errorf("HEAD does not hide the metadata keys. got=%q", got)
+	}
+}
+
+func TestMetadataEncoding(t *testing.T) {
+	tests := []struct {
+		testName         string
+		metadata         string
+		lenient          bool
+		expectError      bool
+		expectedMetadata string
+	}{
+		{"strict padded", "filename YS50eHQ=,name YT8+", false, false, "filename YS50eHQ=,name YT8+"},
+		{"strict unpadded", "filename YS50eHQ", false, true, ""},
+		{"strict url alphabet", "name YT8-", false, true, ""},
+		{"strict trailing bits", "filename YS50eHR=", false, true, ""},
+		{"lenient padded", "filename YS50eHQ=,name YT8+", true, false, "filename YS50eHQ=,name YT8+"},
+		{"lenient unpadded", "filename YS50eHQ,is_confidential", true, false, "filename YS50eHQ=,is_confidential"},
+		{"lenient url alphabet", "name YT8-", true, false, "name YT8+"},
+		{"lenient garbage", "filename ==!o", true, true, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			metadata, err := validateMetadata(test.metadata, test.lenient)
+			if (err != nil) != test.expectError {
+				t.Fatalf("validateMetadata does not return error=%v. got=%v", test.expectError, err)
+			}
+			if metadata != test.expectedMetadata {
+				t.Errorf("validateMetadata does not return %q. got=%q", test.expectedMetadata, metadata)
+			}
+		})
+	}
+
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, MetadataEncoding: METADATA_ENCODING_LENIENT}))
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/files", nil)
+	if err != nil {
+		t.Fatalf("Fail to create test data. Error=%v", err)
+	}
+	req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+	req.Header.Set(HEADER_UPLOAD_METADATA, "filename YS50eHQ,name YT8-")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to create test data. Error=%v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("POST with lenient metadata does not return 201. got=%d", res.StatusCode)
+	}
+	location := res.Header.Get(HEADER_LOCATION)
+	res, err = http.Head(server.URL + "/files/" + location[strings.LastIndex(location, "/")+1:])
+	if err != nil {
+		t.Fatalf("Fail to execute HEAD request. error=%v", err)
+	}
+	res.Body.Close()
+	if metadata := parseMetadata(res.Header.Get(HEADER_UPLOAD_METADATA)); metadata["filename"] != "a.txt" || metadata["name"] != "a?>" {
+		t.Errorf("HEAD does not return the metadata in standard base64. got=%s", res.Header.Get(HEADER_UPLOAD_METADATA))
+	}
+}
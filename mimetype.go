@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+)
+
+// the number of leading bytes the content type is sniffed from, see
+// http.DetectContentType
+const MIME_SNIFF_SIZE = 512
+
+// detectMIMEType sniffs the content type of a complete upload from its first
+// bytes and records it in its state, so the processing steps and the
+// downloads of the uploads created without a filetype don't have to guess.
+// The state is persisted by the caller.
+func (f *File) detectMIMEType() error {
+	if f.Size <= 0 || f.state() != UPLOAD_STATE_COMPLETED || f.isCompressed() || len(f.mimeType()) > 0 {
+		return nil
+	}
+	file, err := os.Open(f.path())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buff := make([]byte, MIME_SNIFF_SIZE)
+	n, err := io.ReadFull(file, buff)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	f.mu.Lock()
+	f.sniffed = http.DetectContentType(buff[:n])
+	f.mu.Unlock()
+	return nil
+}
+
+// mimeType returns the content type sniffed from the data of the upload,
+// empty until it is complete
+func (f *File) mimeType() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.sniffed
+}
+
+// fileType returns the content type of the upload, the filetype metadata of
+// its creation over the sniffed one
+func (f *File) fileType() string {
+	if filetype := parseMetadata(f.metadata())["filetype"]; len(filetype) > 0 {
+		return filetype
+	}
+	return f.mimeType()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDetectMIMEType(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 24)
+	tests := []struct {
+		testName            string
+		metadata            string
+		data                string
+		expectedContentType string
+	}{
+		{"Should type the download per the sniffed type", "", png, "image/png"},
+		{"Should sniff text", "", content[:20], "text/plain; charset=utf-8"},
+		{"Should keep the filetype of the creation", "filetype " + base64.StdEncoding.EncodeToString([]byte("image/x-custom")), png, "image/x-custom"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			defer func() { uploadDir = tempUploadDir }()
+			config := &ServerConfig{UploadDir: t.TempDir(), PersistState: true}
+			server := httptest.NewServer(buildServeMux(config))
+			defer server.Close()
+			host := server.URL + "/files"
+
+			req, err := http.NewRequest(http.MethodPost, host, nil)
+			if err != nil {
+				t.Fatalf("Fail to create test data. Error=%v", err)
+			}
+			req.Header.Set(HEADER_UPLOAD_LENGTH, strconv.Itoa(len(test.data)))
+			req.Header.Set(HEADER_UPLOAD_METADATA, test.metadata)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to create test data. Error=%v", err)
+			}
+			res.Body.Close()
+			location := res.Header.Get(HEADER_LOCATION)
+			fileId := location[strings.LastIndex(location, "/")+1:]
+			patchUpload(t, host, fileId, 0, test.data)
+
+			res, err = http.Get(fmt.Sprintf("%s/%s", host, fileId))
+			if err != nil {
+				t.Fatalf("Fail to execute GET request. error=%v", err)
+			}
+			res.Body.Close()
+			if got := res.Header.Get(HEADER_CONTENT_TYPE); got != test.expectedContentType {
+				t.Errorf("GET does not return Content-Type %s. got=%s", test.expectedContentType, got)
+			}
+
+			info, err := readInfo(filepath.Join(config.UploadDir, fileId+INFO_EXTENSION))
+			if err != nil {
+				t.Fatalf("Fail to read the info file. error=%v", err)
+			}
+			if len(info.MIMEType) <= 0 {
+				t.Errorf("the info file does not record the sniffed type")
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// the form field holding the file of a multipart upload
+const MULTIPART_FILE_FIELD = "file"
+
+// the size of the value of a form field copied into the metadata
+const multipartMaxField = 4096
+
+var (
+	errMultipartNoFile   = errors.New("the form has no file field")
+	errMultipartTooLarge = errors.New("the file is larger than the maximum size")
+)
+
+// readMultipartUpload reads the multipart/form-data body of r, spooling the
+// file field into a temporary file of dir since its size is only known once
+// read. The other fields and the name and type of the file become the
+// metadata of the upload. The caller removes the temporary file.
+func readMultipartUpload(r *http.Request, dir string, maxSize int) (*os.File, int, map[string]string, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	metadata := make(map[string]string)
+	var spool *os.File
+	size := 0
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return spool, 0, nil, err
+		}
+		if part.FormName() != MULTIPART_FILE_FIELD || spool != nil {
+			value, err := io.ReadAll(io.LimitReader(part, multipartMaxField))
+			if err != nil {
+				return spool, 0, nil, err
+			}
+			if len(part.FormName()) > 0 && part.FormName() != MULTIPART_FILE_FIELD {
+				metadata[part.FormName()] = string(value)
+			}
+			continue
+		}
+
+		if spool, err = os.CreateTemp(dir, ".multipart-*"); err != nil {
+			return nil, 0, nil, err
+		}
+		n, err := io.Copy(spool, io.LimitReader(part, int64(maxSize)+1))
+		if err != nil {
+			return spool, 0, nil, err
+		}
+		if n > int64(maxSize) {
+			return spool, 0, nil, errMultipartTooLarge
+		}
+		size = int(n)
+		if name := part.FileName(); len(name) > 0 {
+			metadata["filename"] = name
+		}
+		if filetype := part.Header.Get(HEADER_CONTENT_TYPE); len(filetype) > 0 && !strings.EqualFold(filetype, CONTENT_TYPE_OCTET_STREAM) {
+			metadata["filetype"] = filetype
+		}
+	}
+	if spool == nil {
+		return nil, 0, nil, errMultipartNoFile
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return spool, 0, nil, err
+	}
+	return spool, size, metadata, nil
+}
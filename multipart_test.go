@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"maps"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"testing"
+)
+
+func TestMultipartUpload(t *testing.T) {
+	tests := []struct {
+		testName         string
+		fileField        string
+		data             string
+		fields           map[string]string
+		expectedStatus   int
+		expectedMetadata map[string]string
+	}{
+		{"file", MULTIPART_FILE_FIELD, content[:10], nil, http.StatusCreated, map[string]string{"filename": "a.txt", "filetype": "text/plain"}},
+		{"file and fields", MULTIPART_FILE_FIELD, content[:10], map[string]string{"owner": "me"}, http.StatusCreated, map[string]string{"filename": "a.txt", "filetype": "text/plain", "owner": "me"}},
+		{"empty file", MULTIPART_FILE_FIELD, "", nil, http.StatusCreated, map[string]string{"filename": "a.txt", "filetype": "text/plain"}},
+		{"no file", "other", content[:10], nil, http.StatusBadRequest, nil},
+		{"invalid field name", MULTIPART_FILE_FIELD, content[:10], map[string]string{"a b": "c"}, http.StatusBadRequest, nil},
+	}
+
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, RelativeLocation: true}))
+	defer server.Close()
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			var body bytes.Buffer
+			form := multipart.NewWriter(&body)
+			for k, v := range test.fields {
+				form.WriteField(k, v)
+			}
+			header := make(textproto.MIMEHeader)
+			header.Set("Content-Disposition", `form-data; name="`+test.fileField+`"; filename="a.txt"`)
+			header.Set(HEADER_CONTENT_TYPE, "text/plain")
+			part, err := form.CreatePart(header)
+			if err != nil {
+				t.Fatalf("Fail to create test data. error=%v", err)
+			}
+			io.WriteString(part, test.data)
+			form.Close()
+
+			res, err := http.Post(server.URL+"/upload", form.FormDataContentType(), &body)
+			if err != nil {
+				t.Fatalf("Fail to execute POST request. error=%v", err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != test.expectedStatus {
+				t.Fatalf("POST /upload does not return %v. got=%v", test.expectedStatus, res.StatusCode)
+			}
+			if test.expectedStatus != http.StatusCreated {
+				return
+			}
+			var created struct {
+				ID       string `json:"id"`
+				Location string `json:"location"`
+				Size     int    `json:"size"`
+			}
+			if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+				t.Fatalf("Fail to decode response. error=%v", err)
+			}
+			if created.Location != res.Header.Get(HEADER_LOCATION) || created.Size != len(test.data) {
+				t.Errorf("POST /upload does not return the upload. got=%+v", created)
+			}
+
+			// the upload is a complete tus upload
+			head, err := http.Head(server.URL + created.Location)
+			if err != nil {
+				t.Fatalf("Fail to execute HEAD request. error=%v", err)
+			}
+			head.Body.Close()
+			if head.Header.Get(HEADER_UPLOAD_STATE) != UPLOAD_STATE_COMPLETED || head.Header.Get(HEADER_UPLOAD_OFFSET) != strconv.Itoa(len(test.data)) {
+				t.Errorf("the upload is not complete. got=%s at %s", head.Header.Get(HEADER_UPLOAD_STATE), head.Header.Get(HEADER_UPLOAD_OFFSET))
+			}
+			metadata := parseMetadata(head.Header.Get(HEADER_UPLOAD_METADATA))
+			if !maps.Equal(metadata, test.expectedMetadata) {
+				t.Errorf("the upload metadata is not %v. got=%v", test.expectedMetadata, metadata)
+			}
+			get, err := http.Get(server.URL + created.Location)
+			if err != nil {
+				t.Fatalf("Fail to execute GET request. error=%v", err)
+			}
+			data, _ := io.ReadAll(get.Body)
+			get.Body.Close()
+			if string(data) != test.data {
+				t.Errorf("GET does not return the uploaded file. got=%s", data)
+			}
+		})
+	}
+}
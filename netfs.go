@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// errSizeMismatch is returned by a write on a network filesystem finding the
+// data file no longer ends at the offset it writes at
+var errSizeMismatch = errors.New("data file size does not match the upload offset")
+
+// openAt opens the data file at path for writing at an explicit offset.
+// O_APPEND isn't atomic over NFS and SMB, the client computes the end of the
+// file from attributes that may be stale.
+func openAt(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// sizeCheckedWriter writes to a data file on a network filesystem, it checks
+// before every chunk that the file ends where the chunk goes so a write lost
+// or made by another client behind the lock is caught instead of leaving a
+// hole or overwriting data. The file is opened per PATCH, the close-to-open
+// consistency of NFS then refreshes its attributes.
+type sizeCheckedWriter struct {
+	w      io.Writer
+	file   *os.File
+	offset int64
+}
+
+func (w *sizeCheckedWriter) Write(p []byte) (int, error) {
+	stat, err := w.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if stat.Size() != w.offset {
+		return 0, fmt.Errorf("%w: size=%d offset=%d", errSizeMismatch, stat.Size(), w.offset)
+	}
+	n, err := w.w.Write(p)
+	w.offset += int64(n)
+	return n, err
+}
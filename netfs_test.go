@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNetworkFSWrite(t *testing.T) {
+	tests := []struct {
+		testName       string
+		change         func(path string) error
+		expectedStatus int
+		expectedOffset int
+	}{
+		{"Should write at the offset", func(path string) error { return nil }, http.StatusNoContent, 10},
+		{"Should drop the data written past the offset behind the lock", func(path string) error {
+			file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			_, err = file.WriteString("junk")
+			return err
+		}, http.StatusConflict, 5},
+		{"Should lower the offset to the data left on disk", func(path string) error { return os.Truncate(path, 3) }, http.StatusConflict, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			defer func() { uploadDir = tempUploadDir }()
+			dir := t.TempDir()
+			server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: dir, NetworkFS: true, MaxOpenFiles: 8}))
+			defer server.Close()
+			host := server.URL + "/files"
+
+			fileId := createUpload(t, host, 10)
+			patchUpload(t, host, fileId, 0, content[:5])
+			if err := test.change(filepath.Join(dir, fileId)); err != nil {
+				t.Fatalf("Fail to change the data file. error=%v", err)
+			}
+
+			req, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("%s/%s", host, fileId), strings.NewReader(content[5:10]))
+			if err != nil {
+				t.Fatalf("Fail to create test data. Error=%v", err)
+			}
+			req.Header.Set(HEADER_CONTENT_TYPE, "application/offset+octet-stream")
+			req.Header.Set(HEADER_UPLOAD_OFFSET, "5")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute PATCH request. error=%v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != test.expectedStatus {
+				t.Errorf("PATCH does not return %d. got=%d", test.expectedStatus, res.StatusCode)
+			}
+			if offset := res.Header.Get(HEADER_UPLOAD_OFFSET); offset != strconv.Itoa(test.expectedOffset) {
+				t.Errorf("PATCH does not return the offset %d. got=%s", test.expectedOffset, offset)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, fileId))
+			if err != nil {
+				t.Fatalf("Fail to read the data file. error=%v", err)
+			}
+			if string(data) != content[:test.expectedOffset] {
+				t.Errorf("the data file does not hold the committed data. got=%q", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// openAPIDocument returns the OpenAPI 3 document of the endpoints served by
+// buildServeMux for config, only the optional headers, status codes and
+// endpoints enabled by config are described
+func openAPIDocument(config *ServerConfig, basePath string) map[string]any {
+	tusResumable := openAPIHeader("The version of the tus protocol, "+TUS_PROTOCOL_VERSION, true)
+	offset := openAPIHeader("The offset of the upload in bytes", false)
+	id := map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string", "format": "uuid"}}
+
+	metadata := "Comma separated key and base64 encoded value pairs, filename and filetype name and type the downloads"
+	if config.MetadataEncoding == METADATA_ENCODING_LENIENT {
+		metadata = "Comma separated key and base64 encoded value pairs, padded or not, in the standard or the URL safe alphabet, filename and filetype name and type the downloads"
+	}
+	if len(config.CallbackHosts) > 0 {
+		metadata += ", callback_url is POSTed the upload once complete and must be on an allowed host"
+	}
+	createHeaders := []any{
+		openAPIParameter(HEADER_UPLOAD_LENGTH, "The size of the upload in bytes, at most "+strconv.Itoa(effectiveMaxSize(config)), true),
+		openAPIParameter(HEADER_UPLOAD_METADATA, metadata, false),
+		openAPIParameter(HEADER_UPLOAD_ALIAS, "A relative path naming the upload, i.e., builds/2024-06-01/app.tar.gz, which /aliases/{alias} redirects to the upload", false),
+	}
+	if config.IdempotencyWindow > 0 {
+		idempotencyKey := "Makes a retried creation return the upload of the first attempt"
+		if config.CoalesceCreations > 0 {
+			idempotencyKey = "Makes a retried creation return the upload of the first attempt, a creation sent while the first one is in progress waits for its upload"
+		}
+		createHeaders = append(createHeaders, openAPIParameter(HEADER_IDEMPOTENCY_KEY, idempotencyKey, false))
+	}
+	if config.Digest {
+		createHeaders = append(createHeaders, openAPIParameter(HEADER_REPR_DIGEST, "The SHA-256 of the data as sha-256=:<base64>:, a complete upload of the same data and owner is returned instead of a new one", false))
+	}
+	if config.MaxExpireAfter > 0 {
+		createHeaders = append(createHeaders, openAPIParameter(HEADER_UPLOAD_EXPIRES, "The HTTP date the upload expires at unless completed, instead of after the idle time of the server, lowered to the latest the server allows", false))
+	}
+	if len(config.PolicySecret) > 0 {
+		createHeaders = append(createHeaders, openAPIParameter(HEADER_UPLOAD_POLICY, "The signed policy of the upload issued by the application, setting its max size", !config.AnonymousUploads))
+	}
+
+	headHeaders := map[string]any{
+		HEADER_TUS_RESUMABLE:   tusResumable,
+		HEADER_UPLOAD_OFFSET:   offset,
+		HEADER_UPLOAD_LENGTH:   openAPIHeader("The size of the upload in bytes", true),
+		HEADER_UPLOAD_METADATA: openAPIHeader("The metadata of the upload, without the keys of HiddenMetadata", false),
+		HEADER_UPLOAD_STATE:    openAPIHeader("The state of the upload: created, uploading or completed", false),
+		HEADER_UPLOAD_CREATED:  openAPIHeader("When the upload was created, as an HTTP date", false),
+		HEADER_UPLOAD_ACTIVITY: openAPIHeader("The last write of the upload, as an HTTP date", false),
+		HEADER_UPLOAD_PAUSED:   openAPIHeader("true when the upload is paused, its PATCHes are refused", false),
+		HEADER_UPLOAD_ALIAS:    openAPIHeader("The alias of the upload", false),
+	}
+	patchHeaders := map[string]any{
+		HEADER_TUS_RESUMABLE: tusResumable,
+		HEADER_UPLOAD_OFFSET: offset,
+	}
+	if config.Checksum {
+		checksum := openAPIHeader("The SHA-256 of the complete upload as sha256 <base64>", false)
+		headHeaders[HEADER_UPLOAD_CHECKSUM] = checksum
+		patchHeaders[HEADER_UPLOAD_CHECKSUM] = checksum
+	}
+	if expiring(config) {
+		expires := openAPIHeader("When the upload expires unless completed, as an HTTP date", false)
+		headHeaders[HEADER_UPLOAD_EXPIRES] = expires
+		patchHeaders[HEADER_UPLOAD_EXPIRES] = expires
+	}
+	download := map[string]any{"description": "The bytes uploaded so far, typed per filetype", "content": map[string]any{"*/*": map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}}
+	if config.CompressDownloads {
+		download["description"] = "The bytes uploaded so far, typed per filetype. The text types are sent compressed with the zstd or gzip Content-Encoding the client accepts, ignoring Range"
+	}
+	if config.Digest {
+		digest := openAPIHeader("The SHA-256 of the complete upload as sha-256=:<base64>:, see RFC 9530", false)
+		headHeaders[HEADER_REPR_DIGEST] = digest
+		download["headers"] = map[string]any{HEADER_REPR_DIGEST: digest}
+	}
+	if slices.Contains(config.ProcessingSteps, STEP_TRANSCODE) {
+		headHeaders[HEADER_TRANSCODE_JOB] = openAPIHeader("The id of the transcode job of the video upload once dispatched", false)
+	}
+
+	createdHeaders := map[string]any{HEADER_LOCATION: openAPIHeader("The URL of the upload", true), HEADER_TUS_RESUMABLE: tusResumable}
+	if expiring(config) {
+		createdHeaders[HEADER_UPLOAD_EXPIRES] = openAPIHeader("When the upload expires unless completed, as an HTTP date", false)
+	}
+	invalid := "The metadata is invalid or rejected by a hook"
+	if config.MaxExpireAfter > 0 {
+		invalid = "The metadata or the Upload-Expires is invalid, or the metadata is rejected by a hook"
+	}
+	createResponses := map[string]any{
+		"201": openAPIResponse("The upload is created", createdHeaders),
+		"400": openAPIResponse(invalid, nil),
+		"409": openAPIResponse("The Upload-Alias names another upload", nil),
+		"413": openAPIResponse("The upload is larger than Tus-Max-Size or its metadata is too large", nil),
+		"500": openAPIResponse("The upload could not be created", nil),
+		"507": openAPIResponse("There is not enough disk space for the upload", nil),
+	}
+	if config.Digest {
+		createdHeaders[HEADER_UPLOAD_OFFSET] = openAPIHeader("The offset of the complete upload returned for its Repr-Digest", false)
+		createResponses["201"] = openAPIResponse("The upload is created, or the complete upload of the same Repr-Digest is returned", createdHeaders)
+		createResponses["400"] = openAPIResponse("The metadata or the Repr-Digest is invalid, or rejected by a hook", nil)
+		if config.MaxExpireAfter > 0 {
+			createResponses["400"] = openAPIResponse("The metadata, the Repr-Digest or the Upload-Expires is invalid, or the metadata is rejected by a hook", nil)
+		}
+	}
+	if config.IdempotencyWindow > 0 {
+		createResponses["409"] = openAPIResponse("A creation with the same Idempotency-Key is in progress, or the Upload-Alias names another upload", nil)
+		createResponses["422"] = openAPIResponse("The Idempotency-Key was used for another upload", nil)
+	}
+	if len(config.PolicySecret) > 0 {
+		createResponses["403"] = openAPIResponse("The Upload-Policy is missing, invalid or expired", nil)
+	}
+
+	retryAfter := map[string]any{
+		HEADER_RETRY_AFTER:         openAPIHeader("The seconds to wait before retrying", false),
+		HEADER_RATELIMIT_LIMIT:     openAPIHeader("The number of uploads in progress allowed, the tightest of MaxUploads and MaxUploadsPerClient", false),
+		HEADER_RATELIMIT_REMAINING: openAPIHeader("The number of uploads the client may still start", false),
+		HEADER_RATELIMIT_RESET:     openAPIHeader("The seconds until a slot is likely free", false),
+	}
+	patchResponses := map[string]any{
+		"204": openAPIResponse("The chunk is written", patchHeaders),
+		"400": openAPIResponse("The offset is invalid, the body can't be decoded or the client disconnected, the bytes received are kept", map[string]any{HEADER_UPLOAD_OFFSET: offset}),
+		"404": openAPIResponse("There is no such upload", nil),
+		"409": openAPIResponse("The offset does not match the one of the upload, which the problem details tell too", map[string]any{HEADER_UPLOAD_OFFSET: offset}),
+		"410": openAPIResponse("The upload is terminated or expired", nil),
+		"415": openAPIResponse("The Content-Type is not "+CONTENT_TYPE_OFFSET_OCTET_STREAM+" or the Content-Encoding is not gzip", nil),
+		"423": openAPIResponse("Another PATCH is writing the upload, or the upload is paused, which Upload-Paused and the problem details tell", map[string]any{HEADER_UPLOAD_PAUSED: openAPIHeader("true when the upload is paused", false)}),
+		"500": openAPIResponse("The chunk could not be written", nil),
+	}
+	if config.MaxUploads > 0 || config.MaxUploadsPerClient > 0 {
+		patchResponses["429"] = openAPIResponse("Too many uploads are in progress", retryAfter)
+	}
+	if config.MaxBufferMemory > 0 {
+		patchResponses["503"] = openAPIResponse("The server is out of buffer memory", retryAfter)
+	}
+	downloadResponses := map[string]any{
+		"200": download,
+		"206": openAPIResponse("The requested range", nil),
+		"404": openAPIResponse("There is no such upload", nil),
+		"410": openAPIResponse("The upload is terminated or expired, or another upload was finalized over its file", nil),
+	}
+	headResponses := map[string]any{"200": openAPIResponse("The state of the upload", headHeaders), "404": openAPIResponse("There is no such upload", nil), "410": openAPIResponse("The upload is terminated or expired", nil)}
+	if len(config.PolicySecret) > 0 {
+		signed := openAPIResponse("The signature of the signed URL of the upload is missing, invalid or expired, or the upload is owned by the subject of another Upload-Policy", nil)
+		headResponses["403"] = signed
+		patchResponses["403"] = signed
+		downloadResponses["403"] = openAPIResponse("The upload is owned by the subject of another Upload-Policy, or it is anonymous", nil)
+	}
+	if config.MaxPatchDuration > 0 {
+		patchResponses["204"] = openAPIResponse("The chunk is written, or the part of it received within the max duration of a PATCH, Upload-Offset tells", patchHeaders)
+	}
+	if config.MinTransferRate > 0 {
+		patchResponses["408"] = openAPIResponse("The upload was slower than the minimum transfer rate", map[string]any{HEADER_UPLOAD_OFFSET: offset})
+	}
+
+	paths := map[string]any{
+		basePath: map[string]any{
+			"options": map[string]any{
+				"summary":   "Discover the capabilities of the server",
+				"responses": map[string]any{"204": openAPIResponse("The capabilities", map[string]any{HEADER_TUS_RESUMABLE: tusResumable, HEADER_TUS_VERSION: openAPIHeader("The supported versions", true), HEADER_TUS_EXTENSION: openAPIHeader("The supported extensions: creation, and expiration when the uploads expire", true), HEADER_TUS_MAX_SIZE: openAPIHeader("The largest upload in bytes", true)})},
+			},
+			"post": map[string]any{
+				"summary":    "Create an upload",
+				"parameters": createHeaders,
+				"responses":  createResponses,
+			},
+		},
+		basePath + "/{id}": map[string]any{
+			"parameters": []any{id},
+			"head": map[string]any{
+				"summary":   "Get the offset of an upload to resume it",
+				"responses": headResponses,
+			},
+			"get": map[string]any{
+				"summary":   "Download the bytes uploaded so far",
+				"responses": downloadResponses,
+			},
+			"patch": map[string]any{
+				"summary": "Write a chunk at the offset of the upload",
+				"parameters": []any{
+					openAPIParameter(HEADER_UPLOAD_OFFSET, "The offset the chunk is written at, it must be the one of the upload", true),
+					openAPIParameter(HEADER_TUS_RESUMABLE, "The version of the tus protocol, "+TUS_PROTOCOL_VERSION, true),
+					openAPIParameter(HEADER_CONTENT_ENCODING, "gzip to send the chunk compressed, the offsets count the decompressed bytes", false),
+				},
+				"requestBody": map[string]any{"required": true, "content": map[string]any{CONTENT_TYPE_OFFSET_OCTET_STREAM: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}},
+				"responses":   patchResponses,
+			},
+		},
+	}
+	multipartResponses := map[string]any{
+		"201": map[string]any{"description": "The upload is created complete", "headers": map[string]any{HEADER_LOCATION: openAPIHeader("The URL of the upload", true)}, "content": map[string]any{"application/json": map[string]any{"schema": map[string]any{"type": "object", "properties": map[string]any{
+			"id": map[string]any{"type": "string"}, "location": map[string]any{"type": "string"}, "size": map[string]any{"type": "integer"},
+		}}}}},
+		"400": openAPIResponse("The form has no file or is rejected by a hook", nil),
+		"413": openAPIResponse("The file is larger than Tus-Max-Size or the body carries more than the rest of the upload", nil),
+		"500": openAPIResponse("The upload could not be written", nil),
+	}
+	if config.MaxUploads > 0 || config.MaxUploadsPerClient > 0 {
+		multipartResponses["429"] = openAPIResponse("Too many uploads are in progress", retryAfter)
+	}
+	paths["/aliases/{alias}"] = map[string]any{
+		"get": map[string]any{
+			"summary":    "Find the upload an alias names",
+			"parameters": []any{map[string]any{"name": "alias", "in": "path", "required": true, "description": "The alias, slashes included", "schema": map[string]any{"type": "string"}}},
+			"responses": map[string]any{
+				"307": openAPIResponse("The upload the alias names", map[string]any{HEADER_LOCATION: openAPIHeader("The URL of the upload, not signed", true)}),
+				"404": openAPIResponse("No upload in progress or complete has the alias", nil),
+			},
+		},
+	}
+	paths["/upload"] = map[string]any{
+		"post": map[string]any{
+			"summary": "Upload a file in one request with a classic form, the upload is created complete",
+			"requestBody": map[string]any{"required": true, "content": map[string]any{"multipart/form-data": map[string]any{"schema": map[string]any{
+				"type":                 "object",
+				"required":             []any{MULTIPART_FILE_FIELD},
+				"properties":           map[string]any{MULTIPART_FILE_FIELD: map[string]any{"type": "string", "format": "binary"}},
+				"additionalProperties": map[string]any{"type": "string", "description": "Added to the metadata"},
+			}}}},
+			"responses": multipartResponses,
+		},
+	}
+	if slices.Contains(config.ProcessingSteps, STEP_THUMBNAIL) {
+		paths[basePath+"/{id}/thumbnails/{size}"] = map[string]any{
+			"get": map[string]any{
+				"summary":    "Download a thumbnail of an image upload",
+				"parameters": []any{id, map[string]any{"name": "size", "in": "path", "required": true, "description": "WIDTHxHEIGHT", "schema": map[string]any{"type": "string"}}},
+				"responses": map[string]any{
+					"200": map[string]any{"description": "The thumbnail", "content": map[string]any{"image/jpeg": map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}},
+					"404": openAPIResponse("There is no such upload or thumbnail", nil),
+				},
+			},
+		}
+	}
+	document := map[string]any{
+		"openapi": "3.0.3",
+		"info":    map[string]any{"title": "resumable-upload", "version": TUS_PROTOCOL_VERSION, "description": "A tus " + TUS_PROTOCOL_VERSION + " server, see https://tus.io/protocols/resumable-upload"},
+		"paths":   paths,
+	}
+	if len(config.AdminToken) > 0 {
+		paths["/admin/processing/dead-letters"] = map[string]any{
+			"get": map[string]any{
+				"summary":  "List the uploads whose processing failed for good",
+				"security": []any{map[string]any{"admin": []any{}}},
+				"responses": map[string]any{
+					"200": map[string]any{"description": "The dead letters, oldest first", "content": map[string]any{"application/json": map[string]any{"schema": map[string]any{"type": "array", "items": map[string]any{"type": "object", "properties": map[string]any{
+						"id": map[string]any{"type": "string"}, "step": map[string]any{"type": "string"}, "attempts": map[string]any{"type": "integer"}, "error": map[string]any{"type": "string"}, "time": map[string]any{"type": "string", "format": "date-time"},
+					}}}}}},
+					"401": openAPIResponse("The bearer token is missing or wrong", nil),
+				},
+			},
+		}
+		upload := map[string]any{"type": "object", "properties": map[string]any{
+			"id": map[string]any{"type": "string"}, "size": map[string]any{"type": "integer"}, "offset": map[string]any{"type": "integer"}, "state": map[string]any{"type": "string"},
+			"metadata": map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "string"}}, "path": map[string]any{"type": "string"}, "modified": map[string]any{"type": "string", "format": "date-time"},
+			"paused": map[string]any{"type": "boolean"}, "owner": map[string]any{"type": "string"}, "anonymous": map[string]any{"type": "boolean"},
+			"trashed": map[string]any{"type": "string", "format": "date-time"}, "legal_hold": map[string]any{"type": "boolean"}, "alias": map[string]any{"type": "string"},
+		}}
+		adminEndResponses := map[string]any{
+			"204": openAPIResponse("The upload is ended", nil),
+			"401": openAPIResponse("The bearer token is missing or wrong", nil),
+			"404": openAPIResponse("There is no such upload", nil),
+			"409": openAPIResponse("The upload is being written, under legal hold or can't be ended", nil),
+			"410": openAPIResponse("The upload is already terminated or expired", nil),
+		}
+		paths["/admin/uploads"] = map[string]any{
+			"get": map[string]any{
+				"summary":     "List the uploads held matching the query, sorted by id",
+				"description": "metadata.{key}={value} in the query matches the uploads whose decoded metadata value of key is value, metadata.{key}~={value} the ones whose value contains it, ignoring case",
+				"security":    []any{map[string]any{"admin": []any{}}},
+				"parameters": []any{
+					openAPIQuery("state", "The states of the uploads, comma separated", "string"),
+					openAPIQuery("q", "A text the id or any metadata value of the uploads contains, ignoring case", "string"),
+					openAPIQuery("older_than", "The uploads last written before this duration ago, i.e., 24h", "string"),
+					openAPIQuery("newer_than", "The uploads last written within this duration, i.e., 1h", "string"),
+					openAPIQuery("limit", "The maximum number of uploads returned", "integer"),
+				},
+				"responses": map[string]any{
+					"200": map[string]any{"description": "The uploads", "content": map[string]any{"application/json": map[string]any{"schema": map[string]any{"type": "array", "items": upload}}}},
+					"400": openAPIResponse("A filter of the query is unknown or invalid", nil),
+					"401": openAPIResponse("The bearer token is missing or wrong", nil),
+				},
+			},
+		}
+		paths["/admin/uploads/{id}"] = map[string]any{
+			"get": map[string]any{
+				"summary":    "Show an upload",
+				"security":   []any{map[string]any{"admin": []any{}}},
+				"parameters": []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}},
+				"responses": map[string]any{
+					"200": map[string]any{"description": "The upload", "content": map[string]any{"application/json": map[string]any{"schema": upload}}},
+					"401": openAPIResponse("The bearer token is missing or wrong", nil),
+					"404": openAPIResponse("There is no such upload", nil),
+				},
+			},
+			"delete": map[string]any{
+				"summary":    "Terminate an upload, its data is removed, after the trash retention of the server when it has one",
+				"security":   []any{map[string]any{"admin": []any{}}},
+				"parameters": []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}},
+				"responses":  adminEndResponses,
+			},
+		}
+		paths["/admin/uploads/{id}/expire"] = map[string]any{
+			"post": map[string]any{
+				"summary":    "Expire an upload whatever its age, its data is removed, after the trash retention of the server when it has one",
+				"security":   []any{map[string]any{"admin": []any{}}},
+				"parameters": []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}},
+				"responses":  adminEndResponses,
+			},
+		}
+		adminPauseResponses := map[string]any{
+			"204": openAPIResponse("The upload is paused or unpaused", nil),
+			"401": openAPIResponse("The bearer token is missing or wrong", nil),
+			"404": openAPIResponse("There is no such upload", nil),
+			"409": openAPIResponse("The upload is being written", nil),
+			"410": openAPIResponse("The upload is terminated or expired", nil),
+		}
+		paths["/admin/uploads/{id}/pause"] = map[string]any{
+			"post": map[string]any{
+				"summary":    "Pause an upload, its PATCHes are refused with 423 and it does not expire until it is unpaused",
+				"security":   []any{map[string]any{"admin": []any{}}},
+				"parameters": []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}},
+				"responses":  adminPauseResponses,
+			},
+		}
+		paths["/admin/uploads/{id}/unpause"] = map[string]any{
+			"post": map[string]any{
+				"summary":    "Unpause an upload, its expiration starts over",
+				"security":   []any{map[string]any{"admin": []any{}}},
+				"parameters": []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}},
+				"responses":  adminPauseResponses,
+			},
+		}
+		adminHoldResponses := map[string]any{
+			"204": openAPIResponse("The upload is held or released, which the audit log records", nil),
+			"400": openAPIResponse("The body is not the JSON of a reason", nil),
+			"401": openAPIResponse("The bearer token is missing or wrong", nil),
+			"404": openAPIResponse("There is no such upload", nil),
+			"409": openAPIResponse("The upload is being written", nil),
+			"410": openAPIResponse("The data of the upload is removed", nil),
+			"500": openAPIResponse("The change could not be persisted, or recorded in the audit log and it is rolled back", nil),
+		}
+		reason := map[string]any{"content": map[string]any{"application/json": map[string]any{"schema": map[string]any{"type": "object", "properties": map[string]any{"reason": map[string]any{"type": "string"}}}}}}
+		paths["/admin/uploads/{id}/hold"] = map[string]any{
+			"post": map[string]any{
+				"summary":     "Put an upload under legal hold, it is not terminated, expired or purged from the trash until it is released",
+				"security":    []any{map[string]any{"admin": []any{}}},
+				"parameters":  []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}},
+				"requestBody": reason,
+				"responses":   adminHoldResponses,
+			},
+		}
+		paths["/admin/uploads/{id}/release"] = map[string]any{
+			"post": map[string]any{
+				"summary":     "Release an upload from legal hold",
+				"security":    []any{map[string]any{"admin": []any{}}},
+				"parameters":  []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}},
+				"requestBody": reason,
+				"responses":   adminHoldResponses,
+			},
+		}
+		paths["/admin/uploads/{id}/restore"] = map[string]any{
+			"post": map[string]any{
+				"summary":    "Restore an upload from the trash to the state it was terminated or expired in, its expiration starts over",
+				"security":   []any{map[string]any{"admin": []any{}}},
+				"parameters": []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}},
+				"responses": map[string]any{
+					"204": openAPIResponse("The upload is restored", nil),
+					"401": openAPIResponse("The bearer token is missing or wrong", nil),
+					"404": openAPIResponse("There is no such upload", nil),
+					"409": openAPIResponse("The upload is not in the trash or is being purged", nil),
+				},
+			},
+		}
+		paths["/admin/uploads/{id}/alias"] = map[string]any{
+			"put": map[string]any{
+				"summary":     "Name an upload, an empty alias removes the alias of the upload",
+				"security":    []any{map[string]any{"admin": []any{}}},
+				"parameters":  []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}},
+				"requestBody": map[string]any{"required": true, "content": map[string]any{"application/json": map[string]any{"schema": map[string]any{"type": "object", "properties": map[string]any{"alias": map[string]any{"type": "string"}}}}}},
+				"responses": map[string]any{
+					"204": openAPIResponse("The alias is set", nil),
+					"400": openAPIResponse("The body is not the JSON of an alias or the alias is not a relative path", nil),
+					"401": openAPIResponse("The bearer token is missing or wrong", nil),
+					"404": openAPIResponse("There is no such upload", nil),
+					"409": openAPIResponse("The alias names another upload, or the upload is being written", nil),
+					"410": openAPIResponse("The upload is terminated or expired", nil),
+				},
+			},
+		}
+		paths["/admin/stats"] = map[string]any{
+			"get": map[string]any{
+				"summary":  "Show the traffic of the last 10 minutes, the dashboard at /admin/ graphs it",
+				"security": []any{map[string]any{"admin": []any{}}},
+				"responses": map[string]any{
+					"200": map[string]any{"description": "The traffic per interval seconds, oldest first", "content": map[string]any{"application/json": map[string]any{"schema": map[string]any{"type": "object", "properties": map[string]any{
+						"interval": map[string]any{"type": "number"},
+						"traffic": map[string]any{"type": "array", "items": map[string]any{"type": "object", "properties": map[string]any{
+							"time": map[string]any{"type": "string", "format": "date-time"}, "requests": map[string]any{"type": "integer"}, "bytes": map[string]any{"type": "integer"}, "client_errors": map[string]any{"type": "integer"}, "server_errors": map[string]any{"type": "integer"},
+						}}},
+					}}}}},
+					"401": openAPIResponse("The bearer token is missing or wrong", nil),
+				},
+			},
+		}
+		document["components"] = map[string]any{"securitySchemes": map[string]any{"admin": map[string]any{"type": "http", "scheme": "bearer"}}}
+	}
+	return document
+}
+
+func openAPIQuery(name, description, kind string) map[string]any {
+	return map[string]any{"name": name, "in": "query", "description": description, "schema": map[string]any{"type": kind}}
+}
+
+func openAPIHeader(description string, required bool) map[string]any {
+	return map[string]any{"description": description, "required": required, "schema": map[string]any{"type": "string"}}
+}
+
+func openAPIParameter(name, description string, required bool) map[string]any {
+	return map[string]any{"name": name, "in": "header", "description": description, "required": required, "schema": map[string]any{"type": "string"}}
+}
+
+func openAPIResponse(description string, headers map[string]any) map[string]any {
+	response := map[string]any{"description": description}
+	if len(headers) > 0 {
+		response["headers"] = headers
+	}
+	return response
+}
+
+// registerOpenAPI serves the OpenAPI document of config at /openapi.json
+func registerOpenAPI(mux *http.ServeMux, config *ServerConfig, basePath string) {
+	// maps of strings always marshal
+	document, _ := json.Marshal(openAPIDocument(config, basePath))
+	mux.HandleFunc("GET /openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HEADER_CONTENT_TYPE, "application/json")
+		w.Write(document)
+	})
+}
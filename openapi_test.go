@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenAPI(t *testing.T) {
+	tests := []struct {
+		testName          string
+		config            *ServerConfig
+		expectedPaths     []string
+		unexpectedPaths   []string
+		expectedPatchCode string
+	}{
+		{
+			"default",
+			&ServerConfig{UploadDir: tempUploadDir},
+			[]string{"/files", "/files/{id}"},
+			[]string{"/files/{id}/thumbnails/{size}", "/admin/processing/dead-letters"},
+			"423",
+		},
+		{
+			"extensions",
+			&ServerConfig{UploadDir: tempUploadDir, BasePath: "uploads", AdminToken: "secret", MaxBufferMemory: 1, ProcessingSteps: []string{STEP_THUMBNAIL}},
+			[]string{"/uploads", "/uploads/{id}", "/uploads/{id}/thumbnails/{size}", "/admin/processing/dead-letters"},
+			nil,
+			"503",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			server := httptest.NewServer(buildServeMux(test.config))
+			defer server.Close()
+			res, err := http.Get(server.URL + "/openapi.json")
+			if err != nil {
+				t.Fatalf("Fail to execute GET request. error=%v", err)
+			}
+			defer res.Body.Close()
+			var document struct {
+				OpenAPI string                                `json:"openapi"`
+				Paths   map[string]map[string]json.RawMessage `json:"paths"`
+			}
+			if err := json.NewDecoder(res.Body).Decode(&document); err != nil {
+				t.Fatalf("Fail to decode OpenAPI document. error=%v", err)
+			}
+			if document.OpenAPI != "3.0.3" {
+				t.Errorf("the document is not OpenAPI 3.0.3. got=%s", document.OpenAPI)
+			}
+			for _, path := range test.expectedPaths {
+				if _, ok := document.Paths[path]; !ok {
+					t.Errorf("the document does not describe %s", path)
+				}
+			}
+			for _, path := range test.unexpectedPaths {
+				if _, ok := document.Paths[path]; ok {
+					t.Errorf("the document describes the disabled %s", path)
+				}
+			}
+			var patch struct {
+				Responses map[string]any `json:"responses"`
+			}
+			if err := json.Unmarshal(document.Paths[test.expectedPaths[1]]["patch"], &patch); err != nil {
+				t.Fatalf("Fail to decode PATCH operation. error=%v", err)
+			}
+			if _, ok := patch.Responses[test.expectedPatchCode]; !ok {
+				t.Errorf("PATCH does not document %s. got=%v", test.expectedPatchCode, patch.Responses)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+)
+
+// HEADER_UPLOAD_PAUSED is true on the HEAD of a paused upload and on the 423
+// refusing its PATCHes, telling them apart from the 423 of a concurrent
+// PATCH
+const HEADER_UPLOAD_PAUSED = "Upload-Paused"
+
+// isPaused reports whether the upload is paused, see pause
+func (f *File) isPaused() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.paused
+}
+
+// pause pauses or unpauses f for the admin API. A paused upload refuses the
+// PATCHes and does not expire, the time it was paused does not count toward
+// its expiration once it is unpaused. It returns errLocked while the upload
+// is written.
+func (e *expirer) pause(f *File, paused bool) error {
+	lock, err := e.locker.TryLock(f.ID.String())
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if f.finished() {
+		return errFinished
+	}
+	f.mu.Lock()
+	f.paused = paused
+	f.mu.Unlock()
+	if !paused {
+		f.touch(false)
+	}
+	if f.persist {
+		return f.saveInfo()
+	}
+	return nil
+}
+
+// writePaused answers 423 to a PATCH of a paused upload
+func writePaused(w http.ResponseWriter, f *File) {
+	w.Header().Set(HEADER_UPLOAD_PAUSED, "true")
+	writeProblem(w, http.StatusLocked, "Upload paused", "the upload is paused, it takes no data until it is unpaused", map[string]any{"offset": f.offset()})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"resumable-upload/tusclient"
+)
+
+func TestPause(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: t.TempDir(), AdminToken: "secret", RelativeLocation: true}))
+	defer server.Close()
+	host := server.URL + "/files"
+	adminRequest := func(path string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("Fail to create test data. error=%v", err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to execute POST request. error=%v", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	fileId := createUpload(t, host, 10)
+	patchUpload(t, host, fileId, 0, content[:5])
+	if status := adminRequest("/admin/uploads/" + fileId + "/pause"); status != http.StatusNoContent {
+		t.Fatalf("pause does not return 204. got=%d", status)
+	}
+
+	res, err := http.Head(fmt.Sprintf("%s/%s", host, fileId))
+	if err != nil {
+		t.Fatalf("Fail to execute HEAD request. error=%v", err)
+	}
+	res.Body.Close()
+	if paused := res.Header.Get(HEADER_UPLOAD_PAUSED); paused != "true" {
+		t.Errorf("HEAD does not tell the upload is paused. got=%s", paused)
+	}
+	req, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("%s/%s", host, fileId), strings.NewReader(content[5:10]))
+	if err != nil {
+		t.Fatalf("Fail to create test data. Error=%v", err)
+	}
+	req.Header.Set(HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM)
+	req.Header.Set(HEADER_UPLOAD_OFFSET, "5")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute PATCH request. error=%v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusLocked || res.Header.Get(HEADER_UPLOAD_PAUSED) != "true" {
+		t.Errorf("PATCH of a paused upload does not return 423 with %s. got=%d", HEADER_UPLOAD_PAUSED, res.StatusCode)
+	}
+
+	client := tusclient.New(host)
+	client.RetryDelay = time.Millisecond
+	upload, err := client.Resume(context.Background(), host+"/"+fileId)
+	if err != nil {
+		t.Fatalf("Fail to resume upload. error=%v", err)
+	}
+	if err := upload.Upload(context.Background(), strings.NewReader(content[:10])); !errors.Is(err, tusclient.ErrUploadPaused) {
+		t.Errorf("Upload does not return ErrUploadPaused. got=%v", err)
+	}
+
+	if status := adminRequest("/admin/uploads/" + fileId + "/unpause"); status != http.StatusNoContent {
+		t.Fatalf("unpause does not return 204. got=%d", status)
+	}
+	if err := upload.Upload(context.Background(), strings.NewReader(content[:10])); err != nil || upload.Offset != 10 {
+		t.Errorf("Upload does not resume the unpaused upload. got=%v at %d", err, upload.Offset)
+	}
+
+	if status := adminRequest("/admin/uploads/00000000-0000-0000-0000-000000000000/pause"); status != http.StatusNotFound {
+		t.Errorf("pause of an unknown upload does not return 404. got=%d", status)
+	}
+}
+
+func TestPausedExpiration(t *testing.T) {
+	e := &expirer{after: time.Hour, retention: []RetentionRule{{Key: "category", After: time.Hour}}}
+	now := time.Now()
+	tests := []struct {
+		testName string
+		state    string
+		paused   bool
+		expected time.Time
+	}{
+		{"Should expire an incomplete upload", UPLOAD_STATE_UPLOADING, false, now.Add(time.Hour)},
+		{"Should not expire a paused upload", UPLOAD_STATE_UPLOADING, true, time.Time{}},
+		{"Should not remove a paused complete upload", UPLOAD_STATE_COMPLETED, true, time.Time{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			f := &File{ID: uuid.New(), Metadata: "category dG1w", State: test.state, paused: test.paused}
+			f.created, f.active = now, now
+			if got := e.expiresAt(f); !got.Equal(test.expected) {
+				t.Errorf("expiresAt does not return %v. got=%v", test.expected, got)
+			}
+		})
+	}
+}
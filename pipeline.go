@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// STEP_CHECKSUM rehashes the data on disk and checks it against the
+	// running checksum of the upload
+	STEP_CHECKSUM = "checksum"
+	// STEP_SCAN runs ScanCommand with the path of the data file appended, a
+	// non-zero exit rejects the upload
+	STEP_SCAN = "scan"
+	// STEP_MOVE moves the data file into ProcessedDir
+	STEP_MOVE = "move"
+	// STEP_NOTIFY POSTs the completed event to NotifyURL
+	STEP_NOTIFY = "notify"
+)
+
+// errProcessingRejected is wrapped by the steps failing for good, e.g., a
+// virus found by the scan, their job goes to the dead letters without retry
+var errProcessingRejected = errors.New("upload rejected")
+
+// ProcessingStep is a step of the processing of the complete uploads
+type ProcessingStep interface {
+	Name() string
+	Process(ctx context.Context, f *File) error
+}
+
+// deadLetter is a job that failed for good
+type deadLetter struct {
+	ID       string    `json:"id"`
+	Step     string    `json:"step"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+}
+
+// the number of dead letters kept, the oldest ones are dropped
+const deadLettersMax = 1000
+
+// processingJob runs the steps of an upload from step
+type processingJob struct {
+	file     *File
+	step     int
+	attempts int
+}
+
+// pipeline runs the processing steps of the complete uploads in order on a
+// bounded pool of workers so the PATCH completing an upload only queues it.
+// A failed step is retried with an exponential backoff then the job goes to
+// the dead letters. Jobs hold the write lock of their upload while a step
+// runs. The queue is kept in memory, the jobs pending at shutdown are lost.
+type pipeline struct {
+	steps      []ProcessingStep
+	locker     Locker
+	retries    int
+	retryDelay time.Duration
+	timeout    time.Duration
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue *list.List // of *processingJob
+	dead  []deadLetter
+}
+
+// newPipeline returns the pipeline of config.ProcessingSteps, nil when there
+// is none
+func newPipeline(config *ServerConfig, locker Locker) (*pipeline, error) {
+	if len(config.ProcessingSteps) <= 0 {
+		return nil, nil
+	}
+	steps := make([]ProcessingStep, 0, len(config.ProcessingSteps))
+	for _, name := range config.ProcessingSteps {
+		switch name {
+		case STEP_CHECKSUM:
+			steps = append(steps, checksumStep{})
+		case STEP_SCAN:
+			if len(config.ScanCommand) <= 0 {
+				return nil, errors.New("the scan step needs ScanCommand")
+			}
+			steps = append(steps, scanStep{command: config.ScanCommand})
+		case STEP_THUMBNAIL:
+			step := thumbnailStep{basePath: normalizeBasePath(config.BasePath)}
+			sizes := config.ThumbnailSizes
+			if len(sizes) <= 0 {
+				sizes = []string{"256x256"}
+			}
+			for _, size := range sizes {
+				parsed, err := parseThumbnailSize(size)
+				if err != nil {
+					return nil, err
+				}
+				step.sizes = append(step.sizes, parsed)
+			}
+			steps = append(steps, step)
+		case STEP_TRANSCODE:
+			step, err := newTranscodeStep(config)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, step)
+		case STEP_MOVE:
+			if len(config.ProcessedDir) <= 0 {
+				return nil, errors.New("the move step needs ProcessedDir")
+			}
+			steps = append(steps, moveStep{dir: config.ProcessedDir})
+		case STEP_COMPRESS:
+			if name != config.ProcessingSteps[len(config.ProcessingSteps)-1] {
+				return nil, errors.New("the compress step must be the last one")
+			}
+			steps = append(steps, compressStep{})
+		case STEP_NOTIFY:
+			if len(config.NotifyURL) <= 0 {
+				return nil, errors.New("the notify step needs NotifyURL")
+			}
+			steps = append(steps, notifyStep{url: config.NotifyURL, format: newEventFormat(config, config.EventFormat)})
+		default:
+			return nil, fmt.Errorf("unknown processing step %q", name)
+		}
+	}
+
+	workers := config.ProcessingWorkers
+	if workers <= 0 {
+		workers = 4
+	}
+	p := &pipeline{
+		steps:      steps,
+		locker:     locker,
+		retries:    config.ProcessingRetries,
+		retryDelay: config.ProcessingRetryDelay,
+		timeout:    config.ProcessingTimeout,
+		queue:      list.New(),
+	}
+	if p.retries <= 0 {
+		p.retries = 3
+	}
+	if p.retryDelay <= 0 {
+		p.retryDelay = time.Second
+	}
+	if p.timeout <= 0 {
+		p.timeout = 5 * time.Minute
+	}
+	p.cond = sync.NewCond(&p.mu)
+	for range workers {
+		go p.work()
+	}
+	return p, nil
+}
+
+// enqueue queues the processing of the complete upload f without waiting
+func (p *pipeline) enqueue(f *File) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.push(&processingJob{file: f})
+}
+
+// push queues job, it must be called with the lock held
+func (p *pipeline) push(job *processingJob) {
+	p.queue.PushBack(job)
+	p.cond.Signal()
+}
+
+func (p *pipeline) work() {
+	for {
+		p.mu.Lock()
+		for p.queue.Len() <= 0 {
+			p.cond.Wait()
+		}
+		job := p.queue.Remove(p.queue.Front()).(*processingJob)
+		p.mu.Unlock()
+
+		p.run(job)
+	}
+}
+
+// run runs the steps of job from its current one until one fails
+func (p *pipeline) run(job *processingJob) {
+	id := job.file.ID.String()
+	lock, err := p.locker.TryLock(id)
+	if errors.Is(err, errLocked) {
+		// a HEAD is verifying the upload, come back later without counting
+		// an attempt
+		p.retry(job, p.retryDelay)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("Error locking upload %w", err)
+	} else {
+		for ; job.step < len(p.steps); job.step++ {
+			ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+			err = p.steps[job.step].Process(ctx, job.file)
+			cancel()
+			if err != nil {
+				break
+			}
+			job.attempts = 0
+		}
+		if uerr := lock.Unlock(); uerr != nil {
+			slog.Error("Fail to unlock upload", slog.String("id", id), slog.Any("Error", uerr))
+		}
+	}
+	if err == nil {
+		return
+	}
+
+	step := p.steps[job.step].Name()
+	job.attempts++
+	if job.attempts > p.retries || errors.Is(err, errProcessingRejected) {
+		slog.Error("Fail to process upload", slog.String("id", id), slog.String("step", step), slog.Int("attempts", job.attempts), slog.Any("Error", err))
+		p.mu.Lock()
+		if len(p.dead) >= deadLettersMax {
+			p.dead = p.dead[1:]
+		}
+		p.dead = append(p.dead, deadLetter{ID: id, Step: step, Attempts: job.attempts, Error: err.Error(), Time: time.Now().UTC()})
+		p.mu.Unlock()
+		return
+	}
+	slog.Warn("Retry upload processing", slog.String("id", id), slog.String("step", step), slog.Int("attempts", job.attempts), slog.Any("Error", err))
+	p.retry(job, p.retryDelay<<(job.attempts-1))
+}
+
+// retry queues job again after delay
+func (p *pipeline) retry(job *processingJob, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		p.push(job)
+	})
+}
+
+// deadLetters returns the jobs that failed for good, oldest first
+func (p *pipeline) deadLetters() []deadLetter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]deadLetter{}, p.dead...)
+}
+
+// checksumStep catches the data corrupted on disk after it was written
+type checksumStep struct{}
+
+func (checksumStep) Name() string { return STEP_CHECKSUM }
+
+func (checksumStep) Process(ctx context.Context, f *File) error {
+	if !f.checksum.valid() {
+		return nil
+	}
+	rehashed := newChecksum()
+	if err := rehashed.hashRange(f.path(), 0, int64(f.Size)); err != nil {
+		return err
+	}
+	if rehashed.header() != f.checksum.header() {
+		return fmt.Errorf("%w: the data on disk does not match %s", errProcessingRejected, f.checksum.header())
+	}
+	return nil
+}
+
+type scanStep struct {
+	command []string
+}
+
+func (scanStep) Name() string { return STEP_SCAN }
+
+func (s scanStep) Process(ctx context.Context, f *File) error {
+	cmd := exec.CommandContext(ctx, s.command[0], append(slices.Clone(s.command[1:]), f.path())...)
+	output, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && ctx.Err() == nil {
+		return fmt.Errorf("%w by the scan: %s", errProcessingRejected, strings.TrimSpace(string(output)))
+	}
+	return err
+}
+
+type moveStep struct {
+	dir string
+}
+
+func (moveStep) Name() string { return STEP_MOVE }
+
+func (s moveStep) Process(ctx context.Context, f *File) error {
+	// moved by an attempt whose info failed to save
+	if filepath.Dir(f.path()) != filepath.Clean(s.dir) {
+		if err := f.moveTo(s.dir); err != nil {
+			return err
+		}
+	}
+	if f.persist {
+		return f.saveInfo()
+	}
+	return nil
+}
+
+type notifyStep struct {
+	url    string
+	format eventFormat
+}
+
+func (notifyStep) Name() string { return STEP_NOTIFY }
+
+func (s notifyStep) Process(ctx context.Context, f *File) error {
+	encoded, err := s.format.encode(newUploadEvent(EVENT_COMPLETED, f))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(encoded.payload))
+	if err != nil {
+		return err
+	}
+	encoded.setHeaders(req.Header)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("notify answered %d", res.StatusCode)
+	}
+	return nil
+}
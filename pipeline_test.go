@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or a few seconds passed
+func waitFor(t *testing.T, cond func() bool) bool {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPipeline(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	processedDir := t.TempDir()
+	notified := make(chan UploadEvent, 1)
+	notify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event UploadEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("Fail to decode notification. error=%v", err)
+		}
+		notified <- event
+	}))
+	defer notify.Close()
+	config := &ServerConfig{
+		UploadDir:        t.TempDir(),
+		RelativeLocation: true,
+		ProcessingSteps:  []string{STEP_CHECKSUM, STEP_MOVE, STEP_NOTIFY},
+		ProcessedDir:     processedDir,
+		NotifyURL:        notify.URL,
+	}
+
+	server := httptest.NewServer(buildServeMux(config))
+	defer server.Close()
+	host := server.URL + "/files"
+	req, err := http.NewRequest(http.MethodPost, host, nil)
+	if err != nil {
+		t.Fatalf("Fail to create test data. Error=%v", err)
+	}
+	req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+	req.Header.Set(HEADER_UPLOAD_METADATA, "filename "+base64.StdEncoding.EncodeToString([]byte("a.txt")))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to create test data. Error=%v", err)
+	}
+	res.Body.Close()
+	fileId := filepath.Base(res.Header.Get(HEADER_LOCATION))
+	patchUpload(t, host, fileId, 0, content[:10])
+
+	select {
+	case event := <-notified:
+		if event.Upload.ID != fileId || event.Type != EVENT_COMPLETED {
+			t.Errorf("notify does not POST the completed event. got=%+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Fail to receive notification")
+	}
+	// the move step ran before notify
+	data, err := os.ReadFile(filepath.Join(processedDir, "a.txt"))
+	if err != nil {
+		t.Fatalf("Fail to read processed file. error=%v", err)
+	}
+	if string(data) != content[:10] {
+		t.Errorf("the processed file does not hold the upload. got=%s", data)
+	}
+}
+
+func TestPipelineDeadLetters(t *testing.T) {
+	tests := []struct {
+		testName         string
+		steps            []string
+		expectedStep     string
+		expectedAttempts int
+	}{
+		{"retried notify", []string{STEP_NOTIFY}, STEP_NOTIFY, 3},
+		{"rejecting scan", []string{STEP_SCAN, STEP_NOTIFY}, STEP_SCAN, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			if test.expectedStep == STEP_SCAN && runtime.GOOS == "windows" {
+				t.Skip("the scan command is a shell script")
+			}
+			defer func() { uploadDir = tempUploadDir }()
+			notify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer notify.Close()
+			config := &ServerConfig{
+				UploadDir:            t.TempDir(),
+				RelativeLocation:     true,
+				ProcessingSteps:      test.steps,
+				ProcessingRetries:    2,
+				ProcessingRetryDelay: time.Millisecond,
+				ScanCommand:          []string{"sh", "-c", "echo infected; exit 1", "scan"},
+				NotifyURL:            notify.URL,
+				AdminToken:           "secret",
+			}
+
+			server := httptest.NewServer(buildServeMux(config))
+			defer server.Close()
+			host := server.URL + "/files"
+			fileId := createUpload(t, host, 10)
+			patchUpload(t, host, fileId, 0, content[:10])
+
+			var letters []deadLetter
+			ok := waitFor(t, func() bool {
+				req, _ := http.NewRequest(http.MethodGet, server.URL+"/admin/processing/dead-letters", nil)
+				req.Header.Set("Authorization", "Bearer secret")
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("Fail to execute GET request. error=%v", err)
+				}
+				defer res.Body.Close()
+				letters = nil
+				if err := json.NewDecoder(res.Body).Decode(&letters); err != nil {
+					t.Fatalf("Fail to decode dead letters. error=%v", err)
+				}
+				return len(letters) > 0
+			})
+			if !ok {
+				t.Fatalf("the upload does not go to the dead letters")
+			}
+			if letters[0].ID != fileId || letters[0].Step != test.expectedStep || letters[0].Attempts != test.expectedAttempts {
+				t.Errorf("the dead letter is not the one of step %s after %d attempts. got=%+v", test.expectedStep, test.expectedAttempts, letters[0])
+			}
+		})
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	tests := []struct {
+		testName       string
+		token          string
+		authorization  string
+		expectedStatus int
+	}{
+		{"no token", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer nope", http.StatusUnauthorized},
+		{"not bearer", "secret", "Basic secret", http.StatusUnauthorized},
+		{"right token", "secret", "Bearer secret", http.StatusOK},
+		{"admin disabled", "", "Bearer ", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, AdminToken: test.token}))
+			defer server.Close()
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/admin/processing/dead-letters", nil)
+			if err != nil {
+				t.Fatalf("Fail to create test data. Error=%v", err)
+			}
+			if len(test.authorization) > 0 {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute GET request. error=%v", err)
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			if res.StatusCode != test.expectedStatus {
+				t.Errorf("GET /admin/processing/dead-letters does not return %v. got=%v", test.expectedStatus, res.StatusCode)
+			}
+			if test.expectedStatus == http.StatusOK && string(body) != "[]\n" {
+				t.Errorf("GET /admin/processing/dead-letters does not return an empty list. got=%s", body)
+			}
+		})
+	}
+}
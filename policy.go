@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HEADER_UPLOAD_POLICY carries the signed uploadPolicy of a creation
+const HEADER_UPLOAD_POLICY = "Upload-Policy"
+
+var (
+	errPolicyInvalid = errors.New("invalid upload policy")
+	errPolicyExpired = errors.New("expired upload policy")
+	errNotOwner      = errors.New("upload owned by another principal")
+	// errAnonymousDownload is returned for a download of an anonymous
+	// upload, see ServerConfig.AnonymousUploads
+	errAnonymousDownload = errors.New("anonymous uploads are not downloaded")
+	// errUploadTooLarge is returned by a write past the max size of the upload
+	errUploadTooLarge = errors.New("upload exceeds its max size")
+	// errPastLength is returned by a write past the Upload-Length of the
+	// upload
+	errPastLength = errors.New("upload exceeds its length")
+)
+
+// uploadPolicy is issued by the application to a client, i.e., per plan of
+// the user, and sent by the client with its creations. The server only
+// checks its signature, with ServerConfig.PolicySecret, and its expiration.
+// Its token is base64url(JSON).base64url(HMAC-SHA256 of the JSON part).
+type uploadPolicy struct {
+	MaxSize int    `json:"max_size,omitempty"` // the maximum size of the upload, below the one of the server, 0 is the one of the server
+	Expires int64  `json:"expires,omitempty"`  // the unix time the policy can't be used after, 0 never expires
+	URLTTL  int64  `json:"url_ttl,omitempty"`  // the seconds the URL of the upload is valid for after its creation, see checkUploadURL
+	Subject string `json:"sub,omitempty"`      // the principal the policy is issued to, who owns the uploads created with it, see checkOwner
+
+	anonymous bool // the creation sent no policy, see ServerConfig.AnonymousUploads
+}
+
+// signPolicy returns the token of policy signed with secret
+func signPolicy(secret string, policy uploadPolicy) (string, error) {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(policyMAC(secret, payload)), nil
+}
+
+// parsePolicy returns the policy of token once its signature with secret and
+// its expiration at now are checked
+func parsePolicy(secret, token string, now time.Time) (uploadPolicy, error) {
+	var policy uploadPolicy
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return policy, errPolicyInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, policyMAC(secret, payload)) {
+		return policy, errPolicyInvalid
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(data, &policy) != nil {
+		return policy, errPolicyInvalid
+	}
+	if policy.Expires > 0 && now.Unix() > policy.Expires {
+		return policy, errPolicyExpired
+	}
+	return policy, nil
+}
+
+func policyMAC(secret, payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// creationPolicy returns the policy of the creation r, the zero policy
+// without PolicySecret, where creations need no policy
+func creationPolicy(config *ServerConfig, r *http.Request) (uploadPolicy, error) {
+	if len(config.PolicySecret) <= 0 {
+		return uploadPolicy{}, nil
+	}
+	token := r.Header.Get(HEADER_UPLOAD_POLICY)
+	if len(token) <= 0 && config.AnonymousUploads {
+		return uploadPolicy{MaxSize: int(config.AnonymousMaxSize), anonymous: true}, nil
+	}
+	return parsePolicy(config.PolicySecret, token, time.Now())
+}
+
+// anonymousExpiry returns the expiration of an upload created at now with
+// policy, the one it asked for, expires, lowered to AnonymousExpireAfter when
+// it is anonymous
+func anonymousExpiry(config *ServerConfig, policy uploadPolicy, expires, now time.Time) time.Time {
+	if !policy.anonymous || config.AnonymousExpireAfter <= 0 {
+		return expires
+	}
+	if limit := now.Add(config.AnonymousExpireAfter); expires.IsZero() || expires.After(limit) {
+		return limit
+	}
+	return expires
+}
+
+// checkOwner returns errNotOwner unless r may reach f. An upload created
+// without a subject in its policy is reached by anyone with its URL, the
+// others only with a valid Upload-Policy of their owner or with the
+// AdminToken as bearer, so a guessed URL is of no use to the other users.
+func checkOwner(config *ServerConfig, f *File, r *http.Request, now time.Time) error {
+	if len(f.owner) <= 0 {
+		return nil
+	}
+	if adminRequest(config, r) {
+		return nil
+	}
+	policy, err := parsePolicy(config.PolicySecret, r.Header.Get(HEADER_UPLOAD_POLICY), now)
+	if err != nil {
+		return err
+	}
+	if policy.Subject != f.owner {
+		return errNotOwner
+	}
+	return nil
+}
+
+// checkDownload returns an error unless r may download f, its owner when it
+// has one, see checkOwner, and only the admins when it is anonymous
+func checkDownload(config *ServerConfig, f *File, r *http.Request, now time.Time) error {
+	if f.anonymous && !adminRequest(config, r) {
+		return errAnonymousDownload
+	}
+	return checkOwner(config, f, r, now)
+}
+
+// adminRequest reports whether r carries the AdminToken as bearer
+func adminRequest(config *ServerConfig, r *http.Request) bool {
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && len(config.AdminToken) > 0 && subtle.ConstantTimeCompare([]byte(bearer), []byte(config.AdminToken)) == 1
+}
+
+// effectiveMaxSize returns the largest upload of the server, its MaxSize or
+// MAX_SIZE
+func effectiveMaxSize(config *ServerConfig) int {
+	if config.MaxSize > 0 {
+		return int(config.MaxSize)
+	}
+	return MAX_SIZE
+}
+
+// maxUploadSize returns the max size of an upload, the smallest of the max
+// size of the server and the positive limits of its policy and pre-create
+// hook
+func maxUploadSize(size int, limits ...int) int {
+	for _, limit := range limits {
+		if limit > 0 && limit < size {
+			size = limit
+		}
+	}
+	return size
+}
+
+// sizeLimitedReader fails with err, errUploadTooLarge when nil, once more
+// than remaining bytes are read, the ones up to it are returned
+type sizeLimitedReader struct {
+	r         io.Reader
+	remaining int64
+	err       error
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// one more byte tells an exact fit from an overflow
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 && l.err != nil {
+			return 0, l.err
+		}
+		if n > 0 {
+			return 0, errUploadTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
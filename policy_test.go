@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePolicy(t *testing.T) {
+	now := time.Now()
+	valid, _ := signPolicy("secret", uploadPolicy{MaxSize: 10, Expires: now.Add(time.Hour).Unix()})
+	expired, _ := signPolicy("secret", uploadPolicy{MaxSize: 10, Expires: now.Add(-time.Hour).Unix()})
+	otherKey, _ := signPolicy("other", uploadPolicy{MaxSize: 10})
+	payload, signature, _ := strings.Cut(valid, ".")
+	raised, _ := signPolicy("secret", uploadPolicy{MaxSize: 1000})
+	raisedPayload, _, _ := strings.Cut(raised, ".")
+
+	tests := []struct {
+		testName    string
+		token       string
+		expectedErr error
+	}{
+		{"valid", valid, nil},
+		{"expired", expired, errPolicyExpired},
+		{"other key", otherKey, errPolicyInvalid},
+		{"tampered", raisedPayload + "." + signature, errPolicyInvalid},
+		{"unsigned", payload, errPolicyInvalid},
+		{"missing", "", errPolicyInvalid},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			policy, err := parsePolicy("secret", test.token, now)
+			if !errors.Is(err, test.expectedErr) {
+				t.Errorf("parsePolicy does not return %v. got=%v", test.expectedErr, err)
+			}
+			if err == nil && policy.MaxSize != 10 {
+				t.Errorf("parsePolicy does not return the max size. got=%d", policy.MaxSize)
+			}
+		})
+	}
+}
+
+func TestPolicyMaxSize(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: t.TempDir(), RelativeLocation: true, PolicySecret: "secret"}))
+	defer server.Close()
+	host := server.URL + "/files"
+	free, _ := signPolicy("secret", uploadPolicy{MaxSize: 10})
+
+	create := func(policy string, length int) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, host, nil)
+		if err != nil {
+			t.Fatalf("Fail to create test data. error=%v", err)
+		}
+		req.Header.Set(HEADER_UPLOAD_LENGTH, strconv.Itoa(length))
+		if len(policy) > 0 {
+			req.Header.Set(HEADER_UPLOAD_POLICY, policy)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to execute POST request. error=%v", err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	tests := []struct {
+		testName       string
+		policy         string
+		length         int
+		expectedStatus int
+	}{
+		{"within the policy", free, 10, http.StatusCreated},
+		{"over the policy", free, 11, http.StatusRequestEntityTooLarge},
+		{"no policy", "", 10, http.StatusForbidden},
+		{"invalid policy", free + "x", 10, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			res := create(test.policy, test.length)
+			if res.StatusCode != test.expectedStatus {
+				t.Errorf("POST does not return %d. got=%d", test.expectedStatus, res.StatusCode)
+			}
+			if test.expectedStatus == http.StatusRequestEntityTooLarge && res.Header.Get(HEADER_TUS_MAX_SIZE) != "10" {
+				t.Errorf("POST does not return the max size of the policy. got=%s", res.Header.Get(HEADER_TUS_MAX_SIZE))
+			}
+		})
+	}
+
+	// the data past the max size is rejected, with or without its length
+	location := server.URL + create(free, 10).Header.Get(HEADER_LOCATION)
+	for _, chunked := range []bool{false, true} {
+		var body io.Reader = strings.NewReader(content[:15])
+		if chunked {
+			body = io.MultiReader(body)
+		}
+		req, err := http.NewRequest(http.MethodPatch, location, body)
+		if err != nil {
+			t.Fatalf("Fail to create PATCH request. error=%v", err)
+		}
+		req.Header.Set(HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM)
+		req.Header.Set(HEADER_UPLOAD_OFFSET, "0")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to execute PATCH request. error=%v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("PATCH past the max size does not return 413. chunked=%v got=%d", chunked, res.StatusCode)
+		}
+	}
+	res, err := http.Head(location)
+	if err != nil {
+		t.Fatalf("Fail to execute HEAD request. error=%v", err)
+	}
+	res.Body.Close()
+	if offset := res.Header.Get(HEADER_UPLOAD_OFFSET); offset != "10" {
+		t.Errorf("the bytes up to the max size are not committed. got=%s", offset)
+	}
+}
+
+func TestUploadOwner(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: t.TempDir(), RelativeLocation: true, PolicySecret: "secret", AdminToken: "admin"}))
+	defer server.Close()
+	alice, _ := signPolicy("secret", uploadPolicy{Subject: "alice"})
+	bob, _ := signPolicy("secret", uploadPolicy{Subject: "bob"})
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/files", nil)
+	if err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+	req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+	req.Header.Set(HEADER_UPLOAD_POLICY, alice)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute POST request. error=%v", err)
+	}
+	res.Body.Close()
+	location := server.URL + res.Header.Get(HEADER_LOCATION)
+
+	tests := []struct {
+		testName       string
+		method         string
+		header         map[string]string
+		expectedStatus int
+	}{
+		{"owner HEAD", http.MethodHead, map[string]string{HEADER_UPLOAD_POLICY: alice}, http.StatusOK},
+		{"owner GET", http.MethodGet, map[string]string{HEADER_UPLOAD_POLICY: alice}, http.StatusOK},
+		{"other HEAD", http.MethodHead, map[string]string{HEADER_UPLOAD_POLICY: bob}, http.StatusForbidden},
+		{"other GET", http.MethodGet, map[string]string{HEADER_UPLOAD_POLICY: bob}, http.StatusForbidden},
+		{"other PATCH", http.MethodPatch, map[string]string{HEADER_UPLOAD_POLICY: bob}, http.StatusForbidden},
+		{"no policy", http.MethodHead, nil, http.StatusForbidden},
+		{"admin", http.MethodHead, map[string]string{"Authorization": "Bearer admin"}, http.StatusOK},
+		{"wrong admin token", http.MethodHead, map[string]string{"Authorization": "Bearer alice"}, http.StatusForbidden},
+		{"owner PATCH", http.MethodPatch, map[string]string{HEADER_UPLOAD_POLICY: alice}, http.StatusNoContent},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, location, strings.NewReader(content[:10]))
+			if err != nil {
+				t.Fatalf("Fail to create %s request. error=%v", test.method, err)
+			}
+			req.Header.Set(HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM)
+			req.Header.Set(HEADER_UPLOAD_OFFSET, "0")
+			for key, value := range test.header {
+				req.Header.Set(key, value)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute %s request. error=%v", test.method, err)
+			}
+			res.Body.Close()
+			if res.StatusCode != test.expectedStatus {
+				t.Errorf("%s does not return %d. got=%d", test.method, test.expectedStatus, res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestAnonymousUploads(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	server := httptest.NewServer(buildServeMux(&ServerConfig{
+		UploadDir:            t.TempDir(),
+		RelativeLocation:     true,
+		PolicySecret:         "secret",
+		AdminToken:           "admin",
+		AnonymousUploads:     true,
+		AnonymousMaxSize:     10,
+		AnonymousExpireAfter: time.Hour,
+	}))
+	defer server.Close()
+	host := server.URL + "/files"
+
+	create := func(length int) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, host, nil)
+		if err != nil {
+			t.Fatalf("Fail to create test data. error=%v", err)
+		}
+		req.Header.Set(HEADER_UPLOAD_LENGTH, strconv.Itoa(length))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to execute POST request. error=%v", err)
+		}
+		res.Body.Close()
+		return res
+	}
+	if res := create(11); res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST past the anonymous max size does not return 413. got=%d", res.StatusCode)
+	}
+	res := create(10)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Fail to create anonymous upload. got status=%d", res.StatusCode)
+	}
+	expires, err := http.ParseTime(res.Header.Get(HEADER_UPLOAD_EXPIRES))
+	if err != nil || expires.After(time.Now().Add(time.Hour)) {
+		t.Errorf("POST does not return the anonymous expiration. got=%s", res.Header.Get(HEADER_UPLOAD_EXPIRES))
+	}
+	patchUpload(t, host, path.Base(res.Header.Get(HEADER_LOCATION)), 0, content[:10])
+
+	for _, admin := range []bool{false, true} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+res.Header.Get(HEADER_LOCATION), nil)
+		if err != nil {
+			t.Fatalf("Fail to create GET request. error=%v", err)
+		}
+		expectedStatus := http.StatusForbidden
+		if admin {
+			req.Header.Set("Authorization", "Bearer admin")
+			expectedStatus = http.StatusOK
+		}
+		got, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to execute GET request. error=%v", err)
+		}
+		got.Body.Close()
+		if got.StatusCode != expectedStatus {
+			t.Errorf("GET of an anonymous upload does not return %d. admin=%v got=%d", expectedStatus, admin, got.StatusCode)
+		}
+	}
+}
+
+func TestMaxUploadSize(t *testing.T) {
+	if got := maxUploadSize(MAX_SIZE, 0, 0); got != MAX_SIZE {
+		t.Errorf("maxUploadSize without limits does not return MAX_SIZE. got=%d", got)
+	}
+	if got := maxUploadSize(100, 0, 50); got != 50 {
+		t.Errorf("maxUploadSize does not return the smallest limit. got=%d", got)
+	}
+	if got := maxUploadSize(MAX_SIZE, MAX_SIZE*2); got != MAX_SIZE {
+		t.Errorf("maxUploadSize goes past MAX_SIZE. got=%d", got)
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+import "errors"
+
+// errInsufficientStorage is returned when the disk can't hold the declared
+// Upload-Length
+var errInsufficientStorage = errors.New("insufficient storage")
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// preallocate reserves size bytes of disk for the file with F_PREALLOCATE
+// without changing its apparent size. It first tries a contiguous
+// allocation and falls back to a fragmented one.
+func preallocate(file *os.File, size int64) error {
+	store := &unix.Fstore_t{
+		Flags:   unix.F_ALLOCATECONTIG | unix.F_ALLOCATEALL,
+		Posmode: unix.F_PEOFPOSMODE,
+		Length:  size,
+	}
+	err := unix.FcntlFstore(file.Fd(), unix.F_PREALLOCATE, store)
+	if err != nil {
+		store.Flags = unix.F_ALLOCATEALL
+		err = unix.FcntlFstore(file.Fd(), unix.F_PREALLOCATE, store)
+	}
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, unix.ENOSPC):
+		return errors.Join(errInsufficientStorage, err)
+	case errors.Is(err, unix.ENOTSUP):
+		return nil
+	default:
+		return err
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// preallocate reserves size bytes of disk for the file without changing its
+// apparent size, so appends keep working and a full disk is detected at
+// creation rather than midway through the upload. Filesystems without
+// fallocate support are silently skipped.
+func preallocate(file *os.File, size int64) error {
+	err := unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, unix.ENOSPC), errors.Is(err, unix.EFBIG):
+		return errors.Join(errInsufficientStorage, err)
+	case errors.Is(err, unix.EOPNOTSUPP), errors.Is(err, unix.ENOSYS):
+		return nil
+	default:
+		return err
+	}
+}
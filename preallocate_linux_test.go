@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestPreallocate(t *testing.T) {
+	f := &File{ID: uuid.New(), Size: 8 * CHUNK_SIZE, preallocate: true}
+	if err := f.create(); err != nil {
+		t.Fatalf("Fail to create file. error=%v", err)
+	}
+	path := f.path()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Fail to stat file. error=%v", err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("preallocate changes the file size, expected=0. got=%d", info.Size())
+	}
+	if allocated := info.Sys().(*syscall.Stat_t).Blocks * 512; allocated < int64(f.Size) {
+		t.Skipf("filesystem does not support preallocation. allocated=%d", allocated)
+	}
+
+	// appends still start at the beginning of the file
+	if err := f.write(context.Background(), strings.NewReader("data")); err != nil {
+		t.Fatalf("Fail to write file. error=%v", err)
+	}
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Fail to read file. error=%v", err)
+	}
+	if string(written) != "data" {
+		t.Errorf("write after preallocate is not correct, expected=data. got=%q", written)
+	}
+}
+
+func TestPreallocateInsufficientStorage(t *testing.T) {
+	// far more than any test disk can hold
+	f := &File{ID: uuid.New(), Size: 1 << 60, preallocate: true}
+	err := f.create()
+	if !errors.Is(err, errInsufficientStorage) {
+		t.Errorf("create does not fail with insufficient storage. got=%v", err)
+	}
+	if _, err := os.Stat(f.path()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("create does not remove the file it could not preallocate. error=%v", err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "os"
+
+// preallocate is a no-op where the OS has no preallocation call
+func preallocate(file *os.File, size int64) error {
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// the prefix of the redis channel of an upload, tus:progress:<id>
+const redisProgressPrefix = "tus:progress:"
+
+// progressMessage is published on the channel of an upload as JSON
+type progressMessage struct {
+	ID     string `json:"id"`
+	Offset int    `json:"offset"` // the bytes received so far, committed once state is no longer uploading
+	Size   int    `json:"size"`
+	State  string `json:"state"`
+}
+
+// progressPublisher broadcasts the progress of the uploads on redis pub/sub
+// so the instances not handling an upload can relay it. The messages are
+// published in order by a single goroutine, progress is lossy and the
+// messages overflowing the queue are dropped rather than slowing the writes.
+type progressPublisher struct {
+	client   *redisClient
+	interval time.Duration
+	messages chan progressMessage
+}
+
+func newProgressPublisher(address string, interval time.Duration) *progressPublisher {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	p := &progressPublisher{
+		client:   &redisClient{address: address},
+		interval: interval,
+		messages: make(chan progressMessage, 256),
+	}
+	go p.run()
+	return p
+}
+
+func (p *progressPublisher) run() {
+	for message := range p.messages {
+		data, err := json.Marshal(message)
+		if err != nil {
+			continue
+		}
+		if _, err := p.client.do("PUBLISH", redisProgressPrefix+message.ID, string(data)); err != nil {
+			slog.Error("Fail to publish upload progress", slog.String("id", message.ID), slog.Any("Error", err))
+		}
+	}
+}
+
+// publish queues the progress of f at offset
+func (p *progressPublisher) publish(f *File, offset int) {
+	if p == nil {
+		return
+	}
+	select {
+	case p.messages <- progressMessage{ID: f.ID.String(), Offset: offset, Size: f.Size, State: f.state()}:
+	default:
+	}
+}
+
+// reader returns body publishing the progress of f at most once an interval
+// while it is read
+func (p *progressPublisher) reader(f *File, body io.Reader) io.Reader {
+	if p == nil {
+		return body
+	}
+	return &progressReader{publisher: p, file: f, offset: f.offset(), r: body, last: time.Now()}
+}
+
+type progressReader struct {
+	publisher *progressPublisher
+	file      *File
+	offset    int
+	r         io.Reader
+	last      time.Time
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.offset += n
+	if now := time.Now(); now.Sub(r.last) >= r.publisher.interval {
+		r.last = now
+		r.publisher.publish(r.file, r.offset)
+	}
+	return n, err
+}
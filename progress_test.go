@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// slowBody returns its chunks with a pause in between so the progress is
+// published during the PATCH
+type slowBody struct {
+	chunks []string
+	pause  time.Duration
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	if len(b.chunks) <= 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(b.pause)
+	n := copy(p, b.chunks[0])
+	b.chunks = b.chunks[1:]
+	return n, nil
+}
+
+func TestProgressRedis(t *testing.T) {
+	redis := newFakeRedis(t)
+	server := httptest.NewServer(buildServeMux(&ServerConfig{
+		UploadDir:        tempUploadDir,
+		RedisAddress:     redis.listener.Addr().String(),
+		ProgressRedis:    true,
+		ProgressInterval: 10 * time.Millisecond,
+	}))
+	defer server.Close()
+	host := server.URL + "/files"
+	fileId := createUpload(t, host, 10)
+
+	req, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("%s/%s", host, fileId), &slowBody{chunks: []string{content[:4], content[4:10]}, pause: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Fail to create PATCH request. error=%v", err)
+	}
+	req.Header.Set(HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM)
+	req.Header.Set(HEADER_UPLOAD_OFFSET, "0")
+	req.ContentLength = 10
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute PATCH request. error=%v", err)
+	}
+	res.Body.Close()
+
+	// the messages are published in the background
+	var messages []progressMessage
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		redis.mu.Lock()
+		messages = messages[:0]
+		for _, published := range redis.published {
+			if published[0] != redisProgressPrefix+fileId {
+				t.Fatalf("progress is not published to the channel of the upload. got=%s", published[0])
+			}
+			var message progressMessage
+			if err := json.Unmarshal([]byte(published[1]), &message); err != nil {
+				t.Fatalf("progress is not published as JSON. error=%v", err)
+			}
+			messages = append(messages, message)
+		}
+		redis.mu.Unlock()
+		if len(messages) > 0 && messages[len(messages)-1].State == UPLOAD_STATE_COMPLETED {
+			break
+		}
+	}
+
+	if len(messages) < 2 {
+		t.Fatalf("progress is not published during the PATCH. got=%+v", messages)
+	}
+	if messages[0].Offset != 4 || messages[0].State != UPLOAD_STATE_CREATED {
+		t.Errorf("the progress of the first chunk is not published. got=%+v", messages[0])
+	}
+	last := messages[len(messages)-1]
+	if last.Offset != 10 || last.Size != 10 || last.State != UPLOAD_STATE_COMPLETED {
+		t.Errorf("the completion is not published. got=%+v", last)
+	}
+}
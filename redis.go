@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const redisDialTimeout = 2 * time.Second
+
+// redisClient is the minimal redis client of the redis locker and the
+// progress broadcasting
+type redisClient struct {
+	address string
+}
+
+// do sends a command on a new connection and returns its reply. Commands are
+// rare, a few per PATCH, so a connection pool isn't worth it.
+func (c *redisClient) do(args ...string) (any, error) {
+	conn, err := net.DialTimeout("tcp", c.address, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(redisDialTimeout))
+
+	if _, err := conn.Write(encodeRESP(args)); err != nil {
+		return nil, err
+	}
+	return readRESP(bufio.NewReader(conn))
+}
+
+// encodeRESP encodes a command as a RESP array of bulk strings
+func encodeRESP(args []string) []byte {
+	buff := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, arg := range args {
+		buff = fmt.Appendf(buff, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return buff
+}
+
+// readRESP reads a reply: simple strings and bulk strings as string,
+// integers as int64, arrays as []any and the null bulk string as nil
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("Invalid redis reply %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, fmt.Errorf("redis error %s", value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buff := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buff); err != nil {
+			return nil, err
+		}
+		return string(buff[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]any, n)
+		for i := range values {
+			if values[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("Invalid redis reply %q", line)
+	}
+}
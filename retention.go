@@ -0,0 +1,33 @@
+package main
+
+import (
+	"path"
+	"time"
+)
+
+// RetentionRule gives the complete uploads whose metadata matches their own
+// lifetime, i.e., category=tmp removed after a week and category=legal kept
+// for years
+type RetentionRule struct {
+	Key     string        // the metadata key matched
+	Pattern string        // the path.Match pattern the value must match, empty matches any value
+	After   time.Duration // the matching complete uploads are removed this long after their last write, 0 keeps them
+}
+
+// retention returns the After of the first rule matching metadata, 0 when
+// there is none so the upload is kept
+func retention(rules []RetentionRule, metadata map[string]string) time.Duration {
+	for _, rule := range rules {
+		value, ok := metadata[rule.Key]
+		if !ok {
+			continue
+		}
+		if len(rule.Pattern) > 0 {
+			if matched, err := path.Match(rule.Pattern, value); err != nil || !matched {
+				continue
+			}
+		}
+		return rule.After
+	}
+	return 0
+}
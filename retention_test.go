@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRetention(t *testing.T) {
+	rules := []RetentionRule{
+		{Key: "category", Pattern: "tmp*", After: 7 * 24 * time.Hour},
+		{Key: "category", Pattern: "legal", After: 0},
+		{Key: "project", After: time.Hour},
+	}
+	tests := []struct {
+		testName string
+		metadata map[string]string
+		expected time.Duration
+	}{
+		{"pattern", map[string]string{"category": "tmp-files", "project": "a"}, 7 * 24 * time.Hour},
+		{"kept forever", map[string]string{"category": "legal", "project": "a"}, 0},
+		{"pattern mismatch falls through", map[string]string{"category": "video", "project": "a"}, time.Hour},
+		{"no match", map[string]string{"filename": "a.txt"}, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			if got := retention(rules, test.metadata); got != test.expected {
+				t.Errorf("retention does not return %v. got=%v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestRetentionSweep(t *testing.T) {
+	dir := t.TempDir()
+	locker, err := newLocker(&ServerConfig{})
+	if err != nil {
+		t.Fatalf("Fail to create locker. error=%v", err)
+	}
+	storage := newStorage()
+	e := &expirer{
+		retention: []RetentionRule{
+			{Key: "category", Pattern: "tmp", After: time.Hour},
+			{Key: "category", Pattern: "legal", After: 0},
+		},
+		dir:     dir,
+		storage: storage,
+		locker:  locker,
+	}
+
+	now := time.Now()
+	upload := func(category, state string) *File {
+		t.Helper()
+		f := &File{ID: uuid.New(), Size: 5, Metadata: "category " + base64.StdEncoding.EncodeToString([]byte(category)), State: state, dir: dir}
+		f.created, f.active = now, now
+		if err := os.WriteFile(f.path(), []byte(content[:5]), 0644); err != nil {
+			t.Fatalf("Fail to create test data. error=%v", err)
+		}
+		storage.Put(f.ID.String(), f)
+		return f
+	}
+	tmp := upload("tmp", UPLOAD_STATE_COMPLETED)
+	legal := upload("legal", UPLOAD_STATE_COMPLETED)
+	partial := upload("tmp", UPLOAD_STATE_UPLOADING)
+
+	if expired := e.sweep(now.Add(30 * time.Minute)); expired != 0 {
+		t.Errorf("sweep removes the uploads before their retention. got=%d", expired)
+	}
+	if expired := e.sweep(now.Add(2 * time.Hour)); expired != 1 {
+		t.Errorf("sweep does not remove the upload past its retention only. got=%d", expired)
+	}
+	if state := tmp.state(); state != UPLOAD_STATE_EXPIRED {
+		t.Errorf("the upload past its retention is not expired. got=%s", state)
+	} else if _, err := os.Stat(tmp.path()); !os.IsNotExist(err) {
+		t.Errorf("the data of the upload past its retention is not removed. error=%v", err)
+	}
+	for _, f := range []*File{legal, partial} {
+		if state := f.state(); state == UPLOAD_STATE_EXPIRED {
+			t.Errorf("sweep removes the upload %s outside of the retention rules", f.ID)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+)
+
+// the points of every node on the ring, enough for an even spread of the ids
+// over a handful of nodes
+const hashRingReplicas = 128
+
+// hashRing maps the upload ids to the nodes of a cluster keeping their data
+// on local disks, by consistent hashing so a node joining or leaving moves
+// only the ids of its share. The router and the nodes build the same ring
+// from the same node list: a node only creates ids the ring maps to itself,
+// and the router forwards the requests of an id to the node of the ring.
+type hashRing struct {
+	points []uint32
+	nodes  map[uint32]string
+}
+
+func newHashRing(nodes []string) *hashRing {
+	r := &hashRing{nodes: make(map[uint32]string)}
+	for _, node := range nodes {
+		for i := range hashRingReplicas {
+			point := crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i)))
+			r.points = append(r.points, point)
+			r.nodes[point] = node
+		}
+	}
+	slices.Sort(r.points)
+	return r
+}
+
+// node returns the node of key, the first point clockwise of its hash
+func (r *hashRing) node(key string) string {
+	if len(r.points) <= 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i, _ := slices.BinarySearch(r.points, h)
+	if i >= len(r.points) {
+		i = 0
+	}
+	return r.nodes[r.points[i]]
+}
+
+// newUploadID returns the function generating the ids of the uploads, which
+// are the ones the ring of ClusterNodes maps to ClusterNode in a cluster
+func newUploadID(config *ServerConfig) func() (uuid.UUID, error) {
+	if len(config.ClusterNodes) <= 0 || !slices.Contains(config.ClusterNodes, config.ClusterNode) {
+		return uuid.NewUUID
+	}
+	ring := newHashRing(config.ClusterNodes)
+	return func() (uuid.UUID, error) {
+		// a node owns 1/n of the ids, n tries are expected
+		for {
+			id, err := uuid.NewUUID()
+			if err != nil || ring.node(id.String()) == config.ClusterNode {
+				return id, err
+			}
+		}
+	}
+}
+
+// newRouter returns the reverse proxy in front of the nodes: a request of an
+// upload, with its id in the path, goes to the node of the id, the others,
+// i.e., the creations, go to the nodes in turn. The nodes must trust the
+// router as a proxy, see ServerConfig.TrustedProxies, to build the Location
+// of the router.
+func newRouter(nodes []string) (http.Handler, error) {
+	if len(nodes) <= 0 {
+		return nil, errors.New("the router needs nodes")
+	}
+	targets := make(map[string]*url.URL, len(nodes))
+	for _, node := range nodes {
+		target, err := url.Parse(node)
+		if err != nil || len(target.Host) <= 0 {
+			return nil, fmt.Errorf("invalid node %q", node)
+		}
+		targets[node] = target
+	}
+	ring := newHashRing(nodes)
+	var next atomic.Uint64
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			node := ""
+			if id, ok := pathUploadID(r.In.URL.Path); ok {
+				node = ring.node(id)
+			} else {
+				node = nodes[next.Add(1)%uint64(len(nodes))]
+			}
+			r.SetURL(targets[node])
+			r.SetXForwarded()
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Error("Fail to route request", slog.String("path", r.URL.Path), slog.Any("Error", err))
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}, nil
+}
+
+// pathUploadID returns the upload id in path, the first segment that is a
+// uuid, i.e., /files/{id} or /tenants/{tenant}/files/{id}/thumbnails/{size}
+func pathUploadID(path string) (string, bool) {
+	for _, segment := range strings.Split(path, "/") {
+		if _, err := uuid.Parse(segment); err == nil && len(segment) == 36 {
+			return segment, true
+		}
+	}
+	return "", false
+}
+
+// runRouter parses the arguments of the router subcommand and runs the
+// router until it is shut down
+func runRouter(args []string) error {
+	var nodes listFlag
+	cfg := defaultServerConfig()
+	flags := flag.NewFlagSet("router", flag.ContinueOnError)
+	flags.Var(&nodes, "nodes", "the root URLs of the nodes, comma separated, i.e., http://10.0.0.1:8080,http://10.0.0.2:8080, the same list as their --cluster-nodes")
+	flags.StringVar(&cfg.Host, "host", cfg.Host, "the host to listen on")
+	flags.IntVar(&cfg.Port, "port", cfg.Port, "the port to listen on")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	router, err := newRouter(nodes)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", router)
+	// a router proxies the upload streams, it must not time them out
+	cfg.ReadTimeout, cfg.WriteTimeout = 0, 0
+	return NewServer(cfg, mux).Start()
+}
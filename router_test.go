@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestHashRing(t *testing.T) {
+	nodes := []string{"http://a", "http://b", "http://c"}
+	ring := newHashRing(nodes)
+	counts := map[string]int{}
+	keys := make([]string, 3000)
+	for i := range keys {
+		keys[i] = uuid.NewString()
+		counts[ring.node(keys[i])]++
+	}
+	for _, node := range nodes {
+		if counts[node] < 500 {
+			t.Errorf("the ids are not spread over the nodes. got=%v", counts)
+		}
+	}
+
+	// a node leaving only moves its own ids
+	smaller := newHashRing(nodes[:2])
+	for _, key := range keys {
+		if before := ring.node(key); before != "http://c" && smaller.node(key) != before {
+			t.Fatalf("the id %s of %s moves to %s", key, before, smaller.node(key))
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	// the nodes need their URLs in their config
+	handlers := make([]http.Handler, 2)
+	var nodes []string
+	var servers []*httptest.Server
+	for i := range handlers {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlers[i].ServeHTTP(w, r) }))
+		defer server.Close()
+		servers = append(servers, server)
+		nodes = append(nodes, server.URL)
+	}
+	for i := range handlers {
+		handlers[i] = buildServeMux(&ServerConfig{UploadDir: t.TempDir(), RelativeLocation: true, ClusterNodes: nodes, ClusterNode: nodes[i]})
+	}
+	router, err := newRouter(nodes)
+	if err != nil {
+		t.Fatalf("Fail to create router. error=%v", err)
+	}
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	ring := newHashRing(nodes)
+	for i := range 4 {
+		id := createUpload(t, proxy.URL+"/files", 10)
+		patchUpload(t, proxy.URL+"/files", id, 0, content[:10])
+		if got := downloadUpload(t, proxy.URL+"/files/"+id); got != content[:10] {
+			t.Errorf("upload %d does not hold the data through the router. got=%s", i, got)
+		}
+		// the data is on the node of the ring
+		owner := ring.node(id)
+		res, err := http.Head(owner + "/files/" + id)
+		if err != nil {
+			t.Fatalf("Fail to execute HEAD request. error=%v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || res.Header.Get(HEADER_UPLOAD_OFFSET) != strconv.Itoa(10) {
+			t.Errorf("the upload is not on its node %s. got=%d", owner, res.StatusCode)
+		}
+	}
+
+	if _, err := newRouter([]string{"not a url"}); err == nil {
+		t.Errorf("an invalid node does not fail")
+	}
+	if id, ok := pathUploadID("/tenants/acme/files/" + strings.Repeat("0", 8) + "-0000-0000-0000-000000000000/thumbnails/64x64"); !ok || id != "00000000-0000-0000-0000-000000000000" {
+		t.Errorf("pathUploadID does not find the id. got=%s", id)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// STORAGE_DIR is the key of HookFileInfoChanges.Storage setting the
+// directory the complete upload is moved to
+const STORAGE_DIR = "Dir"
+
+// StorageRoute sends the uploads whose metadata matches to their own final
+// directory, i.e., a storage_class of hot or cold to the volume of the class
+type StorageRoute struct {
+	Key     string // the metadata key matched
+	Pattern string // the path.Match pattern the value must match, empty matches any value
+	Dir     string // the final directory of the matching uploads, {value} is replaced by the value of the key
+}
+
+// match returns the directory of the upload of metadata when the route
+// matches it. A value replacing {value} must be a plain name, a value with a
+// path separator or a dot name never matches so it can't point out of the
+// directory.
+func (r StorageRoute) match(metadata map[string]string) (string, bool) {
+	value, ok := metadata[r.Key]
+	if !ok {
+		return "", false
+	}
+	if len(r.Pattern) > 0 {
+		if matched, err := path.Match(r.Pattern, value); err != nil || !matched {
+			return "", false
+		}
+	}
+	if !strings.Contains(r.Dir, "{value}") {
+		return r.Dir, true
+	}
+	if len(value) <= 0 || value == "." || value == ".." || strings.ContainsAny(value, `/\`) || filepath.VolumeName(value) != "" {
+		return "", false
+	}
+	return strings.ReplaceAll(r.Dir, "{value}", value), true
+}
+
+// routeStorage returns the Dir of the first route matching metadata, dir
+// when there is none
+func routeStorage(routes []StorageRoute, metadata map[string]string, dir string) string {
+	for _, route := range routes {
+		if routed, ok := route.match(metadata); ok {
+			return routed
+		}
+	}
+	return dir
+}
+
+// unroutedKeys returns the violations of the keys of metadata routed on
+// whose value none of the routes of the key matches, the routes of a key are
+// the allowlist of its values, see ServerConfig.StrictStorageRoutes
+func unroutedKeys(routes []StorageRoute, metadata map[string]string) []metadataViolation {
+	var violations []metadataViolation
+	var keys []string
+	for _, route := range routes {
+		if _, ok := metadata[route.Key]; ok && !slices.Contains(keys, route.Key) {
+			keys = append(keys, route.Key)
+		}
+	}
+	for _, key := range keys {
+		if !slices.ContainsFunc(routes, func(r StorageRoute) bool {
+			_, ok := r.match(metadata)
+			return ok && r.Key == key
+		}) {
+			violations = append(violations, metadataViolation{key, "matches no storage route"})
+		}
+	}
+	return violations
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	"resumable-upload/hookpb"
+)
+
+func TestRouteStorage(t *testing.T) {
+	routes := []StorageRoute{
+		{Key: "category", Pattern: "image*", Dir: "/images"},
+		{Key: "project", Dir: "/projects/{value}"},
+		{Key: "archive", Dir: "/archive"},
+	}
+	tests := []struct {
+		testName string
+		metadata map[string]string
+		expected string
+	}{
+		{"pattern", map[string]string{"category": "images", "project": "a"}, "/images"},
+		{"pattern mismatch falls through", map[string]string{"category": "video", "project": "a"}, "/projects/a"},
+		{"any value", map[string]string{"archive": ""}, "/archive"},
+		{"value with separator", map[string]string{"project": "../etc"}, "/final"},
+		{"dot value", map[string]string{"project": ".."}, "/final"},
+		{"no match", map[string]string{"filename": "a.txt"}, "/final"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			if got := routeStorage(routes, test.metadata, "/final"); got != test.expected {
+				t.Errorf("routeStorage does not return %s. got=%s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestStorageRouting(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fail to listen. error=%v", err)
+	}
+	hookDir := t.TempDir()
+	service := grpc.NewServer()
+	hookpb.RegisterHookHandlerServer(service, &fakeHookService{dir: hookDir})
+	go service.Serve(listener)
+	defer service.Stop()
+
+	finalDir := t.TempDir()
+	projectsDir := t.TempDir()
+	tests := []struct {
+		testName    string
+		hooks       string
+		metadata    string
+		expectedDir string
+	}{
+		{"default", "", "", finalDir},
+		{"route", "", "project " + base64.StdEncoding.EncodeToString([]byte("a")), filepath.Join(projectsDir, "a")},
+		{"hook", listener.Addr().String(), "project " + base64.StdEncoding.EncodeToString([]byte("a")), hookDir},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			defer func() { uploadDir = tempUploadDir }()
+			config := &ServerConfig{
+				UploadDir:        t.TempDir(),
+				RelativeLocation: true,
+				FinalDir:         finalDir,
+				StorageRoutes:    []StorageRoute{{Key: "project", Dir: filepath.Join(projectsDir, "{value}")}},
+				HooksGRPC:        test.hooks,
+			}
+			server := httptest.NewServer(buildServeMux(config))
+			defer server.Close()
+			host := server.URL + "/files"
+			req, err := http.NewRequest(http.MethodPost, host, nil)
+			if err != nil {
+				t.Fatalf("Fail to create test data. Error=%v", err)
+			}
+			req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+			if len(test.metadata) > 0 {
+				req.Header.Set(HEADER_UPLOAD_METADATA, test.metadata)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to create test data. Error=%v", err)
+			}
+			res.Body.Close()
+			fileId := filepath.Base(res.Header.Get(HEADER_LOCATION))
+			patchUpload(t, host, fileId, 0, content[:10])
+
+			if _, err := os.Stat(filepath.Join(test.expectedDir, fileId)); err != nil {
+				t.Errorf("the upload is not moved to %s. error=%v", test.expectedDir, err)
+			}
+		})
+	}
+}
+
+func TestStrictStorageRoutes(t *testing.T) {
+	routes := []StorageRoute{
+		{Key: "storage_class", Pattern: "hot", Dir: "/mnt/hot"},
+		{Key: "storage_class", Pattern: "cold", Dir: "/mnt/cold"},
+		{Key: "project", Dir: "/projects/{value}"},
+	}
+	tests := []struct {
+		testName     string
+		metadata     map[string]string
+		expectedKeys []string
+	}{
+		{"allowed class", map[string]string{"storage_class": "cold"}, nil},
+		{"class not allowed", map[string]string{"storage_class": "glacier"}, []string{"storage_class"}},
+		{"no class", map[string]string{"filename": "a.txt"}, nil},
+		{"value out of the directory", map[string]string{"storage_class": "hot", "project": ".."}, []string{"project"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			var keys []string
+			for _, v := range unroutedKeys(routes, test.metadata) {
+				keys = append(keys, v.Key)
+			}
+			if !slices.Equal(keys, test.expectedKeys) {
+				t.Errorf("unroutedKeys does not return %v. got=%v", test.expectedKeys, keys)
+			}
+		})
+	}
+
+	defer func() { uploadDir = tempUploadDir }()
+	coldDir := t.TempDir()
+	server := httptest.NewServer(buildServeMux(&ServerConfig{
+		UploadDir:           t.TempDir(),
+		RelativeLocation:    true,
+		StorageRoutes:       []StorageRoute{{Key: "storage_class", Pattern: "cold", Dir: coldDir}},
+		StrictStorageRoutes: true,
+	}))
+	defer server.Close()
+	host := server.URL + "/files"
+	create := func(class string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, host, nil)
+		if err != nil {
+			t.Fatalf("Fail to create test data. Error=%v", err)
+		}
+		req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+		req.Header.Set(HEADER_UPLOAD_METADATA, "storage_class "+base64.StdEncoding.EncodeToString([]byte(class)))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to create test data. Error=%v", err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	if res := create("glacier"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST with a storage class not allowed does not return 400. got=%d", res.StatusCode)
+	}
+	res := create("cold")
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("POST with an allowed storage class does not return 201. got=%d", res.StatusCode)
+	}
+	fileId := filepath.Base(res.Header.Get(HEADER_LOCATION))
+	patchUpload(t, host, fileId, 0, content[:10])
+	if _, err := os.Stat(filepath.Join(coldDir, fileId)); err != nil {
+		t.Errorf("the upload is not moved to the directory of its class. error=%v", err)
+	}
+}
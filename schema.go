@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// MetadataSchema declares the metadata keys the creations may carry, a
+// creation violating it is rejected with a problem detail listing the keys
+type MetadataSchema struct {
+	Fields       map[string]MetadataField `json:"fields"`
+	AllowUnknown bool                     `json:"allow_unknown"` // accept the keys missing from Fields, they are rejected otherwise
+}
+
+// MetadataField constrains the decoded value of a metadata key
+type MetadataField struct {
+	Required  bool   `json:"required"`
+	MaxLength int    `json:"max_length"` // the maximum length in bytes, 0 is unlimited
+	Pattern   string `json:"pattern"`    // a regular expression the whole value must match, i.e., [a-z0-9-]+
+}
+
+// metadataViolation is a key of a creation violating the MetadataSchema
+type metadataViolation struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+// metadataSchema is a MetadataSchema with its patterns compiled
+type metadataSchema struct {
+	MetadataSchema
+	patterns map[string]*regexp.Regexp
+}
+
+// newMetadataSchema returns the schema of config, the one of
+// MetadataSchemaFile over MetadataSchema, nil when there is none
+func newMetadataSchema(config *ServerConfig) (*metadataSchema, error) {
+	schema := config.MetadataSchema
+	if len(config.MetadataSchemaFile) > 0 {
+		data, err := os.ReadFile(config.MetadataSchemaFile)
+		if err != nil {
+			return nil, err
+		}
+		schema = &MetadataSchema{}
+		if err := json.Unmarshal(data, schema); err != nil {
+			return nil, fmt.Errorf("invalid metadata schema %s: %w", config.MetadataSchemaFile, err)
+		}
+	}
+	if schema == nil {
+		return nil, nil
+	}
+	compiled := &metadataSchema{MetadataSchema: *schema, patterns: map[string]*regexp.Regexp{}}
+	for k, field := range schema.Fields {
+		if len(field.Pattern) <= 0 {
+			continue
+		}
+		pattern, err := regexp.Compile("^(?:" + field.Pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern of metadata %s: %w", k, err)
+		}
+		compiled.patterns[k] = pattern
+	}
+	return compiled, nil
+}
+
+// validate returns the violations of the decoded metadata, sorted by key
+func (s *metadataSchema) validate(metadata map[string]string) []metadataViolation {
+	if s == nil {
+		return nil
+	}
+	var violations []metadataViolation
+	for k, v := range metadata {
+		field, ok := s.Fields[k]
+		switch {
+		case !ok && !s.AllowUnknown:
+			violations = append(violations, metadataViolation{k, "not allowed"})
+		case !ok:
+		case field.MaxLength > 0 && len(v) > field.MaxLength:
+			violations = append(violations, metadataViolation{k, fmt.Sprintf("longer than %d bytes", field.MaxLength)})
+		case s.patterns[k] != nil && !s.patterns[k].MatchString(v):
+			violations = append(violations, metadataViolation{k, "does not match " + field.Pattern})
+		}
+	}
+	for k, field := range s.Fields {
+		if _, ok := metadata[k]; field.Required && !ok {
+			violations = append(violations, metadataViolation{k, "required"})
+		}
+	}
+	slices.SortFunc(violations, func(a, b metadataViolation) int { return strings.Compare(a.Key, b.Key) })
+	return violations
+}
+
+// writeMetadataProblem rejects a creation violating the schema with an RFC
+// 9457 problem detail
+func writeMetadataProblem(w http.ResponseWriter, violations []metadataViolation) {
+	keys := make([]string, 0, len(violations))
+	for _, v := range violations {
+		keys = append(keys, v.Key+" "+v.Reason)
+	}
+	writeProblem(w, http.StatusBadRequest, "Invalid upload metadata", strings.Join(keys, ", "), map[string]any{"invalid_keys": violations})
+}
+
+// metadataLimits caps the Upload-Metadata of the creations, the zero fields
+// are unlimited
+type metadataLimits struct {
+	bytes int // the encoded header
+	keys  int
+	value int // a decoded value
+}
+
+func newMetadataLimits(config *ServerConfig) metadataLimits {
+	return metadataLimits{bytes: config.MaxMetadataSize, keys: config.MaxMetadataKeys, value: config.MaxMetadataValueSize}
+}
+
+// check returns the status and the reason rejecting the encoded metadata, 0
+// when it is within the limits
+func (l metadataLimits) check(metadata string) (int, string) {
+	if l.bytes > 0 && len(metadata) > l.bytes {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("the metadata is %d bytes, more than %d", len(metadata), l.bytes)
+	}
+	if len(strings.TrimSpace(metadata)) <= 0 {
+		return 0, ""
+	}
+	pairs := strings.Split(metadata, ",")
+	if l.keys > 0 && len(pairs) > l.keys {
+		return http.StatusBadRequest, fmt.Sprintf("the metadata has %d keys, more than %d", len(pairs), l.keys)
+	}
+	if l.value > 0 {
+		for _, pair := range pairs {
+			k, v, _ := strings.Cut(strings.TrimSpace(pair), " ")
+			if size := base64.StdEncoding.DecodedLen(len(strings.TrimSpace(v))); size > l.value {
+				// the padding may make the exact size a bit smaller
+				if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v)); err != nil || len(decoded) > l.value {
+					return http.StatusRequestEntityTooLarge, fmt.Sprintf("the value of %s is more than %d bytes", k, l.value)
+				}
+			}
+		}
+	}
+	return 0, ""
+}
+
+// writeMetadataLimitProblem rejects a creation whose metadata exceeds the
+// limits with status
+func writeMetadataLimitProblem(w http.ResponseWriter, status int, detail string) {
+	writeProblem(w, status, "Upload metadata too large", detail, nil)
+}
+
+// writeProblem answers with an RFC 9457 problem detail, extra members added
+func writeProblem(w http.ResponseWriter, status int, title, detail string, extra map[string]any) {
+	problem := map[string]any{"type": "about:blank", "title": title, "status": status, "detail": detail}
+	for k, v := range extra {
+		problem[k] = v
+	}
+	w.Header().Set(HEADER_CONTENT_TYPE, "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem)
+}
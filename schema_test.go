@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMetadataSchema(t *testing.T) {
+	schema, err := newMetadataSchema(&ServerConfig{MetadataSchema: &MetadataSchema{Fields: map[string]MetadataField{
+		"filename": {Required: true, MaxLength: 8},
+		"owner":    {Pattern: "[a-z]+"},
+	}}})
+	if err != nil {
+		t.Fatalf("Fail to compile schema. error=%v", err)
+	}
+
+	tests := []struct {
+		testName string
+		metadata map[string]string
+		expected []metadataViolation
+	}{
+		{"valid", map[string]string{"filename": "a.txt", "owner": "alice"}, nil},
+		{"required only", map[string]string{"filename": "a.txt"}, nil},
+		{"missing required", map[string]string{"owner": "alice"}, []metadataViolation{{"filename", "required"}}},
+		{"too long", map[string]string{"filename": "report.pdf"}, []metadataViolation{{"filename", "longer than 8 bytes"}}},
+		{"not matching", map[string]string{"filename": "a.txt", "owner": "Alice1"}, []metadataViolation{{"owner", "does not match [a-z]+"}}},
+		{"unknown", map[string]string{"filename": "a.txt", "tag": "x"}, []metadataViolation{{"tag", "not allowed"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			if got := schema.validate(test.metadata); !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("validate does not return %v. got=%v", test.expected, got)
+			}
+		})
+	}
+
+	schema.AllowUnknown = true
+	if got := schema.validate(map[string]string{"filename": "a.txt", "tag": "x"}); len(got) > 0 {
+		t.Errorf("validate rejects an unknown key with AllowUnknown. got=%v", got)
+	}
+	if _, err := newMetadataSchema(&ServerConfig{MetadataSchema: &MetadataSchema{Fields: map[string]MetadataField{"a": {Pattern: "("}}}}); err == nil {
+		t.Errorf("an invalid pattern does not fail")
+	}
+}
+
+func TestMetadataSchemaCreation(t *testing.T) {
+	schemaFile := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(schemaFile, []byte(`{"fields": {"filename": {"required": true}}}`), 0644); err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, MetadataSchemaFile: schemaFile}))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/files", nil)
+	if err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+	req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+	req.Header.Set(HEADER_UPLOAD_METADATA, encodeMetadata(map[string]string{"owner": "alice"}))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute POST request. error=%v", err)
+	}
+	defer res.Body.Close()
+	var problem struct {
+		Status      int                 `json:"status"`
+		InvalidKeys []metadataViolation `json:"invalid_keys"`
+	}
+	json.NewDecoder(res.Body).Decode(&problem)
+	if res.StatusCode != http.StatusBadRequest || res.Header.Get(HEADER_CONTENT_TYPE) != "application/problem+json" {
+		t.Errorf("POST violating the schema does not return a problem detail. got=%d %s", res.StatusCode, res.Header.Get(HEADER_CONTENT_TYPE))
+	}
+	expected := []metadataViolation{{"filename", "required"}, {"owner", "not allowed"}}
+	if !reflect.DeepEqual(problem.InvalidKeys, expected) {
+		t.Errorf("the problem does not list the offending keys. got=%v", problem.InvalidKeys)
+	}
+}
+
+func TestMetadataLimits(t *testing.T) {
+	limits := metadataLimits{bytes: 64, keys: 2, value: 8}
+
+	tests := []struct {
+		testName       string
+		metadata       string
+		expectedStatus int
+	}{
+		{"empty", "", 0},
+		{"within", encodeMetadata(map[string]string{"a": "12345678", "b": "x"}), 0},
+		{"too many keys", encodeMetadata(map[string]string{"a": "1", "b": "2", "c": "3"}), http.StatusBadRequest},
+		{"value too large", encodeMetadata(map[string]string{"a": "123456789"}), http.StatusRequestEntityTooLarge},
+		{"header too large", encodeMetadata(map[string]string{"a": strings.Repeat("x", 60)}), http.StatusRequestEntityTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			if status, reason := limits.check(test.metadata); status != test.expectedStatus {
+				t.Errorf("check does not return %d. got=%d %s", test.expectedStatus, status, reason)
+			}
+		})
+	}
+
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, MaxMetadataKeys: 1}))
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/files", nil)
+	if err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+	req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+	req.Header.Set(HEADER_UPLOAD_METADATA, encodeMetadata(map[string]string{"a": "1", "b": "2"}))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute POST request. error=%v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "2 keys, more than 1") {
+		t.Errorf("POST with too many metadata keys does not return a clear 400. got=%d %s", res.StatusCode, body)
+	}
+}
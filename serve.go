@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// defaultServerConfig is the configuration of the serve subcommand before
+// its config file and flags
+func defaultServerConfig() *ServerConfig {
+	return &ServerConfig{
+		UploadDir:              "upload",
+		BasePath:               "/files",
+		Host:                   "localhost",
+		Port:                   8080,
+		Protocol:               "http",
+		ShutdownTimeoutSeconds: 10,
+		ReadTimeout:            60 * time.Second,
+		WriteTimeout:           60 * time.Second,
+		IdleTimeout:            30 * time.Second,
+		MaxConnections:         1024,
+		ConnectionOverflow:     CONNECTION_OVERFLOW_QUEUE,
+		ConnectionQueueTimeout: 5 * time.Second,
+		MaxUploads:             256,
+		MaxUploadsPerClient:    8,
+		UploadRetryAfter:       5 * time.Second,
+		IdempotencyWindow:      24 * time.Hour,
+		MaxBufferMemory:        256 * CHUNK_SIZE,
+		MaxOpenFiles:           512,
+		FileIdleTimeout:        30 * time.Second,
+		FsyncPolicy:            FSYNC_COMPLETION,
+		Preallocate:            true,
+		Checksum:               true,
+		Digest:                 true,
+		PersistState:           true,
+		MaxMetadataSize:        16 * 1024,
+		MaxMetadataKeys:        64,
+		MaxMetadataValueSize:   4 * 1024,
+	}
+}
+
+// parseServeConfig returns the configuration of the serve subcommand: the
+// defaults, overridden by the JSON ServerConfig of --config, overridden by
+// the flags. Every string, bool, number, duration and list field of
+// ServerConfig has a flag named after it, i.e., --upload-dir for UploadDir
+// and --kafka-brokers a,b for KafkaBrokers. The structured fields, i.e.,
+// CORS, Listeners or Tenants, are set in the config file only.
+func parseServeConfig(args []string, output io.Writer) (*ServerConfig, error) {
+	cfg := defaultServerConfig()
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.SetOutput(output)
+	configFile := flags.String("config", "", "a JSON file of ServerConfig fields, durations in nanoseconds, overridden by the flags")
+	registerConfigFlags(flags, reflect.ValueOf(cfg).Elem())
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+	if len(*configFile) <= 0 {
+		return cfg, nil
+	}
+
+	// the file goes under the flags, so it is loaded on the defaults then
+	// the flags set are parsed again on top of it
+	cfg = defaultServerConfig()
+	data, err := os.ReadFile(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", *configFile, err)
+	}
+	again := flag.NewFlagSet("serve", flag.ContinueOnError)
+	again.SetOutput(io.Discard)
+	again.String("config", "", "")
+	registerConfigFlags(again, reflect.ValueOf(cfg).Elem())
+	if err := again.Parse(args); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// registerConfigFlags registers a flag per field of config it can parse
+func registerConfigFlags(flags *flag.FlagSet, config reflect.Value) {
+	for i := range config.NumField() {
+		field := config.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := flagName(field.Name)
+		usage := "see ServerConfig." + field.Name
+		switch ptr := config.Field(i).Addr().Interface().(type) {
+		case *string:
+			flags.StringVar(ptr, name, *ptr, usage)
+		case *bool:
+			flags.BoolVar(ptr, name, *ptr, usage)
+		case *int:
+			flags.IntVar(ptr, name, *ptr, usage)
+		case *int64:
+			flags.Int64Var(ptr, name, *ptr, usage)
+		case *time.Duration:
+			flags.DurationVar(ptr, name, *ptr, usage)
+		case *[]string:
+			flags.Var((*listFlag)(ptr), name, usage+", comma separated")
+		case flag.Value:
+			flags.Var(ptr, name, usage)
+		}
+	}
+}
+
+// flagName returns the kebab case of a Go field name, i.e., MaxUploads is
+// max-uploads and AMQPURL is amqpurl
+func flagName(field string) string {
+	runes := []rune(field)
+	var name strings.Builder
+	for i, r := range runes {
+		// a word starts at an upper case letter after a lower case one, or
+		// at the last upper case letter of an acronym
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+			name.WriteByte('-')
+		}
+		name.WriteRune(unicode.ToLower(r))
+	}
+	return name.String()
+}
+
+// listFlag is a comma separated list flag
+type listFlag []string
+
+func (l *listFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = nil
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// runServe parses the arguments of the serve subcommand then runs the server
+// until it is shut down
+func runServe(args []string) error {
+	cfg, err := parseServeConfig(args, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if err := prepareUploadDir(cfg); err != nil {
+		return err
+	}
+	return NewServer(cfg, buildServeMux(cfg)).Start()
+}
+
+// prepareUploadDir creates the UploadDir of config with UploadDirMode when it
+// is missing and checks the server can write in it, so a server that could
+// not store an upload fails at start up instead of at every creation
+func prepareUploadDir(config *ServerConfig) error {
+	dir := config.UploadDir
+	if len(dir) <= 0 {
+		dir = uploadDir
+	}
+	mode := os.FileMode(0755)
+	if len(config.UploadDirMode) > 0 {
+		m, err := strconv.ParseUint(config.UploadDirMode, 8, 32)
+		if err != nil || m > uint64(os.ModePerm) {
+			return fmt.Errorf("invalid upload directory mode %q", config.UploadDirMode)
+		}
+		mode = os.FileMode(m)
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return fmt.Errorf("fail to create the upload directory %s: %w", dir, err)
+	}
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("fail to read the upload directory %s: %w", dir, err)
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("the upload directory %s is not a directory", dir)
+	}
+	probe, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return fmt.Errorf("the upload directory %s is not writable: %w", dir, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
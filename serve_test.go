@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFlagName(t *testing.T) {
+	tests := []struct {
+		field    string
+		expected string
+	}{
+		{"UploadDir", "upload-dir"},
+		{"MaxUploadsPerClient", "max-uploads-per-client"},
+		{"HooksGRPC", "hooks-grpc"},
+		{"AMQPURL", "amqpurl"},
+		{"NATSAddress", "nats-address"},
+		{"Port", "port"},
+	}
+
+	for _, test := range tests {
+		if got := flagName(test.field); got != test.expected {
+			t.Errorf("flagName(%s) does not return %s. got=%s", test.field, test.expected, got)
+		}
+	}
+}
+
+func TestParseServeConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	config := `{"Port": 9000, "MaxUploads": 4, "MaxSize": "2GiB", "CORS": {"AllowedOrigins": ["*"]}}`
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatalf("Fail to create config file. error=%v", err)
+	}
+
+	cfg, err := parseServeConfig([]string{"--upload-dir", "/data", "--read-timeout", "5s", "--kafka-brokers", "a:9092,b:9092", "--preallocate=false", "--max-size", "50GB"}, io.Discard)
+	if err != nil {
+		t.Fatalf("Fail to parse flags. error=%v", err)
+	}
+	if cfg.UploadDir != "/data" || cfg.ReadTimeout != 5*time.Second || !slices.Equal(cfg.KafkaBrokers, []string{"a:9092", "b:9092"}) || cfg.Preallocate || cfg.MaxSize != 50e9 {
+		t.Errorf("the flags are not set. got=%+v", cfg)
+	}
+	if cfg.Port != 8080 || cfg.BasePath != "/files" {
+		t.Errorf("the defaults are not kept. got=%+v", cfg)
+	}
+
+	cfg, err = parseServeConfig([]string{"--config", configFile, "--port", "9001"}, io.Discard)
+	if err != nil {
+		t.Fatalf("Fail to parse config file. error=%v", err)
+	}
+	if cfg.Port != 9001 || cfg.MaxUploads != 4 || cfg.MaxSize != 2<<30 || cfg.CORS == nil || cfg.UploadDir != "upload" {
+		t.Errorf("the flags do not override the config file over the defaults. got=%+v", cfg)
+	}
+
+	if _, err := parseServeConfig([]string{"--unknown"}, io.Discard); err == nil {
+		t.Errorf("an unknown flag does not fail")
+	}
+}
+
+func TestPrepareUploadDir(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+	tests := []struct {
+		testName      string
+		dir           string
+		mode          string
+		expectedError bool
+		expectedMode  os.FileMode
+	}{
+		{"Should create the missing directory", filepath.Join(root, "a", "upload"), "", false, 0755},
+		{"Should create the directory with the mode", filepath.Join(root, "b"), "0700", false, 0700},
+		{"Should accept an existing directory", root, "", false, 0},
+		{"Should fail on a file", file, "", true, 0},
+		{"Should fail on an invalid mode", filepath.Join(root, "c"), "rwx", true, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			err := prepareUploadDir(&ServerConfig{UploadDir: test.dir, UploadDirMode: test.mode})
+			if (err != nil) != test.expectedError {
+				t.Fatalf("prepareUploadDir does not fail %v. error=%v", test.expectedError, err)
+			}
+			if test.expectedMode == 0 {
+				return
+			}
+			stat, err := os.Stat(test.dir)
+			if err != nil {
+				t.Fatalf("Fail to stat the upload directory. error=%v", err)
+			}
+			// the umask may only drop permissions
+			if mode := stat.Mode().Perm(); mode&^test.expectedMode != 0 || mode&0700 != 0700 {
+				t.Errorf("the upload directory is not created with %o. got=%o", test.expectedMode, mode)
+			}
+			if entries, _ := os.ReadDir(test.dir); len(entries) > 0 {
+				t.Errorf("the writable check leaves files behind. got=%v", entries)
+			}
+		})
+	}
+}
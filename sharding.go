@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// shardPath returns the path of the upload id in dir. A sharded layout
+// stores it two levels down, i.e., ab/cd/<id>, where abcd is the start of
+// the hash of the id, so no directory ends up with more than a few thousand
+// entries whatever the number of uploads and the id scheme.
+func shardPath(dir, id string, sharded bool) string {
+	if !sharded {
+		return filepath.Join(dir, id)
+	}
+	sum := sha256.Sum256([]byte(id))
+	prefix := hex.EncodeToString(sum[:2])
+	return filepath.Join(dir, prefix[:2], prefix[2:], id)
+}
+
+// migrateToShards moves the uploads stored flat in dir, from before sharding
+// was enabled, into their shard subdirectory. Only the data and info files
+// of uploads are moved, it returns the number of files moved.
+func migrateToShards(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		// the info files move along with their data
+		id := strings.TrimSuffix(entry.Name(), INFO_EXTENSION)
+		if _, err := uuid.Parse(id); err != nil {
+			continue
+		}
+
+		target := shardPath(dir, id, true) + strings.TrimPrefix(entry.Name(), id)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return moved, err
+		}
+		if err := os.Rename(filepath.Join(dir, entry.Name()), target); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	if moved > 0 {
+		slog.Info("Migrated flat uploads to shards", slog.String("dir", dir), slog.Int("count", moved))
+	}
+	return moved, nil
+}
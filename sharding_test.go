@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestShardPath(t *testing.T) {
+	id := uuid.New().String()
+	tests := []struct {
+		testName string
+		sharded  bool
+		depth    int
+	}{
+		{"flat", false, 1},
+		{"sharded", true, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			path := shardPath("dir", id, test.sharded)
+			parts := strings.Split(path, string(filepath.Separator))
+			if len(parts)-1 != test.depth {
+				t.Errorf("shardPath does not return a path %d levels deep. got=%s", test.depth, path)
+			}
+			if parts[len(parts)-1] != id {
+				t.Errorf("shardPath does not end with the id. got=%s", path)
+			}
+			if path != shardPath("dir", id, test.sharded) {
+				t.Errorf("shardPath is not stable. got=%s", path)
+			}
+		})
+	}
+}
+
+func TestShardedWrite(t *testing.T) {
+	f := &File{ID: uuid.New(), Size: 4, sharded: true}
+	if err := f.create(); err != nil {
+		t.Fatalf("Fail to create file. error=%v", err)
+	}
+	if err := f.write(context.Background(), strings.NewReader("data")); err != nil {
+		t.Fatalf("Fail to write file. error=%v", err)
+	}
+
+	written, err := os.ReadFile(shardPath(uploadDir, f.ID.String(), true))
+	if err != nil {
+		t.Fatalf("Fail to read sharded file. error=%v", err)
+	}
+	if string(written) != "data" {
+		t.Errorf("sharded write is not correct, expected=data. got=%q", written)
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, f.ID.String())); !os.IsNotExist(err) {
+		t.Errorf("sharded write creates a flat file. error=%v", err)
+	}
+}
+
+func TestMigrateToShards(t *testing.T) {
+	dir := t.TempDir()
+	ids := []string{uuid.New().String(), uuid.New().String()}
+	for _, id := range ids {
+		if err := os.WriteFile(filepath.Join(dir, id), []byte(id), 0644); err != nil {
+			t.Fatalf("Fail to create test data. error=%v", err)
+		}
+	}
+	// not an upload, must be left alone
+	if err := os.WriteFile(filepath.Join(dir, "README"), nil, 0644); err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+
+	moved, err := migrateToShards(dir)
+	if err != nil {
+		t.Fatalf("Fail to migrate. error=%v", err)
+	}
+	if moved != len(ids) {
+		t.Errorf("migrateToShards does not move %d uploads. got=%d", len(ids), moved)
+	}
+	for _, id := range ids {
+		data, err := os.ReadFile(shardPath(dir, id, true))
+		if err != nil || string(data) != id {
+			t.Errorf("migrateToShards does not move %s to its shard. error=%v", id, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "README")); err != nil {
+		t.Errorf("migrateToShards moves files that are not uploads. error=%v", err)
+	}
+
+	// running it again is a no-op
+	if moved, err := migrateToShards(dir); err != nil || moved != 0 {
+		t.Errorf("migrateToShards is not idempotent. moved=%d error=%v", moved, err)
+	}
+}
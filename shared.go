@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+
+	"github.com/google/uuid"
+)
+
+// sharedUploads finds the uploads of an UploadDir shared by several
+// instances, i.e., on NFS behind a load balancer, where any instance may
+// serve any request of an upload. The state of the uploads is shared through
+// the info files of PersistState, or through redis with the redis
+// StateStore, see redisStateStore: an upload created by another instance is
+// loaded from its state on its first request, and the state of a known one
+// is reloaded on every request since another instance may have written it
+// since.
+type sharedUploads struct {
+	storage *Storage
+	newFile func(id uuid.UUID, size int, metadata string) *File
+}
+
+// get returns the upload of id with its persisted state, nil when no
+// instance knows it
+func (s *sharedUploads) get(id string) *File {
+	f := s.storage.Get(id)
+	if f == nil {
+		uid, err := uuid.Parse(id)
+		if err != nil {
+			return nil
+		}
+		// the File locates the info file of the id
+		f = s.newFile(uid, 0, "")
+		info, err := f.readState()
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				slog.Error("Fail to load shared upload", slog.String("id", id), slog.Any("Error", err))
+			}
+			return nil
+		}
+		f.Size = info.Size
+		f.applyInfo(info, true)
+		// a concurrent request may have loaded it first, there is a single
+		// File for an upload
+		f, _ = s.storage.LoadOrStore(id, f)
+		return f
+	}
+
+	if err := f.refresh(false); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// terminated by another instance
+			s.storage.Delete(id)
+			return nil
+		}
+		slog.Error("Fail to refresh shared upload", slog.String("id", id), slog.Any("Error", err))
+	}
+	return f
+}
+
+// refresh reloads the state of f persisted by the instances sharing its
+// UploadDir, the checksum too with withChecksum, which must run under the
+// write lock of the upload
+func (f *File) refresh(withChecksum bool) error {
+	info, err := f.readState()
+	if err != nil {
+		return err
+	}
+	if withChecksum && info.Offset != f.offset() {
+		// the last write was made by another instance
+		f.lastWrite = committedRange{}
+	}
+	f.applyInfo(info, withChecksum)
+	return nil
+}
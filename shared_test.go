@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSharedStorage(t *testing.T) {
+	redis := newFakeRedis(t)
+	tests := []struct {
+		testName   string
+		stateStore string
+	}{
+		{"file", STATE_STORE_FILE},
+		{"redis", STATE_STORE_REDIS},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			defer func() { uploadDir = tempUploadDir }()
+			dir := t.TempDir()
+			newInstance := func() *httptest.Server {
+				return httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: dir, RelativeLocation: true, SharedStorage: true, Locker: LOCKER_FILE, Checksum: true, StateStore: test.stateStore, RedisAddress: redis.listener.Addr().String(), AdminToken: "secret"}))
+			}
+			a, b := newInstance(), newInstance()
+			defer a.Close()
+			defer b.Close()
+
+			headOffset := func(server *httptest.Server, id string) (int, string) {
+				t.Helper()
+				res, err := http.Head(server.URL + "/files/" + id)
+				if err != nil {
+					t.Fatalf("Fail to execute HEAD request. error=%v", err)
+				}
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					return -1, ""
+				}
+				offset, _ := strconv.Atoi(res.Header.Get(HEADER_UPLOAD_OFFSET))
+				return offset, res.Header.Get(HEADER_UPLOAD_CHECKSUM)
+			}
+
+			// created and half written on one instance, finished on the other
+			id := createUpload(t, a.URL+"/files", 10)
+			patchUpload(t, a.URL+"/files", id, 0, content[:5])
+			if offset, _ := headOffset(b, id); offset != 5 {
+				t.Errorf("the other instance does not know the upload at 5. got=%d", offset)
+			}
+			patchUpload(t, b.URL+"/files", id, 5, content[5:10])
+			if offset, _ := headOffset(a, id); offset != 10 {
+				t.Errorf("the creating instance does not see the upload completed elsewhere. got=%d", offset)
+			}
+			if _, checksum := headOffset(b, id); checksum != expectedChecksum([]byte(content[:10])) {
+				t.Errorf("the completing instance does not send the checksum of the whole upload. got=%s", checksum)
+			}
+			if got := downloadUpload(t, a.URL+"/files/"+id); got != content[:10] {
+				t.Errorf("the upload does not hold the data of both instances. got=%s", got)
+			}
+			if offset, _ := headOffset(b, "00000000-0000-0000-0000-000000000000"); offset != -1 {
+				t.Errorf("an unknown upload is found. got=%d", offset)
+			}
+
+			// the admin API of an instance reaches the uploads of the other
+			other := createUpload(t, a.URL+"/files", 10)
+			req, err := http.NewRequest(http.MethodGet, b.URL+"/admin/uploads/"+other, nil)
+			if err != nil {
+				t.Fatalf("Fail to create test data. error=%v", err)
+			}
+			req.Header.Set("Authorization", "Bearer secret")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute GET request. error=%v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("the admin API does not find the upload of the other instance. got=%d", res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestSharedUploadsSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	newFile := func(id uuid.UUID, size int, metadata string) *File {
+		return &File{ID: id, Size: size, Metadata: metadata, persist: true, dir: dir}
+	}
+	f := newFile(uuid.New(), 10, "")
+	if err := f.saveInfo(); err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+	shared := &sharedUploads{storage: newStorage(), newFile: newFile}
+
+	// the concurrent first requests of an upload share its File
+	files := make([]*File, 16)
+	var wg sync.WaitGroup
+	for i := range files {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			files[i] = shared.get(f.ID.String())
+		}()
+	}
+	wg.Wait()
+	for i, got := range files {
+		if got == nil || got != files[0] {
+			t.Errorf("the request %d does not get the File of the others. got=%p want=%p", i, got, files[0])
+		}
+	}
+}
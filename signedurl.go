@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// the query parameters of a signed upload URL
+const (
+	QUERY_EXPIRES   = "expires"
+	QUERY_SIGNATURE = "signature"
+)
+
+var (
+	errURLInvalid = errors.New("invalid upload url signature")
+	errURLExpired = errors.New("expired upload url")
+)
+
+// urlExpiry returns the unix time the URL of an upload created at now
+// expires, per the url_ttl of its policy over ServerConfig.UploadURLTTL, 0
+// when its URL is not signed. The URLs are signed with PolicySecret.
+func urlExpiry(config *ServerConfig, policy uploadPolicy, now time.Time) int64 {
+	if len(config.PolicySecret) <= 0 {
+		return 0
+	}
+	ttl := config.UploadURLTTL
+	if policy.URLTTL > 0 {
+		ttl = time.Duration(policy.URLTTL) * time.Second
+	}
+	if ttl <= 0 {
+		return 0
+	}
+	return now.Add(ttl).Unix()
+}
+
+// signUploadURL returns the query of the URL of the upload id expiring at
+// expires, signed with secret
+func signUploadURL(secret, id string, expires int64) string {
+	query := url.Values{}
+	query.Set(QUERY_EXPIRES, strconv.FormatInt(expires, 10))
+	query.Set(QUERY_SIGNATURE, base64.RawURLEncoding.EncodeToString(uploadURLMAC(secret, id, expires)))
+	return query.Encode()
+}
+
+// checkUploadURL checks the query of a request on f against the signed URL
+// of f at now. The expiry is recorded in f so it can't be dropped from the
+// URL, and it is independent of the expiration of the upload, see expirer.
+func checkUploadURL(secret string, f *File, query url.Values, now time.Time) error {
+	if f.urlExpires <= 0 {
+		return nil
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(query.Get(QUERY_SIGNATURE))
+	if err != nil || query.Get(QUERY_EXPIRES) != strconv.FormatInt(f.urlExpires, 10) || !hmac.Equal(mac, uploadURLMAC(secret, f.ID.String(), f.urlExpires)) {
+		return errURLInvalid
+	}
+	if now.Unix() > f.urlExpires {
+		return errURLExpired
+	}
+	return nil
+}
+
+func uploadURLMAC(secret, id string, expires int64) []byte {
+	return policyMAC(secret, id+"."+strconv.FormatInt(expires, 10))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestCheckUploadURL(t *testing.T) {
+	now := time.Now()
+	f := &File{ID: uuid.New(), urlExpires: now.Add(time.Hour).Unix()}
+	expired := &File{ID: uuid.New(), urlExpires: now.Add(-time.Hour).Unix()}
+	query := func(secret string, f *File, expires int64) url.Values {
+		values, _ := url.ParseQuery(signUploadURL(secret, f.ID.String(), expires))
+		return values
+	}
+
+	tests := []struct {
+		testName    string
+		file        *File
+		query       url.Values
+		expectedErr error
+	}{
+		{"valid", f, query("secret", f, f.urlExpires), nil},
+		{"not signed", &File{ID: uuid.New()}, url.Values{}, nil},
+		{"missing", f, url.Values{}, errURLInvalid},
+		{"other key", f, query("other", f, f.urlExpires), errURLInvalid},
+		{"extended", f, query("secret", f, f.urlExpires+3600), errURLInvalid},
+		{"other upload", f, query("secret", expired, f.urlExpires), errURLInvalid},
+		{"expired", expired, query("secret", expired, expired.urlExpires), errURLExpired},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			if err := checkUploadURL("secret", test.file, test.query, now); !errors.Is(err, test.expectedErr) {
+				t.Errorf("checkUploadURL does not return %v. got=%v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestSignedUploadURL(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: t.TempDir(), RelativeLocation: true, PolicySecret: "secret"}))
+	defer server.Close()
+	host := server.URL + "/files"
+	link, _ := signPolicy("secret", uploadPolicy{URLTTL: 60})
+
+	req, err := http.NewRequest(http.MethodPost, host, nil)
+	if err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+	req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+	req.Header.Set(HEADER_UPLOAD_POLICY, link)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute POST request. error=%v", err)
+	}
+	res.Body.Close()
+	location := res.Header.Get(HEADER_LOCATION)
+	if !strings.Contains(location, QUERY_SIGNATURE+"=") {
+		t.Fatalf("POST does not return a signed location. got=%s", location)
+	}
+	unsigned, _, _ := strings.Cut(location, "?")
+
+	tests := []struct {
+		testName       string
+		method         string
+		url            string
+		expectedStatus int
+	}{
+		{"Should accept HEAD on the signed URL", http.MethodHead, location, http.StatusOK},
+		{"Should refuse HEAD on the unsigned URL", http.MethodHead, unsigned, http.StatusForbidden},
+		{"Should refuse PATCH on the unsigned URL", http.MethodPatch, unsigned, http.StatusForbidden},
+		{"Should accept PATCH on the signed URL", http.MethodPatch, location, http.StatusNoContent},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, server.URL+test.url, strings.NewReader(content[:10]))
+			if err != nil {
+				t.Fatalf("Fail to create request. error=%v", err)
+			}
+			req.Header.Set(HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM)
+			req.Header.Set(HEADER_UPLOAD_OFFSET, "0")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute request. error=%v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != test.expectedStatus {
+				t.Errorf("%s does not return %d. got=%d", test.method, test.expectedStatus, res.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// the extension of the file holding the state of an upload, next to its data
+const INFO_EXTENSION = ".info"
+
+// uploadInfo is the state of an upload persisted in its info file
+type uploadInfo struct {
+	ID         string    `json:"id"`
+	Size       int       `json:"size"`
+	Offset     int       `json:"offset"`
+	Metadata   string    `json:"metadata"`
+	State      string    `json:"state,omitempty"`
+	Checksum   []byte    `json:"checksum,omitempty"`    // the marshaled state of the running SHA-256
+	Final      string    `json:"final,omitempty"`       // the path of the data file once finalized
+	FinalStamp string    `json:"final_stamp,omitempty"` // the identity of the final data file, see fileStamp
+	Job        string    `json:"job,omitempty"`         // the id of the transcode job
+	FinalDir   string    `json:"dir,omitempty"`         // the final directory chosen at creation
+	MaxSize    int       `json:"max_size,omitempty"`    // the max size of the policy of the upload
+	Compressed bool      `json:"compressed,omitempty"`  // the data file is compressed, see compressStep
+	SHA256     string    `json:"sha256,omitempty"`      // the hex SHA-256 of the complete upload, see recordDigest
+	MIMEType   string    `json:"mime_type,omitempty"`   // the content type sniffed from the data, see detectMIMEType
+	URLExpires int64     `json:"url_expires,omitempty"` // the unix time the signed URL of the upload expires, see checkUploadURL
+	Created    time.Time `json:"created,omitzero"`      // when the upload was created
+	Active     time.Time `json:"active,omitzero"`       // the last write of the upload
+	Paused     bool      `json:"paused,omitempty"`      // the upload is paused, see pause
+	Expires    time.Time `json:"expires,omitzero"`      // the expiration asked for at creation, see requestedExpiry
+	Owner      string    `json:"owner,omitempty"`       // the subject of the policy of the creation, see checkOwner
+	Anonymous  bool      `json:"anonymous,omitempty"`   // the creation sent no policy, see ServerConfig.AnonymousUploads
+	Trashed    time.Time `json:"trashed,omitzero"`      // when the upload went to the trash, see expirer.remove
+	Restore    string    `json:"restore,omitempty"`     // the state the upload was trashed in
+	LegalHold  bool      `json:"legal_hold,omitempty"`  // see expirer.hold
+	Alias      string    `json:"alias,omitempty"`       // the name of the upload, see aliasIndex
+}
+
+func (f *File) infoPath() string {
+	return f.stagingPath() + INFO_EXTENSION
+}
+
+// saveInfo persists the state of the upload. The info file is replaced
+// atomically with a rename so a crash leaves either the previous or the new
+// state, never a torn one. It is called once the data has been fsynced per
+// the policy, so the recorded offset is at most as durable as the data and
+// load trims whatever a crash left the two out of step.
+func (f *File) saveInfo() error {
+	info := uploadInfo{
+		ID:         f.ID.String(),
+		Size:       f.Size,
+		Offset:     f.offset(),
+		Metadata:   f.metadata(),
+		State:      f.state(),
+		Job:        f.transcode(),
+		FinalDir:   f.finalDir,
+		MaxSize:    f.maxSize,
+		Compressed: f.isCompressed(),
+		SHA256:     hex.EncodeToString(f.sha256()),
+		MIMEType:   f.mimeType(),
+		URLExpires: f.urlExpires,
+		Paused:     f.isPaused(),
+		Expires:    f.expiry(),
+		Owner:      f.owner,
+		Anonymous:  f.anonymous,
+		LegalHold:  f.onHold(),
+		Alias:      f.alias(),
+	}
+	info.Created, info.Active = f.timestamps()
+	f.mu.Lock()
+	info.Trashed, info.Restore = f.trashed, f.trashedFrom
+	info.Final, info.FinalStamp = f.final, f.finalStamp
+	f.mu.Unlock()
+	if f.checksum.valid() {
+		state, err := f.checksum.hash.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		info.Checksum = state
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if f.states != nil {
+		return f.states.write(f.ID.String(), data)
+	}
+
+	path := f.infoPath()
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil && f.fsync.syncs() {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := replaceFile(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if f.fsync.syncs() {
+		// make the rename itself durable
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// loadUploads reloads the uploads persisted in dir into storage, newFile
+// builds the File of an upload with the server config. The offset and the
+// data of every upload are reconciled since a crash may have left them out of
+// step, see reconcile.
+func loadUploads(dir string, storage *Storage, newFile func(id uuid.UUID, size int, metadata string) *File) (int, error) {
+	loaded := 0
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(path, INFO_EXTENSION) {
+			return err
+		}
+		id, err := uuid.Parse(strings.TrimSuffix(entry.Name(), INFO_EXTENSION))
+		if err != nil {
+			return nil
+		}
+		if f, err := loadUpload(path, id, newFile); err != nil {
+			slog.Error("Fail to load upload", slog.String("path", path), slog.Any("Error", err))
+		} else {
+			storage.Put(id.String(), f)
+			loaded++
+		}
+		return nil
+	})
+	if loaded > 0 {
+		slog.Info("Loaded uploads", slog.String("dir", dir), slog.Int("count", loaded))
+	}
+	return loaded, err
+}
+
+func loadUpload(path string, id uuid.UUID, newFile func(id uuid.UUID, size int, metadata string) *File) (*File, error) {
+	info, err := readInfo(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := newFile(id, info.Size, info.Metadata)
+	f.applyInfo(info, true)
+	// the uploads persisted before the timestamps date from their last write
+	if info.Created.IsZero() {
+		if stat, err := os.Stat(f.storedPath()); err == nil {
+			f.created, f.active = stat.ModTime(), stat.ModTime()
+		}
+	}
+
+	// a compressed upload is complete and processed, only its data is left
+	if f.isCompressed() {
+		if _, err := os.Stat(f.storedPath()); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	stat, err := os.Stat(f.path())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.reconcile(stat.Size()); err != nil {
+		return nil, err
+	}
+	// infer the state of the uploads persisted before states existed
+	if len(info.State) <= 0 {
+		if err := f.advanceState(); err != nil {
+			return nil, err
+		}
+	}
+	if err := f.finalize(); err != nil {
+		slog.Error("Fail to finalize upload", slog.String("id", f.ID.String()), slog.Any("Error", err))
+		return f, nil
+	}
+	// the digest and the type of an upload completed before they were
+	// recorded
+	if err := f.recordDigest(); err != nil {
+		slog.Error("Fail to record upload digest", slog.String("id", f.ID.String()), slog.Any("Error", err))
+	}
+	if err := f.detectMIMEType(); err != nil {
+		slog.Error("Fail to detect upload MIME type", slog.String("id", f.ID.String()), slog.Any("Error", err))
+	}
+	if f.persist && (f.finalized() && len(info.Final) <= 0 || len(f.sha256()) > 0 && len(info.SHA256) <= 0 || len(f.mimeType()) > 0 && len(info.MIMEType) <= 0) {
+		if err := f.saveInfo(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// readState reads the persisted state of f, from its info file or from the
+// state store of the instances sharing it
+func (f *File) readState() (uploadInfo, error) {
+	if f.states != nil {
+		return f.states.read(f.ID.String())
+	}
+	return readInfo(f.infoPath())
+}
+
+// removeState removes the persisted state of f, a missing one is no error
+func (f *File) removeState() error {
+	if f.states != nil {
+		return f.states.remove(f.ID.String())
+	}
+	if err := os.Remove(f.infoPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// readInfo reads the info file at path
+func readInfo(path string) (uploadInfo, error) {
+	var info uploadInfo
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return info, err
+	}
+	return info, json.Unmarshal(data, &info)
+}
+
+// applyInfo sets the state persisted in info on f, and the checksum too with
+// withChecksum, which must not run during a write. A checksum persisted with
+// checksums disabled starts over from the data on disk.
+func (f *File) applyInfo(info uploadInfo, withChecksum bool) {
+	f.mu.Lock()
+	f.Offset = info.Offset
+	f.Metadata = info.Metadata
+	f.State = info.State
+	f.final, f.finalStamp = info.Final, info.FinalStamp
+	f.transcoding = info.Job
+	if len(info.FinalDir) > 0 {
+		f.finalDir = info.FinalDir
+	}
+	f.maxSize = info.MaxSize
+	f.compressed = info.Compressed
+	f.digest, _ = hex.DecodeString(info.SHA256)
+	f.sniffed = info.MIMEType
+	f.urlExpires = info.URLExpires
+	f.owner = info.Owner
+	f.anonymous = info.Anonymous
+	f.trashed, f.trashedFrom = info.Trashed, info.Restore
+	f.legalHold = info.LegalHold
+	f.aliasName = info.Alias
+	f.created, f.active = info.Created, info.Active
+	f.paused = info.Paused
+	f.expires = info.Expires
+	f.mu.Unlock()
+	f.dedup.add(f)
+
+	if f.checksum != nil && withChecksum {
+		if f.checksum.hash == nil {
+			f.checksum.reset()
+		}
+		err := f.checksum.hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(info.Checksum)
+		f.checksum.hashed = int64(info.Offset)
+		if err != nil {
+			f.checksum.reset()
+			if err := f.checksum.hashRange(f.path(), 0, int64(info.Offset)); err != nil {
+				f.checksum.hash = nil
+			}
+		}
+	}
+}
+
+// reconcile brings the offset and the data of the upload back in step when
+// the data file is size bytes long, it returns whether they had diverged.
+// Bytes past the offset were never committed and are trimmed, since the next
+// append must start at the offset. An offset past the data, i.e., data lost
+// in a crash or removed out of band, is lowered to the data on disk and the
+// checksum is recomputed from it.
+func (f *File) reconcile(size int64) (bool, error) {
+	offset := int64(f.offset())
+	if offset == size {
+		return false, nil
+	}
+	if offset < size {
+		return true, os.Truncate(f.path(), offset)
+	}
+
+	f.setOffset(int(size))
+	// the lost data has to be uploaded again, which no transition allows
+	// from completed
+	f.mu.Lock()
+	if f.State == UPLOAD_STATE_COMPLETED {
+		f.State = UPLOAD_STATE_UPLOADING
+	}
+	f.mu.Unlock()
+	if f.checksum != nil {
+		f.checksum.reset()
+		if err := f.checksum.hashRange(f.path(), 0, size); err != nil {
+			f.checksum.hash = nil
+		}
+	}
+	return true, nil
+}
+
+// verifyOffset checks the offset of the upload against its data on disk and
+// reconciles them, see reconcile. It must not run during a write. It returns
+// an error when the data file is gone.
+func (f *File) verifyOffset() error {
+	// the size of a compressed upload is not the one of its data file
+	if f.isCompressed() {
+		return nil
+	}
+	stat, err := os.Stat(f.path())
+	if err != nil {
+		return err
+	}
+	offset := f.offset()
+	diverged, err := f.reconcile(stat.Size())
+	if !diverged {
+		return err
+	}
+	slog.Warn("Upload offset diverged from its data on disk", slog.String("id", f.ID.String()), slog.Int("offset", offset), slog.Int64("size", stat.Size()), slog.Int("reconciled", f.offset()))
+	if err != nil {
+		return err
+	}
+	if f.persist {
+		return f.saveInfo()
+	}
+	return nil
+}
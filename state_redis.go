@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+)
+
+const (
+	// STATE_STORE_FILE keeps the state of every upload in an info file next
+	// to its data, on the filesystem shared by the instances
+	STATE_STORE_FILE = "file"
+	// STATE_STORE_REDIS keeps the state of the uploads in redis at
+	// RedisAddress, only their data is on the shared filesystem
+	STATE_STORE_REDIS = "redis"
+)
+
+// the prefix of the keys of the upload states in redis
+const redisStatePrefix = "tus:state:"
+
+// redisStateStore keeps the uploadInfo of the uploads in redis, as the JSON
+// of their info file, for the instances sharing the uploads, see
+// sharedUploads. A write replaces the state atomically like the rename of
+// an info file.
+type redisStateStore struct {
+	client *redisClient
+}
+
+func newRedisStateStore(address string) *redisStateStore {
+	return &redisStateStore{client: &redisClient{address: address}}
+}
+
+// read returns the state of the upload of id, fs.ErrNotExist when it has
+// none like for a missing info file
+func (s *redisStateStore) read(id string) (uploadInfo, error) {
+	var info uploadInfo
+	reply, err := s.client.do("GET", redisStatePrefix+id)
+	if err != nil {
+		return info, err
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return info, fs.ErrNotExist
+	}
+	return info, json.Unmarshal([]byte(data), &info)
+}
+
+func (s *redisStateStore) write(id string, data []byte) error {
+	_, err := s.client.do("SET", redisStatePrefix+id, string(data))
+	return err
+}
+
+func (s *redisStateStore) remove(id string) error {
+	_, err := s.client.do("DEL", redisStatePrefix+id)
+	return err
+}
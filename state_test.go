@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestPersistState(t *testing.T) {
+	dir := t.TempDir()
+	defer func() { uploadDir = tempUploadDir }()
+	config := &ServerConfig{UploadDir: dir, PersistState: true, Checksum: true}
+
+	server := httptest.NewServer(buildServeMux(config))
+	host := server.URL + "/files"
+	req, err := http.NewRequest(http.MethodPost, host, nil)
+	if err != nil {
+		t.Fatalf("Fail to create test data. Error=%v", err)
+	}
+	req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+	req.Header.Set(HEADER_UPLOAD_METADATA, "filename "+base64.StdEncoding.EncodeToString([]byte("a.txt")))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to create test data. Error=%v", err)
+	}
+	res.Body.Close()
+	location := res.Header.Get(HEADER_LOCATION)
+	fileId := location[bytes.LastIndexByte([]byte(location), '/')+1:]
+	patchUpload(t, host, fileId, 0, content[:4])
+	server.Close()
+
+	// a restarted server picks the upload up where it was left
+	server = httptest.NewServer(buildServeMux(config))
+	defer server.Close()
+	host = server.URL + "/files"
+	res, err = http.Head(fmt.Sprintf("%s/%s", host, fileId))
+	if err != nil {
+		t.Fatalf("Fail to execute HEAD request. error=%v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("HEAD /files/%s does not find the persisted upload. got=%v", fileId, res.StatusCode)
+	}
+	if offset := res.Header.Get(HEADER_UPLOAD_OFFSET); offset != "4" {
+		t.Errorf("HEAD /files/%s does not return the persisted offset, expected=4. got=%v", fileId, offset)
+	}
+	if metadata := res.Header.Get(HEADER_UPLOAD_METADATA); metadata != req.Header.Get(HEADER_UPLOAD_METADATA) {
+		t.Errorf("HEAD /files/%s does not return the persisted metadata. got=%v", fileId, metadata)
+	}
+
+	// the checksum carries on from the persisted state
+	patchUpload(t, host, fileId, 4, content[4:10])
+	res, err = http.Head(fmt.Sprintf("%s/%s", host, fileId))
+	if err != nil {
+		t.Fatalf("Fail to execute HEAD request. error=%v", err)
+	}
+	res.Body.Close()
+	if checksum := res.Header.Get(HEADER_UPLOAD_CHECKSUM); checksum != expectedChecksum([]byte(content[:10])) {
+		t.Errorf("HEAD /files/%s does not return the checksum of the whole upload. got=%v", fileId, checksum)
+	}
+}
+
+func TestLoadUploadAfterCrash(t *testing.T) {
+	tests := []struct {
+		testName       string
+		recordedOffset int
+		dataOnDisk     int
+		expectedOffset int
+	}{
+		{"Should trim the data written after the last save", 4, 8, 4},
+		{"Should lower the offset to the data on disk", 8, 4, 4},
+		{"Should keep a consistent upload", 6, 6, 6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			newFile := func(id uuid.UUID, size int, metadata string) *File {
+				return &File{ID: id, Size: size, Metadata: metadata, persist: true, checksum: newChecksum()}
+			}
+			f := newFile(uuid.New(), 10, "")
+			if err := f.create(); err != nil {
+				t.Fatalf("Fail to create file. error=%v", err)
+			}
+			if err := f.write(context.Background(), bytes.NewReader([]byte(content[:test.recordedOffset]))); err != nil {
+				t.Fatalf("Fail to write file. error=%v", err)
+			}
+			// simulate the crash
+			if err := os.WriteFile(f.path(), []byte(content[:test.dataOnDisk]), 0644); err != nil {
+				t.Fatalf("Fail to write file. error=%v", err)
+			}
+
+			loaded, err := loadUpload(f.infoPath(), f.ID, newFile)
+			if err != nil {
+				t.Fatalf("Fail to load upload. error=%v", err)
+			}
+			if loaded.Offset != test.expectedOffset {
+				t.Errorf("loadUpload does not return the offset %d. got=%d", test.expectedOffset, loaded.Offset)
+			}
+			info, err := os.Stat(loaded.path())
+			if err != nil {
+				t.Fatalf("Fail to stat file. error=%v", err)
+			}
+			if int(info.Size()) != test.expectedOffset {
+				t.Errorf("loadUpload does not trim the data to the offset, expected=%d. got=%d", test.expectedOffset, info.Size())
+			}
+			if got := loaded.checksum.header(); got != expectedChecksum([]byte(content[:test.expectedOffset])) {
+				t.Errorf("loadUpload does not restore the checksum of the data. got=%s", got)
+			}
+		})
+	}
+}
+
+func TestVerifyOffset(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, VerifyOffset: true}))
+	defer server.Close()
+	host := server.URL + "/files"
+	fileId := createUpload(t, host, 10)
+	patchUpload(t, host, fileId, 0, content[:6])
+	path := shardPath(uploadDir, fileId, false)
+
+	tests := []struct {
+		testName               string
+		tamper                 func() error
+		expectedResponseStatus int
+		expectedOffset         string
+		expectedSize           int64
+	}{
+		{
+			testName:               "Should keep a consistent upload",
+			tamper:                 func() error { return nil },
+			expectedResponseStatus: http.StatusOK,
+			expectedOffset:         "6",
+			expectedSize:           6,
+		},
+		{
+			testName: "Should trim bytes appended out of band",
+			tamper: func() error {
+				return os.WriteFile(path, []byte(content[:9]), 0644)
+			},
+			expectedResponseStatus: http.StatusOK,
+			expectedOffset:         "6",
+			expectedSize:           6,
+		},
+		{
+			testName:               "Should lower the offset to lost data",
+			tamper:                 func() error { return os.Truncate(path, 3) },
+			expectedResponseStatus: http.StatusOK,
+			expectedOffset:         "3",
+			expectedSize:           3,
+		},
+		{
+			testName:               "Should forget an upload whose data is gone",
+			tamper:                 func() error { return os.Remove(path) },
+			expectedResponseStatus: http.StatusNotFound,
+			expectedSize:           -1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			if err := test.tamper(); err != nil {
+				t.Fatalf("Fail to tamper with the upload. error=%v", err)
+			}
+			res, err := http.Head(fmt.Sprintf("%s/%s", host, fileId))
+			if err != nil {
+				t.Fatalf("Fail to execute HEAD request. error=%v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != test.expectedResponseStatus {
+				t.Errorf("HEAD /files/%s does not return %v. got=%v", fileId, test.expectedResponseStatus, res.StatusCode)
+			}
+			if offset := res.Header.Get(HEADER_UPLOAD_OFFSET); offset != test.expectedOffset {
+				t.Errorf("HEAD /files/%s does not return the offset %s. got=%s", fileId, test.expectedOffset, offset)
+			}
+			if test.expectedSize >= 0 {
+				info, err := os.Stat(path)
+				if err != nil {
+					t.Fatalf("Fail to stat file. error=%v", err)
+				}
+				if info.Size() != test.expectedSize {
+					t.Errorf("HEAD /files/%s does not reconcile the data, expected size=%d. got=%d", fileId, test.expectedSize, info.Size())
+				}
+			}
+		})
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	dir := t.TempDir()
+	defer func() { uploadDir = tempUploadDir }()
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: dir, PersistState: true}))
+	defer server.Close()
+	host := server.URL + "/files"
+
+	head := func(fileId string) (time.Time, time.Time) {
+		t.Helper()
+		res, err := http.Head(fmt.Sprintf("%s/%s", host, fileId))
+		if err != nil {
+			t.Fatalf("Fail to execute HEAD request. error=%v", err)
+		}
+		res.Body.Close()
+		created, err := http.ParseTime(res.Header.Get(HEADER_UPLOAD_CREATED))
+		if err != nil {
+			t.Fatalf("HEAD does not return Upload-Created. got=%q", res.Header.Get(HEADER_UPLOAD_CREATED))
+		}
+		active, err := http.ParseTime(res.Header.Get(HEADER_UPLOAD_ACTIVITY))
+		if err != nil {
+			t.Fatalf("HEAD does not return Upload-Last-Activity. got=%q", res.Header.Get(HEADER_UPLOAD_ACTIVITY))
+		}
+		return created, active
+	}
+
+	before := time.Now().Truncate(time.Second)
+	fileId := createUpload(t, host, 10)
+	created, active := head(fileId)
+	if created.Before(before) || !active.Equal(created) {
+		t.Errorf("the creation does not set the timestamps. created=%v active=%v", created, active)
+	}
+
+	// the HTTP dates are in seconds
+	time.Sleep(time.Second)
+	patchUpload(t, host, fileId, 0, content[:4])
+	if c, a := head(fileId); !c.Equal(created) || !a.After(active) {
+		t.Errorf("a write does not advance the last activity only. created=%v active=%v", c, a)
+	}
+
+	info, err := readInfo(filepath.Join(dir, fileId+INFO_EXTENSION))
+	if err != nil {
+		t.Fatalf("Fail to read the info file. error=%v", err)
+	}
+	if info.Created.IsZero() || !info.Active.After(info.Created) {
+		t.Errorf("the info file does not record the timestamps. got=%+v", info)
+	}
+}
+
+func TestInfoOmitsZeroTimes(t *testing.T) {
+	data, err := json.Marshal(uploadInfo{ID: uuid.NewString()})
+	if err != nil {
+		t.Fatalf("Fail to marshal upload info. error=%v", err)
+	}
+	for _, name := range []string{"created", "active", "expires", "trashed"} {
+		if bytes.Contains(data, []byte(`"`+name+`"`)) {
+			t.Errorf("the info of an upload records a zero %s. got=%s", name, data)
+		}
+	}
+}
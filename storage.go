@@ -0,0 +1,114 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// the number of independently locked shards of Storage, a power of two
+const storageShards = 32
+
+// Storage is the registry of the uploads by id, safe for concurrent use. It
+// is split into shards with their own lock so requests on different uploads
+// rarely contend.
+type Storage struct {
+	shards [storageShards]storageShard
+}
+
+type storageShard struct {
+	mu    sync.RWMutex
+	files map[string]*File
+}
+
+func newStorage() *Storage {
+	s := &Storage{}
+	for i := range s.shards {
+		s.shards[i].files = make(map[string]*File)
+	}
+	return s
+}
+
+func (s *Storage) shard(id string) *storageShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &s.shards[h.Sum32()&(storageShards-1)]
+}
+
+// Get returns the upload of id, nil when there is none
+func (s *Storage) Get(id string) *File {
+	shard := s.shard(id)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	return shard.files[id]
+}
+
+func (s *Storage) Put(id string, f *File) {
+	shard := s.shard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.files[id] = f
+}
+
+// LoadOrStore returns the upload of id when there is one, else it stores f
+// and returns it. It reports whether the upload was there already.
+func (s *Storage) LoadOrStore(id string, f *File) (*File, bool) {
+	shard := s.shard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if existing, ok := shard.files[id]; ok {
+		return existing, true
+	}
+	shard.files[id] = f
+	return f, false
+}
+
+func (s *Storage) Delete(id string) {
+	shard := s.shard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	delete(shard.files, id)
+}
+
+// Size returns the total size of the uploads
+func (s *Storage) Size() int64 {
+	var size int64
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.RLock()
+		for _, f := range shard.files {
+			size += int64(f.Size)
+		}
+		shard.mu.RUnlock()
+	}
+	return size
+}
+
+// Len returns the number of uploads
+func (s *Storage) Len() int {
+	n := 0
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.RLock()
+		n += len(shard.files)
+		shard.mu.RUnlock()
+	}
+	return n
+}
+
+// Files returns the uploads, in no particular order
+func (s *Storage) Files() []*File {
+	var files []*File
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.RLock()
+		for _, f := range shard.files {
+			files = append(files, f)
+		}
+		shard.mu.RUnlock()
+	}
+	return files
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestStorage(t *testing.T) {
+	storage := newStorage()
+	f := &File{}
+	storage.Put("id", f)
+	if got := storage.Get("id"); got != f {
+		t.Errorf("Get does not return the upload put. got=%v", got)
+	}
+	if got := storage.Get("unknown"); got != nil {
+		t.Errorf("Get does not return nil for an unknown id. got=%v", got)
+	}
+	if storage.Len() != 1 {
+		t.Errorf("Len does not return 1. got=%d", storage.Len())
+	}
+	storage.Delete("id")
+	if got := storage.Get("id"); got != nil {
+		t.Errorf("Get does not return nil after Delete. got=%v", got)
+	}
+	if storage.Len() != 0 {
+		t.Errorf("Len does not return 0. got=%d", storage.Len())
+	}
+}
+
+// run with -race
+func TestStorageConcurrent(t *testing.T) {
+	storage := newStorage()
+	workers, perWorker := 16, 200
+
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWorker {
+				id := strconv.Itoa(w*perWorker + i)
+				storage.Put(id, &File{})
+				if storage.Get(id) == nil {
+					t.Errorf("Get does not return the upload put. id=%s", id)
+				}
+				if i%2 == 0 {
+					storage.Delete(id)
+				}
+				storage.Len()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if expected := workers * perWorker / 2; storage.Len() != expected {
+		t.Errorf("Len does not return %d. got=%d", expected, storage.Len())
+	}
+}
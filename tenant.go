@@ -0,0 +1,173 @@
+package main
+
+import (
+	"cmp"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// TenantConfig overrides the ServerConfig for a tenant, the zero fields keep
+// the value of the server
+type TenantConfig struct {
+	UploadDir           string   // the directory of the uploads of the tenant, defaults to tenants/<tenant> in the UploadDir of the server
+	MaxStorage          int64    // the total size in bytes of the uploads of the tenant
+	MaxSize             ByteSize // the largest upload of the tenant, see ServerConfig.MaxSize
+	MaxUploads          int      // the maximum number of simultaneously active PATCH streams of the tenant
+	MaxUploadsPerClient int      // the maximum number of simultaneously active PATCH streams of the tenant per client IP
+	MaxBandwidth        int      // the ingress bandwidth of the tenant in bytes per second
+	HooksDir            string   // the hooks of the tenant, see ServerConfig.HooksDir
+	CallbackHosts       []string // the hosts the callback_url of the tenant uploads may point to
+
+	// the paths of the tenant, each defaults to tenants/<tenant> in the one of
+	// the server, or next to it for a file, so the tenants never share a
+	// directory
+	FinalDir      string         // see ServerConfig.FinalDir
+	ProcessedDir  string         // see ServerConfig.ProcessedDir
+	LockDir       string         // see ServerConfig.LockDir
+	AuditLog      string         // see ServerConfig.AuditLog
+	StorageRoutes []StorageRoute // see ServerConfig.StorageRoutes, the routes of the server are kept with their Dir under tenants/<tenant>
+
+	AdminToken string // the bearer token of the admin API of the tenant under /tenants/<tenant>/admin, defaults to the one of the server
+}
+
+// the tenant names, they are part of the routes and of the upload directory
+var tenantName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// tenantPrefix returns the prefix of the routes of the tenant of config, empty
+// for the server itself
+func tenantPrefix(config *ServerConfig) string {
+	if len(config.tenant) <= 0 {
+		return ""
+	}
+	return "/tenants/" + config.tenant
+}
+
+// tenantDir returns the directory of tenant in the directory of the server
+// dir, empty when dir is
+func tenantDir(dir, tenant string) string {
+	if len(dir) <= 0 {
+		return ""
+	}
+	return filepath.Join(dir, "tenants", tenant)
+}
+
+// newTenantConfig derives the config of tenant from the one of the server
+// whose uploads are in dir
+func newTenantConfig(config *ServerConfig, dir, tenant string, overrides TenantConfig) *ServerConfig {
+	c := *config
+	c.tenant = tenant
+	c.Tenants = nil
+	// served by the server itself, the admin API of the tenant is served
+	// under its prefix
+	c.Demo = false
+	c.CORS = nil
+	c.BasePath = tenantPrefix(&c) + normalizeBasePath(config.BasePath)
+	c.UploadDir = overrides.UploadDir
+	if len(c.UploadDir) <= 0 {
+		c.UploadDir = filepath.Join(dir, "tenants", tenant)
+	}
+	if overrides.MaxStorage > 0 {
+		c.MaxStorage = overrides.MaxStorage
+	}
+	if overrides.MaxSize > 0 {
+		c.MaxSize = overrides.MaxSize
+	}
+	if overrides.MaxUploads > 0 {
+		c.MaxUploads = overrides.MaxUploads
+	}
+	if overrides.MaxUploadsPerClient > 0 {
+		c.MaxUploadsPerClient = overrides.MaxUploadsPerClient
+	}
+	if overrides.MaxBandwidth > 0 {
+		c.MaxBandwidth = overrides.MaxBandwidth
+		c.BandwidthBurst = 0
+	}
+	if len(overrides.HooksDir) > 0 {
+		c.HooksDir = overrides.HooksDir
+	}
+	if len(overrides.CallbackHosts) > 0 {
+		c.CallbackHosts = overrides.CallbackHosts
+	}
+	c.FinalDir = cmp.Or(overrides.FinalDir, tenantDir(config.FinalDir, tenant))
+	c.ProcessedDir = cmp.Or(overrides.ProcessedDir, tenantDir(config.ProcessedDir, tenant))
+	c.LockDir = cmp.Or(overrides.LockDir, tenantDir(config.LockDir, tenant))
+	c.AuditLog = overrides.AuditLog
+	if len(c.AuditLog) <= 0 && len(config.AuditLog) > 0 {
+		c.AuditLog = filepath.Join(tenantDir(filepath.Dir(config.AuditLog), tenant), filepath.Base(config.AuditLog))
+	}
+	c.StorageRoutes = overrides.StorageRoutes
+	if len(c.StorageRoutes) <= 0 {
+		c.StorageRoutes = make([]StorageRoute, len(config.StorageRoutes))
+		for i, route := range config.StorageRoutes {
+			route.Dir = tenantDir(route.Dir, tenant)
+			c.StorageRoutes[i] = route
+		}
+	}
+	c.AdminToken = cmp.Or(overrides.AdminToken, config.AdminToken)
+	return &c
+}
+
+// registerTenants serves each tenant of config under /tenants/<tenant> with
+// its own storage, directory and limits, so the uploads of a tenant can't be
+// reached from another one
+func registerTenants(mux *http.ServeMux, config *ServerConfig, dir string) {
+	for tenant, overrides := range config.Tenants {
+		if !tenantName.MatchString(tenant) {
+			slog.Error("Invalid tenant name, skipping it", slog.String("tenant", tenant))
+			continue
+		}
+		c := newTenantConfig(config, dir, tenant, overrides)
+		if err := prepareUploadDir(c); err != nil {
+			slog.Error("Fail to prepare the upload directory of the tenant, skipping it", slog.String("tenant", tenant), slog.Any("Error", err))
+			continue
+		}
+		mux.Handle("/tenants/"+tenant+"/", buildServeMux(c))
+	}
+}
+
+// storageQuota bounds the total size of the uploads, a zero quota means
+// unlimited. The size of an upload is reserved at its creation.
+type storageQuota struct {
+	mu   sync.Mutex
+	max  int64
+	used int64
+}
+
+// newStorageQuota returns the quota of max bytes of which used are held by
+// the existing uploads, nil when max is zero
+func newStorageQuota(max, used int64) *storageQuota {
+	if max <= 0 {
+		return nil
+	}
+	return &storageQuota{max: max, used: used}
+}
+
+// reserve reserves size bytes, it returns false when the quota would be
+// exceeded
+func (q *storageQuota) reserve(size int) bool {
+	if q == nil {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.used+int64(size) > q.max {
+		return false
+	}
+	q.used += int64(size)
+	return true
+}
+
+// release gives back the reservation of an upload that was not created
+func (q *storageQuota) release(size int) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.used -= int64(size)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTenants(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	dir := t.TempDir()
+	quotaDir := t.TempDir()
+	finalDir := t.TempDir()
+	config := &ServerConfig{
+		UploadDir:        dir,
+		FinalDir:         finalDir,
+		PersistState:     true,
+		RelativeLocation: true,
+		AdminToken:       "secret",
+		Tenants: map[string]TenantConfig{
+			"a":       {},
+			"b":       {UploadDir: quotaDir, MaxStorage: 10, AdminToken: "b-secret"},
+			"../evil": {},
+		},
+	}
+	server := httptest.NewServer(buildServeMux(config))
+	defer server.Close()
+	if uploadDir != dir {
+		t.Errorf("the tenants change the upload directory of the server. got=%s", uploadDir)
+	}
+
+	// the uploads of a tenant are stored and served apart
+	fileId := createUpload(t, server.URL+"/tenants/a/files", 10)
+	patchUpload(t, server.URL+"/tenants/a/files", fileId, 0, content[:10])
+	if _, err := os.Stat(filepath.Join(dir, "tenants", "a", fileId+INFO_EXTENSION)); err != nil {
+		t.Errorf("the upload is not stored in the directory of the tenant. error=%v", err)
+	}
+	if _, err := os.Stat(filepath.Join(finalDir, "tenants", "a", fileId)); err != nil {
+		t.Errorf("the upload is not finalized in the final directory of the tenant. error=%v", err)
+	}
+	tests := []struct {
+		testName       string
+		url            string
+		expectedStatus int
+	}{
+		{"same tenant", server.URL + "/tenants/a/files/" + fileId, http.StatusOK},
+		{"other tenant", server.URL + "/tenants/b/files/" + fileId, http.StatusNotFound},
+		{"server", server.URL + "/files/" + fileId, http.StatusNotFound},
+		{"invalid tenant", server.URL + "/tenants/../evil/files/" + fileId, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			res, err := http.Head(test.url)
+			if err != nil {
+				t.Fatalf("Fail to execute HEAD request. error=%v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != test.expectedStatus {
+				t.Errorf("HEAD %s does not return %v. got=%v", test.url, test.expectedStatus, res.StatusCode)
+			}
+		})
+	}
+
+	// a tenant serves the admin API of its uploads
+	adminTests := []struct {
+		testName       string
+		url            string
+		token          string
+		expectedStatus int
+	}{
+		{"same tenant", server.URL + "/tenants/a/admin/uploads/" + fileId, "secret", http.StatusOK},
+		{"other tenant", server.URL + "/tenants/b/admin/uploads/" + fileId, "b-secret", http.StatusNotFound},
+		{"token of the server", server.URL + "/tenants/b/admin/uploads/" + fileId, "secret", http.StatusUnauthorized},
+		{"server", server.URL + "/admin/uploads/" + fileId, "secret", http.StatusNotFound},
+	}
+	for _, test := range adminTests {
+		t.Run("admin "+test.testName, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, test.url, nil)
+			if err != nil {
+				t.Fatalf("Fail to create test data. error=%v", err)
+			}
+			req.Header.Set("Authorization", "Bearer "+test.token)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to execute GET request. error=%v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != test.expectedStatus {
+				t.Errorf("GET %s does not return %v. got=%v", test.url, test.expectedStatus, res.StatusCode)
+			}
+		})
+	}
+
+	// the quota of a tenant
+	createUpload(t, server.URL+"/tenants/b/files", 10)
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/tenants/b/files", nil)
+	if err != nil {
+		t.Fatalf("Fail to create test data. Error=%v", err)
+	}
+	req.Header.Set(HEADER_UPLOAD_LENGTH, "1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to execute POST request. error=%v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST above the quota of the tenant does not return %v. got=%v", http.StatusRequestEntityTooLarge, res.StatusCode)
+	}
+	createUpload(t, server.URL+"/tenants/a/files", 10)
+}
+
+func TestStorageQuota(t *testing.T) {
+	q := newStorageQuota(10, 4)
+	if !q.reserve(6) {
+		t.Errorf("reserve does not accept the remaining bytes")
+	}
+	if q.reserve(1) {
+		t.Errorf("reserve accepts bytes above the quota")
+	}
+	q.release(6)
+	if !q.reserve(6) {
+		t.Errorf("release does not give back the bytes")
+	}
+	var unlimited *storageQuota
+	if !unlimited.reserve(MAX_SIZE) {
+		t.Errorf("a nil quota is not unlimited")
+	}
+}
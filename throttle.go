@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket is a byte rate limiter shared by all the PATCH streams. Tokens
+// are refilled at rate bytes per second up to burst bytes.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens from the bucket, which may go into debt, and returns
+// how long the caller has to wait before the tokens are actually available
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// wait blocks until n tokens are available or the context is done
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	delay := b.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledReader reads from r no faster than the bucket allows. The time
+// spent waiting on the bucket is excused by the watcher of the stream, if
+// any, the server slowing a stream down is not its client being slow.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	bucket  *tokenBucket
+	watcher *transferRateWatcher
+}
+
+func newThrottledReader(ctx context.Context, r io.Reader, bucket *tokenBucket) *throttledReader {
+	return &throttledReader{ctx: ctx, r: r, bucket: bucket}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// never read more than a burst at once, otherwise a single read could
+	// overshoot the rate by a whole buffer
+	if len(p) > int(t.bucket.burst) {
+		p = p[:int(t.bucket.burst)]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.watcher.pause()
+		werr := t.bucket.wait(t.ctx, n)
+		t.watcher.resume()
+		if werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// transferRateWatcher counts the bytes read through it and calls abort when
+// less than minRate bytes per second have been read during a whole window,
+// but the time it is paused, see throttledReader. abort is expected to
+// unblock the pending Read, i.e., by setting a read deadline on the
+// connection.
+type transferRateWatcher struct {
+	r        io.Reader
+	read     atomic.Int64
+	evicted  atomic.Bool
+	done     chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	paused   time.Duration // the time paused during the current window
+	pausedAt time.Time     // when the pending pause started, zero when there is none
+}
+
+func newTransferRateWatcher(r io.Reader, minRate int, window time.Duration, abort func()) *transferRateWatcher {
+	w := &transferRateWatcher{r: r, done: make(chan struct{})}
+
+	go func() {
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				active := window - w.takePaused(now)
+				if read := w.read.Swap(0); active > 0 && read < int64(float64(minRate)*active.Seconds()) {
+					w.evicted.Store(true)
+					abort()
+					return
+				}
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+func (w *transferRateWatcher) Read(p []byte) (int, error) {
+	n, err := w.r.Read(p)
+	w.read.Add(int64(n))
+	return n, err
+}
+
+// pause stops counting the time until resume, nil does nothing
+func (w *transferRateWatcher) pause() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pausedAt = time.Now()
+}
+
+func (w *transferRateWatcher) resume() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.paused += time.Since(w.pausedAt)
+	w.pausedAt = time.Time{}
+}
+
+// takePaused returns the time paused in the window ending at now, the
+// pending pause included, and starts the next window
+func (w *transferRateWatcher) takePaused(now time.Time) time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	paused := w.paused
+	w.paused = 0
+	if !w.pausedAt.IsZero() {
+		paused += now.Sub(w.pausedAt)
+		w.pausedAt = now
+	}
+	return paused
+}
+
+// Stop stops watching the transfer rate, it must be called once the stream
+// is done
+func (w *transferRateWatcher) Stop() {
+	w.once.Do(func() { close(w.done) })
+}
+
+// Evicted reports whether the stream has been aborted for being too slow
+func (w *transferRateWatcher) Evicted() bool {
+	return w.evicted.Load()
+}
+
+// requestDeadline calls abort once a request has run for its max duration,
+// abort is expected to unblock the pending Read like for the
+// transferRateWatcher
+type requestDeadline struct {
+	timer    *time.Timer
+	exceeded atomic.Bool
+}
+
+func newRequestDeadline(max time.Duration, abort func()) *requestDeadline {
+	d := &requestDeadline{}
+	d.timer = time.AfterFunc(max, func() {
+		d.exceeded.Store(true)
+		abort()
+	})
+	return d
+}
+
+// Stop stops the deadline, it must be called once the stream is done
+func (d *requestDeadline) Stop() {
+	d.timer.Stop()
+}
+
+// Exceeded reports whether the stream has been cut at the deadline
+func (d *requestDeadline) Exceeded() bool {
+	return d.exceeded.Load()
+}
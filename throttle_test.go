@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestThrottledReader(t *testing.T) {
+	tests := []struct {
+		testName        string
+		rate            int
+		burst           int
+		size            int
+		minimumDuration time.Duration
+	}{
+		{
+			testName:        "Should read within the burst without waiting",
+			rate:            1000,
+			burst:           1000,
+			size:            500,
+			minimumDuration: 0,
+		},
+		{
+			testName:        "Should throttle reads above the burst",
+			rate:            1000,
+			burst:           100,
+			size:            400,
+			minimumDuration: 250 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			data := bytes.Repeat([]byte("a"), tt.size)
+			reader := newThrottledReader(context.Background(), bytes.NewReader(data), newTokenBucket(tt.rate, tt.burst))
+
+			start := time.Now()
+			read, err := io.ReadAll(reader)
+			elapsed := time.Since(start)
+			if err != nil {
+				t.Fatalf("Fail to read. error=%v", err)
+			}
+
+			if len(read) != tt.size {
+				t.Errorf("throttledReader does not read all bytes, expected=%d. got=%d", tt.size, len(read))
+			}
+			if elapsed < tt.minimumDuration {
+				t.Errorf("throttledReader reads too fast, expected at least=%v. got=%v", tt.minimumDuration, elapsed)
+			}
+		})
+	}
+}
+
+func TestThrottledReaderCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := newThrottledReader(ctx, bytes.NewReader(make([]byte, 1000)), newTokenBucket(10, 10))
+	cancel()
+
+	if _, err := io.ReadAll(reader); err != context.Canceled {
+		t.Errorf("throttledReader does not stop when the context is canceled. got=%v", err)
+	}
+}
+
+func TestTransferRateWatcherThrottled(t *testing.T) {
+	// the throttle lets 100 bytes per second through, far below the minimum
+	// rate, the watcher does not count its waits against the client
+	watcher := newTransferRateWatcher(bytes.NewReader(make([]byte, 1000)), 1000, 50*time.Millisecond, func() {})
+	defer watcher.Stop()
+	reader := newThrottledReader(context.Background(), watcher, newTokenBucket(100, 10))
+	reader.watcher = watcher
+
+	buf := make([]byte, 10)
+	for start := time.Now(); time.Since(start) < 300*time.Millisecond; {
+		if _, err := reader.Read(buf); err != nil {
+			t.Fatalf("Fail to read. error=%v", err)
+		}
+	}
+	if watcher.Evicted() {
+		t.Errorf("the watcher evicts a stream slowed down by the throttle")
+	}
+}
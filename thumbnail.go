@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// STEP_THUMBNAIL generates the ThumbnailSizes thumbnails of the image uploads
+const STEP_THUMBNAIL = "thumbnail"
+
+// METADATA_THUMBNAIL_PREFIX prefixes the metadata keys holding the location
+// of the thumbnails, i.e., thumbnail_256x256
+const METADATA_THUMBNAIL_PREFIX = "thumbnail_"
+
+// the largest image, in pixels, decoded to make thumbnails so a small
+// compressed upload can't exhaust the memory of the server
+const thumbnailMaxPixels = 64 << 20
+
+// thumbnailSize is the box a thumbnail fits in, keeping the aspect ratio of
+// the image
+type thumbnailSize struct {
+	width, height int
+}
+
+func (s thumbnailSize) String() string {
+	return strconv.Itoa(s.width) + "x" + strconv.Itoa(s.height)
+}
+
+// parseThumbnailSize parses a WIDTHxHEIGHT size
+func parseThumbnailSize(size string) (thumbnailSize, error) {
+	w, h, ok := strings.Cut(size, "x")
+	width, werr := strconv.Atoi(w)
+	height, herr := strconv.Atoi(h)
+	if !ok || werr != nil || herr != nil || width <= 0 || height <= 0 {
+		return thumbnailSize{}, fmt.Errorf("invalid thumbnail size %q, expecting WIDTHxHEIGHT", size)
+	}
+	return thumbnailSize{width: width, height: height}, nil
+}
+
+// thumbnailPath returns the path of the thumbnail of f, next to the data file
+// in UploadDir like the info file
+func thumbnailPath(f *File, size string) string {
+	return f.stagingPath() + ".thumb-" + size + ".jpg"
+}
+
+// thumbnailStep writes a JPEG thumbnail of every size for the JPEG, PNG and
+// GIF uploads and records the location they are served from in the
+// metadata. The other uploads are skipped. Images are never upscaled.
+type thumbnailStep struct {
+	sizes    []thumbnailSize
+	basePath string
+}
+
+func (thumbnailStep) Name() string { return STEP_THUMBNAIL }
+
+func (s thumbnailStep) Process(ctx context.Context, f *File) error {
+	metadata := parseMetadata(f.metadata())
+	if filetype := f.fileType(); len(filetype) > 0 && !strings.HasPrefix(filetype, "image/") {
+		return nil
+	}
+	data, err := os.Open(f.path())
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	config, _, err := image.DecodeConfig(data)
+	if errors.Is(err, image.ErrFormat) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: undecodable image %v", errProcessingRejected, err)
+	}
+	if config.Width*config.Height > thumbnailMaxPixels {
+		return fmt.Errorf("%w: the image of %dx%d is too large for thumbnails", errProcessingRejected, config.Width, config.Height)
+	}
+	if _, err := data.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(data)
+	if err != nil {
+		return fmt.Errorf("%w: undecodable image %v", errProcessingRejected, err)
+	}
+
+	for _, size := range s.sizes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := writeThumbnail(thumbnailPath(f, size.String()), img, size); err != nil {
+			return err
+		}
+		metadata[METADATA_THUMBNAIL_PREFIX+size.String()] = s.basePath + "/" + f.ID.String() + "/thumbnails/" + size.String()
+	}
+	f.setMetadata(encodeMetadata(metadata))
+	if f.persist {
+		return f.saveInfo()
+	}
+	return nil
+}
+
+// writeThumbnail scales img down to fit in size and writes it as a JPEG at
+// path, through a rename so the thumbnail served is never a partial one. The
+// transparent pixels turn white.
+func writeThumbnail(path string, img image.Image, size thumbnailSize) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > size.width || height > size.height {
+		if width*size.height > height*size.width {
+			width, height = size.width, max(1, height*size.width/width)
+		} else {
+			width, height = max(1, width*size.height/height), size.height
+		}
+	}
+	thumbnail := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(thumbnail, thumbnail.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(thumbnail, thumbnail.Bounds(), img, bounds, draw.Over, nil)
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := jpeg.Encode(tmp, thumbnail, &jpeg.Options{Quality: 85}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
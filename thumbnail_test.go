@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseThumbnailSize(t *testing.T) {
+	tests := []struct {
+		testName    string
+		size        string
+		expected    thumbnailSize
+		expectError bool
+	}{
+		{"valid", "256x128", thumbnailSize{256, 128}, false},
+		{"missing height", "256", thumbnailSize{}, true},
+		{"zero width", "0x128", thumbnailSize{}, true},
+		{"not a number", "ax128", thumbnailSize{}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			got, err := parseThumbnailSize(test.size)
+			if (err != nil) != test.expectError {
+				t.Errorf("parseThumbnailSize does not return error=%v. got=%v", test.expectError, err)
+			}
+			if got != test.expected {
+				t.Errorf("parseThumbnailSize does not return %v. got=%v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestThumbnailStep(t *testing.T) {
+	var buff bytes.Buffer
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	img.Set(0, 0, color.Black)
+	if err := png.Encode(&buff, img); err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+
+	tests := []struct {
+		testName string
+		data     string
+		filetype string
+		expected map[string]image.Point // the dimensions of the thumbnails
+	}{
+		{"png", buff.String(), "image/png", map[string]image.Point{"100x100": {100, 50}, "1000x1000": {400, 200}}},
+		{"not an image", content[:10], "", nil},
+		{"not an image type", buff.String(), "application/octet-stream", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			defer func() { uploadDir = tempUploadDir }()
+			// notify runs once the thumbnails are done
+			processed := make(chan struct{}, 1)
+			notify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				processed <- struct{}{}
+			}))
+			defer notify.Close()
+			config := &ServerConfig{
+				UploadDir:        t.TempDir(),
+				RelativeLocation: true,
+				ProcessingSteps:  []string{STEP_THUMBNAIL, STEP_NOTIFY},
+				ThumbnailSizes:   []string{"100x100", "1000x1000"},
+				NotifyURL:        notify.URL,
+			}
+			server := httptest.NewServer(buildServeMux(config))
+			defer server.Close()
+			host := server.URL + "/files"
+			req, err := http.NewRequest(http.MethodPost, host, nil)
+			if err != nil {
+				t.Fatalf("Fail to create test data. Error=%v", err)
+			}
+			req.Header.Set(HEADER_UPLOAD_LENGTH, strconv.Itoa(len(test.data)))
+			if len(test.filetype) > 0 {
+				req.Header.Set(HEADER_UPLOAD_METADATA, "filetype "+base64.StdEncoding.EncodeToString([]byte(test.filetype)))
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to create test data. Error=%v", err)
+			}
+			res.Body.Close()
+			fileId := filepath.Base(res.Header.Get(HEADER_LOCATION))
+			patchUpload(t, host, fileId, 0, test.data)
+
+			select {
+			case <-processed:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Fail to process upload")
+			}
+			res, err = http.Head(host + "/" + fileId)
+			if err != nil {
+				t.Fatalf("Fail to execute HEAD request. error=%v", err)
+			}
+			res.Body.Close()
+			metadata := parseMetadata(res.Header.Get(HEADER_UPLOAD_METADATA))
+			if len(test.expected) <= 0 && strings.Contains(res.Header.Get(HEADER_UPLOAD_METADATA), METADATA_THUMBNAIL_PREFIX) {
+				t.Errorf("thumbnails are made of a non image upload. got=%v", metadata)
+			}
+			for size, expected := range test.expected {
+				location := metadata[METADATA_THUMBNAIL_PREFIX+size]
+				if location != "/files/"+fileId+"/thumbnails/"+size {
+					t.Errorf("the location of thumbnail %s is not recorded. got=%s", size, location)
+				}
+				res, err := http.Get(server.URL + location)
+				if err != nil {
+					t.Fatalf("Fail to execute GET request. error=%v", err)
+				}
+				thumbnail, err := jpeg.Decode(res.Body)
+				res.Body.Close()
+				if err != nil {
+					t.Fatalf("Fail to decode thumbnail %s. error=%v", size, err)
+				}
+				if got := thumbnail.Bounds().Size(); got != expected {
+					t.Errorf("thumbnail %s is not %v. got=%v", size, expected, got)
+				}
+			}
+		})
+	}
+}
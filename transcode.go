@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// STEP_TRANSCODE dispatches a transcode job for the video uploads
+const STEP_TRANSCODE = "transcode"
+
+// EVENT_TRANSCODE is the event of a transcode job dispatched on a queue
+const EVENT_TRANSCODE = "transcode"
+
+// HEADER_TRANSCODE_JOB answers a HEAD with the id of the transcode job of
+// the upload once dispatched
+const HEADER_TRANSCODE_JOB = "Upload-Transcode-Job"
+
+const (
+	// TRANSCODE_QUEUE_NATS publishes the jobs on the NATSAddress server
+	TRANSCODE_QUEUE_NATS = "nats"
+	// TRANSCODE_QUEUE_AMQP publishes the jobs on the AMQPURL broker
+	TRANSCODE_QUEUE_AMQP = "amqp"
+)
+
+// transcodeStep hands the video uploads to a transcoder. The job is the
+// transcode event of the upload, with its path and metadata. It is POSTed to
+// an HTTP endpoint answering the id of the job as {"id": "..."}, or published
+// on a queue with an id generated here. The id is recorded in the state of
+// the upload and a job is dispatched only once per upload.
+type transcodeStep struct {
+	url   string         // the HTTP endpoint, empty when queued
+	queue EventPublisher // the queue, nil when POSTed
+}
+
+func newTranscodeStep(config *ServerConfig) (*transcodeStep, error) {
+	// the jobs are JSON whatever the format of the events, the transcoders
+	// read their job
+	format := eventFormat{name: EVENT_FORMAT_JSON}
+	switch {
+	case len(config.TranscodeURL) > 0:
+		return &transcodeStep{url: config.TranscodeURL}, nil
+	case config.TranscodeQueue == TRANSCODE_QUEUE_NATS && len(config.NATSAddress) > 0:
+		return &transcodeStep{queue: newNATSPublisher(config.NATSAddress, config.NATSSubjectPrefix, format)}, nil
+	case config.TranscodeQueue == TRANSCODE_QUEUE_AMQP && len(config.AMQPURL) > 0:
+		return &transcodeStep{queue: newAMQPPublisher(config.AMQPURL, config.AMQPExchange, config.AMQPRoutingKey, format)}, nil
+	default:
+		return nil, fmt.Errorf("the transcode step needs TranscodeURL, or TranscodeQueue with the address of its broker")
+	}
+}
+
+func (*transcodeStep) Name() string { return STEP_TRANSCODE }
+
+func (s *transcodeStep) Process(ctx context.Context, f *File) error {
+	video := isVideo(parseMetadata(f.metadata())) || strings.HasPrefix(f.mimeType(), "video/")
+	if !video || len(f.transcode()) > 0 {
+		return nil
+	}
+	event := newUploadEvent(EVENT_TRANSCODE, f)
+	var job string
+	if s.queue != nil {
+		job = uuid.NewString()
+		event.Job = job
+		if err := s.queue.Publish(ctx, event); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if job, err = s.post(ctx, event); err != nil {
+			return err
+		}
+	}
+
+	f.setTranscode(job)
+	if f.persist {
+		return f.saveInfo()
+	}
+	return nil
+}
+
+// post POSTs the job to the endpoint and returns the id it answered
+func (s *transcodeStep) post(ctx context.Context, event *UploadEvent) (string, error) {
+	payload, err := event.marshal()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(HEADER_CONTENT_TYPE, "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return "", fmt.Errorf("transcode answered %d", res.StatusCode)
+	}
+	var reply struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&reply); err != nil {
+		return "", fmt.Errorf("Invalid transcode reply %w", err)
+	}
+	if len(reply.ID) <= 0 {
+		return "", fmt.Errorf("transcode answered no job id")
+	}
+	return reply.ID, nil
+}
+
+// isVideo reports whether the upload is a video per its filetype metadata,
+// or the extension of its filename when it has no filetype
+func isVideo(metadata map[string]string) bool {
+	filetype := metadata["filetype"]
+	if len(filetype) <= 0 {
+		filetype = mime.TypeByExtension(filepath.Ext(metadata["filename"]))
+	}
+	return strings.HasPrefix(filetype, "video/")
+}
+
+// transcode returns the id of the transcode job of the upload, empty until
+// dispatched
+func (f *File) transcode() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.transcoding
+}
+
+func (f *File) setTranscode(job string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.transcoding = job
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIsVideo(t *testing.T) {
+	tests := []struct {
+		testName string
+		metadata map[string]string
+		expected bool
+	}{
+		{"video filetype", map[string]string{"filetype": "video/mp4"}, true},
+		{"image filetype", map[string]string{"filetype": "image/png", "filename": "a.mp4"}, false},
+		{"no metadata", map[string]string{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			if got := isVideo(test.metadata); got != test.expected {
+				t.Errorf("isVideo does not return %v. got=%v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestTranscodeStep(t *testing.T) {
+	tests := []struct {
+		testName string
+		queue    string
+		filetype string
+		expected bool // a job is dispatched
+	}{
+		{"http", "", "video/mp4", true},
+		{"nats", TRANSCODE_QUEUE_NATS, "video/mp4", true},
+		{"not a video", "", "image/png", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			defer func() { uploadDir = tempUploadDir }()
+			jobs := make(chan UploadEvent, 1)
+			transcoder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var event UploadEvent
+				if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+					t.Errorf("Fail to decode transcode job. error=%v", err)
+				}
+				jobs <- event
+				w.Write([]byte(`{"id":"job-1"}`))
+			}))
+			defer transcoder.Close()
+			nats := newFakeNATS(t)
+			// notify runs once the job is dispatched
+			processed := make(chan struct{}, 1)
+			notify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				processed <- struct{}{}
+			}))
+			defer notify.Close()
+			config := &ServerConfig{
+				UploadDir:        t.TempDir(),
+				PersistState:     true,
+				RelativeLocation: true,
+				ProcessingSteps:  []string{STEP_TRANSCODE, STEP_NOTIFY},
+				NotifyURL:        notify.URL,
+				NATSAddress:      nats.listener.Addr().String(),
+				TranscodeQueue:   test.queue,
+			}
+			if len(test.queue) <= 0 {
+				config.TranscodeURL = transcoder.URL
+			}
+
+			server := httptest.NewServer(buildServeMux(config))
+			host := server.URL + "/files"
+			req, err := http.NewRequest(http.MethodPost, host, nil)
+			if err != nil {
+				t.Fatalf("Fail to create test data. Error=%v", err)
+			}
+			req.Header.Set(HEADER_UPLOAD_LENGTH, "10")
+			req.Header.Set(HEADER_UPLOAD_METADATA, "filetype "+base64.StdEncoding.EncodeToString([]byte(test.filetype)))
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Fail to create test data. Error=%v", err)
+			}
+			res.Body.Close()
+			fileId := filepath.Base(res.Header.Get(HEADER_LOCATION))
+			patchUpload(t, host, fileId, 0, content[:10])
+			select {
+			case <-processed:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Fail to process upload")
+			}
+			server.Close()
+
+			var job UploadEvent
+			select {
+			case job = <-jobs:
+			default:
+				if len(test.queue) > 0 {
+					// the lifecycle events are published on the same server
+					message := nats.next(t)
+					for message.subject != "uploads."+EVENT_TRANSCODE {
+						message = nats.next(t)
+					}
+					if err := json.Unmarshal(message.payload, &job); err != nil {
+						t.Fatalf("Fail to decode transcode job. error=%v", err)
+					}
+				}
+			}
+			expectedJob := ""
+			if test.expected {
+				if job.Upload.ID != fileId || job.Upload.Metadata["filetype"] != test.filetype || len(job.Upload.Path) <= 0 {
+					t.Errorf("the transcode job does not hold the upload. got=%+v", job)
+				}
+				expectedJob = "job-1"
+				if len(test.queue) > 0 {
+					expectedJob = job.Job
+				}
+			} else if len(job.Upload.ID) > 0 {
+				t.Errorf("a transcode job is dispatched for a non video upload. got=%+v", job)
+			}
+
+			// the job id is part of the persisted state
+			server = httptest.NewServer(buildServeMux(config))
+			defer server.Close()
+			res, err = http.Head(server.URL + "/files/" + fileId)
+			if err != nil {
+				t.Fatalf("Fail to execute HEAD request. error=%v", err)
+			}
+			res.Body.Close()
+			if got := res.Header.Get(HEADER_TRANSCODE_JOB); got != expectedJob || (test.expected && len(got) <= 0) {
+				t.Errorf("HEAD does not return the transcode job %q. got=%q", expectedJob, got)
+			}
+		})
+	}
+}
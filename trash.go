@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// errNotTrashed is returned when restoring an upload not in the trash
+var errNotTrashed = errors.New("upload is not in the trash")
+
+// trashedAt returns when the upload was terminated or expired into the
+// trash, zero when it is not in it, see expirer.remove
+func (f *File) trashedAt() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.trashed
+}
+
+// purgeTrash removes for good the uploads in the trash for the
+// TrashRetention at now, it returns how many it removed
+func (e *expirer) purgeTrash(now time.Time) int {
+	purged := 0
+	for _, f := range e.uploads() {
+		trashed := f.trashedAt()
+		if trashed.IsZero() || trashed.Add(e.trash).After(now) {
+			continue
+		}
+		ok, err := e.purge(f)
+		if err != nil {
+			slog.Error("Fail to purge upload", slog.String("id", f.ID.String()), slog.Any("Error", err))
+		} else if ok {
+			purged++
+		}
+	}
+	if purged > 0 {
+		slog.Info("Purged uploads", slog.Int("count", purged))
+	}
+	return purged
+}
+
+// purge removes the data and the info file of f, in the trash, unless it
+// was restored meanwhile or is under legal hold. An upload being restored is
+// locked and left to the next sweep.
+func (e *expirer) purge(f *File) (bool, error) {
+	lock, err := e.locker.TryLock(f.ID.String())
+	if err != nil {
+		if errors.Is(err, errLocked) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer lock.Unlock()
+
+	if f.trashedAt().IsZero() || f.onHold() {
+		return false, nil
+	}
+	if err := e.erase(f); err != nil {
+		return false, err
+	}
+	f.mu.Lock()
+	f.trashed = time.Time{}
+	f.mu.Unlock()
+	return true, nil
+}
+
+// restore takes f out of the trash back to the state it was terminated or
+// expired in, for the admin API. Its last write moves to now so that it
+// does not expire again at once. It returns errNotTrashed unless it is in
+// the trash and errLocked while it is purged.
+func (e *expirer) restore(f *File) error {
+	lock, err := e.locker.TryLock(f.ID.String())
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	f.mu.Lock()
+	if f.trashed.IsZero() {
+		f.mu.Unlock()
+		return errNotTrashed
+	}
+	// no transition leaves the finished states, restoring undoes the one
+	// into them
+	f.State, f.trashed, f.trashedFrom = f.trashedFrom, time.Time{}, ""
+	f.mu.Unlock()
+	f.touch(false)
+	if f.persist {
+		return f.saveInfo()
+	}
+	return nil
+}
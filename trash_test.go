@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestTrash(t *testing.T) {
+	defer func() { uploadDir = tempUploadDir }()
+	dir := t.TempDir()
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: dir, AdminToken: "secret", RelativeLocation: true, PersistState: true, TrashRetention: time.Hour}))
+	defer server.Close()
+	host := server.URL + "/files"
+	adminRequest := func(method, path string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("Fail to create test data. error=%v", err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to execute %s request. error=%v", method, err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	head := func(fileId string) *http.Response {
+		t.Helper()
+		res, err := http.Head(fmt.Sprintf("%s/%s", host, fileId))
+		if err != nil {
+			t.Fatalf("Fail to execute HEAD request. error=%v", err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	fileId := createUpload(t, host, 10)
+	patchUpload(t, host, fileId, 0, content[:5])
+	if status := adminRequest(http.MethodDelete, "/admin/uploads/"+fileId); status != http.StatusNoContent {
+		t.Fatalf("DELETE does not return 204. got=%d", status)
+	}
+	if res := head(fileId); res.StatusCode != http.StatusGone {
+		t.Errorf("HEAD of a trashed upload does not return 410. got=%d", res.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(dir, fileId)); err != nil {
+		t.Errorf("the data of a trashed upload is removed. error=%v", err)
+	}
+	info, err := readInfo(filepath.Join(dir, fileId+INFO_EXTENSION))
+	if err != nil {
+		t.Fatalf("Fail to read upload info. error=%v", err)
+	}
+	if info.State != UPLOAD_STATE_TERMINATED || info.Trashed.IsZero() || info.Restore != UPLOAD_STATE_UPLOADING {
+		t.Errorf("the info of a trashed upload does not record the trash. got=%+v", info)
+	}
+
+	if status := adminRequest(http.MethodPost, "/admin/uploads/"+fileId+"/restore"); status != http.StatusNoContent {
+		t.Fatalf("restore does not return 204. got=%d", status)
+	}
+	if res := head(fileId); res.StatusCode != http.StatusOK || res.Header.Get(HEADER_UPLOAD_OFFSET) != "5" {
+		t.Errorf("HEAD of a restored upload does not return 200 at its offset. got=%d offset=%s", res.StatusCode, res.Header.Get(HEADER_UPLOAD_OFFSET))
+	}
+	patchUpload(t, host, fileId, 5, content[5:10])
+	if status := adminRequest(http.MethodPost, "/admin/uploads/"+fileId+"/restore"); status != http.StatusConflict {
+		t.Errorf("restore of an upload not in the trash does not return 409. got=%d", status)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	dir := t.TempDir()
+	locker, err := newLocker(&ServerConfig{})
+	if err != nil {
+		t.Fatalf("Fail to create locker. error=%v", err)
+	}
+	storage := newStorage()
+	e := &expirer{trash: time.Hour, dir: dir, storage: storage, locker: locker}
+
+	f := &File{ID: uuid.New(), Size: 5, State: UPLOAD_STATE_COMPLETED, dir: dir}
+	if err := os.WriteFile(f.path(), []byte(content[:5]), 0644); err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+	storage.Put(f.ID.String(), f)
+	if err := e.end(f, UPLOAD_STATE_EXPIRED); err != nil {
+		t.Fatalf("Fail to expire upload. error=%v", err)
+	}
+
+	e.sweep(time.Now().Add(30 * time.Minute))
+	if _, err := os.Stat(f.path()); err != nil || storage.Get(f.ID.String()) == nil {
+		t.Errorf("sweep purges the upload before the trash retention. error=%v", err)
+	}
+	e.sweep(time.Now().Add(2 * time.Hour))
+	if _, err := os.Stat(f.path()); !os.IsNotExist(err) {
+		t.Errorf("sweep does not purge the upload past the trash retention. error=%v", err)
+	}
+	if got := storage.Get(f.ID.String()); got != nil {
+		t.Errorf("the purged upload is not removed from the storage. got=%v", got)
+	}
+	if err := e.restore(f); !errors.Is(err, errNotTrashed) {
+		t.Errorf("restore of a purged upload does not return errNotTrashed. got=%v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package tusclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+)
+
+// Credentials authenticate the requests of a Client. Authorize is called
+// before every request, so a provider of short lived tokens refreshes them
+// during a long upload.
+type Credentials interface {
+	Authorize(req *http.Request) error
+}
+
+// CredentialsFunc is a function of Credentials
+type CredentialsFunc func(req *http.Request) error
+
+func (f CredentialsFunc) Authorize(req *http.Request) error {
+	return f(req)
+}
+
+// BearerToken sends token as Authorization: Bearer <token>
+func BearerToken(token string) Credentials {
+	return TokenSource(func(context.Context) (string, error) { return token, nil })
+}
+
+// TokenSource sends the token returned by source for every request as a
+// bearer token, source is expected to cache it until it expires
+func TokenSource(source func(ctx context.Context) (string, error)) Credentials {
+	return CredentialsFunc(func(req *http.Request) error {
+		token, err := source(req.Context())
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	})
+}
+
+// APIKey sends key in the header, i.e., X-API-Key
+func APIKey(header, key string) Credentials {
+	return CredentialsFunc(func(req *http.Request) error {
+		req.Header.Set(header, key)
+		return nil
+	})
+}
+
+// NewTLSHTTPClient returns an http.Client presenting the client certificate
+// of certFile and keyFile, both PEM, for a server requiring mutual TLS.
+// caFile adds the PEM certificates of a private CA to trust, empty trusts
+// the system ones only.
+func NewTLSHTTPClient(certFile, keyFile, caFile string) (*http.Client, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if len(caFile) > 0 {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("tusclient: no certificate in " + caFile)
+		}
+		config.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,83 @@
+package tusclient
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+	"io"
+	"slices"
+	"strings"
+)
+
+const (
+	HEADER_UPLOAD_CHECKSUM        = "Upload-Checksum"
+	HEADER_TUS_CHECKSUM_ALGORITHM = "Tus-Checksum-Algorithm"
+	EXTENSION_CHECKSUM            = "checksum"
+	STATUS_CHECKSUM_MISMATCH      = 460
+)
+
+// the algorithms of Client.ChecksumAlgorithms the client can compute
+var checksumHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// checksumAlgorithm returns the first of ChecksumAlgorithms the server
+// supports per its OPTIONS, empty when there is none. The answer is kept for
+// the life of the client, a failed OPTIONS is asked again next time.
+func (c *Client) checksumAlgorithm(ctx context.Context) (string, error) {
+	if len(c.ChecksumAlgorithms) <= 0 {
+		return "", nil
+	}
+	c.checksumMu.Lock()
+	defer c.checksumMu.Unlock()
+
+	if c.checksumNegotiated {
+		return c.checksum, nil
+	}
+	header, err := c.options(ctx)
+	if err != nil {
+		return "", err
+	}
+	if slices.Contains(splitList(header.Get(HEADER_TUS_EXTENSION)), EXTENSION_CHECKSUM) {
+		supported := splitList(header.Get(HEADER_TUS_CHECKSUM_ALGORITHM))
+		for _, algorithm := range c.ChecksumAlgorithms {
+			if _, ok := checksumHashes[algorithm]; ok && slices.Contains(supported, algorithm) {
+				c.checksum = algorithm
+				break
+			}
+		}
+	}
+	c.checksumNegotiated = true
+	return c.checksum, nil
+}
+
+// chunkChecksum returns the Upload-Checksum of the size bytes of data from
+// offset, data is left at offset
+func chunkChecksum(algorithm string, data io.ReadSeeker, offset, size int64) (string, error) {
+	h := checksumHashes[algorithm]()
+	if _, err := io.CopyN(h, data, size); err != nil {
+		return "", err
+	}
+	if _, err := data.Seek(offset, io.SeekStart); err != nil {
+		return "", err
+	}
+	return algorithm + " " + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// splitList splits a comma separated header value
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
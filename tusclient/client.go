@@ -0,0 +1,504 @@
+// Package tusclient uploads to a tus 1.0.0 server such as resumable-upload.
+// An upload is created with Create, or found again with Resume from its URL,
+// then its data is sent in chunks from an io.ReadSeeker. A failed chunk is
+// retried from the offset the server reports with a HEAD, so an upload
+// survives dropped connections and restarts of the server. A Store keeps the
+// URLs of the uploads in progress so a process continues the upload a
+// previous one was interrupted in.
+package tusclient
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TUS_PROTOCOL_VERSION             = "1.0.0"
+	CONTENT_TYPE_OFFSET_OCTET_STREAM = "application/offset+octet-stream"
+
+	HEADER_TUS_RESUMABLE   = "Tus-Resumable"
+	HEADER_LOCATION        = "Location"
+	HEADER_UPLOAD_LENGTH   = "Upload-Length"
+	HEADER_UPLOAD_OFFSET   = "Upload-Offset"
+	HEADER_UPLOAD_METADATA = "Upload-Metadata"
+	HEADER_CONTENT_TYPE    = "Content-Type"
+	HEADER_UPLOAD_PAUSED   = "Upload-Paused"
+
+	HEADER_RETRY_AFTER         = "Retry-After"
+	HEADER_RATELIMIT_REMAINING = "X-RateLimit-Remaining"
+	HEADER_RATELIMIT_RESET     = "X-RateLimit-Reset"
+)
+
+// DEFAULT_CHUNK_SIZE is the size of the PATCHes of a Client without
+// ChunkSize
+const DEFAULT_CHUNK_SIZE = 4 * 1024 * 1024
+
+var (
+	// ErrUploadGone is returned for an upload the server does not know
+	// anymore, it must be created again
+	ErrUploadGone = errors.New("tusclient: the upload is gone")
+	// ErrUploadPaused is returned for an upload the server paused, it can
+	// be resumed once the server unpauses it
+	ErrUploadPaused = errors.New("tusclient: the upload is paused")
+	// ErrSizeMismatch is returned when the data does not have the size of
+	// the upload
+	ErrSizeMismatch = errors.New("tusclient: the data does not match the size of the upload")
+)
+
+// StatusError is the unexpected answer of the server to a request
+type StatusError struct {
+	Method     string
+	StatusCode int
+	RetryAfter time.Duration // the delay the server asked for before a retry, 0 when it did not
+	resynced   bool          // the offset of the upload was taken from the answer, no HEAD is needed
+}
+
+// newStatusError returns the StatusError of res, with the delay of its
+// Retry-After, or of its X-RateLimit-Reset once no request remains
+func newStatusError(req *http.Request, res *http.Response) *StatusError {
+	err := &StatusError{Method: req.Method, StatusCode: res.StatusCode}
+	if after := res.Header.Get(HEADER_RETRY_AFTER); len(after) > 0 {
+		if seconds, perr := strconv.Atoi(after); perr == nil {
+			err.RetryAfter = time.Duration(seconds) * time.Second
+		} else if date, perr := http.ParseTime(after); perr == nil {
+			err.RetryAfter = time.Until(date)
+		}
+	} else if res.Header.Get(HEADER_RATELIMIT_REMAINING) == "0" {
+		if seconds, perr := strconv.Atoi(res.Header.Get(HEADER_RATELIMIT_RESET)); perr == nil {
+			err.RetryAfter = time.Duration(seconds) * time.Second
+		}
+	}
+	err.RetryAfter = max(err.RetryAfter, 0)
+	return err
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("tusclient: %s answered %d", e.Method, e.StatusCode)
+}
+
+// retryable reports whether the request may succeed later
+func (e *StatusError) retryable() bool {
+	switch e.StatusCode {
+	case http.StatusConflict, http.StatusLocked, http.StatusTooManyRequests, http.StatusRequestTimeout, STATUS_CHECKSUM_MISMATCH:
+		return true
+	}
+	return e.StatusCode >= 500
+}
+
+// Client uploads to the creation endpoint of a tus server, i.e.,
+// http://localhost:8080/files. Its fields must not change once it is used.
+type Client struct {
+	Endpoint      string
+	HTTPClient    *http.Client   // defaults to http.DefaultClient
+	Header        http.Header    // added to every request, i.e., Authorization
+	Credentials   Credentials    // authorize every request after Header, nil sends none
+	ChunkSize     int64          // the size of the PATCHes, defaults to DEFAULT_CHUNK_SIZE
+	Retries       int            // how many times a failed chunk is retried in a row, negative never retries
+	RetryDelay    time.Duration  // the delay before the first retry, doubled on every retry then jittered
+	MaxRetryDelay time.Duration  // caps the delay between retries, 0 does not cap it, the Retry-After of a server is honored over it
+	Store         Store          // keeps the URLs of the uploads in progress of UploadFile and UploadFingerprinted, nil always creates new uploads
+	OnProgress    func(Progress) // called while the data of an upload is sent, see PROGRESS_INTERVAL
+	MaxBandwidth  int64          // the bytes per second shared by all the uploads of the client, 0 means unlimited
+	// the Upload-Checksum algorithms of the PATCHes by preference, i.e.,
+	// sha256, the first one the server supports is used, empty sends none
+	ChecksumAlgorithms []string
+
+	bucketOnce         sync.Once
+	bucket             *tokenBucket // of MaxBandwidth, created on the first PATCH
+	checksumMu         sync.Mutex
+	checksumNegotiated bool
+	checksum           string // the algorithm of ChecksumAlgorithms negotiated, guarded by checksumMu
+}
+
+// New returns a Client of endpoint retrying a failed chunk 5 times, after
+// about 1, 2, 4, 8 then 16 seconds and never more than a minute
+func New(endpoint string) *Client {
+	return &Client{Endpoint: endpoint, Retries: 5, RetryDelay: time.Second, MaxRetryDelay: time.Minute}
+}
+
+// retryDelay returns the delay before the retry following failures failures
+// in a row, RetryDelay doubled per failure and capped by MaxRetryDelay. Half
+// of it is random so the clients cut off by the same outage do not retry in
+// lockstep.
+func (c *Client) retryDelay(failures int) time.Duration {
+	delay := c.RetryDelay << min(failures-1, 32)
+	if c.MaxRetryDelay > 0 && (delay > c.MaxRetryDelay || delay <= 0) {
+		delay = c.MaxRetryDelay
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + rand.N(delay/2)
+}
+
+// Upload is an upload of the server
+type Upload struct {
+	URL      string
+	Size     int64 // negative while the length of a stream is unknown, see UploadStream
+	Offset   int64 // the offset confirmed by the server
+	Metadata map[string]string
+
+	client         *Client
+	progress       *progressTracker // of the running Upload call, nil without Client.OnProgress
+	lengthDeferred bool             // the Upload-Length is not sent yet, see UploadStream
+	checksum       string           // the Upload-Checksum algorithm of the PATCHes, empty sends none
+}
+
+// Create creates an upload of size bytes
+func (c *Client) Create(ctx context.Context, size int64, metadata map[string]string) (*Upload, error) {
+	return c.create(ctx, size, metadata, nil)
+}
+
+// create creates an upload with the extra headers of an extension, a
+// negative size sends no Upload-Length
+func (c *Client) create(ctx context.Context, size int64, metadata map[string]string, extra http.Header) (*Upload, error) {
+	req, err := c.newRequest(ctx, http.MethodPost, c.Endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 {
+		req.Header.Set(HEADER_UPLOAD_LENGTH, strconv.FormatInt(size, 10))
+	}
+	maps.Copy(req.Header, extra)
+	if len(metadata) > 0 {
+		req.Header.Set(HEADER_UPLOAD_METADATA, EncodeMetadata(metadata))
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return nil, newStatusError(req, res)
+	}
+	location, err := req.URL.Parse(res.Header.Get(HEADER_LOCATION))
+	if err != nil || len(res.Header.Get(HEADER_LOCATION)) <= 0 {
+		return nil, fmt.Errorf("tusclient: invalid Location %q", res.Header.Get(HEADER_LOCATION))
+	}
+	return &Upload{URL: location.String(), Size: size, Metadata: metadata, client: c}, nil
+}
+
+// Resume returns the upload at uploadURL with its offset, ErrUploadGone when
+// the server does not know it
+func (c *Client) Resume(ctx context.Context, uploadURL string) (*Upload, error) {
+	u := &Upload{URL: uploadURL, client: c}
+	if err := u.head(ctx); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Upload sends the data of the upload from its offset, data holds the whole
+// upload and is read from the offset on. A failed chunk is retried per
+// Client.Retries after a HEAD gives the offset to continue from.
+func (u *Upload) Upload(ctx context.Context, data io.ReadSeeker) error {
+	end, err := data.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if end != u.Size {
+		return ErrSizeMismatch
+	}
+	if u.client.OnProgress != nil {
+		u.progress = newProgressTracker(u.client.OnProgress, u.Size, u.Offset)
+		defer func() { u.progress = nil }()
+	}
+	return u.send(ctx, data, u.Size)
+}
+
+// send sends data from the offset up to end in chunks, retrying the failed
+// ones, then the Upload-Length of a deferred length once it is known
+func (u *Upload) send(ctx context.Context, data io.ReadSeeker, end int64) error {
+	chunk := u.client.ChunkSize
+	if chunk <= 0 {
+		chunk = DEFAULT_CHUNK_SIZE
+	}
+	checksum, err := u.client.checksumAlgorithm(ctx)
+	if err != nil {
+		return err
+	}
+	u.checksum = checksum
+
+	failures := 0
+	for u.Offset < end || (u.lengthDeferred && u.Size >= 0) {
+		err := u.patch(ctx, data, min(chunk, end-u.Offset))
+		if err == nil {
+			failures = 0
+			if u.progress != nil {
+				u.progress.update(u.Offset, u.Size >= 0 && u.Offset >= u.Size)
+			}
+			continue
+		}
+		var status *StatusError
+		if ctx.Err() != nil || errors.Is(err, ErrUploadGone) || errors.Is(err, ErrUploadPaused) || (errors.As(err, &status) && !status.retryable()) {
+			return err
+		}
+		failures++
+		if failures > u.client.Retries {
+			return err
+		}
+		// a server out of upload slots tells when to come back
+		delay := u.client.retryDelay(failures)
+		if status != nil {
+			delay = max(delay, status.RetryAfter)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if status != nil && status.resynced {
+			continue
+		}
+		// the server may have committed part of the failed chunk, a failed
+		// HEAD leaves the offset as is and the next PATCH fails in turn
+		if err := u.head(ctx); errors.Is(err, ErrUploadGone) {
+			return err
+		}
+	}
+	return nil
+}
+
+// patch sends size bytes of data from the offset
+func (u *Upload) patch(ctx context.Context, data io.ReadSeeker, size int64) error {
+	if _, err := data.Seek(u.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	checksum := ""
+	if len(u.checksum) > 0 {
+		var err error
+		if checksum, err = chunkChecksum(u.checksum, data, u.Offset, size); err != nil {
+			return err
+		}
+	}
+	body := u.client.throttle(ctx, io.LimitReader(data, size))
+	if u.progress != nil {
+		body = u.progress.reader(body, u.Offset)
+	}
+	req, err := u.client.newRequest(ctx, http.MethodPatch, u.URL, io.NopCloser(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set(HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM)
+	req.Header.Set(HEADER_UPLOAD_OFFSET, strconv.FormatInt(u.Offset, 10))
+	if len(checksum) > 0 {
+		req.Header.Set(HEADER_UPLOAD_CHECKSUM, checksum)
+	}
+	if u.lengthDeferred && u.Size >= 0 {
+		req.Header.Set(HEADER_UPLOAD_LENGTH, strconv.FormatInt(u.Size, 10))
+	}
+	res, err := u.client.do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusNoContent:
+		offset, err := strconv.ParseInt(res.Header.Get(HEADER_UPLOAD_OFFSET), 10, 64)
+		if err != nil || offset < u.Offset {
+			return fmt.Errorf("tusclient: invalid Upload-Offset %q", res.Header.Get(HEADER_UPLOAD_OFFSET))
+		}
+		u.Offset = offset
+		if u.Size >= 0 {
+			u.lengthDeferred = false
+		}
+		return nil
+	case http.StatusNotFound, http.StatusGone:
+		return ErrUploadGone
+	case http.StatusLocked:
+		// a paused upload won't take data for a while, unlike one written
+		// by another PATCH
+		if res.Header.Get(HEADER_UPLOAD_PAUSED) == "true" {
+			return ErrUploadPaused
+		}
+		return newStatusError(req, res)
+	case http.StatusConflict:
+		// the server tells its offset along the conflict
+		err := newStatusError(req, res)
+		if offset, perr := strconv.ParseInt(res.Header.Get(HEADER_UPLOAD_OFFSET), 10, 64); perr == nil && offset >= 0 {
+			u.Offset = offset
+			err.resynced = true
+		}
+		return err
+	default:
+		return newStatusError(req, res)
+	}
+}
+
+// head updates the offset and metadata of the upload from the server
+func (u *Upload) head(ctx context.Context) error {
+	req, err := u.client.newRequest(ctx, http.MethodHead, u.URL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := u.client.do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return ErrUploadGone
+	default:
+		return newStatusError(req, res)
+	}
+	offset, err := strconv.ParseInt(res.Header.Get(HEADER_UPLOAD_OFFSET), 10, 64)
+	if err != nil {
+		return fmt.Errorf("tusclient: invalid Upload-Offset %q", res.Header.Get(HEADER_UPLOAD_OFFSET))
+	}
+	u.Offset = offset
+	if length := res.Header.Get(HEADER_UPLOAD_LENGTH); len(length) > 0 {
+		if u.Size, err = strconv.ParseInt(length, 10, 64); err != nil {
+			return fmt.Errorf("tusclient: invalid Upload-Length %q", length)
+		}
+		u.lengthDeferred = false
+	}
+	if metadata := res.Header.Get(HEADER_UPLOAD_METADATA); len(metadata) > 0 {
+		u.Metadata = DecodeMetadata(metadata)
+	}
+	return nil
+}
+
+// UploadFile sends the file at path in an upload named after it, resuming
+// the upload of the same file in the Store, see Fingerprint
+func (c *Client) UploadFile(ctx context.Context, path string, metadata map[string]string) (*Upload, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, ok := metadata["filename"]; !ok {
+		named := map[string]string{"filename": filepath.Base(path)}
+		maps.Copy(named, metadata)
+		metadata = named
+	}
+	fingerprint := ""
+	if c.Store != nil {
+		if fingerprint, err = Fingerprint(path); err != nil {
+			return nil, err
+		}
+	}
+	return c.UploadFingerprinted(ctx, fingerprint, file, metadata)
+}
+
+// UploadFingerprinted sends data, resuming the upload of fingerprint in the
+// Store when the server still has it, or creating one recorded under
+// fingerprint. The record is dropped once the upload is complete. An empty
+// fingerprint always creates a new upload.
+func (c *Client) UploadFingerprinted(ctx context.Context, fingerprint string, data io.ReadSeeker, metadata map[string]string) (*Upload, error) {
+	size, err := data.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	store := c.Store
+	if len(fingerprint) <= 0 {
+		store = nil
+	}
+
+	var upload *Upload
+	if store != nil {
+		url, err := store.Get(fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		if len(url) > 0 {
+			upload, err = c.Resume(ctx, url)
+			// a stale record starts over
+			if errors.Is(err, ErrUploadGone) || (err == nil && upload.Size != size) {
+				upload, err = nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if upload == nil {
+		if upload, err = c.Create(ctx, size, metadata); err != nil {
+			return nil, err
+		}
+		if store != nil {
+			if err := store.Set(fingerprint, upload.URL); err != nil {
+				return upload, err
+			}
+		}
+	}
+
+	if err := upload.Upload(ctx, data); err != nil {
+		if errors.Is(err, ErrUploadGone) && store != nil {
+			store.Delete(fingerprint)
+		}
+		return upload, err
+	}
+	if store != nil {
+		return upload, store.Delete(fingerprint)
+	}
+	return upload, nil
+}
+
+func (c *Client) newRequest(ctx context.Context, method, target string, body io.ReadCloser) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set(HEADER_TUS_RESUMABLE, TUS_PROTOCOL_VERSION)
+	if c.Credentials != nil {
+		if err := c.Credentials.Authorize(req); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// EncodeMetadata encodes metadata as an Upload-Metadata header, the keys are
+// sorted
+func EncodeMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for _, k := range slices.Sorted(maps.Keys(metadata)) {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(metadata[k])))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// DecodeMetadata decodes an Upload-Metadata header, the invalid pairs are
+// skipped
+func DecodeMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if len(k) <= 0 {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		metadata[k] = string(value)
+	}
+	return metadata
+}
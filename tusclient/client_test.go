@@ -0,0 +1,416 @@
+package tusclient
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+	metadata := map[string]string{"filename": "a b.txt", "empty": "", "filetype": "text/plain"}
+	encoded := EncodeMetadata(metadata)
+	if encoded != "empty ,filename YSBiLnR4dA==,filetype dGV4dC9wbGFpbg==" {
+		t.Errorf("EncodeMetadata does not sort and encode the pairs. got=%s", encoded)
+	}
+	if got := DecodeMetadata(encoded); !maps.Equal(got, metadata) {
+		t.Errorf("DecodeMetadata does not return %v. got=%v", metadata, got)
+	}
+}
+
+func TestStatusErrorRetryable(t *testing.T) {
+	tests := []struct {
+		testName   string
+		statusCode int
+		expected   bool
+	}{
+		{"offset conflict", http.StatusConflict, true},
+		{"locked", http.StatusLocked, true},
+		{"too many uploads", http.StatusTooManyRequests, true},
+		{"unavailable", http.StatusServiceUnavailable, true},
+		{"bad request", http.StatusBadRequest, false},
+		{"forbidden", http.StatusForbidden, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			err := &StatusError{Method: http.MethodPatch, StatusCode: test.statusCode}
+			if got := err.retryable(); got != test.expected {
+				t.Errorf("retryable does not return %v. got=%v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store", "uploads.json")
+	store := NewFileStore(path)
+	if url, err := store.Get("a"); err != nil || len(url) > 0 {
+		t.Errorf("Get of an empty store does not return nothing. got=%q error=%v", url, err)
+	}
+	if err := store.Set("a", "http://localhost/files/1"); err != nil {
+		t.Fatalf("Fail to set url. error=%v", err)
+	}
+	if url, _ := NewFileStore(path).Get("a"); url != "http://localhost/files/1" {
+		t.Errorf("the url is not persisted. got=%q", url)
+	}
+	if err := store.Delete("a"); err != nil {
+		t.Fatalf("Fail to delete url. error=%v", err)
+	}
+	if url, _ := NewFileStore(path).Get("a"); len(url) > 0 {
+		t.Errorf("the url is not deleted. got=%q", url)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	os.WriteFile(path, []byte("hello"), 0644)
+	first, err := Fingerprint(path)
+	if err != nil {
+		t.Fatalf("Fail to fingerprint file. error=%v", err)
+	}
+	if again, _ := Fingerprint(path); again != first {
+		t.Errorf("Fingerprint is not stable. expected=%s got=%s", first, again)
+	}
+	os.WriteFile(path, []byte("hello world"), 0644)
+	if changed, _ := Fingerprint(path); changed == first {
+		t.Errorf("Fingerprint does not change with the file")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	client := &Client{RetryDelay: time.Second, MaxRetryDelay: 10 * time.Second}
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		for range 10 {
+			if got := client.retryDelay(test.failures); got < test.expected/2 || got > test.expected {
+				t.Errorf("retryDelay(%d) is not within [%v, %v]. got=%v", test.failures, test.expected/2, test.expected, got)
+			}
+		}
+	}
+}
+
+// memoryServer is a tus server of the concatenation and
+// creation-defer-length extensions keeping the uploads in memory
+type memoryServer struct {
+	mu      sync.Mutex
+	uploads map[string][]byte
+	lengths map[string]string // the Upload-Length sent in a PATCH
+	final   string
+	// the Upload-Checksum received, the first mismatches PATCHes are
+	// answered 460 as if the chunk got corrupted
+	checksums  []string
+	mismatches int
+}
+
+func newMemoryServer() *memoryServer {
+	return &memoryServer{uploads: make(map[string][]byte), lengths: make(map[string]string)}
+}
+
+func (s *memoryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodOptions:
+		w.Header().Set(HEADER_TUS_EXTENSION, "creation,creation-defer-length,concatenation,checksum")
+		w.Header().Set(HEADER_TUS_CHECKSUM_ALGORITHM, "md5,sha1")
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && (r.Header.Get(HEADER_UPLOAD_CONCAT) == "partial" || r.Header.Get(HEADER_UPLOAD_DEFER_LENGTH) == "1"):
+		url := fmt.Sprintf("/files/%d", len(s.uploads))
+		s.uploads[url] = nil
+		w.Header().Set(HEADER_LOCATION, url)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPost:
+		urls, _ := strings.CutPrefix(r.Header.Get(HEADER_UPLOAD_CONCAT), "final;")
+		for _, url := range strings.Fields(urls) {
+			s.final += string(s.uploads[strings.TrimPrefix(url, "http://"+r.Host)])
+		}
+		w.Header().Set(HEADER_LOCATION, "/files/final")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodHead:
+		w.Header().Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(len(s.uploads[r.URL.Path])))
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPatch:
+		data, _ := io.ReadAll(r.Body)
+		if checksum := r.Header.Get(HEADER_UPLOAD_CHECKSUM); len(checksum) > 0 {
+			s.checksums = append(s.checksums, checksum)
+			if s.mismatches > 0 {
+				s.mismatches--
+				w.WriteHeader(STATUS_CHECKSUM_MISMATCH)
+				return
+			}
+		}
+		s.uploads[r.URL.Path] = append(s.uploads[r.URL.Path], data...)
+		if length := r.Header.Get(HEADER_UPLOAD_LENGTH); len(length) > 0 {
+			s.lengths[r.URL.Path] = length
+		}
+		w.Header().Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(len(s.uploads[r.URL.Path])))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestUploadParallel(t *testing.T) {
+	handler := newMemoryServer()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client := New(server.URL + "/files")
+	data := "the quick brown fox jumps over the lazy dog"
+
+	upload, err := client.UploadParallel(context.Background(), strings.NewReader(data), int64(len(data)), 4, nil)
+	if err != nil {
+		t.Fatalf("Fail to upload in parallel. error=%v", err)
+	}
+	if len(handler.uploads) != 4 {
+		t.Errorf("UploadParallel does not create 4 partial uploads. got=%d", len(handler.uploads))
+	}
+	if handler.final != data {
+		t.Errorf("the final upload does not concatenate the parts in order. got=%s", handler.final)
+	}
+	if upload.URL != server.URL+"/files/final" || upload.Offset != int64(len(data)) {
+		t.Errorf("UploadParallel does not return the final upload. got=%+v", upload)
+	}
+}
+
+func TestUploadStream(t *testing.T) {
+	tests := []struct {
+		testName string
+		data     string
+	}{
+		{"partial last chunk", "the quick brown fox"},
+		{"whole chunks", "the quick brown fox jumps"},
+		{"empty", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			handler := newMemoryServer()
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			client := New(server.URL + "/files")
+			client.ChunkSize = 5
+
+			// hide the Seek of the reader like a pipe
+			upload, err := client.UploadStream(context.Background(), io.MultiReader(strings.NewReader(test.data)), nil)
+			if err != nil {
+				t.Fatalf("Fail to upload stream. error=%v", err)
+			}
+			if got := string(handler.uploads["/files/0"]); got != test.data {
+				t.Errorf("the upload does not hold the stream. got=%q", got)
+			}
+			if got := handler.lengths["/files/0"]; got != strconv.Itoa(len(test.data)) {
+				t.Errorf("the length is not sent at EOF. got=%q", got)
+			}
+			if upload.Size != int64(len(test.data)) || upload.Offset != upload.Size {
+				t.Errorf("UploadStream does not return the complete upload. got=%+v", upload)
+			}
+		})
+	}
+}
+
+func TestMaxBandwidth(t *testing.T) {
+	handler := newMemoryServer()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client := New(server.URL + "/files")
+	client.ChunkSize = 10
+	client.MaxBandwidth = 40
+
+	// a second worth of bytes goes at once, the 20 others take half a second
+	start := time.Now()
+	upload, err := client.UploadStream(context.Background(), strings.NewReader(strings.Repeat("a", 60)), nil)
+	if err != nil {
+		t.Fatalf("Fail to upload. error=%v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("the upload is not throttled. got=%v", elapsed)
+	}
+	if upload.Offset != 60 {
+		t.Errorf("the throttled upload is not complete. got=%d", upload.Offset)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		testName   string
+		algorithms []string
+		expected   string
+	}{
+		{"negotiated", []string{"sha256", "sha1"}, "sha1 qvTGHdzF6KLavt4PO0gs2a6pQ00="},
+		{"unsupported by the server", []string{"sha512"}, ""},
+		{"disabled", nil, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			handler := newMemoryServer()
+			handler.mismatches = 1
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			client := New(server.URL + "/files")
+			client.ChunkSize = 5
+			client.RetryDelay = time.Millisecond
+			client.ChecksumAlgorithms = test.algorithms
+
+			upload, err := client.UploadStream(context.Background(), strings.NewReader("hello"), nil)
+			if err != nil {
+				t.Fatalf("Fail to upload. error=%v", err)
+			}
+			if len(test.expected) <= 0 {
+				if len(handler.checksums) > 0 {
+					t.Errorf("a checksum is sent. got=%v", handler.checksums)
+				}
+				return
+			}
+			// the chunk rejected with 460 is sent again
+			if len(handler.checksums) < 2 || handler.checksums[0] != test.expected || handler.checksums[1] != test.expected {
+				t.Errorf("the chunk is not sent twice with checksum %s. got=%v", test.expected, handler.checksums)
+			}
+			if upload.Offset != 5 || string(handler.uploads["/files/0"]) != "hello" {
+				t.Errorf("the upload is not complete after the mismatch. got=%+v", upload)
+			}
+		})
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	var authorizations []string
+	handler := newMemoryServer()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// a new token for every request, like a refreshed short lived one
+	tokens := 0
+	client := New(server.URL + "/files")
+	client.ChunkSize = 5
+	client.Credentials = TokenSource(func(ctx context.Context) (string, error) {
+		tokens++
+		return strconv.Itoa(tokens), nil
+	})
+	if _, err := client.UploadStream(context.Background(), strings.NewReader("hello world"), nil); err != nil {
+		t.Fatalf("Fail to upload. error=%v", err)
+	}
+	for i, authorization := range authorizations {
+		if expected := "Bearer " + strconv.Itoa(i+1); authorization != expected {
+			t.Errorf("request %d is not authorized with %s. got=%s", i, expected, authorization)
+		}
+	}
+}
+
+func TestNewTLSHTTPClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+
+	client, err := NewTLSHTTPClient("", "", caFile)
+	if err != nil {
+		t.Fatalf("Fail to create client. error=%v", err)
+	}
+	res, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("the client does not trust the CA. error=%v", err)
+	}
+	res.Body.Close()
+
+	if _, err := NewTLSHTTPClient("missing.pem", "missing.key", ""); err == nil {
+		t.Errorf("a missing certificate does not fail")
+	}
+}
+
+func TestStatusErrorRetryAfter(t *testing.T) {
+	tests := []struct {
+		testName string
+		header   map[string]string
+		expected time.Duration
+	}{
+		{"Retry-After seconds", map[string]string{HEADER_RETRY_AFTER: "3"}, 3 * time.Second},
+		{"Retry-After over the reset", map[string]string{HEADER_RETRY_AFTER: "3", HEADER_RATELIMIT_REMAINING: "0", HEADER_RATELIMIT_RESET: "5"}, 3 * time.Second},
+		{"reset once nothing remains", map[string]string{HEADER_RATELIMIT_REMAINING: "0", HEADER_RATELIMIT_RESET: "5"}, 5 * time.Second},
+		{"reset while requests remain", map[string]string{HEADER_RATELIMIT_REMAINING: "2", HEADER_RATELIMIT_RESET: "5"}, 0},
+		{"Retry-After in the past", map[string]string{HEADER_RETRY_AFTER: "Mon, 02 Jan 2006 15:04:05 GMT"}, 0},
+		{"none", nil, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			res := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+			for key, value := range test.header {
+				res.Header.Set(key, value)
+			}
+			err := newStatusError(&http.Request{Method: http.MethodPatch}, res)
+			if err.RetryAfter != test.expected {
+				t.Errorf("RetryAfter is not %v. got=%v", test.expected, err.RetryAfter)
+			}
+		})
+	}
+}
+
+func TestConflictResync(t *testing.T) {
+	data := "the quick brown fox"
+	received := ""
+	heads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			w.Header().Set(HEADER_LOCATION, "/files/1")
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodHead:
+			heads++
+			w.Header().Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(len(received)))
+			w.WriteHeader(http.StatusOK)
+		case http.MethodPatch:
+			// another client committed the first bytes in the meantime
+			if len(received) <= 0 {
+				received = data[:4]
+				w.Header().Set(HEADER_UPLOAD_OFFSET, "4")
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			received += string(body)
+			w.Header().Set(HEADER_UPLOAD_OFFSET, strconv.Itoa(len(received)))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+	client := New(server.URL + "/files")
+	client.RetryDelay = time.Millisecond
+
+	upload, err := client.Create(context.Background(), int64(len(data)), nil)
+	if err != nil {
+		t.Fatalf("Fail to create upload. error=%v", err)
+	}
+	if err := upload.Upload(context.Background(), strings.NewReader(data)); err != nil {
+		t.Fatalf("Fail to upload. error=%v", err)
+	}
+	if received != data {
+		t.Errorf("the upload does not resume at the offset of the conflict. got=%q", received)
+	}
+	if heads != 0 {
+		t.Errorf("the conflict is followed by a HEAD. got=%d", heads)
+	}
+}
@@ -0,0 +1,109 @@
+package tusclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	HEADER_TUS_EXTENSION = "Tus-Extension"
+	HEADER_UPLOAD_CONCAT = "Upload-Concat"
+
+	EXTENSION_CONCATENATION = "concatenation"
+)
+
+// Extensions returns the extensions the server announces in its answer to an
+// OPTIONS of the endpoint
+func (c *Client) Extensions(ctx context.Context) ([]string, error) {
+	header, err := c.options(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return splitList(header.Get(HEADER_TUS_EXTENSION)), nil
+}
+
+// options returns the headers of the answer to an OPTIONS of the endpoint
+func (c *Client) options(ctx context.Context) (http.Header, error) {
+	req, err := c.newRequest(ctx, http.MethodOptions, c.Endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return nil, newStatusError(req, res)
+	}
+	return res.Header, nil
+}
+
+// UploadParallel sends the size bytes of data as parts partial uploads over
+// as many connections, then creates the final upload concatenating them with
+// metadata. A server without the concatenation extension gets a single
+// upload instead. Each part is retried on its own per Client.Retries.
+func (c *Client) UploadParallel(ctx context.Context, data io.ReaderAt, size int64, parts int, metadata map[string]string) (*Upload, error) {
+	parts = int(min(int64(parts), size))
+	if parts > 1 {
+		extensions, err := c.Extensions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(extensions, EXTENSION_CONCATENATION) {
+			parts = 1
+		}
+	}
+	if parts <= 1 {
+		upload, err := c.Create(ctx, size, metadata)
+		if err != nil {
+			return nil, err
+		}
+		return upload, upload.Upload(ctx, io.NewSectionReader(data, 0, size))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	urls := make([]string, parts)
+	errs := make([]error, parts)
+	var wg sync.WaitGroup
+	for i := range parts {
+		start := size / int64(parts) * int64(i)
+		end := size / int64(parts) * int64(i+1)
+		if i == parts-1 {
+			end = size
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			partial, err := c.create(ctx, end-start, nil, http.Header{HEADER_UPLOAD_CONCAT: {"partial"}})
+			if err == nil {
+				urls[i] = partial.URL
+				err = partial.Upload(ctx, io.NewSectionReader(data, start, end-start))
+			}
+			if err != nil {
+				errs[i] = err
+				// the other parts are of no use anymore
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	// the first error is the cause, the others are the cancellation
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	final, err := c.create(ctx, -1, metadata, http.Header{HEADER_UPLOAD_CONCAT: {"final;" + strings.Join(urls, " ")}})
+	if err != nil {
+		return nil, err
+	}
+	final.Size, final.Offset = size, size
+	return final, nil
+}
@@ -0,0 +1,62 @@
+package tusclient
+
+import (
+	"io"
+	"time"
+)
+
+// PROGRESS_INTERVAL is the least time between two reports to
+// Client.OnProgress, but for the report of the complete upload
+const PROGRESS_INTERVAL = 100 * time.Millisecond
+
+// Progress reports the data sent of an upload
+type Progress struct {
+	Sent  int64   // the bytes sent from the start of the upload, it goes back when a failed chunk is sent again
+	Total int64   // the size of the upload
+	Rate  float64 // the bytes sent per second since the previous report
+}
+
+// progressTracker reports the bytes read from the chunks of an Upload call
+type progressTracker struct {
+	report   func(Progress)
+	total    int64
+	lastSent int64
+	lastTime time.Time
+}
+
+func newProgressTracker(report func(Progress), total, offset int64) *progressTracker {
+	return &progressTracker{report: report, total: total, lastSent: offset, lastTime: time.Now()}
+}
+
+// update reports sent, at most every PROGRESS_INTERVAL unless forced
+func (t *progressTracker) update(sent int64, force bool) {
+	now := time.Now()
+	elapsed := now.Sub(t.lastTime)
+	if !force && elapsed < PROGRESS_INTERVAL {
+		return
+	}
+	rate := 0.0
+	if elapsed > 0 && sent > t.lastSent {
+		rate = float64(sent-t.lastSent) / elapsed.Seconds()
+	}
+	t.lastSent, t.lastTime = sent, now
+	t.report(Progress{Sent: sent, Total: t.total, Rate: rate})
+}
+
+// reader returns r reporting the bytes read past offset
+func (t *progressTracker) reader(r io.Reader, offset int64) io.Reader {
+	return &progressReader{Reader: r, tracker: t, sent: offset}
+}
+
+type progressReader struct {
+	io.Reader
+	tracker *progressTracker
+	sent    int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.sent += int64(n)
+	r.tracker.update(r.sent, false)
+	return n, err
+}
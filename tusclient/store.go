@@ -0,0 +1,166 @@
+package tusclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Store keeps the URLs of the uploads in progress by the fingerprint of
+// their source so an upload interrupted with its process is resumed by the
+// next one instead of starting over
+type Store interface {
+	// Get returns the URL of fingerprint, empty when there is none
+	Get(fingerprint string) (string, error)
+	Set(fingerprint, url string) error
+	Delete(fingerprint string) error
+}
+
+// Fingerprint identifies the file at path by its absolute path, size and
+// modification time, a file changed since stops matching its upload
+func Fingerprint(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(abs))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.FormatInt(info.Size(), 10)))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.FormatInt(info.ModTime().UnixNano(), 10)))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// MemoryStore is a Store of a single process, for tests or for retrying
+// within a process
+type MemoryStore struct {
+	mu   sync.Mutex
+	urls map[string]string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{urls: make(map[string]string)}
+}
+
+func (s *MemoryStore) Get(fingerprint string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.urls[fingerprint], nil
+}
+
+func (s *MemoryStore) Set(fingerprint, url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.urls[fingerprint] = url
+	return nil
+}
+
+func (s *MemoryStore) Delete(fingerprint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.urls, fingerprint)
+	return nil
+}
+
+// FileStore is a Store persisted as a JSON object in a file, replaced
+// atomically with a rename on every change. It is safe for concurrent use
+// within a process, not across processes sharing the file.
+type FileStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileStore returns the Store of the file at path, created on the first
+// Set
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+func (s *FileStore) Get(fingerprint string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	urls, err := s.load()
+	return urls[fingerprint], err
+}
+
+func (s *FileStore) Set(fingerprint, url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	urls, err := s.load()
+	if err != nil {
+		return err
+	}
+	urls[fingerprint] = url
+	return s.save(urls)
+}
+
+func (s *FileStore) Delete(fingerprint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	urls, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := urls[fingerprint]; !ok {
+		return nil
+	}
+	delete(urls, fingerprint)
+	return s.save(urls)
+}
+
+// load reads the URLs, it must be called with the lock held
+func (s *FileStore) load() (map[string]string, error) {
+	urls := make(map[string]string)
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return urls, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &urls); err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+// save writes the URLs, it must be called with the lock held
+func (s *FileStore) save(urls map[string]string) error {
+	data, err := json.Marshal(urls)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
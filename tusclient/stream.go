@@ -0,0 +1,86 @@
+package tusclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+)
+
+const (
+	HEADER_UPLOAD_DEFER_LENGTH = "Upload-Defer-Length"
+
+	EXTENSION_CREATION_DEFER_LENGTH = "creation-defer-length"
+)
+
+// ErrDeferLengthUnsupported is returned by UploadStream for a server without
+// the creation-defer-length extension
+var ErrDeferLengthUnsupported = errors.New("tusclient: the server does not support uploads of unknown length")
+
+// UploadStream sends data, whose length is unknown until its EOF, in an
+// upload created with Upload-Defer-Length. A chunk is read from data then
+// sent, retried per Client.Retries from the buffered chunk, and the length is
+// sent with the last chunk.
+func (c *Client) UploadStream(ctx context.Context, data io.Reader, metadata map[string]string) (*Upload, error) {
+	extensions, err := c.Extensions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(extensions, EXTENSION_CREATION_DEFER_LENGTH) {
+		return nil, ErrDeferLengthUnsupported
+	}
+	upload, err := c.create(ctx, -1, metadata, http.Header{HEADER_UPLOAD_DEFER_LENGTH: {"1"}})
+	if err != nil {
+		return nil, err
+	}
+	upload.Size, upload.lengthDeferred = -1, true
+	if c.OnProgress != nil {
+		upload.progress = newProgressTracker(c.OnProgress, -1, 0)
+		defer func() { upload.progress = nil }()
+	}
+
+	chunk := c.ChunkSize
+	if chunk <= 0 {
+		chunk = DEFAULT_CHUNK_SIZE
+	}
+	buff := make([]byte, chunk)
+	for upload.lengthDeferred {
+		n, err := io.ReadFull(data, buff)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			upload.Size = upload.Offset + int64(n)
+			if upload.progress != nil {
+				upload.progress.total = upload.Size
+			}
+		} else if err != nil {
+			return upload, err
+		}
+		start := upload.Offset
+		buffered := io.NewSectionReader(&chunkBuffer{data: buff[:n], start: start}, 0, start+int64(n))
+		if err := upload.send(ctx, buffered, start+int64(n)); err != nil {
+			return upload, err
+		}
+	}
+	return upload, nil
+}
+
+// chunkBuffer holds the bytes of an upload from start on, the only ones a
+// retry may read again
+type chunkBuffer struct {
+	data  []byte
+	start int64
+}
+
+func (b *chunkBuffer) ReadAt(p []byte, off int64) (int, error) {
+	if off < b.start {
+		return 0, errors.New("tusclient: the server lost data already sent of a stream")
+	}
+	if off-b.start >= int64(len(b.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data[off-b.start:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
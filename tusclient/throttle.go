@@ -0,0 +1,77 @@
+package tusclient
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// tokenBucket is the byte rate limiter shared by the uploads of a Client.
+// Tokens are refilled at rate bytes per second up to a second worth of them.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait takes n tokens from the bucket, which may go into debt, and blocks
+// until they are actually available or the context is done
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledReader reads from r no faster than the bucket allows
+type throttledReader struct {
+	ctx    context.Context
+	r      io.Reader
+	bucket *tokenBucket
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// never read more than a second worth at once, otherwise a single read
+	// could overshoot the rate by a whole buffer
+	if len(p) > int(t.bucket.rate) {
+		p = p[:max(int(t.bucket.rate), 1)]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.bucket.wait(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// throttle returns r limited to the MaxBandwidth of the client, r as is
+// without one
+func (c *Client) throttle(ctx context.Context, r io.Reader) io.Reader {
+	if c.MaxBandwidth <= 0 {
+		return r
+	}
+	c.bucketOnce.Do(func() { c.bucket = newTokenBucket(c.MaxBandwidth) })
+	return &throttledReader{ctx: ctx, r: r, bucket: c.bucket}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"resumable-upload/tusclient"
+)
+
+// interruptedReader fails once it read past limit, like a process stopped
+// mid upload
+type interruptedReader struct {
+	*strings.Reader
+	limit int64
+}
+
+func (r *interruptedReader) Read(p []byte) (int, error) {
+	offset, _ := r.Seek(0, io.SeekCurrent)
+	if offset >= r.limit {
+		return 0, errors.New("interrupted")
+	}
+	return r.Reader.Read(p[:min(int64(len(p)), r.limit-offset)])
+}
+
+func downloadUpload(t *testing.T, url string) string {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Fail to execute GET request. error=%v", err)
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(res.Body)
+	return string(data)
+}
+
+func TestTusClient(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, RelativeLocation: true}))
+	defer server.Close()
+	client := tusclient.New(server.URL + "/files")
+	client.ChunkSize = 4
+	client.RetryDelay = time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(path, []byte(content[:10]), 0644); err != nil {
+		t.Fatalf("Fail to create test data. error=%v", err)
+	}
+	upload, err := client.UploadFile(context.Background(), path, map[string]string{"owner": "me"})
+	if err != nil {
+		t.Fatalf("Fail to upload file. error=%v", err)
+	}
+	if upload.Offset != 10 {
+		t.Errorf("UploadFile does not send the whole file. got=%d", upload.Offset)
+	}
+	if got := downloadUpload(t, upload.URL); got != content[:10] {
+		t.Errorf("the upload does not hold the file. got=%s", got)
+	}
+	resumed, err := client.Resume(context.Background(), upload.URL)
+	if err != nil {
+		t.Fatalf("Fail to resume upload. error=%v", err)
+	}
+	if resumed.Size != 10 || resumed.Offset != 10 || resumed.Metadata["filename"] != "a.txt" || resumed.Metadata["owner"] != "me" {
+		t.Errorf("Resume does not return the upload. got=%+v", resumed)
+	}
+}
+
+func TestTusClientResume(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, RelativeLocation: true}))
+	defer server.Close()
+	client := tusclient.New(server.URL + "/files")
+	client.ChunkSize = 4
+	client.Retries = -1
+
+	upload, err := client.Create(context.Background(), 10, nil)
+	if err != nil {
+		t.Fatalf("Fail to create upload. error=%v", err)
+	}
+	interrupted := &interruptedReader{Reader: strings.NewReader(content[:10]), limit: 6}
+	if err := upload.Upload(context.Background(), interrupted); err == nil {
+		t.Fatalf("an interrupted upload does not fail")
+	}
+
+	// another process resumes from the URL alone
+	resumed, err := client.Resume(context.Background(), upload.URL)
+	if err != nil {
+		t.Fatalf("Fail to resume upload. error=%v", err)
+	}
+	if resumed.Offset < 4 || resumed.Offset > 6 {
+		t.Errorf("Resume does not return the offset reached. got=%d", resumed.Offset)
+	}
+	if err := resumed.Upload(context.Background(), strings.NewReader(content[:10])); err != nil {
+		t.Fatalf("Fail to finish resumed upload. error=%v", err)
+	}
+	if got := downloadUpload(t, upload.URL); got != content[:10] {
+		t.Errorf("the resumed upload does not hold the data. got=%s", got)
+	}
+
+	if _, err := client.Resume(context.Background(), server.URL+"/files/00000000-0000-0000-0000-000000000000"); !errors.Is(err, tusclient.ErrUploadGone) {
+		t.Errorf("Resume of an unknown upload does not return ErrUploadGone. got=%v", err)
+	}
+}
+
+func TestTusClientRetry(t *testing.T) {
+	mux := buildServeMux(&ServerConfig{UploadDir: tempUploadDir, RelativeLocation: true})
+	// the first PATCH fails like an overloaded server
+	var patches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch && patches.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		testName    string
+		retries     int
+		expectError bool
+	}{
+		{"retried", 1, false},
+		{"not retried", -1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			patches.Store(0)
+			client := tusclient.New(server.URL + "/files")
+			client.Retries = test.retries
+			client.RetryDelay = time.Millisecond
+			upload, err := client.Create(context.Background(), 10, nil)
+			if err != nil {
+				t.Fatalf("Fail to create upload. error=%v", err)
+			}
+			err = upload.Upload(context.Background(), strings.NewReader(content[:10]))
+			var status *tusclient.StatusError
+			if test.expectError && (!errors.As(err, &status) || status.StatusCode != http.StatusServiceUnavailable) {
+				t.Errorf("Upload does not return the 503. got=%v", err)
+			}
+			if !test.expectError && (err != nil || upload.Offset != 10) {
+				t.Errorf("Upload does not retry the failed chunk. got=%v at %d", err, upload.Offset)
+			}
+		})
+	}
+}
+
+func TestTusClientStore(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, RelativeLocation: true}))
+	defer server.Close()
+	storePath := filepath.Join(t.TempDir(), "uploads.json")
+	client := tusclient.New(server.URL + "/files")
+	client.ChunkSize = 4
+	client.Retries = -1
+	client.Store = tusclient.NewFileStore(storePath)
+
+	upload, err := client.UploadFingerprinted(context.Background(), "key", &interruptedReader{Reader: strings.NewReader(content[:10]), limit: 6}, nil)
+	if err == nil {
+		t.Fatalf("an interrupted upload does not fail")
+	}
+
+	// the next process finds the upload in the store
+	next := tusclient.New(server.URL + "/files")
+	next.Store = tusclient.NewFileStore(storePath)
+	resumed, err := next.UploadFingerprinted(context.Background(), "key", strings.NewReader(content[:10]), nil)
+	if err != nil {
+		t.Fatalf("Fail to resume upload. error=%v", err)
+	}
+	if resumed.URL != upload.URL {
+		t.Errorf("UploadFingerprinted does not resume the stored upload. expected=%s got=%s", upload.URL, resumed.URL)
+	}
+	if got := downloadUpload(t, upload.URL); got != content[:10] {
+		t.Errorf("the resumed upload does not hold the data. got=%s", got)
+	}
+	if url, _ := next.Store.Get("key"); len(url) > 0 {
+		t.Errorf("a complete upload is not dropped from the store. got=%s", url)
+	}
+}
+
+func TestTusClientProgress(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, RelativeLocation: true}))
+	defer server.Close()
+	var reports []tusclient.Progress
+	client := tusclient.New(server.URL + "/files")
+	client.ChunkSize = 4
+	client.OnProgress = func(p tusclient.Progress) { reports = append(reports, p) }
+
+	upload, err := client.Create(context.Background(), 10, nil)
+	if err != nil {
+		t.Fatalf("Fail to create upload. error=%v", err)
+	}
+	if err := upload.Upload(context.Background(), strings.NewReader(content[:10])); err != nil {
+		t.Fatalf("Fail to upload. error=%v", err)
+	}
+	if len(reports) <= 0 {
+		t.Fatalf("OnProgress is not called")
+	}
+	if last := reports[len(reports)-1]; last.Sent != 10 || last.Total != 10 {
+		t.Errorf("the last report is not the complete upload. got=%+v", last)
+	}
+	for i := 1; i < len(reports); i++ {
+		if reports[i].Sent < reports[i-1].Sent {
+			t.Errorf("the reports go back without a failure. got=%+v", reports)
+		}
+	}
+}
+
+func TestTusClientParallelFallback(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, RelativeLocation: true}))
+	defer server.Close()
+	client := tusclient.New(server.URL + "/files")
+
+	// the server has no concatenation, the data goes in a single upload
+	upload, err := client.UploadParallel(context.Background(), strings.NewReader(content[:10]), 10, 4, nil)
+	if err != nil {
+		t.Fatalf("Fail to upload. error=%v", err)
+	}
+	if got := downloadUpload(t, upload.URL); got != content[:10] {
+		t.Errorf("the upload does not hold the data. got=%s", got)
+	}
+}
+
+func TestTusClientStreamUnsupported(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir, RelativeLocation: true}))
+	defer server.Close()
+	client := tusclient.New(server.URL + "/files")
+
+	if _, err := client.UploadStream(context.Background(), strings.NewReader(content[:10]), nil); !errors.Is(err, tusclient.ErrDeferLengthUnsupported) {
+		t.Errorf("UploadStream does not return ErrDeferLengthUnsupported. got=%v", err)
+	}
+}
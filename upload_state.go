@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+const HEADER_UPLOAD_STATE = "Upload-State"
+
+const (
+	// UPLOAD_STATE_CREATED is an upload no byte has been written to yet
+	UPLOAD_STATE_CREATED = "created"
+	// UPLOAD_STATE_UPLOADING is an upload with part of its data written
+	UPLOAD_STATE_UPLOADING = "uploading"
+	// UPLOAD_STATE_COMPLETED is an upload with all of its data written
+	UPLOAD_STATE_COMPLETED = "completed"
+	// UPLOAD_STATE_TERMINATED is an upload deleted by its client or an admin
+	UPLOAD_STATE_TERMINATED = "terminated"
+	// UPLOAD_STATE_EXPIRED is an upload removed because it was not completed
+	// or kept in time
+	UPLOAD_STATE_EXPIRED = "expired"
+)
+
+// uploadTransitions lists the states each state may move to, terminated and
+// expired are final
+var uploadTransitions = map[string][]string{
+	UPLOAD_STATE_CREATED:   {UPLOAD_STATE_UPLOADING, UPLOAD_STATE_COMPLETED, UPLOAD_STATE_TERMINATED, UPLOAD_STATE_EXPIRED},
+	UPLOAD_STATE_UPLOADING: {UPLOAD_STATE_COMPLETED, UPLOAD_STATE_TERMINATED, UPLOAD_STATE_EXPIRED},
+	UPLOAD_STATE_COMPLETED: {UPLOAD_STATE_TERMINATED, UPLOAD_STATE_EXPIRED},
+}
+
+// state returns the state of the upload, a File that never went through a
+// transition is created
+func (f *File) state() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.State) <= 0 {
+		return UPLOAD_STATE_CREATED
+	}
+	return f.State
+}
+
+// transition moves the upload to the state to, staying in the current state
+// is always allowed
+func (f *File) transition(to string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	from := f.State
+	if len(from) <= 0 {
+		from = UPLOAD_STATE_CREATED
+	}
+	if from != to && !slices.Contains(uploadTransitions[from], to) {
+		return fmt.Errorf("invalid upload state transition from %s to %s", from, to)
+	}
+	f.State = to
+	return nil
+}
+
+// advanceState moves the upload to the state its offset calls for once data
+// has been written
+func (f *File) advanceState() error {
+	switch offset := f.offset(); {
+	case offset >= f.Size:
+		return f.transition(UPLOAD_STATE_COMPLETED)
+	case offset > 0:
+		return f.transition(UPLOAD_STATE_UPLOADING)
+	}
+	return nil
+}
+
+// finished reports whether the upload is terminated or expired, it doesn't
+// accept any request anymore
+func (f *File) finished() bool {
+	state := f.state()
+	return state == UPLOAD_STATE_TERMINATED || state == UPLOAD_STATE_EXPIRED
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUploadStateTransition(t *testing.T) {
+	tests := []struct {
+		testName    string
+		from        string
+		to          string
+		expectError bool
+	}{
+		{"created to uploading", UPLOAD_STATE_CREATED, UPLOAD_STATE_UPLOADING, false},
+		{"created to completed", UPLOAD_STATE_CREATED, UPLOAD_STATE_COMPLETED, false},
+		{"uploading to uploading", UPLOAD_STATE_UPLOADING, UPLOAD_STATE_UPLOADING, false},
+		{"uploading to completed", UPLOAD_STATE_UPLOADING, UPLOAD_STATE_COMPLETED, false},
+		{"completed to terminated", UPLOAD_STATE_COMPLETED, UPLOAD_STATE_TERMINATED, false},
+		{"uploading to expired", UPLOAD_STATE_UPLOADING, UPLOAD_STATE_EXPIRED, false},
+		{"completed to uploading", UPLOAD_STATE_COMPLETED, UPLOAD_STATE_UPLOADING, true},
+		{"uploading to created", UPLOAD_STATE_UPLOADING, UPLOAD_STATE_CREATED, true},
+		{"terminated to completed", UPLOAD_STATE_TERMINATED, UPLOAD_STATE_COMPLETED, true},
+		{"expired to uploading", UPLOAD_STATE_EXPIRED, UPLOAD_STATE_UPLOADING, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			f := &File{State: test.from}
+			err := f.transition(test.to)
+			if test.expectError != (err != nil) {
+				t.Errorf("transition does not return the expected error. got=%v", err)
+			}
+			expected := test.to
+			if test.expectError {
+				expected = test.from
+			}
+			if f.state() != expected {
+				t.Errorf("transition does not leave the upload %s. got=%s", expected, f.state())
+			}
+		})
+	}
+}
+
+func TestUploadState(t *testing.T) {
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: tempUploadDir}))
+	defer server.Close()
+	host := server.URL + "/files"
+
+	state := func(fileId string) string {
+		t.Helper()
+		res, err := http.Head(fmt.Sprintf("%s/%s", host, fileId))
+		if err != nil {
+			t.Fatalf("Fail to execute HEAD request. error=%v", err)
+		}
+		res.Body.Close()
+		return res.Header.Get(HEADER_UPLOAD_STATE)
+	}
+
+	fileId := createUpload(t, host, 10)
+	if got := state(fileId); got != UPLOAD_STATE_CREATED {
+		t.Errorf("HEAD does not return the state %s. got=%s", UPLOAD_STATE_CREATED, got)
+	}
+	patchUpload(t, host, fileId, 0, content[:4])
+	if got := state(fileId); got != UPLOAD_STATE_UPLOADING {
+		t.Errorf("HEAD does not return the state %s. got=%s", UPLOAD_STATE_UPLOADING, got)
+	}
+	patchUpload(t, host, fileId, 4, content[4:10])
+	if got := state(fileId); got != UPLOAD_STATE_COMPLETED {
+		t.Errorf("HEAD does not return the state %s. got=%s", UPLOAD_STATE_COMPLETED, got)
+	}
+
+	if got := state(createUpload(t, host, 0)); got != UPLOAD_STATE_COMPLETED {
+		t.Errorf("HEAD does not return the state %s for an empty upload. got=%s", UPLOAD_STATE_COMPLETED, got)
+	}
+}
+
+func TestFinishedUpload(t *testing.T) {
+	dir := t.TempDir()
+	defer func() { uploadDir = tempUploadDir }()
+	uploadDir = dir
+
+	// terminated while the server was down
+	f := &File{ID: [16]byte{1}, Size: 10, persist: true}
+	if err := f.create(); err != nil {
+		t.Fatalf("Fail to create file. error=%v", err)
+	}
+	if err := f.write(context.Background(), strings.NewReader(content[:4])); err != nil {
+		t.Fatalf("Fail to write file. error=%v", err)
+	}
+	if err := f.transition(UPLOAD_STATE_TERMINATED); err != nil {
+		t.Fatalf("Fail to terminate upload. error=%v", err)
+	}
+	if err := f.saveInfo(); err != nil {
+		t.Fatalf("Fail to save upload. error=%v", err)
+	}
+
+	server := httptest.NewServer(buildServeMux(&ServerConfig{UploadDir: dir, PersistState: true}))
+	defer server.Close()
+	for _, method := range []string{http.MethodHead, http.MethodGet, http.MethodPatch} {
+		req, err := http.NewRequest(method, fmt.Sprintf("%s/files/%s", server.URL, f.ID), nil)
+		if err != nil {
+			t.Fatalf("Fail to create request. error=%v", err)
+		}
+		req.Header.Set(HEADER_CONTENT_TYPE, CONTENT_TYPE_OFFSET_OCTET_STREAM)
+		req.Header.Set(HEADER_UPLOAD_OFFSET, "4")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Fail to execute request. error=%v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusGone {
+			t.Errorf("%s /files/%s does not return %v for a terminated upload. got=%v", method, f.ID, http.StatusGone, res.StatusCode)
+		}
+	}
+}